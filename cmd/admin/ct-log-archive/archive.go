@@ -0,0 +1,143 @@
+package main
+
+import (
+	"archive/tar"
+	"encoding/binary"
+	"encoding/json"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"time"
+)
+
+// The archive is a tar file with the following entries, in this order:
+//
+//   manifest.json          -> Describes the archive; see `manifest`.
+//   tree.json              -> The log's config in jsonpb, without its private key.
+//   sths.json              -> Every signed tree head in the log's history, oldest first.
+//   frontier.bin           -> Frontier of the most recent STH, in its binary encoding.
+//   leaves/<batch>         -> Batches of 1024 leaves, in the same JSON as the bucket.
+//   index/merkle/<chunk>   -> Chunks of the index by Merkle hash.
+//   index/identity/<chunk> -> Chunks of the index by identity hash.
+//
+// where <batch> and <chunk> are in hex. Index chunks hold up to
+// indexChunkSize entries, each encoded as:
+//
+//   uvarint(len(hash)) || hash || varint(sequence number)
+const (
+	archiveFormat  = "ct-log-archive"
+	archiveVersion = 1
+
+	indexChunkSize = 65536
+)
+
+// manifest describes the contents of an archive.
+type manifest struct {
+	Format     string    `json:"format"`
+	Version    int       `json:"version"`
+	TreeID     int64     `json:"tree_id"`
+	TreeSize   int64     `json:"tree_size"`
+	RootHash   []byte    `json:"sha256_root_hash"`
+	ExportedAt time.Time `json:"exported_at"`
+	// FrozenSTH is the final signed tree head of a frozen log, as a get-sth
+	// response, or missing if the log wasn't frozen.
+	FrozenSTH json.RawMessage `json:"frozen_sth,omitempty"`
+}
+
+// archivedSTH is the JSON representation of a signed tree head in sths.json.
+type archivedSTH struct {
+	LogRoot          []byte `json:"log_root"`
+	LogRootSignature []byte `json:"log_root_signature"`
+}
+
+type archiveWriter struct {
+	tw      *tar.Writer
+	modTime time.Time
+}
+
+func newArchiveWriter(w io.Writer) *archiveWriter {
+	return &archiveWriter{tw: tar.NewWriter(w), modTime: time.Now()}
+}
+
+func (aw *archiveWriter) writeFile(name string, data []byte) error {
+	err := aw.tw.WriteHeader(&tar.Header{
+		Name:    name,
+		Mode:    0644,
+		Size:    int64(len(data)),
+		ModTime: aw.modTime,
+	})
+	if err != nil {
+		return fmt.Errorf("failed to write %v: %v", name, err)
+	} else if _, err := aw.tw.Write(data); err != nil {
+		return fmt.Errorf("failed to write %v: %v", name, err)
+	}
+	return nil
+}
+
+func (aw *archiveWriter) Close() error { return aw.tw.Close() }
+
+type archiveReader struct {
+	tr *tar.Reader
+}
+
+func newArchiveReader(r io.Reader) *archiveReader {
+	return &archiveReader{tar.NewReader(r)}
+}
+
+// next returns the name and contents of the next file in the archive, or
+// io.EOF if there are no more files.
+func (ar *archiveReader) next() (string, []byte, error) {
+	hdr, err := ar.tr.Next()
+	if err != nil {
+		return "", nil, err
+	} else if hdr.Typeflag != tar.TypeReg {
+		return "", nil, fmt.Errorf("unexpected entry in archive: %v", hdr.Name)
+	}
+	data, err := ioutil.ReadAll(ar.tr)
+	if err != nil {
+		return "", nil, fmt.Errorf("failed to read %v: %v", hdr.Name, err)
+	}
+	return hdr.Name, data, nil
+}
+
+// expect returns the contents of the next file in the archive, which must have
+// the given name.
+func (ar *archiveReader) expect(name string) ([]byte, error) {
+	got, data, err := ar.next()
+	if err == io.EOF {
+		return nil, fmt.Errorf("archive is missing %v", name)
+	} else if err != nil {
+		return nil, err
+	} else if got != name {
+		return nil, fmt.Errorf("expected %v in archive, but found %v", name, got)
+	}
+	return data, nil
+}
+
+func appendIndexEntry(out, hash []byte, seq int64) []byte {
+	buff := make([]byte, binary.MaxVarintLen64)
+	n := binary.PutUvarint(buff, uint64(len(hash)))
+	out = append(out, buff[:n]...)
+	out = append(out, hash...)
+	n = binary.PutVarint(buff, seq)
+	return append(out, buff[:n]...)
+}
+
+func parseIndexChunk(in []byte) (hashes [][]byte, seqs []int64, err error) {
+	for len(in) > 0 {
+		size, n := binary.Uvarint(in)
+		if n <= 0 || size > uint64(len(in)-n) {
+			return nil, nil, fmt.Errorf("malformed index entry")
+		}
+		hashes = append(hashes, in[n:n+int(size)])
+		in = in[n+int(size):]
+
+		seq, n := binary.Varint(in)
+		if n <= 0 {
+			return nil, nil, fmt.Errorf("malformed index entry")
+		}
+		seqs = append(seqs, seq)
+		in = in[n:]
+	}
+	return hashes, seqs, nil
+}
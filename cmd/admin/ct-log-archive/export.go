@@ -0,0 +1,142 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"log"
+	"math"
+	"time"
+
+	"github.com/cloudflare/ct-log/ct"
+
+	"github.com/golang/protobuf/jsonpb"
+	"github.com/golang/protobuf/proto"
+	"github.com/google/certificate-transparency-go/trillian/ctfe/configpb"
+)
+
+// export writes an archive of the log with the given config to `w`.
+func export(ctx context.Context, ls *ct.LogStorage, lc *configpb.LogConfig, w io.Writer) error {
+	treeID := lc.LogId
+
+	root, front, err := ls.Local.MostRecentRoot(treeID)
+	if err != nil {
+		return err
+	}
+	sths, err := ls.Local.ListRoots(treeID, 0, math.MaxInt64, math.MaxInt32)
+	if err != nil {
+		return err
+	} else if len(sths) == 0 || !bytes.Equal(sths[len(sths)-1].LogRoot, root.LogRoot) {
+		return fmt.Errorf("history of signed tree heads doesn't end at the most recent root")
+	}
+	frozen, err := ls.Local.GetFrozenSTH(treeID)
+	if err != nil {
+		return err
+	}
+	published, err := ls.Remote.GetFrozenSTH(ctx, treeID)
+	if err != nil {
+		return err
+	} else if !bytes.Equal(frozen, published) {
+		return fmt.Errorf("frozen sth in local database doesn't match the one in remote database")
+	}
+	log.Printf("exporting log %v: %v leaves, %v signed tree heads", treeID, root.TreeSize, len(sths))
+
+	aw := newArchiveWriter(w)
+
+	// Write the metadata.
+	raw, err := json.Marshal(manifest{
+		Format:     archiveFormat,
+		Version:    archiveVersion,
+		TreeID:     treeID,
+		TreeSize:   root.TreeSize,
+		RootHash:   root.RootHash,
+		ExportedAt: time.Now().UTC(),
+		FrozenSTH:  frozen,
+	})
+	if err != nil {
+		return err
+	} else if err := aw.writeFile("manifest.json", raw); err != nil {
+		return err
+	}
+
+	pub := proto.Clone(lc).(*configpb.LogConfig)
+	pub.PrivateKey = nil
+	treeRaw, err := (&jsonpb.Marshaler{Indent: "  "}).MarshalToString(pub)
+	if err != nil {
+		return err
+	} else if err := aw.writeFile("tree.json", []byte(treeRaw)); err != nil {
+		return err
+	}
+
+	archived := make([]archivedSTH, 0, len(sths))
+	for _, sth := range sths {
+		archived = append(archived, archivedSTH{sth.LogRoot, sth.LogRootSignature})
+	}
+	if raw, err = json.Marshal(archived); err != nil {
+		return err
+	} else if err := aw.writeFile("sths.json", raw); err != nil {
+		return err
+	}
+
+	if raw, err = front.MarshalBinary(); err != nil {
+		return err
+	} else if err := aw.writeFile("frontier.bin", raw); err != nil {
+		return err
+	}
+
+	// Write the leaves, one batch at a time.
+	for b := int64(0); 1024*b < root.TreeSize; b++ {
+		seqs := make([]int64, 0, 1024)
+		for i := 1024 * b; i < 1024*(b+1) && i < root.TreeSize; i++ {
+			seqs = append(seqs, i)
+		}
+		leaves, err := ls.Remote.GetLeaves(ctx, treeID, seqs)
+		if err != nil {
+			return fmt.Errorf("failed to read batch %x: %v", b, err)
+		}
+		buff := &bytes.Buffer{}
+		if err := json.NewEncoder(buff).Encode(leaves); err != nil {
+			return err
+		} else if err := aw.writeFile(fmt.Sprintf("leaves/%x", b), buff.Bytes()); err != nil {
+			return err
+		}
+		if (b+1)%1000 == 0 {
+			log.Printf("exported %v leaves", 1024*(b+1))
+		}
+	}
+
+	// Write the indices.
+	for _, idx := range []struct {
+		name         string
+		byMerkleHash bool
+	}{{"merkle", true}, {"identity", false}} {
+		var (
+			chunk   []byte
+			entries int
+			n       int64
+		)
+		flush := func() error {
+			err := aw.writeFile(fmt.Sprintf("index/%v/%x", idx.name, n), chunk)
+			chunk, entries, n = chunk[:0], 0, n+1
+			return err
+		}
+		err := ls.Local.ScanIndex(treeID, idx.byMerkleHash, func(hash []byte, seq int64) error {
+			chunk = appendIndexEntry(chunk, hash, seq)
+			if entries++; entries == indexChunkSize {
+				return flush()
+			}
+			return nil
+		})
+		if err != nil {
+			return err
+		} else if entries > 0 {
+			if err := flush(); err != nil {
+				return err
+			}
+		}
+	}
+
+	return aw.Close()
+}
@@ -0,0 +1,214 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"crypto/x509"
+	"encoding/json"
+	"fmt"
+	"io"
+	"log"
+	"strings"
+
+	"github.com/cloudflare/ct-log/ct"
+	"github.com/cloudflare/ct-log/custom/frontier"
+
+	"github.com/golang/protobuf/jsonpb"
+	ctgo "github.com/google/certificate-transparency-go"
+	"github.com/google/certificate-transparency-go/trillian/ctfe/configpb"
+	"github.com/google/trillian"
+	"github.com/google/trillian/types"
+)
+
+// importArchive reads an archive from `r` and rebuilds the log with the given
+// config from it. Every signed tree head in the archive is checked against the
+// rebuilt tree as it's imported.
+func importArchive(ctx context.Context, ls *ct.LogStorage, lc *configpb.LogConfig, r io.Reader) error {
+	ar := newArchiveReader(r)
+
+	// Read and check the metadata.
+	raw, err := ar.expect("manifest.json")
+	if err != nil {
+		return err
+	}
+	var man manifest
+	if err := json.Unmarshal(raw, &man); err != nil {
+		return fmt.Errorf("failed to parse manifest: %v", err)
+	} else if man.Format != archiveFormat {
+		return fmt.Errorf("archive has unknown format: %q", man.Format)
+	} else if man.Version != archiveVersion {
+		return fmt.Errorf("archive has unknown version: %v", man.Version)
+	} else if man.TreeID != lc.LogId {
+		return fmt.Errorf("archive is of log %v, not %v", man.TreeID, lc.LogId)
+	}
+
+	if raw, err = ar.expect("tree.json"); err != nil {
+		return err
+	}
+	var archivedConfig configpb.LogConfig
+	if err := jsonpb.UnmarshalString(string(raw), &archivedConfig); err != nil {
+		return fmt.Errorf("failed to parse tree config: %v", err)
+	} else if !bytes.Equal(archivedConfig.PublicKey.GetDer(), lc.PublicKey.GetDer()) {
+		return fmt.Errorf("archive's public key doesn't match the config file")
+	}
+
+	if raw, err = ar.expect("sths.json"); err != nil {
+		return err
+	}
+	var sths []archivedSTH
+	if err := json.Unmarshal(raw, &sths); err != nil {
+		return fmt.Errorf("failed to parse signed tree heads: %v", err)
+	} else if len(sths) == 0 {
+		return fmt.Errorf("archive has no signed tree heads")
+	}
+
+	if raw, err = ar.expect("frontier.bin"); err != nil {
+		return err
+	}
+	var front frontier.Frontier
+	if err := front.UnmarshalBinary(raw); err != nil {
+		return fmt.Errorf("failed to parse frontier: %v", err)
+	}
+
+	log.Printf("importing log %v: %v leaves, %v signed tree heads", man.TreeID, man.TreeSize, len(sths))
+	im, err := ls.NewImporter(ctx, man.TreeID)
+	if err != nil {
+		return err
+	}
+
+	// Replay the log's history: add the leaves of each signed tree head, and
+	// then store it.
+	var (
+		pending []*trillian.LogLeaf
+		batch   int64
+	)
+	for _, sth := range sths {
+		var root types.LogRootV1
+		if err := root.UnmarshalBinary(sth.LogRoot); err != nil {
+			return fmt.Errorf("failed to parse signed tree head: %v", err)
+		}
+
+		for im.Size() < int64(root.TreeSize) {
+			if len(pending) == 0 {
+				if pending, err = readBatch(ar, batch); err != nil {
+					return err
+				}
+				batch++
+			}
+			n := int64(root.TreeSize) - im.Size()
+			if n > int64(len(pending)) {
+				n = int64(len(pending))
+			}
+			if err := im.AddLeaves(ctx, pending[:n], int64(root.Revision)); err != nil {
+				return err
+			}
+			pending = pending[n:]
+
+			if im.Size()%(1024*1000) == 0 {
+				log.Printf("imported %v leaves", im.Size())
+			}
+		}
+
+		err := im.StoreRoot(ctx, trillian.SignedLogRoot{
+			LogRoot:          sth.LogRoot,
+			LogRootSignature: sth.LogRootSignature,
+		})
+		if err != nil {
+			return err
+		}
+	}
+	if len(pending) > 0 {
+		return fmt.Errorf("archive has leaves past the last signed tree head")
+	}
+
+	// Restore the indices.
+	for {
+		name, raw, err := ar.next()
+		if err == io.EOF {
+			break
+		} else if err != nil {
+			return err
+		}
+
+		var byMerkleHash bool
+		if strings.HasPrefix(name, "index/merkle/") {
+			byMerkleHash = true
+		} else if strings.HasPrefix(name, "index/identity/") {
+			byMerkleHash = false
+		} else {
+			return fmt.Errorf("unexpected file in archive: %v", name)
+		}
+		hashes, seqs, err := parseIndexChunk(raw)
+		if err != nil {
+			return fmt.Errorf("%v: %v", name, err)
+		} else if err := im.AddIndex(ctx, byMerkleHash, hashes, seqs); err != nil {
+			return fmt.Errorf("%v: %v", name, err)
+		}
+	}
+
+	// Check the rebuilt tree against the exported root.
+	root, rebuiltFront, err := ls.Local.MostRecentRoot(man.TreeID)
+	if err != nil {
+		return err
+	} else if root.TreeSize != man.TreeSize || !bytes.Equal(root.RootHash, man.RootHash) {
+		return fmt.Errorf("rebuilt tree has size %v and root hash %x, but exported tree had size %v and root hash %x",
+			root.TreeSize, root.RootHash, man.TreeSize, man.RootHash)
+	}
+	got, err := rebuiltFront.MarshalBinary()
+	if err != nil {
+		return err
+	}
+	want, err := front.MarshalBinary()
+	if err != nil {
+		return err
+	} else if !bytes.Equal(got, want) {
+		return fmt.Errorf("rebuilt frontier doesn't match exported frontier")
+	}
+
+	// Restore the final signed tree head of a frozen log.
+	if man.FrozenSTH != nil {
+		if err := importFrozenSTH(ctx, im, lc, man.FrozenSTH); err != nil {
+			return err
+		}
+	} else if lc.FrozenSth != nil {
+		return fmt.Errorf("log has a frozen sth in the config file, but not in the archive")
+	}
+
+	return nil
+}
+
+// importFrozenSTH checks the archive's frozen signed tree head against the
+// config file, if it has one, and stores it with `im`.
+func importFrozenSTH(ctx context.Context, im *ct.Importer, lc *configpb.LogConfig, raw []byte) error {
+	pubKey, err := x509.ParsePKIXPublicKey(lc.PublicKey.GetDer())
+	if err != nil {
+		return fmt.Errorf("failed to parse public key: %v", err)
+	}
+	if want := lc.FrozenSth; want != nil {
+		var got ctgo.GetSTHResponse
+		if err := json.Unmarshal(raw, &got); err != nil {
+			return fmt.Errorf("failed to parse frozen sth: %v", err)
+		} else if int64(got.TreeSize) != want.TreeSize || int64(got.Timestamp) != want.Timestamp ||
+			!bytes.Equal(got.SHA256RootHash, want.Sha256RootHash) || !bytes.Equal(got.TreeHeadSignature, want.TreeHeadSignature) {
+			return fmt.Errorf("archive's frozen sth doesn't match the config file")
+		}
+	}
+	return im.StoreFrozenSTH(ctx, raw, pubKey)
+}
+
+// readBatch reads the next batch of leaves from the archive, which must be the
+// batch with the given number.
+func readBatch(ar *archiveReader, batch int64) ([]*trillian.LogLeaf, error) {
+	name := fmt.Sprintf("leaves/%x", batch)
+	raw, err := ar.expect(name)
+	if err != nil {
+		return nil, err
+	}
+	leaves := make([]*trillian.LogLeaf, 0)
+	if err := json.Unmarshal(raw, &leaves); err != nil {
+		return nil, fmt.Errorf("failed to parse %v: %v", name, err)
+	} else if len(leaves) == 0 {
+		return nil, fmt.Errorf("%v is empty", name)
+	}
+	return leaves, nil
+}
@@ -0,0 +1,109 @@
+// Command ct-log-archive exports a log into a single self-describing archive,
+// and imports an archive into a fresh local database and bucket. It's used to
+// move logs between providers, and to keep cold archives of retired shards.
+//
+// The log's server must be stopped while an archive is exported or imported,
+// because the local database can only be opened by one process at a time.
+//
+// Usage:
+//
+//   ct-log-archive -cfg config.yaml -log-id 1 export log.tar
+//   ct-log-archive -cfg config.yaml -log-id 1 import log.tar
+package main
+
+import (
+	"context"
+	"flag"
+	"fmt"
+	"log"
+	"os"
+
+	"github.com/cloudflare/ct-log/config"
+	"github.com/cloudflare/ct-log/ct"
+	"github.com/cloudflare/ct-log/custom"
+
+	"github.com/google/certificate-transparency-go/trillian/ctfe/configpb"
+)
+
+var (
+	configFile = flag.String("cfg", "", "Path to a YAML config file.")
+	logID      = flag.Int64("log-id", 0, "The id of the log to export or import.")
+)
+
+func main() {
+	log.SetFlags(log.LstdFlags | log.Lshortfile)
+	flag.Usage = func() {
+		fmt.Fprintf(flag.CommandLine.Output(), "Usage: %s -cfg config.yaml -log-id id (export|import) archive.tar\n", os.Args[0])
+		flag.PrintDefaults()
+	}
+	flag.Parse()
+	if flag.NArg() != 2 {
+		flag.Usage()
+		os.Exit(2)
+	}
+	ctx := context.Background()
+
+	cfg, err := config.FromFile(*configFile)
+	if err != nil {
+		log.Fatalf("failed to read config: %v", err)
+	}
+	var logConfig *configpb.LogConfig
+	for _, lc := range cfg.LogConfigs {
+		if lc.LogId == *logID {
+			logConfig = lc
+		}
+	}
+	if logConfig == nil {
+		log.Fatalf("log %v is not in the config file", *logID)
+	}
+
+	local, err := custom.NewLocal(cfg.LevelDBPath, cfg.LevelDB.Options())
+	if err != nil {
+		log.Fatalf("failed to open local database: %v", err)
+	}
+	remote, err := custom.NewRemote(cfg.B2AcctId, cfg.B2AppKey, cfg.B2Bucket, cfg.B2Url)
+	if err != nil {
+		local.Close()
+		log.Fatalf("failed to open remote database: %v", err)
+	}
+	ls := &ct.LogStorage{Local: local, Remote: remote}
+
+	err = run(ctx, ls, logConfig, flag.Arg(0), flag.Arg(1))
+	if closeErr := local.Close(); err == nil && closeErr != nil {
+		err = fmt.Errorf("failed to close local database: %v", closeErr)
+	}
+	if err != nil {
+		log.Fatal(err)
+	}
+	log.Println("Done.")
+}
+
+// run exports or imports the log to or from the archive at `path`, depending
+// on `cmd`.
+func run(ctx context.Context, ls *ct.LogStorage, logConfig *configpb.LogConfig, cmd, path string) error {
+	switch cmd {
+	case "export":
+		fh, err := os.Create(path)
+		if err != nil {
+			return err
+		}
+		if err := export(ctx, ls, logConfig, fh); err != nil {
+			fh.Close()
+			os.Remove(path)
+			return fmt.Errorf("failed to export log: %v", err)
+		}
+		return fh.Close()
+	case "import":
+		fh, err := os.Open(path)
+		if err != nil {
+			return err
+		}
+		defer fh.Close()
+		if err := importArchive(ctx, ls, logConfig, fh); err != nil {
+			return fmt.Errorf("failed to import log: %v", err)
+		}
+		return nil
+	default:
+		return fmt.Errorf("unknown command: %v", cmd)
+	}
+}
@@ -0,0 +1,285 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"crypto"
+	"crypto/x509"
+	"fmt"
+	"log"
+	"math"
+
+	"github.com/cloudflare/ct-log/ct"
+	"github.com/cloudflare/ct-log/custom/frontier"
+
+	"github.com/google/certificate-transparency-go/trillian/ctfe/configpb"
+	"github.com/google/trillian"
+	tcrypto "github.com/google/trillian/crypto"
+	"github.com/google/trillian/merkle/hashers"
+	"github.com/google/trillian/storage"
+
+	_ "github.com/google/trillian/merkle/rfc6962"
+)
+
+// maxErrors is the maximum number of errors reported by each check.
+const maxErrors = 100
+
+// checkResult is the outcome of one check of a tree.
+type checkResult struct {
+	Name   string   `json:"name"`
+	OK     bool     `json:"ok"`
+	Errors []string `json:"errors,omitempty"`
+
+	omitted int
+}
+
+func (cr *checkResult) errorf(format string, args ...interface{}) {
+	cr.OK = false
+	if len(cr.Errors) < maxErrors {
+		cr.Errors = append(cr.Errors, fmt.Sprintf(format, args...))
+	} else {
+		cr.omitted++
+	}
+}
+
+func (cr *checkResult) finish() checkResult {
+	if cr.omitted > 0 {
+		cr.Errors = append(cr.Errors, fmt.Sprintf("... and %v more errors", cr.omitted))
+	}
+	return *cr
+}
+
+// treeReport is the outcome of every check of a tree.
+type treeReport struct {
+	TreeID   int64         `json:"tree_id"`
+	TreeSize int64         `json:"tree_size"`
+	OK       bool          `json:"ok"`
+	Checks   []checkResult `json:"checks"`
+}
+
+func (tr *treeReport) add(cr *checkResult) {
+	tr.OK = tr.OK && cr.OK
+	tr.Checks = append(tr.Checks, cr.finish())
+}
+
+// checker runs the checks of a single tree.
+type checker struct {
+	ls     *ct.LogStorage
+	lc     *configpb.LogConfig
+	hasher hashers.LogHasher
+
+	treeID int64
+	root   trillian.SignedLogRoot
+	front  frontier.Frontier
+}
+
+func checkTree(ctx context.Context, ls *ct.LogStorage, lc *configpb.LogConfig) treeReport {
+	tr := treeReport{TreeID: lc.LogId, OK: true, Checks: make([]checkResult, 0)}
+	log.Printf("checking log %v", lc.LogId)
+
+	hasher, err := hashers.NewLogHasher(trillian.HashStrategy_RFC6962_SHA256)
+	if err != nil {
+		log.Fatal(err)
+	}
+	c := &checker{ls: ls, lc: lc, hasher: hasher, treeID: lc.LogId}
+	cr := &checkResult{Name: "root", OK: true}
+	tr.add(c.checkRoot(cr))
+	if !cr.OK {
+		return tr
+	}
+	tr.TreeSize = c.root.TreeSize
+
+	tr.add(c.checkFrontier(&checkResult{Name: "frontier", OK: true}))
+	tr.add(c.checkSignatures(&checkResult{Name: "signatures", OK: true}))
+	tr.add(c.checkSubtrees(ctx, &checkResult{Name: "subtrees", OK: true}))
+
+	leaves, index := &checkResult{Name: "leaves", OK: true}, &checkResult{Name: "index", OK: true}
+	c.checkLeaves(ctx, leaves, index)
+	tr.add(leaves)
+	tr.add(index)
+
+	return tr
+}
+
+// checkRoot reads the tree's most recent root, and checks that no sequencing
+// run was left unfinished.
+func (c *checker) checkRoot(cr *checkResult) *checkResult {
+	var err error
+	c.root, c.front, err = c.ls.Local.MostRecentRoot(c.treeID)
+	if err != nil {
+		cr.errorf("failed to read most recent root: %v", err)
+		return cr
+	}
+	if start, end, ok, err := c.ls.Local.PendingSequencing(c.treeID); err != nil {
+		cr.errorf("failed to read sequencing journal: %v", err)
+	} else if ok {
+		cr.errorf("sequencing run of leaves [%v, %v) is unfinished; start the server to recover it", start, end)
+	}
+	return cr
+}
+
+// checkFrontier checks that the frontier's head is the stored root hash.
+func (c *checker) checkFrontier(cr *checkResult) *checkResult {
+	if head := c.front.Head(); !bytes.Equal(head, c.root.RootHash) {
+		cr.errorf("frontier has head %x, but root hash is %x", head, c.root.RootHash)
+	}
+	return cr
+}
+
+// checkSignatures checks that the most recent root and every signed tree head
+// in the tree's history verify with the configured public key.
+func (c *checker) checkSignatures(cr *checkResult) *checkResult {
+	pub, err := x509.ParsePKIXPublicKey(c.lc.PublicKey.GetDer())
+	if err != nil {
+		cr.errorf("failed to parse configured public key: %v", err)
+		return cr
+	}
+	if _, err := tcrypto.VerifySignedLogRoot(pub, crypto.SHA256, &c.root); err != nil {
+		cr.errorf("most recent root: %v", err)
+	}
+
+	sths, err := c.ls.Local.ListRoots(c.treeID, 0, math.MaxInt64, math.MaxInt32)
+	if err != nil {
+		cr.errorf("failed to read history: %v", err)
+		return cr
+	} else if len(sths) == 0 || !bytes.Equal(sths[len(sths)-1].LogRoot, c.root.LogRoot) {
+		cr.errorf("history of signed tree heads doesn't end at the most recent root")
+	}
+	for _, sth := range sths {
+		if _, err := tcrypto.VerifySignedLogRoot(pub, crypto.SHA256, &sth); err != nil {
+			cr.errorf("signed tree head at tree size %v, timestamp %v: %v", sth.TreeSize, sth.TimestampNanos, err)
+		}
+	}
+	return cr
+}
+
+// checkSubtrees rebuilds the root hash from the stored subtrees, by reading the
+// nodes that make up the compact range [0, TreeSize).
+func (c *checker) checkSubtrees(ctx context.Context, cr *checkResult) *checkResult {
+	tx, err := c.ls.SnapshotForTree(ctx, &trillian.Tree{TreeId: c.treeID})
+	if err != nil {
+		cr.errorf("failed to open snapshot: %v", err)
+		return cr
+	}
+	defer tx.Close()
+
+	var hash []byte
+	for depth, size := 0, c.root.TreeSize; size > 0; depth, size = depth+1, size>>1 {
+		if size&1 == 0 {
+			continue
+		}
+		id, err := storage.NewNodeIDForTreeCoords(int64(depth), size-1, 64)
+		if err != nil {
+			cr.errorf("failed to create node id: %v", err)
+			return cr
+		}
+		nodes, err := tx.GetMerkleNodes(ctx, c.root.TreeRevision, []storage.NodeID{id})
+		if err != nil {
+			cr.errorf("failed to read node at depth %v, index %v: %v", depth, size-1, err)
+			return cr
+		} else if len(nodes) != 1 || len(nodes[0].Hash) == 0 {
+			cr.errorf("node at depth %v, index %v is missing", depth, size-1)
+			return cr
+		}
+
+		if hash == nil {
+			hash = nodes[0].Hash
+		} else {
+			hash = c.hasher.HashChildren(nodes[0].Hash, hash)
+		}
+	}
+	if hash == nil {
+		hash = c.hasher.EmptyRoot()
+	}
+
+	if !bytes.Equal(hash, c.root.RootHash) {
+		cr.errorf("subtrees have root hash %x, but stored root hash is %x", hash, c.root.RootHash)
+	}
+	return cr
+}
+
+// checkLeaves reads every leaf from remote storage, checks that they cover
+// exactly [0, TreeSize), and checks the indices against them.
+//
+// Rather than look up the leaf that each index entry points to, which would
+// take a remote read per entry, an entry is counted as verified when the leaf
+// that it points to is read and has a matching hash. Every entry is valid if
+// the number of verified entries is the number of entries in the index.
+func (c *checker) checkLeaves(ctx context.Context, cr, index *checkResult) {
+	var verifiedMerkle, verifiedID int64
+
+	for start := int64(0); start < c.root.TreeSize; start += 1024 {
+		seqs := make([]int64, 0, 1024)
+		for i := start; i < start+1024 && i < c.root.TreeSize; i++ {
+			seqs = append(seqs, i)
+		}
+		leaves, err := c.ls.Remote.GetLeaves(ctx, c.treeID, seqs)
+		if err != nil {
+			cr.errorf("failed to read leaves [%v, %v): %v", start, start+int64(len(seqs)), err)
+			continue
+		}
+
+		merkleHashes := make([][]byte, 0, len(leaves))
+		idHashes := make([][]byte, 0, len(leaves))
+		for i, leaf := range leaves {
+			if leaf.LeafIndex != seqs[i] {
+				cr.errorf("leaf %v has index %v", seqs[i], leaf.LeafIndex)
+			}
+			if hash, err := c.hasher.HashLeaf(leaf.LeafValue); err != nil {
+				cr.errorf("leaf %v: failed to hash: %v", seqs[i], err)
+			} else if !bytes.Equal(hash, leaf.MerkleLeafHash) {
+				cr.errorf("leaf %v has Merkle hash %x, but its value hashes to %x", seqs[i], leaf.MerkleLeafHash, hash)
+			}
+			merkleHashes = append(merkleHashes, leaf.MerkleLeafHash)
+			idHashes = append(idHashes, leaf.LeafIdentityHash)
+		}
+
+		byMerkle, err := c.ls.Local.GetSequenceByMerkleHash(c.treeID, merkleHashes)
+		if err != nil {
+			index.errorf("%v", err)
+			continue
+		}
+		byID, err := c.ls.Local.GetSequenceByIdentityHash(c.treeID, idHashes)
+		if err != nil {
+			index.errorf("%v", err)
+			continue
+		}
+		for i := range leaves {
+			if byMerkle[i] == -1 {
+				index.errorf("leaf %v is missing from the index by Merkle hash", seqs[i])
+			} else if byMerkle[i] == seqs[i] {
+				verifiedMerkle++
+			}
+			if byID[i] == -1 {
+				index.errorf("leaf %v is missing from the index by identity hash", seqs[i])
+			} else if byID[i] == seqs[i] {
+				verifiedID++
+			}
+		}
+	}
+
+	// Remote storage should have nothing past the end of the tree.
+	if _, err := c.ls.Remote.GetLeaves(ctx, c.treeID, []int64{c.root.TreeSize}); err == nil {
+		cr.errorf("remote storage has a leaf at index %v, past the end of the tree", c.root.TreeSize)
+	}
+
+	for _, idx := range []struct {
+		name         string
+		byMerkleHash bool
+		verified     int64
+	}{{"Merkle hash", true, verifiedMerkle}, {"identity hash", false, verifiedID}} {
+		var total int64
+		err := c.ls.Local.ScanIndex(c.treeID, idx.byMerkleHash, func(hash []byte, seq int64) error {
+			total++
+			if seq < 0 || seq >= c.root.TreeSize {
+				index.errorf("entry %x in the index by %v points to leaf %v, past the end of the tree", hash, idx.name, seq)
+			}
+			return nil
+		})
+		if err != nil {
+			index.errorf("failed to scan index by %v: %v", idx.name, err)
+		} else if total != idx.verified {
+			index.errorf("index by %v has %v entries, but only %v point to a leaf with a matching hash", idx.name, total, idx.verified)
+		}
+	}
+}
@@ -0,0 +1,77 @@
+// Command ct-log-fsck checks the consistency of the local database and bucket
+// of each log in a config file. The local database is opened read-only, but
+// LevelDB still only allows one process to open it, so the log's server must be
+// stopped first.
+//
+// It prints a JSON report to stdout, and exits with a non-zero status if any
+// check failed.
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"flag"
+	"log"
+	"os"
+
+	"github.com/cloudflare/ct-log/config"
+	"github.com/cloudflare/ct-log/ct"
+	"github.com/cloudflare/ct-log/custom"
+
+	"github.com/syndtr/goleveldb/leveldb/opt"
+)
+
+var (
+	configFile = flag.String("cfg", "", "Path to a YAML config file.")
+	logID      = flag.Int64("log-id", 0, "The id of the log to check. All logs in the config file are checked by default.")
+)
+
+// report is the output of the command.
+type report struct {
+	OK    bool         `json:"ok"`
+	Trees []treeReport `json:"trees"`
+}
+
+func main() {
+	log.SetFlags(log.LstdFlags | log.Lshortfile)
+	flag.Parse()
+	ctx := context.Background()
+
+	cfg, err := config.FromFile(*configFile)
+	if err != nil {
+		log.Fatalf("failed to read config: %v", err)
+	}
+	local, err := custom.NewLocal(cfg.LevelDBPath, &opt.Options{ReadOnly: true})
+	if err != nil {
+		log.Fatalf("failed to open local database: %v", err)
+	}
+	defer local.Close()
+	remote, err := custom.NewRemote(cfg.B2AcctId, cfg.B2AppKey, cfg.B2Bucket, cfg.B2Url)
+	if err != nil {
+		log.Fatalf("failed to open remote database: %v", err)
+	}
+	ls := &ct.LogStorage{Local: local, Remote: remote}
+
+	out := report{OK: true, Trees: make([]treeReport, 0)}
+	for _, lc := range cfg.LogConfigs {
+		if *logID != 0 && lc.LogId != *logID {
+			continue
+		}
+		tr := checkTree(ctx, ls, lc)
+		out.OK = out.OK && tr.OK
+		out.Trees = append(out.Trees, tr)
+	}
+	if len(out.Trees) == 0 {
+		log.Fatalf("log %v is not in the config file", *logID)
+	}
+
+	enc := json.NewEncoder(os.Stdout)
+	enc.SetIndent("", "  ")
+	if err := enc.Encode(out); err != nil {
+		log.Fatal(err)
+	}
+	if !out.OK {
+		local.Close()
+		os.Exit(1)
+	}
+}
@@ -0,0 +1,57 @@
+// Command ct-log-lint checks a config file, and prints every problem it finds
+// instead of stopping at the first one like the server does. As well as the
+// checks that the server makes when it reads the config file, it checks that
+// each log's keys pair up and that its roots are all usable, and that the logs'
+// prefixes are unique and their temporal shards don't overlap. It also checks
+// that leveldb_path is writable and that the remote database can be written
+// to, so it should be run where the server runs.
+//
+// It exits with a non-zero status if any problem was found.
+package main
+
+import (
+	"context"
+	"flag"
+	"fmt"
+	"log"
+	"time"
+
+	"github.com/cloudflare/ct-log/config"
+	"github.com/cloudflare/ct-log/custom"
+)
+
+var (
+	configFile = flag.String("cfg", "", "Path to a YAML config file.")
+	offline    = flag.Bool("offline", false, "Don't check that the remote database can be written to.")
+)
+
+func main() {
+	log.SetFlags(log.LstdFlags | log.Lshortfile)
+	flag.Parse()
+
+	var probe config.RemoteProbe
+	if !*offline {
+		probe = probeRemote
+	}
+	problems := config.Lint(*configFile, probe)
+	for _, problem := range problems {
+		fmt.Println(problem)
+	}
+	if len(problems) > 0 {
+		log.Fatalf("found %v problems in config file", len(problems))
+	}
+	log.Println("no problems found in config file")
+}
+
+// probeRemote checks that an object can be written to, read from, and deleted
+// from the remote database. Every version of the object is deleted, so nothing
+// is left in the bucket.
+func probeRemote(acctId, appKey, bucket, url string) error {
+	remote, err := custom.NewRemote(acctId, appKey, bucket, url)
+	if err != nil {
+		return err
+	}
+	ctx, cancel := context.WithTimeout(context.Background(), time.Minute)
+	defer cancel()
+	return remote.Probe(ctx)
+}
@@ -0,0 +1,180 @@
+package main
+
+import (
+	"context"
+	"encoding/base64"
+	"fmt"
+	"net/http"
+	"strconv"
+	"time"
+
+	"github.com/golang/glog"
+	"github.com/google/certificate-transparency-go/trillian/ctfe/configpb"
+	"github.com/google/trillian"
+	"github.com/google/trillian/trees"
+)
+
+// freezeTimeout is the maximum amount of time to wait for a log's queue to be
+// drained before it's frozen.
+const freezeTimeout = 10 * time.Minute
+
+// freezeHandler freezes a log when it receives a POST with a `log_id`
+// parameter. It responds once the log is frozen, with the config that the log
+// should be given in the config file.
+type freezeHandler struct {
+	lm *logManager
+}
+
+func (fh freezeHandler) ServeHTTP(rw http.ResponseWriter, req *http.Request) {
+	if req.Method != http.MethodPost {
+		rw.Header().Set("Allow", http.MethodPost)
+		http.Error(rw, "freezing a log requires a POST", http.StatusMethodNotAllowed)
+		return
+	}
+	logID, err := strconv.ParseInt(req.FormValue("log_id"), 10, 64)
+	if err != nil {
+		http.Error(rw, "failed to parse log_id: "+err.Error(), http.StatusBadRequest)
+		return
+	}
+
+	ctx, cancel := context.WithTimeout(req.Context(), freezeTimeout)
+	defer cancel()
+	sth, err := fh.lm.freeze(ctx, logID)
+	if err != nil {
+		glog.Errorf("failed to freeze log %v: %v", logID, err)
+		http.Error(rw, err.Error(), http.StatusInternalServerError)
+		return
+	}
+
+	fmt.Fprintf(rw, "Log %v is frozen. Update its entry in the config file to:\n\n", logID)
+	fmt.Fprintf(rw, "    tree_state: FROZEN\n")
+	fmt.Fprintf(rw, "    frozen_sth:\n")
+	fmt.Fprintf(rw, "      tree_size: %v\n", sth.TreeSize)
+	fmt.Fprintf(rw, "      timestamp: %v\n", sth.Timestamp)
+	fmt.Fprintf(rw, "      sha256_root_hash: %v\n", base64.StdEncoding.EncodeToString(sth.Sha256RootHash))
+	fmt.Fprintf(rw, "      tree_head_signature: %v\n", base64.StdEncoding.EncodeToString(sth.TreeHeadSignature))
+}
+
+// freeze stops the log from accepting new leaves, waits for the leaves that are
+// queued to be sequenced, and then signs and serves the log's final STH. The
+// log is made active again if its queue can't be drained before ctx expires.
+func (lm *logManager) freeze(ctx context.Context, logID int64) (*configpb.SignedTreeHead, error) {
+	if err := lm.startFreeze(logID); err != nil {
+		return nil, err
+	}
+	glog.Infof("freezing log %v: waiting for its queue to be drained", logID)
+
+	if err := lm.drain(ctx, logID); err != nil {
+		lm.mu.Lock()
+		defer lm.mu.Unlock()
+		if err := lm.cfg.SetTreeState(logID, trillian.TreeState_ACTIVE); err != nil {
+			glog.Errorf("failed to make log %v active again: %v", logID, err)
+		}
+		lm.qm.SetFrozen(logID, false)
+		lm.logStorage.Local.SetFrozen(logID, false)
+		return nil, fmt.Errorf("failed to drain log, so it's active again: %v", err)
+	}
+
+	lm.mu.Lock()
+	defer lm.mu.Unlock()
+	sth, err := lm.finishFreeze(ctx, logID)
+	if err != nil {
+		// The log is still draining, so nothing is queued, but the freeze can be
+		// tried again.
+		return nil, err
+	}
+	glog.Infof("froze log %v at tree size %v", logID, sth.TreeSize)
+	return sth, nil
+}
+
+// startFreeze checks that a log can be frozen, and puts it in the DRAINING
+// state, where it's sequenced but doesn't accept new leaves. Leaves that were
+// let through by the quota manager before are refused by the local database,
+// so that none are queued after the log is drained.
+func (lm *logManager) startFreeze(logID int64) error {
+	lm.mu.Lock()
+	defer lm.mu.Unlock()
+
+	state, err := lm.cfg.TreeState(logID)
+	if err != nil {
+		return err
+	} else if state != trillian.TreeState_ACTIVE && state != trillian.TreeState_DRAINING {
+		return fmt.Errorf("log %v is %v, only active logs can be frozen", logID, state)
+	}
+	for _, logConfig := range lm.cfg.LogConfigs {
+		if logConfig.LogId == logID && logConfig.IsMirror {
+			return fmt.Errorf("log %v is a mirror, which can't sign its own sth", logID)
+		}
+	}
+
+	lm.qm.SetFrozen(logID, true)
+	lm.logStorage.Local.SetFrozen(logID, true)
+	return lm.cfg.SetTreeState(logID, trillian.TreeState_DRAINING)
+}
+
+// drain waits until a log has no unsequenced leaves.
+func (lm *logManager) drain(ctx context.Context, logID int64) error {
+	for {
+		count, err := lm.logStorage.Local.Unsequenced(logID)
+		if err != nil {
+			return err
+		} else if count == 0 {
+			return nil
+		}
+		glog.V(1).Infof("freezing log %v: %v unsequenced leaves left", logID, count)
+
+		select {
+		case <-ctx.Done():
+			return ctx.Err()
+		case <-time.After(lm.cfg.Signer.RunInterval):
+		}
+	}
+}
+
+// finishFreeze signs the final STH of a drained log, and sets up the log's
+// handlers to serve it.
+func (lm *logManager) finishFreeze(ctx context.Context, logID int64) (*configpb.SignedTreeHead, error) {
+	if state, err := lm.cfg.TreeState(logID); err != nil {
+		return nil, err
+	} else if state != trillian.TreeState_DRAINING {
+		return nil, fmt.Errorf("log %v became %v while it was being drained", logID, state)
+	}
+	tx, err := lm.cfg.AdminStorage.Snapshot(ctx)
+	if err != nil {
+		return nil, err
+	}
+	defer tx.Close()
+	tree, err := tx.GetTree(ctx, logID)
+	if err != nil {
+		return nil, err
+	}
+	signer, err := trees.Signer(ctx, tree)
+	if err != nil {
+		return nil, fmt.Errorf("failed to create signer: %v", err)
+	}
+
+	sth, err := lm.logStorage.FreezeSTH(ctx, logID, signer.Signer)
+	if err != nil {
+		return nil, err
+	} else if err := lm.cfg.SetFrozenSTH(logID, sth); err != nil {
+		return nil, err
+	} else if err := lm.cfg.SetTreeState(logID, trillian.TreeState_FROZEN); err != nil {
+		return nil, err
+	}
+	lm.unwatch(logID)
+
+	for i, logConfig := range lm.cfg.LogConfigs {
+		if logConfig.LogId != logID {
+			continue
+		}
+		handlers, err := lm.setUp(ctx, lm.cfg, i)
+		if err != nil {
+			// Trillian won't sequence the log anymore, so its old handlers
+			// serve STHs over the final root until it's set up again.
+			glog.Errorf("failed to set up frozen log %v: %v", logID, err)
+			break
+		}
+		lm.handlers.set(handlers, true)
+	}
+	return sth, nil
+}
@@ -0,0 +1,140 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"net/http"
+	"time"
+
+	"github.com/cloudflare/ct-log/ct"
+
+	"github.com/golang/protobuf/ptypes"
+	"github.com/google/trillian"
+	"github.com/google/trillian/storage"
+)
+
+// healthTimeout is the maximum amount of time to spend on a health check.
+const healthTimeout = 10 * time.Second
+
+// healthChecker probes the server's storage and signer. It serves two
+// endpoints:
+//   - /healthz fails if the databases are inaccessible, or if the signer hasn't
+//     committed a sequencing run of an active or draining log in a while. It's
+//     meant for systemd's watchdog, which restarts the server.
+//   - /readyz additionally fails if the most recent root of an active log is
+//     older than its max_root_duration. It's meant for the load balancer, which
+//     stops sending requests to the server.
+type healthChecker struct {
+	logStorage   *ct.LogStorage
+	adminStorage storage.AdminStorage
+
+	// stallAfter is how long the signer can go without a sequencing run of a
+	// log before it's considered stuck.
+	stallAfter time.Duration
+	started    time.Time
+}
+
+func newHealthChecker(ls *ct.LogStorage, as storage.AdminStorage, runInterval time.Duration) *healthChecker {
+	stallAfter := 10 * runInterval
+	if stallAfter < time.Minute {
+		stallAfter = time.Minute
+	}
+	return &healthChecker{
+		logStorage:   ls,
+		adminStorage: as,
+
+		stallAfter: stallAfter,
+		started:    time.Now(),
+	}
+}
+
+// healthz returns every failed liveness check.
+func (hc *healthChecker) healthz(ctx context.Context) []error {
+	errs := make([]error, 0)
+	if err := hc.adminStorage.CheckDatabaseAccessible(ctx); err != nil {
+		errs = append(errs, fmt.Errorf("admin storage: %v", err))
+	}
+	if err := hc.logStorage.CheckDatabaseAccessible(ctx); err != nil {
+		errs = append(errs, fmt.Errorf("log storage: %v", err))
+	}
+
+	trees, err := hc.activeTrees(ctx)
+	if err != nil {
+		return append(errs, err)
+	}
+	for _, tree := range trees {
+		last, ok := hc.logStorage.LastSequencerRun(tree.TreeId)
+		if !ok {
+			last = hc.started
+		}
+		if since := time.Since(last); since > hc.stallAfter {
+			errs = append(errs, fmt.Errorf("signer hasn't finished a run of tree %v in %v", tree.TreeId, since.Round(time.Second)))
+		}
+	}
+	return errs
+}
+
+// readyz returns every failed readiness check.
+func (hc *healthChecker) readyz(ctx context.Context) []error {
+	errs := hc.healthz(ctx)
+
+	trees, err := hc.activeTrees(ctx)
+	if err != nil {
+		return append(errs, err)
+	}
+	for _, tree := range trees {
+		maxRootDuration, err := ptypes.Duration(tree.MaxRootDuration)
+		if err != nil {
+			errs = append(errs, fmt.Errorf("tree %v has invalid max root duration: %v", tree.TreeId, err))
+			continue
+		} else if maxRootDuration == 0 {
+			continue
+		}
+		// The signer only notices that a root is too old at its next run, so
+		// allow it as much leeway as it has before it's considered stuck.
+		if err := hc.logStorage.CheckRootAge(tree.TreeId, maxRootDuration+hc.stallAfter); err != nil {
+			errs = append(errs, err)
+		}
+	}
+	return errs
+}
+
+// activeTrees returns the trees that the signer is expected to sequence.
+func (hc *healthChecker) activeTrees(ctx context.Context) ([]*trillian.Tree, error) {
+	tx, err := hc.adminStorage.Snapshot(ctx)
+	if err != nil {
+		return nil, fmt.Errorf("admin storage: %v", err)
+	}
+	defer tx.Close()
+	trees, err := tx.ListTrees(ctx, false)
+	if err != nil {
+		return nil, fmt.Errorf("admin storage: %v", err)
+	}
+
+	out := make([]*trillian.Tree, 0, len(trees))
+	for _, tree := range trees {
+		if tree.TreeState == trillian.TreeState_ACTIVE || tree.TreeState == trillian.TreeState_DRAINING {
+			out = append(out, tree)
+		}
+	}
+	return out, nil
+}
+
+// handler returns an http.Handler that serves the result of `check`.
+func (hc *healthChecker) handler(check func(context.Context) []error) http.Handler {
+	return http.HandlerFunc(func(rw http.ResponseWriter, req *http.Request) {
+		ctx, cancel := context.WithTimeout(req.Context(), healthTimeout)
+		defer cancel()
+
+		rw.Header().Set("Cache-Control", "no-cache")
+		errs := check(ctx)
+		if len(errs) == 0 {
+			fmt.Fprintln(rw, "ok")
+			return
+		}
+		rw.WriteHeader(http.StatusServiceUnavailable)
+		for _, err := range errs {
+			fmt.Fprintln(rw, err)
+		}
+	})
+}
@@ -0,0 +1,127 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"strconv"
+	"time"
+
+	"github.com/cloudflare/ct-log/custom"
+
+	"github.com/google/trillian"
+)
+
+// historicalSTH is the JSON representation of a signed tree head in a log's
+// history.
+type historicalSTH struct {
+	TreeSize         int64     `json:"tree_size"`
+	Timestamp        time.Time `json:"timestamp"`
+	TreeRevision     int64     `json:"tree_revision"`
+	RootHash         []byte    `json:"sha256_root_hash"`
+	LogRoot          []byte    `json:"log_root"`
+	LogRootSignature []byte    `json:"log_root_signature"`
+}
+
+// historyHandler serves the signed tree heads that a log has signed. It takes a
+// required `log_id` parameter, and then one of:
+//   - `tree_size`: returns the first STH with that tree size,
+//   - `at`: returns the most recent STH signed at or before an RFC 3339 time,
+//   - `start`, `end`, and `limit`: lists up to `limit` STHs signed in the
+//     range [start, end), where start and end are RFC 3339 times.
+type historyHandler struct {
+	local *custom.Local
+}
+
+func (hh historyHandler) ServeHTTP(rw http.ResponseWriter, req *http.Request) {
+	sths, err := hh.query(req)
+	if err == custom.ErrRootNotFound {
+		http.Error(rw, err.Error(), http.StatusNotFound)
+		return
+	} else if _, ok := err.(paramError); ok {
+		http.Error(rw, err.Error(), http.StatusBadRequest)
+		return
+	} else if err != nil {
+		http.Error(rw, err.Error(), http.StatusInternalServerError)
+		return
+	}
+
+	out := make([]historicalSTH, 0, len(sths))
+	for _, sth := range sths {
+		out = append(out, historicalSTH{
+			TreeSize:         sth.TreeSize,
+			Timestamp:        time.Unix(0, sth.TimestampNanos).UTC(),
+			TreeRevision:     sth.TreeRevision,
+			RootHash:         sth.RootHash,
+			LogRoot:          sth.LogRoot,
+			LogRootSignature: sth.LogRootSignature,
+		})
+	}
+
+	rw.Header().Set("Content-Type", "application/json")
+	if err := json.NewEncoder(rw).Encode(out); err != nil {
+		http.Error(rw, err.Error(), http.StatusInternalServerError)
+	}
+}
+
+// paramError is returned by query when a request's parameters are invalid,
+// rather than when the history can't be read.
+type paramError struct {
+	error
+}
+
+func (hh historyHandler) query(req *http.Request) ([]trillian.SignedLogRoot, error) {
+	q := req.URL.Query()
+
+	treeID, err := strconv.ParseInt(q.Get("log_id"), 10, 64)
+	if err != nil {
+		return nil, paramError{fmt.Errorf("failed to parse log_id: %v", err)}
+	}
+
+	if q.Get("tree_size") != "" {
+		treeSize, err := strconv.ParseInt(q.Get("tree_size"), 10, 64)
+		if err != nil {
+			return nil, paramError{fmt.Errorf("failed to parse tree_size: %v", err)}
+		} else if treeSize < 0 {
+			return nil, paramError{fmt.Errorf("tree_size cannot be less than zero")}
+		}
+		sth, err := hh.local.GetRootByTreeSize(treeID, treeSize)
+		if err != nil {
+			return nil, err
+		}
+		return []trillian.SignedLogRoot{sth}, nil
+	} else if q.Get("at") != "" {
+		at, err := time.Parse(time.RFC3339, q.Get("at"))
+		if err != nil {
+			return nil, paramError{fmt.Errorf("failed to parse at: %v", err)}
+		} else if at.Before(time.Unix(0, 0)) {
+			return nil, paramError{fmt.Errorf("at cannot be before the epoch")}
+		}
+		sth, err := hh.local.GetRootAtTime(treeID, at.UnixNano())
+		if err != nil {
+			return nil, err
+		}
+		return []trillian.SignedLogRoot{sth}, nil
+	}
+
+	end, limit := time.Now(), 100
+	start := end.Add(-24 * time.Hour)
+	if q.Get("start") != "" {
+		if start, err = time.Parse(time.RFC3339, q.Get("start")); err != nil {
+			return nil, paramError{fmt.Errorf("failed to parse start: %v", err)}
+		}
+	}
+	if q.Get("end") != "" {
+		if end, err = time.Parse(time.RFC3339, q.Get("end")); err != nil {
+			return nil, paramError{fmt.Errorf("failed to parse end: %v", err)}
+		}
+	}
+	if q.Get("limit") != "" {
+		if limit, err = strconv.Atoi(q.Get("limit")); err != nil {
+			return nil, paramError{fmt.Errorf("failed to parse limit: %v", err)}
+		} else if limit < 1 || limit > 10000 {
+			return nil, paramError{fmt.Errorf("limit must be between 1 and 10000")}
+		}
+	}
+	return hh.local.ListRoots(treeID, start.UnixNano(), end.UnixNano(), limit)
+}
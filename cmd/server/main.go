@@ -21,8 +21,6 @@ import (
 
 	"github.com/golang/glog"
 	"github.com/golang/protobuf/proto"
-	"github.com/google/certificate-transparency-go/trillian/ctfe"
-	"github.com/google/trillian"
 	"github.com/google/trillian/crypto/keys/der"
 	"github.com/google/trillian/crypto/keyspb"
 	"github.com/google/trillian/extension"
@@ -30,7 +28,6 @@ import (
 	"github.com/google/trillian/quota"
 	"github.com/google/trillian/server"
 	"github.com/google/trillian/server/interceptor"
-	"github.com/google/trillian/storage"
 	"github.com/google/trillian/util"
 	"github.com/google/trillian/util/election"
 	"golang.org/x/net/netutil"
@@ -72,13 +69,24 @@ func main() {
 	glog.CopyStandardLogTo("WARNING")
 	glog.Info("**** CT HTTP Server Starting ****")
 
+	// Trillian's PKCS#11 key handler takes its module from a flag, which only
+	// exists when the server is built with the pkcs11 tag.
+	if cfg.PKCS11Module != "" {
+		if err := flag.Set("pkcs11_module_path", cfg.PKCS11Module); err != nil {
+			glog.Exitf("failed to set pkcs11 module, the server must be built with -tags pkcs11: %v", err)
+		}
+	}
+	if err := cfg.CheckSigners(ctx); err != nil {
+		glog.Exitf("failed to load signers: %v", err)
+	}
+
 	// Set cache size, if specified.
 	if cfg.LeafCacheSize != 0 {
 		ct.SetLeafCacheSize(cfg.LeafCacheSize)
 	}
 
 	// Connect to databases.
-	local, err := custom.NewLocal(cfg.LevelDBPath)
+	local, err := custom.NewLocal(cfg.LevelDBPath, cfg.LevelDB.Options())
 	if err != nil {
 		glog.Exitf("failed to open local database: %v", err)
 	}
@@ -89,19 +97,40 @@ func main() {
 
 	// Wrap our database connections in a struct that will implement
 	// storage.LogStorage over them.
+	subtreeCacheSize := ct.DefaultSubtreeCacheSize
+	if cfg.SubtreeCacheSize != 0 {
+		subtreeCacheSize = cfg.SubtreeCacheSize
+	}
 	logStorage := &ct.LogStorage{
-		Local:  local,
-		Remote: remote,
+		Local:    local,
+		Remote:   remote,
+		Subtrees: ct.NewSubtreeCache(subtreeCacheSize),
 
 		AdminStorage: cfg.AdminStorage,
 	}
 
-	// Initialize a quota manager and set it to watch the number of unsequenced
-	// leaves in all of our logs.
+	// Initialize a quota manager to watch the number of unsequenced leaves in
+	// all of our logs. The log storage keeps it up to date.
 	qm := ct.NewQuotaManager(cfg.MaxUnsequencedLeaves)
+	logStorage.Observer = qm
+	lm := &logManager{
+		cfg:        cfg,
+		logStorage: logStorage,
+		qm:         qm,
+		watches:    make(map[int64]context.CancelFunc),
+		followers:  make(map[int64]*follower),
+	}
 	for _, logConfig := range cfg.LogConfigs {
-		qm.WatchLog(local, logConfig.LogId)
+		if err := lm.prepare(ctx, cfg, logConfig.LogId); err != nil {
+			glog.Exitf("failed to prepare log %v: %v", logConfig.LogId, err)
+		}
+	}
+	if err := lm.loadFrozenSTHs(cfg); err != nil {
+		glog.Exitf("failed to load frozen sths: %v", err)
 	}
+	reportRoots(cfg)
+	lm.setRateLimits()
+	lm.setFrozen()
 
 	// Setup the log server.
 	serverRegistry := extension.Registry{
@@ -129,42 +158,19 @@ func main() {
 			fmt.Fprintln(rw, "404 not found")
 		}
 	})
+	lm.logServer, lm.handlers = logServer, newLogHandlers(mux)
 	for i, logConfig := range cfg.LogConfigs {
-		_, err := logServer.GetLatestSignedLogRoot(ctx, &trillian.GetLatestSignedLogRootRequest{
-			LogId: logConfig.LogId,
-		})
-		if err == storage.ErrTreeNeedsInit {
-			_, err = logServer.InitLog(ctx, &trillian.InitLogRequest{
-				LogId: logConfig.LogId,
-			})
-			if err != nil {
-				glog.Exitf("failed to initialize log: %#v: %v", i, err)
-			}
-			glog.Infof("initialized log: %v", logConfig.LogId)
-		} else if err != nil {
-			glog.Exitf("failed to check if log is initialized: %#v: %v", i, err)
+		if err := lm.initLog(ctx, logConfig.LogId); err != nil {
+			glog.Exitf("failed to initialize log %v: %v", logConfig.LogId, err)
 		}
-
-		vcfg, err := ctfe.ValidateLogConfig(logConfig)
-		if err != nil {
-			glog.Exitf("failed to validate log config: %#v: %v", i, err)
-		}
-		opts := ctfe.InstanceOptions{
-			Validated:     vcfg,
-			Client:        logServer,
-			Deadline:      cfg.RequestTimeout,
-			MetricFactory: prometheus.MetricFactory{},
-			RequestLog:    new(ctfe.DefaultRequestLog),
-		}
-		handlers, err := ctfe.SetUpInstance(ctx, opts)
+		handlers, err := lm.setUp(ctx, cfg, i)
 		if err != nil {
 			glog.Exitf("failed to set up log #%v: %v", i, err)
 		}
-		for path, handler := range *handlers {
-			mux.Handle(path, handler)
-		}
+		lm.handlers.set(handlers, isFrozen(cfg, logConfig.LogId))
 	}
-	svc := http.Server{Handler: cacheHandler{mux}}
+	lm.follow(ctx)
+	svc := http.Server{Handler: cacheHandler{mux, lm.handlers}}
 
 	// Setup the sequencing loop. This controls both sequencing and signing.
 	signerRegistry := extension.Registry{
@@ -207,8 +213,8 @@ func main() {
 	}
 
 	// Spin off main threads of work.
-	go awaitSignal(cancel)
-	go metrics(qm, metricsList)
+	go awaitSignal(cancel, func() { lm.reload(ctx) })
+	go metrics(qm, logStorage.Subtrees, cfg.AdminStorage, local, newHealthChecker(logStorage, cfg.AdminStorage, cfg.Signer.RunInterval), lm, metricsList)
 	go func() {
 		if cfg.CertFile == "" {
 			glog.Exit(svc.Serve(httpList))
@@ -225,20 +231,29 @@ func main() {
 }
 
 // awaitSignal waits for standard termination signals, then exits the process.
-func awaitSignal(doneFn func()) {
+// The config is reloaded with reloadFn each time SIGHUP is received.
+func awaitSignal(doneFn, reloadFn func()) {
 	sigs := make(chan os.Signal, 1)
-	signal.Notify(sigs, syscall.SIGINT, syscall.SIGTERM)
+	signal.Notify(sigs, syscall.SIGINT, syscall.SIGTERM, syscall.SIGHUP)
 
-	sig := <-sigs
-	glog.Warningf("Signal received: %v", sig)
-	glog.Flush()
+	for sig := range sigs {
+		if sig == syscall.SIGHUP {
+			reloadFn()
+			continue
+		}
+		glog.Warningf("Signal received: %v", sig)
+		glog.Flush()
 
-	doneFn()
+		doneFn()
+		return
+	}
 }
 
 // cacheHandler sets the Cache-Control header on common, cache-able requests.
+// Every response for a frozen log can be cached, since it won't change.
 type cacheHandler struct {
 	inner http.Handler
+	logs  *logHandlers
 }
 
 func (ch cacheHandler) ServeHTTP(rw http.ResponseWriter, req *http.Request) {
@@ -251,6 +266,8 @@ func (ch cacheHandler) ServeHTTP(rw http.ResponseWriter, req *http.Request) {
 	if req.Method == "GET" {
 		if req.URL.Path == "/" {
 			rw.Header().Set("Cache-Control", "public, max-age=14400")
+		} else if ch.logs.isFrozen(req.URL.Path) {
+			rw.Header().Set("Cache-Control", "public, max-age=86400")
 		} else if strings.HasSuffix(req.URL.Path, "/ct/v1/get-sth") {
 			rw.Header().Set("Cache-Control", "public, max-age=3600")
 		} else if strings.HasSuffix(req.URL.Path, "/ct/v1/get-roots") {
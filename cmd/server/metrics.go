@@ -7,8 +7,10 @@ import (
 	"net/http/pprof"
 
 	"github.com/cloudflare/ct-log/ct"
+	"github.com/cloudflare/ct-log/custom"
 
 	"github.com/golang/glog"
+	"github.com/google/trillian/storage"
 	"github.com/prometheus/client_golang/prometheus"
 	"github.com/prometheus/client_golang/prometheus/promhttp"
 )
@@ -30,12 +32,101 @@ var (
 	)
 )
 
-func metrics(qm *ct.QuotaManager, metricsList net.Listener) {
+// levelDBCollector exports LevelDB's internal statistics about the local
+// database. The statistics are read each time the collector is scraped.
+type levelDBCollector struct {
+	local *custom.Local
+
+	ioRead, ioWrite                    *prometheus.Desc
+	writeDelayCount, writeDelaySeconds *prometheus.Desc
+	blockCacheSize, openedTables       *prometheus.Desc
+	blockCacheRequests                 *prometheus.Desc
+	aliveSnapshots, aliveIterators     *prometheus.Desc
+	levelSize, levelTables             *prometheus.Desc
+	compactionRead, compactionWrite    *prometheus.Desc
+	compactionSeconds                  *prometheus.Desc
+}
+
+func newLevelDBCollector(local *custom.Local) *levelDBCollector {
+	desc := func(name, help string, labels ...string) *prometheus.Desc {
+		return prometheus.NewDesc("leveldb_"+name, help, labels, nil)
+	}
+
+	return &levelDBCollector{
+		local: local,
+
+		ioRead:             desc("io_read_bytes", "The number of bytes read from disk by LevelDB."),
+		ioWrite:            desc("io_write_bytes", "The number of bytes written to disk by LevelDB."),
+		writeDelayCount:    desc("write_delay_count", "The number of writes that LevelDB has delayed."),
+		writeDelaySeconds:  desc("write_delay_seconds", "The cumulative time that writes have been delayed by LevelDB."),
+		blockCacheSize:     desc("block_cache_size_bytes", "The size of LevelDB's block cache."),
+		blockCacheRequests: desc("block_cache_requests", "The number of lookups in LevelDB's block cache, by whether the block was cached.", "result"),
+		openedTables:       desc("opened_tables", "The number of tables that LevelDB has open."),
+		aliveSnapshots:     desc("alive_snapshots", "The number of LevelDB snapshots that haven't been released."),
+		aliveIterators:     desc("alive_iterators", "The number of LevelDB iterators that haven't been released."),
+		levelSize:          desc("level_size_bytes", "The size of each LevelDB level.", "level"),
+		levelTables:        desc("level_tables", "The number of tables in each LevelDB level.", "level"),
+		compactionRead:     desc("compaction_read_bytes", "The number of bytes read by compactions, per level.", "level"),
+		compactionWrite:    desc("compaction_write_bytes", "The number of bytes written by compactions, per level.", "level"),
+		compactionSeconds:  desc("compaction_seconds", "The cumulative time spent on compactions, per level.", "level"),
+	}
+}
+
+func (lc *levelDBCollector) Describe(ch chan<- *prometheus.Desc) {
+	ch <- lc.ioRead
+	ch <- lc.ioWrite
+	ch <- lc.writeDelayCount
+	ch <- lc.writeDelaySeconds
+	ch <- lc.blockCacheSize
+	ch <- lc.blockCacheRequests
+	ch <- lc.openedTables
+	ch <- lc.aliveSnapshots
+	ch <- lc.aliveIterators
+	ch <- lc.levelSize
+	ch <- lc.levelTables
+	ch <- lc.compactionRead
+	ch <- lc.compactionWrite
+	ch <- lc.compactionSeconds
+}
+
+func (lc *levelDBCollector) Collect(ch chan<- prometheus.Metric) {
+	stats, err := lc.local.Stats()
+	if err != nil {
+		glog.Warningf("failed to get leveldb stats: %v", err)
+		return
+	}
+
+	ch <- prometheus.MustNewConstMetric(lc.ioRead, prometheus.CounterValue, float64(stats.IORead))
+	ch <- prometheus.MustNewConstMetric(lc.ioWrite, prometheus.CounterValue, float64(stats.IOWrite))
+	ch <- prometheus.MustNewConstMetric(lc.writeDelayCount, prometheus.CounterValue, float64(stats.WriteDelayCount))
+	ch <- prometheus.MustNewConstMetric(lc.writeDelaySeconds, prometheus.CounterValue, stats.WriteDelayDuration.Seconds())
+	ch <- prometheus.MustNewConstMetric(lc.blockCacheSize, prometheus.GaugeValue, float64(stats.BlockCacheSize))
+	hits, misses := lc.local.BlockCacheRequests()
+	ch <- prometheus.MustNewConstMetric(lc.blockCacheRequests, prometheus.CounterValue, float64(hits), "hit")
+	ch <- prometheus.MustNewConstMetric(lc.blockCacheRequests, prometheus.CounterValue, float64(misses), "miss")
+	ch <- prometheus.MustNewConstMetric(lc.openedTables, prometheus.GaugeValue, float64(stats.OpenedTablesCount))
+	ch <- prometheus.MustNewConstMetric(lc.aliveSnapshots, prometheus.GaugeValue, float64(stats.AliveSnapshots))
+	ch <- prometheus.MustNewConstMetric(lc.aliveIterators, prometheus.GaugeValue, float64(stats.AliveIterators))
+
+	for i := range stats.LevelSizes {
+		level := fmt.Sprint(i)
+		ch <- prometheus.MustNewConstMetric(lc.levelSize, prometheus.GaugeValue, float64(stats.LevelSizes[i]), level)
+		ch <- prometheus.MustNewConstMetric(lc.levelTables, prometheus.GaugeValue, float64(stats.LevelTablesCounts[i]), level)
+		ch <- prometheus.MustNewConstMetric(lc.compactionRead, prometheus.CounterValue, float64(stats.LevelRead[i]), level)
+		ch <- prometheus.MustNewConstMetric(lc.compactionWrite, prometheus.CounterValue, float64(stats.LevelWrite[i]), level)
+		ch <- prometheus.MustNewConstMetric(lc.compactionSeconds, prometheus.CounterValue, stats.LevelDurations[i].Seconds(), level)
+	}
+}
+
+func metrics(qm *ct.QuotaManager, subtrees *ct.SubtreeCache, as storage.AdminStorage, local *custom.Local, hc *healthChecker, lm *logManager, metricsList net.Listener) {
 	buildInfo.WithLabelValues(Version, GoVersion).Set(1)
 	prometheus.MustRegister(buildInfo)
 	prometheus.MustRegister(reqsByColo)
 	prometheus.MustRegister(qm.TreeSize)
 	prometheus.MustRegister(qm.UnsequencedLeaves)
+	prometheus.MustRegister(qm.RateLimited)
+	prometheus.MustRegister(subtrees.Requests)
+	prometheus.MustRegister(newLevelDBCollector(local))
 
 	mux := http.NewServeMux()
 	mux.HandleFunc("/", func(rw http.ResponseWriter, req *http.Request) {
@@ -47,6 +138,8 @@ func metrics(qm *ct.QuotaManager, metricsList net.Listener) {
 		}
 	})
 	mux.Handle("/metrics", promhttp.Handler())
+	mux.Handle("/healthz", hc.handler(hc.healthz))
+	mux.Handle("/readyz", hc.handler(hc.readyz))
 
 	mux.HandleFunc("/debug/pprof/", pprof.Index)
 	mux.HandleFunc("/debug/pprof/cmdline", pprof.Cmdline)
@@ -54,6 +147,12 @@ func metrics(qm *ct.QuotaManager, metricsList net.Listener) {
 	mux.HandleFunc("/debug/pprof/symbol", pprof.Symbol)
 	mux.HandleFunc("/debug/pprof/trace", pprof.Trace)
 
+	mux.Handle("/debug/sth-history", historyHandler{local})
+	mux.Handle("/debug/quota", quotaHandler{qm, as})
+	mux.Handle("/debug/quota/rate-limited", rateLimitedHandler{qm})
+	mux.Handle("/debug/freeze", freezeHandler{lm})
+	mux.Handle("/debug/roots", rootsHandler{lm})
+
 	mux.HandleFunc("/debug/version", func(w http.ResponseWriter, req *http.Request) {
 		fmt.Fprintf(w, "Version: %s, GoVersion: %s", Version, GoVersion)
 	})
@@ -0,0 +1,74 @@
+package main
+
+import (
+	"context"
+
+	"github.com/cloudflare/ct-log/config"
+	"github.com/cloudflare/ct-log/mirror"
+
+	"github.com/golang/glog"
+	"github.com/google/trillian"
+)
+
+// follower is a running mirror, and the config that it was started with.
+type follower struct {
+	cfg    config.MirrorConfig
+	cancel context.CancelFunc
+}
+
+// follow starts a mirror for each active log that has a source in the config,
+// and stops the mirrors of logs that are no longer active or whose source has
+// changed. It must be called once the logs are initialized.
+func (lm *logManager) follow(ctx context.Context) {
+	for logID, f := range lm.followers {
+		cfg, ok := lm.cfg.Mirrors[logID]
+		if state, err := lm.cfg.TreeState(logID); !ok || cfg != f.cfg || err != nil || state != trillian.TreeState_ACTIVE {
+			f.cancel()
+			delete(lm.followers, logID)
+		}
+	}
+	for logID, cfg := range lm.cfg.Mirrors {
+		if _, ok := lm.followers[logID]; ok {
+			continue
+		} else if state, err := lm.cfg.TreeState(logID); err != nil || state != trillian.TreeState_ACTIVE {
+			continue
+		}
+		if err := lm.startFollower(ctx, logID, cfg); err != nil {
+			glog.Errorf("failed to start mirroring log %v: %v", logID, err)
+		}
+	}
+}
+
+// startFollower starts a mirror that copies the entries of the source in `cfg`
+// into a log, until it's cancelled or diverges from the source. The leaves are
+// integrated by the signer, like those of any other log.
+func (lm *logManager) startFollower(ctx context.Context, logID int64, cfg config.MirrorConfig) error {
+	tx, err := lm.cfg.AdminStorage.Snapshot(ctx)
+	if err != nil {
+		return err
+	}
+	defer tx.Close()
+	tree, err := tx.GetTree(ctx, logID)
+	if err != nil {
+		return err
+	}
+
+	src, err := mirror.NewLogClient(cfg.Source, cfg.SourcePubKey)
+	if err != nil {
+		return err
+	}
+	m, err := mirror.New(src, lm.logStorage, tree, cfg.BatchSize, cfg.PollInterval, lm.cfg.Signer.RunInterval)
+	if err != nil {
+		return err
+	}
+
+	followCtx, cancel := context.WithCancel(ctx)
+	lm.followers[logID] = &follower{cfg: cfg, cancel: cancel}
+	go func() {
+		if err := m.Run(followCtx); err != nil {
+			glog.Errorf("stopped mirroring log %v from %v: %v", logID, cfg.Source, err)
+		}
+	}()
+	glog.Infof("mirroring log %v from %v", logID, cfg.Source)
+	return nil
+}
@@ -0,0 +1,147 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"net"
+	"net/http"
+	"strconv"
+
+	"github.com/cloudflare/ct-log/ct"
+
+	"github.com/google/trillian/quota"
+	"github.com/google/trillian/storage"
+)
+
+// logQuota is the JSON representation of a log's remaining quota.
+type logQuota struct {
+	LogID     int64 `json:"log_id"`
+	Remaining int   `json:"remaining"`
+}
+
+// quotaHandler serves the number of leaves that each log will accept before it
+// starts refusing submissions. A POST request resets the quota of the log in
+// the `log_id` parameter, or of every log if it's missing, by recounting the
+// log's unsequenced leaves.
+type quotaHandler struct {
+	qm *ct.QuotaManager
+	as storage.AdminStorage
+}
+
+func (qh quotaHandler) ServeHTTP(rw http.ResponseWriter, req *http.Request) {
+	logIDs, err := listLogIDs(req.Context(), qh.as)
+	if err != nil {
+		http.Error(rw, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	if raw := req.URL.Query().Get("log_id"); raw != "" {
+		logID, err := strconv.ParseInt(raw, 10, 64)
+		if err != nil {
+			http.Error(rw, fmt.Sprintf("failed to parse log_id: %v", err), http.StatusBadRequest)
+			return
+		}
+		logIDs = []int64{logID}
+	}
+	specs := make([]quota.Spec, 0, len(logIDs))
+	for _, logID := range logIDs {
+		specs = append(specs, quota.Spec{Group: quota.Tree, Kind: quota.Write, TreeID: logID})
+	}
+
+	switch req.Method {
+	case "GET":
+	case "POST":
+		if err := qh.qm.ResetQuota(req.Context(), specs); err != nil {
+			http.Error(rw, err.Error(), http.StatusBadRequest)
+			return
+		}
+	default:
+		http.Error(rw, "method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+
+	tokens, err := qh.qm.PeekTokens(req.Context(), specs)
+	if err != nil {
+		http.Error(rw, err.Error(), http.StatusBadRequest)
+		return
+	}
+	out := make([]logQuota, 0, len(specs))
+	for _, spec := range specs {
+		out = append(out, logQuota{LogID: spec.TreeID, Remaining: tokens[spec]})
+	}
+
+	rw.Header().Set("Content-Type", "application/json")
+	if err := json.NewEncoder(rw).Encode(out); err != nil {
+		http.Error(rw, err.Error(), http.StatusInternalServerError)
+	}
+}
+
+// rateLimitedHandler serves the submitters that had the most requests rejected
+// by their rate limit, up to the number in the optional `limit` parameter.
+type rateLimitedHandler struct {
+	qm *ct.QuotaManager
+}
+
+func (rh rateLimitedHandler) ServeHTTP(rw http.ResponseWriter, req *http.Request) {
+	limit := 100
+	if raw := req.URL.Query().Get("limit"); raw != "" {
+		var err error
+		if limit, err = strconv.Atoi(raw); err != nil {
+			http.Error(rw, fmt.Sprintf("failed to parse limit: %v", err), http.StatusBadRequest)
+			return
+		} else if limit < 1 {
+			http.Error(rw, "limit must be at least 1", http.StatusBadRequest)
+			return
+		}
+	}
+
+	rw.Header().Set("Content-Type", "application/json")
+	if err := json.NewEncoder(rw).Encode(rh.qm.RateLimitedUsers(limit)); err != nil {
+		http.Error(rw, err.Error(), http.StatusInternalServerError)
+	}
+}
+
+// listLogIDs returns the ids of the logs that are currently configured.
+func listLogIDs(ctx context.Context, as storage.AdminStorage) ([]int64, error) {
+	tx, err := as.Snapshot(ctx)
+	if err != nil {
+		return nil, err
+	}
+	defer tx.Close()
+	return tx.ListTreeIDs(ctx, false)
+}
+
+// remoteQuotaUser returns a function that identifies the submitter of a request
+// by its IP address. Requests that come from one of our edge networks are
+// identified by the CF-Connecting-IP header instead, which is the address of
+// the client that connected to the edge. IPv6 clients are identified by their
+// /64, because a single host can usually use any address in it.
+func remoteQuotaUser(edgeNetworks []*net.IPNet) func(*http.Request) string {
+	return func(req *http.Request) string {
+		host, _, err := net.SplitHostPort(req.RemoteAddr)
+		if err != nil {
+			host = req.RemoteAddr
+		}
+		ip := net.ParseIP(host)
+		if ip == nil {
+			return host
+		}
+		for _, network := range edgeNetworks {
+			if !network.Contains(ip) {
+				continue
+			} else if client := net.ParseIP(req.Header.Get("CF-Connecting-IP")); client != nil {
+				return quotaUserIP(client)
+			}
+			break
+		}
+		return quotaUserIP(ip)
+	}
+}
+
+// quotaUserIP returns the quota user of a client's IP address.
+func quotaUserIP(ip net.IP) string {
+	if ip.To4() != nil {
+		return ip.String()
+	}
+	return fmt.Sprintf("%v/64", ip.Mask(net.CIDRMask(64, 128)))
+}
@@ -0,0 +1,395 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"os"
+	"strings"
+	"sync"
+
+	"github.com/cloudflare/ct-log/config"
+	"github.com/cloudflare/ct-log/ct"
+
+	"github.com/golang/glog"
+	"github.com/golang/protobuf/proto"
+	"github.com/google/certificate-transparency-go/trillian/ctfe"
+	"github.com/google/certificate-transparency-go/trillian/ctfe/configpb"
+	"github.com/google/trillian"
+	"github.com/google/trillian/monitoring/prometheus"
+	"github.com/google/trillian/storage"
+)
+
+// logHandlers serves the CT endpoints of every log. The handlers of a log are
+// replaced when the config is reloaded, and the paths of new logs are added to
+// mux.
+type logHandlers struct {
+	mux *http.ServeMux
+
+	mu       sync.RWMutex
+	handlers map[string]http.Handler
+	// frozen is the set of paths served for frozen logs, whose responses
+	// don't change.
+	frozen map[string]bool
+}
+
+func newLogHandlers(mux *http.ServeMux) *logHandlers {
+	return &logHandlers{
+		mux:      mux,
+		handlers: make(map[string]http.Handler),
+		frozen:   make(map[string]bool),
+	}
+}
+
+// set serves each path with its new handler. `frozen` is whether the handlers
+// are for a frozen log.
+func (lh *logHandlers) set(handlers ctfe.PathHandlers, frozen bool) {
+	lh.mu.Lock()
+	defer lh.mu.Unlock()
+
+	for path, handler := range handlers {
+		lh.frozen[path] = frozen
+		if _, ok := lh.handlers[path]; !ok {
+			path := path
+			lh.mux.HandleFunc(path, func(rw http.ResponseWriter, req *http.Request) {
+				lh.mu.RLock()
+				handler := lh.handlers[path]
+				lh.mu.RUnlock()
+				handler.ServeHTTP(rw, req)
+			})
+		}
+		lh.handlers[path] = handler
+	}
+}
+
+// isFrozen returns whether `path` is served for a frozen log.
+func (lh *logHandlers) isFrozen(path string) bool {
+	lh.mu.RLock()
+	defer lh.mu.RUnlock()
+	return lh.frozen[path]
+}
+
+// logManager sets up the logs in the config, and applies changes to them when
+// the config is reloaded.
+type logManager struct {
+	cfg        *config.Config
+	logStorage *ct.LogStorage
+	qm         *ct.QuotaManager
+	logServer  trillianLogClient
+	handlers   *logHandlers
+
+	// watches cancels the quota manager's watch of each log. Logs are only
+	// watched while they can have unsequenced leaves, so not once they're
+	// frozen.
+	watches map[int64]context.CancelFunc
+	// followers are the mirrors that are following their source log. Logs are
+	// only followed while they're active.
+	followers map[int64]*follower
+
+	// mu serializes changes to the config, which are made when it's reloaded
+	// and when a log is frozen.
+	mu sync.Mutex
+}
+
+// prepare gets the storage of a log ready to be served: it cleans up after any
+// sequencing run that was interrupted by a crash, warms the subtree cache,
+// starts backfilling completed Merkle nodes, and has the quota manager watch
+// the log unless it's frozen in `cfg`. It must be called before the signer
+// runs for the log.
+func (lm *logManager) prepare(ctx context.Context, cfg *config.Config, logID int64) error {
+	if err := lm.logStorage.Recover(ctx, logID); err != nil {
+		return err
+	}
+
+	// Read the subtrees that proofs need most into the shared cache.
+	if err := lm.logStorage.WarmSubtreeCache(ctx, logID); err != nil {
+		glog.Warningf("failed to warm subtree cache for log %v: %v", logID, err)
+	}
+
+	// Store the completed Merkle nodes of logs that were sequenced before they
+	// were stored, so that proofs don't depend on old subtree revisions.
+	go func() {
+		if err := lm.logStorage.BackfillCompletedNodes(ctx, logID); err != nil {
+			glog.Errorf("failed to backfill completed nodes of log %v: %v", logID, err)
+		}
+	}()
+
+	if isFrozen(cfg, logID) {
+		return nil
+	}
+	return lm.watch(ctx, logID)
+}
+
+// watch has the quota manager keep track of a log's unsequenced leaves, until
+// unwatch is called.
+func (lm *logManager) watch(ctx context.Context, logID int64) error {
+	if _, ok := lm.watches[logID]; ok {
+		return nil
+	}
+	watchCtx, cancel := context.WithCancel(ctx)
+	if err := lm.qm.WatchLog(watchCtx, lm.logStorage.Local, logID); err != nil {
+		cancel()
+		return err
+	}
+	lm.watches[logID] = cancel
+	return nil
+}
+
+// unwatch stops the quota manager from keeping track of a log, once it's frozen
+// or removed.
+func (lm *logManager) unwatch(logID int64) {
+	if cancel, ok := lm.watches[logID]; ok {
+		cancel()
+		delete(lm.watches, logID)
+	}
+}
+
+// initLog initializes a log's tree, if it hasn't been already.
+func (lm *logManager) initLog(ctx context.Context, logID int64) error {
+	_, err := lm.logServer.GetLatestSignedLogRoot(ctx, &trillian.GetLatestSignedLogRootRequest{
+		LogId: logID,
+	})
+	if err != storage.ErrTreeNeedsInit {
+		return err
+	}
+	_, err = lm.logServer.InitLog(ctx, &trillian.InitLogRequest{LogId: logID})
+	if err != nil {
+		return err
+	}
+	glog.Infof("initialized log: %v", logID)
+	return nil
+}
+
+// setUp returns the handlers of a log's CT endpoints, as configured by `cfg`.
+func (lm *logManager) setUp(ctx context.Context, cfg *config.Config, i int) (ctfe.PathHandlers, error) {
+	// ctfe reads roots from files, so give it a file with just the roots that
+	// the log accepts. It's only read while the log is set up.
+	logConfig := proto.Clone(cfg.LogConfigs[i]).(*configpb.LogConfig)
+	logConfig.RootsPemFile = nil
+	if roots := cfg.Roots[logConfig.LogId]; roots != nil && len(roots.Certs) > 0 {
+		rootsFile, err := writeRoots(roots)
+		if err != nil {
+			return nil, err
+		}
+		defer os.Remove(rootsFile)
+		logConfig.RootsPemFile = []string{rootsFile}
+	}
+
+	vcfg, err := ctfe.ValidateLogConfig(logConfig)
+	if err != nil {
+		return nil, err
+	}
+	opts := ctfe.InstanceOptions{
+		Validated:     vcfg,
+		Client:        lm.logServer,
+		Deadline:      cfg.RequestTimeout,
+		MetricFactory: prometheus.MetricFactory{},
+		RequestLog:    new(ctfe.DefaultRequestLog),
+	}
+	if cfg.RateLimit.Client.Capacity > 0 {
+		opts.RemoteQuotaUser = remoteQuotaUser(cfg.RateLimit.EdgeNetworks)
+	}
+	if cfg.RateLimit.Issuer.Capacity > 0 {
+		opts.CertificateQuotaUser = ctfe.QuotaUserForCert
+	}
+	handlers, err := ctfe.SetUpInstance(ctx, opts)
+	if err != nil {
+		return nil, err
+	}
+	// Serve the log under its override_handler_prefix, if it has one.
+	ohPrefix := strings.TrimRight("/"+strings.Trim(vcfg.Config.OverrideHandlerPrefix, "/"), "/")
+	if ohPrefix == "" {
+		return *handlers, nil
+	}
+	out := make(ctfe.PathHandlers)
+	for path, handler := range *handlers {
+		out[ohPrefix+path] = handler
+	}
+	return out, nil
+}
+
+// loadFrozenSTHs gives each frozen log in `cfg` that doesn't have a frozen_sth
+// in the config file the STH that was signed when it was frozen. It returns an
+// error if a log that isn't frozen in `cfg` has a stored STH, because the log
+// was frozen but the config file wasn't updated, and it mustn't sign new STHs.
+func (lm *logManager) loadFrozenSTHs(cfg *config.Config) error {
+	for _, logConfig := range cfg.LogConfigs {
+		sth, err := lm.logStorage.GetFrozenSTH(logConfig.LogId)
+		if err != nil {
+			return fmt.Errorf("log %v: %v", logConfig.LogId, err)
+		}
+		if !isFrozen(cfg, logConfig.LogId) {
+			if sth != nil {
+				state, _ := cfg.TreeState(logConfig.LogId)
+				return fmt.Errorf("log %v was frozen at tree size %v, but its tree_state is %v; set it to FROZEN in the config file", logConfig.LogId, sth.TreeSize, state)
+			}
+			continue
+		} else if logConfig.FrozenSth != nil {
+			continue
+		} else if sth == nil {
+			glog.Warningf("log %v is frozen, but has no frozen sth; it will keep signing new sths", logConfig.LogId)
+			continue
+		} else if err := cfg.SetFrozenSTH(logConfig.LogId, sth); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// setFrozen has the quota manager and the local database refuse new leaves for
+// every log that isn't active.
+func (lm *logManager) setFrozen() {
+	for _, logConfig := range lm.cfg.LogConfigs {
+		state, _ := lm.cfg.TreeState(logConfig.LogId)
+		lm.qm.SetFrozen(logConfig.LogId, state != trillian.TreeState_ACTIVE)
+		lm.logStorage.Local.SetFrozen(logConfig.LogId, state != trillian.TreeState_ACTIVE)
+	}
+}
+
+// isFrozen returns whether the log with the given id is frozen in `cfg`.
+func isFrozen(cfg *config.Config, logID int64) bool {
+	state, _ := cfg.TreeState(logID)
+	return state == trillian.TreeState_FROZEN
+}
+
+// writeRoots writes roots to a temporary file, and returns its path.
+func writeRoots(roots *config.Roots) (string, error) {
+	f, err := ioutil.TempFile("", "ct-log-roots")
+	if err != nil {
+		return "", fmt.Errorf("failed to write roots: %v", err)
+	}
+	defer f.Close()
+	if _, err := f.Write(roots.PEM()); err != nil {
+		os.Remove(f.Name())
+		return "", fmt.Errorf("failed to write roots: %v", err)
+	}
+	return f.Name(), nil
+}
+
+// reportRoots logs every problem with the roots of the logs in `cfg`.
+func reportRoots(cfg *config.Config) {
+	for _, logConfig := range cfg.LogConfigs {
+		roots := cfg.Roots[logConfig.LogId]
+		if roots == nil {
+			continue
+		}
+		for _, problem := range roots.Problems {
+			glog.Warningf("roots of log %v: %v", logConfig.LogId, problem)
+		}
+		glog.Infof("log %v accepts %v roots, %v excluded", logConfig.LogId, len(roots.Certs), len(roots.Excluded))
+	}
+}
+
+// setRateLimits sets the quota manager's rate limits from the config.
+func (lm *logManager) setRateLimits() {
+	lm.qm.SetRateLimits(
+		ct.RateLimit(lm.cfg.RateLimit.Client),
+		ct.RateLimit(lm.cfg.RateLimit.Issuer),
+	)
+}
+
+// reload reads the config file again, and applies the changes that can be made
+// without a restart. Nothing is changed if the new config has any other
+// changes, or if any log can't be set up with it.
+func (lm *logManager) reload(ctx context.Context) {
+	lm.mu.Lock()
+	defer lm.mu.Unlock()
+
+	glog.Infof("reloading config from %v", *configFile)
+	next, err := config.FromFile(*configFile)
+	if err != nil {
+		glog.Errorf("failed to reload config: %v", err)
+		return
+	} else if err := lm.loadFrozenSTHs(next); err != nil {
+		glog.Errorf("failed to reload config: %v", err)
+		return
+	} else if err := lm.cfg.CheckReload(next); err != nil {
+		glog.Errorf("refusing to reload config: %v", err)
+		return
+	} else if err := next.CheckSigners(ctx); err != nil {
+		glog.Errorf("refusing to reload config: %v", err)
+		return
+	}
+	reportRoots(next)
+
+	// Set up every log's handlers before changing anything, which loads their
+	// roots and signers.
+	handlers := make([]ctfe.PathHandlers, 0, len(next.LogConfigs))
+	for i, logConfig := range next.LogConfigs {
+		h, err := lm.setUp(ctx, next, i)
+		if err != nil {
+			glog.Errorf("refusing to reload config: failed to set up log %v: %v", logConfig.LogId, err)
+			return
+		}
+		handlers = append(handlers, h)
+	}
+
+	existing := make(map[int64]bool)
+	for _, logConfig := range lm.cfg.LogConfigs {
+		existing[logConfig.LogId] = true
+	}
+	added := make([]int64, 0)
+	unprepare := func() {
+		for _, logID := range added {
+			lm.unwatch(logID)
+		}
+	}
+	for _, logConfig := range next.LogConfigs {
+		if !existing[logConfig.LogId] {
+			if err := lm.prepare(ctx, next, logConfig.LogId); err != nil {
+				glog.Errorf("refusing to reload config: failed to prepare log %v: %v", logConfig.LogId, err)
+				unprepare()
+				return
+			}
+			added = append(added, logConfig.LogId)
+		}
+	}
+
+	// New B2 credentials are authorized first, but only used once the rest of
+	// the config has been applied.
+	var useCredentials func()
+	if next.B2AcctId != lm.cfg.B2AcctId || next.B2AppKey != lm.cfg.B2AppKey {
+		useCredentials, err = lm.logStorage.Remote.AuthorizeCredentials(next.B2AcctId, next.B2AppKey)
+		if err != nil {
+			glog.Errorf("refusing to reload config: failed to authorize new b2 credentials: %v", err)
+			unprepare()
+			return
+		}
+	}
+
+	prev := *lm.cfg
+	if err := lm.cfg.Reload(next); err != nil {
+		glog.Errorf("refusing to reload config: %v", err)
+		unprepare()
+		return
+	}
+	if useCredentials != nil {
+		useCredentials()
+		glog.Infof("reloaded b2 credentials")
+	}
+	for _, logID := range added {
+		if err := lm.initLog(ctx, logID); err != nil {
+			glog.Errorf("failed to initialize log %v: %v", logID, err)
+		}
+	}
+
+	if lm.cfg.LeafCacheSize != prev.LeafCacheSize && lm.cfg.LeafCacheSize != 0 {
+		ct.SetLeafCacheSize(lm.cfg.LeafCacheSize)
+	}
+	lm.qm.SetMaxUnsequencedLeaves(lm.cfg.MaxUnsequencedLeaves)
+	if lm.cfg.RateLimit.Client != prev.RateLimit.Client || lm.cfg.RateLimit.Issuer != prev.RateLimit.Issuer {
+		lm.setRateLimits()
+	}
+	lm.setFrozen()
+	for logID := range lm.watches {
+		if state, err := lm.cfg.TreeState(logID); err != nil || state == trillian.TreeState_FROZEN {
+			lm.unwatch(logID)
+		}
+	}
+	for i, h := range handlers {
+		lm.handlers.set(h, isFrozen(lm.cfg, lm.cfg.LogConfigs[i].LogId))
+	}
+	lm.follow(ctx)
+	glog.Infof("reloaded config: %v logs, %v added", len(lm.cfg.LogConfigs), len(added))
+}
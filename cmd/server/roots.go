@@ -0,0 +1,86 @@
+package main
+
+import (
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"strconv"
+	"time"
+
+	"github.com/cloudflare/ct-log/config"
+)
+
+// logRoots is the JSON representation of the roots that a log accepts.
+type logRoots struct {
+	LogID    int64      `json:"log_id"`
+	Roots    []rootInfo `json:"roots"`
+	Excluded []rootInfo `json:"excluded"`
+	Problems []string   `json:"problems"`
+}
+
+// rootInfo is the JSON representation of one root.
+type rootInfo struct {
+	Subject  string    `json:"subject"`
+	SPKIHash string    `json:"spki_sha256"`
+	NotAfter time.Time `json:"not_after"`
+	File     string    `json:"file"`
+}
+
+func newRootInfos(roots []config.Root) []rootInfo {
+	out := make([]rootInfo, 0, len(roots))
+	for _, root := range roots {
+		hash := root.SPKIHash()
+		out = append(out, rootInfo{
+			Subject:  root.Cert.Subject.String(),
+			SPKIHash: hex.EncodeToString(hash[:]),
+			NotAfter: root.Cert.NotAfter.UTC(),
+			File:     root.File,
+		})
+	}
+	return out
+}
+
+// rootsHandler serves the roots that each log accepts, as of the last time the
+// config was loaded, and the problems that were found with them. It takes an
+// optional `log_id` parameter to show only one log.
+type rootsHandler struct {
+	lm *logManager
+}
+
+func (rh rootsHandler) ServeHTTP(rw http.ResponseWriter, req *http.Request) {
+	var logID int64
+	if raw := req.URL.Query().Get("log_id"); raw != "" {
+		var err error
+		logID, err = strconv.ParseInt(raw, 10, 64)
+		if err != nil {
+			http.Error(rw, fmt.Sprintf("failed to parse log_id: %v", err), http.StatusBadRequest)
+			return
+		}
+	}
+
+	rh.lm.mu.Lock()
+	out := make([]logRoots, 0, len(rh.lm.cfg.LogConfigs))
+	for _, logConfig := range rh.lm.cfg.LogConfigs {
+		roots := rh.lm.cfg.Roots[logConfig.LogId]
+		if roots == nil || (logID != 0 && logConfig.LogId != logID) {
+			continue
+		}
+		out = append(out, logRoots{
+			LogID:    logConfig.LogId,
+			Roots:    newRootInfos(roots.Certs),
+			Excluded: newRootInfos(roots.Excluded),
+			Problems: append([]string{}, roots.Problems...),
+		})
+	}
+	rh.lm.mu.Unlock()
+
+	if logID != 0 && len(out) == 0 {
+		http.Error(rw, fmt.Sprintf("log %v not found", logID), http.StatusNotFound)
+		return
+	}
+	rw.Header().Set("Content-Type", "application/json")
+	if err := json.NewEncoder(rw).Encode(out); err != nil {
+		http.Error(rw, err.Error(), http.StatusInternalServerError)
+	}
+}
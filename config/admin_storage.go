@@ -3,29 +3,104 @@ package config
 import (
 	"context"
 	"fmt"
+	"sync"
 
+	"github.com/golang/protobuf/proto"
 	"github.com/google/trillian"
 	"github.com/google/trillian/storage"
+	"github.com/google/trillian/trees"
 )
 
+// errSignersNotChecked is reported by the health check until the signers of
+// the trees have been checked.
+var errSignersNotChecked = fmt.Errorf("signers haven't been checked")
+
+// adminStorage serves the trees from the config. They're replaced when the
+// config is reloaded; each transaction sees the trees from when it started.
 type adminStorage struct {
+	mu    sync.RWMutex
 	trees []*trillian.Tree
+	// signerErr is the result of the last check of the trees' signers, which
+	// is kept so that health checks don't open a session with a PKCS#11
+	// token or signing process each time.
+	signerErr error
+}
+
+func (as *adminStorage) getTrees() []*trillian.Tree {
+	as.mu.RLock()
+	defer as.mu.RUnlock()
+	return as.trees
+}
+
+// replace replaces the trees with those of `next`, along with the result of
+// checking their signers.
+func (as *adminStorage) replace(next *adminStorage) {
+	next.mu.RLock()
+	trees, signerErr := next.trees, next.signerErr
+	next.mu.RUnlock()
+
+	as.mu.Lock()
+	defer as.mu.Unlock()
+	as.trees, as.signerErr = trees, signerErr
+}
+
+// checkSigners checks that a signer can be created for each tree, and keeps
+// the result for health checks.
+func (as *adminStorage) checkSigners(ctx context.Context) error {
+	var signerErr error
+	for _, tree := range as.getTrees() {
+		if _, err := trees.Signer(ctx, tree); err != nil {
+			signerErr = fmt.Errorf("tree %v: failed to create signer: %v", tree.TreeId, err)
+			break
+		}
+	}
+
+	as.mu.Lock()
+	defer as.mu.Unlock()
+	as.signerErr = signerErr
+	return signerErr
+}
+
+// setTreeState replaces the tree with the given id with a copy in `state`.
+func (as *adminStorage) setTreeState(treeID int64, state trillian.TreeState) error {
+	as.mu.Lock()
+	defer as.mu.Unlock()
+
+	for i, tree := range as.trees {
+		if tree.TreeId != treeID {
+			continue
+		}
+		updated := proto.Clone(tree).(*trillian.Tree)
+		updated.TreeState = state
+		trees := append([]*trillian.Tree(nil), as.trees...)
+		trees[i] = updated
+		as.trees = trees
+		return nil
+	}
+	return fmt.Errorf("tree %v not found", treeID)
 }
 
 // Snapshot starts a read-only transaction.
 func (as *adminStorage) Snapshot(ctx context.Context) (storage.ReadOnlyAdminTX, error) {
-	return &adminTx{as.trees}, nil
+	return &adminTx{as.getTrees()}, nil
 }
 
 // ReadWriteTransaction creates a transaction, and runs f with it.
 func (as *adminStorage) ReadWriteTransaction(ctx context.Context, f storage.AdminTXFunc) error {
-	return f(ctx, &adminTx{as.trees})
+	return f(ctx, &adminTx{as.getTrees()})
 }
 
 // CheckDatabaseAccessible checks whether we are able to connect to / open the
-// underlying storage.
+// underlying storage. Trees are kept in memory, so instead it checks that
+// there's at least one, and that their signers passed the last check, which
+// is made when the config is loaded and reloaded.
 func (as *adminStorage) CheckDatabaseAccessible(ctx context.Context) error {
-	return nil
+	as.mu.RLock()
+	defer as.mu.RUnlock()
+	if len(as.trees) == 0 {
+		return fmt.Errorf("no trees are configured")
+	}
+	return as.signerErr
 }
 
 type adminTx struct {
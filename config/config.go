@@ -3,20 +3,30 @@
 package config
 
 import (
+	"encoding/base64"
 	"encoding/pem"
 	"fmt"
 	"io/ioutil"
+	"math"
+	"net"
 	"os"
+	"strings"
 	"time"
 
+	"github.com/cloudflare/ct-log/custom/signer"
+
+	"github.com/golang/protobuf/proto"
 	"github.com/golang/protobuf/ptypes"
 	"github.com/golang/protobuf/ptypes/any"
 	"github.com/golang/protobuf/ptypes/timestamp"
+	"github.com/google/certificate-transparency-go/trillian/ctfe"
 	"github.com/google/certificate-transparency-go/trillian/ctfe/configpb"
 	"github.com/google/trillian"
 	"github.com/google/trillian/crypto/keyspb"
 	spb "github.com/google/trillian/crypto/sigpb"
 	"github.com/google/trillian/storage"
+	"github.com/syndtr/goleveldb/leveldb/filter"
+	"github.com/syndtr/goleveldb/leveldb/opt"
 	"gopkg.in/yaml.v2"
 )
 
@@ -29,17 +39,34 @@ type file struct {
 	KeyFile     string `yaml:"key_file"`
 
 	LevelDBPath string `yaml:"leveldb_path"`
-
-	B2AcctId string `yaml:"b2_acct_id"`
-	B2AppKey string `yaml:"b2_app_key"`
-	B2Bucket string `yaml:"b2_bucket"`
-	B2Url    string `yaml:"b2_url"`
+	LevelDB     struct {
+		BlockCacheSize         int `yaml:"block_cache_size"`
+		WriteBufferSize        int `yaml:"write_buffer_size"`
+		CompactionTableSize    int `yaml:"compaction_table_size"`
+		BloomFilterBits        int `yaml:"bloom_filter_bits"`
+		OpenFilesCacheCapacity int `yaml:"open_files_cache_capacity"`
+	} `yaml:"leveldb"`
+
+	B2AcctId     string `yaml:"b2_acct_id"`
+	B2AcctIdFile string `yaml:"b2_acct_id_file"`
+	B2AppKey     string `yaml:"b2_app_key"`
+	B2AppKeyFile string `yaml:"b2_app_key_file"`
+	B2Bucket     string `yaml:"b2_bucket"`
+	B2BucketFile string `yaml:"b2_bucket_file"`
+	B2Url        string `yaml:"b2_url"`
 
 	LeafCacheSize        int    `yaml:"leaf_cache_size"`
+	SubtreeCacheSize     int    `yaml:"subtree_cache_size"`
 	MaxUnsequencedLeaves int64  `yaml:"max_unsequenced_leaves"`
 	MaxClients           int    `yaml:"max_clients"`
 	RequestTimeout       string `yaml:"request_timeout"`
 
+	RateLimit struct {
+		EdgeNetworks []string   `yaml:"edge_networks"`
+		Client       bucketMeta `yaml:"client"`
+		Issuer       bucketMeta `yaml:"issuer"`
+	} `yaml:"rate_limit"`
+
 	Signer struct {
 		BatchSize   int           `yaml:"batch_size"`
 		RunInterval time.Duration `yaml:"run_interval"`
@@ -48,11 +75,17 @@ type file struct {
 	Logs []logMeta `yaml:"logs"`
 }
 
+type bucketMeta struct {
+	Capacity   int64   `yaml:"capacity"`
+	RefillRate float64 `yaml:"refill_per_second"`
+}
+
 type logMeta struct {
 	LogId      int64  `yaml:"log_id"`
 	CreateTime string `yaml:"create_time"`
 	UpdateTime string `yaml:"update_time"`
 
+	TreeType        string `yaml:"tree_type"`
 	TreeState       string `yaml:"tree_state"`
 	SigAlg          string `yaml:"sig_alg"`
 	MaxRootDuration string `yaml:"max_root_duration"`
@@ -60,11 +93,58 @@ type logMeta struct {
 	NotAfterStart string `yaml:"not_after_start"`
 	NotAfterStop  string `yaml:"not_after_stop"`
 
-	Prefix    string `yaml:"prefix"`
-	RootsFile string `yaml:"roots_file"`
+	Prefix                string   `yaml:"prefix"`
+	OverrideHandlerPrefix string   `yaml:"override_handler_prefix"`
+	RootsFile             string   `yaml:"roots_file"`
+	RootsFiles            []string `yaml:"roots_files"`
+	RootsDirs             []string `yaml:"roots_dirs"`
+	RootsExclude          []string `yaml:"roots_exclude"`
+	RejectExpired         bool     `yaml:"reject_expired"`
+	RejectUnexpired       bool     `yaml:"reject_unexpired"`
+	ExtKeyUsages          []string `yaml:"ext_key_usages"`
+	AcceptOnlyCA          bool     `yaml:"accept_only_ca"`
+	MaxMergeDelay         string   `yaml:"max_merge_delay"`
+	ExpectedMergeDelay    string   `yaml:"expected_merge_delay"`
+	FrozenSTH             *sthMeta `yaml:"frozen_sth"`
+
+	Mirror *mirrorMeta `yaml:"mirror"`
+
+	PubKey      string     `yaml:"pub_key"`
+	PubKeyFile  string     `yaml:"pub_key_file"`
+	PrivKey     string     `yaml:"priv_key"`
+	PrivKeyFile string     `yaml:"priv_key_file"`
+	Signer      signerMeta `yaml:"signer"`
+}
 
-	PubKey  string `yaml:"pub_key"`
-	PrivKey string `yaml:"priv_key"`
+// sthMeta is a signed tree head, in the same format as a get-sth response.
+type sthMeta struct {
+	TreeSize          int64  `yaml:"tree_size"`
+	Timestamp         int64  `yaml:"timestamp"`
+	SHA256RootHash    string `yaml:"sha256_root_hash"`
+	TreeHeadSignature string `yaml:"tree_head_signature"`
+}
+
+// mirrorMeta configures the source log that a PREORDERED_LOG follows.
+type mirrorMeta struct {
+	Source           string `yaml:"source"`
+	SourcePubKey     string `yaml:"source_pub_key"`
+	SourcePubKeyFile string `yaml:"source_pub_key_file"`
+	PollInterval     string `yaml:"poll_interval"`
+	BatchSize        int64  `yaml:"batch_size"`
+}
+
+// signerMeta configures where a log's private key is kept, if it isn't in
+// priv_key.
+type signerMeta struct {
+	PKCS11 struct {
+		Module     string `yaml:"module"`
+		TokenLabel string `yaml:"token_label"`
+		PinFile    string `yaml:"pin_file"`
+		// Slot is only parsed so that it can be refused, because Trillian
+		// only finds tokens by their label.
+		Slot *int `yaml:"slot"`
+	} `yaml:"pkcs11"`
+	Socket string `yaml:"socket"`
 }
 
 type Config struct {
@@ -74,6 +154,7 @@ type Config struct {
 	KeyFile     string
 
 	LevelDBPath string
+	LevelDB     LevelDBConfig
 
 	B2AcctId string
 	B2AppKey string
@@ -81,15 +162,70 @@ type Config struct {
 	B2Url    string
 
 	LeafCacheSize        int
+	SubtreeCacheSize     int
 	MaxUnsequencedLeaves int64
 	MaxClients           int
 	RequestTimeout       time.Duration
 
+	RateLimit    RateLimitConfig
 	Signer       SignerConfig
+	PKCS11Module string
 	LogConfigs   []*configpb.LogConfig
+	Roots        map[int64]*Roots
+	Mirrors      map[int64]MirrorConfig
 	AdminStorage storage.AdminStorage
 }
 
+// LevelDBConfig contains tuning options for the local database. Zero values
+// mean that LevelDB's defaults should be used. Sizes are in bytes.
+type LevelDBConfig struct {
+	BlockCacheSize         int
+	WriteBufferSize        int
+	CompactionTableSize    int
+	BloomFilterBits        int
+	OpenFilesCacheCapacity int
+}
+
+// Options converts the LevelDB tuning options into the options understood by
+// LevelDB.
+func (c LevelDBConfig) Options() *opt.Options {
+	o := &opt.Options{
+		BlockCacheCapacity:     c.BlockCacheSize,
+		WriteBuffer:            c.WriteBufferSize,
+		CompactionTableSize:    c.CompactionTableSize,
+		OpenFilesCacheCapacity: c.OpenFilesCacheCapacity,
+	}
+	if c.BloomFilterBits > 0 {
+		o.Filter = filter.NewBloomFilter(c.BloomFilterBits)
+	}
+	return o
+}
+
+// RateLimitConfig contains the limits on how fast each submitter can add
+// leaves. Submitters are identified by their IP address, which is taken from
+// the CF-Connecting-IP header if the request came from one of EdgeNetworks,
+// and optionally by the intermediates in their chains.
+type RateLimitConfig struct {
+	EdgeNetworks []*net.IPNet
+	Client       BucketConfig
+	Issuer       BucketConfig
+}
+
+// BucketConfig configures a token bucket for each submitter. A zero Capacity
+// means there's no limit.
+type BucketConfig struct {
+	Capacity   int64
+	RefillRate float64 // Tokens per second.
+}
+
+// MirrorConfig configures how a mirror follows its source log.
+type MirrorConfig struct {
+	Source       string // The source log's URI.
+	SourcePubKey string // The source log's public key, in PEM.
+	PollInterval time.Duration
+	BatchSize    int64 // The max number of entries to add at a time.
+}
+
 type SignerConfig struct {
 	BatchSize   int
 	RunInterval time.Duration
@@ -107,51 +243,29 @@ func FromFile(path string) (*Config, error) {
 		return nil, err
 	}
 
-	if len(parsed.MetricsAddr) == 0 {
-		return nil, fmt.Errorf("no address to serve metrics on was found in config file")
-	} else if len(parsed.ServerAddr) == 0 {
-		return nil, fmt.Errorf("no address for the server to listen on was found in config file")
-	}
-
-	if len(parsed.LevelDBPath) == 0 {
-		return nil, fmt.Errorf("leveldb path not found in config file")
-	} else if len(parsed.B2AcctId) == 0 {
-		return nil, fmt.Errorf("no backblaze account id found in config file")
-	} else if len(parsed.B2AppKey) == 0 {
-		return nil, fmt.Errorf("no backblaze application key found in config file")
-	} else if len(parsed.B2Bucket) == 0 {
-		return nil, fmt.Errorf("no backblaze bucket found in config file")
-	} else if len(parsed.B2Url) == 0 {
-		return nil, fmt.Errorf("no backblaze download url found in config file")
+	if errs := checkOptions(parsed); len(errs) > 0 {
+		return nil, errs[0]
 	}
-
-	if parsed.LeafCacheSize < 0 {
-		return nil, fmt.Errorf("leaf_cache_size cannot be less than zero")
-	} else if parsed.MaxUnsequencedLeaves < 1 {
-		return nil, fmt.Errorf("max_unsequenced_leaves cannot be less than one")
-	} else if parsed.MaxClients < 1 {
-		return nil, fmt.Errorf("max_clients cannot be less than one")
+	b2AcctId, b2AppKey, b2Bucket, errs := readB2(parsed)
+	if len(errs) > 0 {
+		return nil, errs[0]
 	}
 	requestTimeout, err := time.ParseDuration(parsed.RequestTimeout)
 	if err != nil {
 		return nil, fmt.Errorf("failed to parse request timeout: %v", err)
 	}
 
-	if len(parsed.Logs) == 0 {
-		return nil, fmt.Errorf("no logs found in config file")
+	rateLimit, err := readRateLimit(parsed)
+	if err != nil {
+		return nil, err
 	}
 
-	// Verify that all log ids are distinct and well-formed.
-	for i, meta := range parsed.Logs {
-		if meta.LogId <= 0 {
-			return nil, fmt.Errorf("log #%v in config file: log cannot have id %v", i+1, meta.LogId)
-		}
-
-		for j, cand := range parsed.Logs[i+1:] {
-			if meta.LogId == cand.LogId {
-				return nil, fmt.Errorf("logs #%v and #%v in config file have the same log id", i+1, j+1)
-			}
-		}
+	if errs := checkLogIDs(parsed); len(errs) > 0 {
+		return nil, errs[0]
+	}
+	pkcs11Module, errs := readPKCS11Module(parsed)
+	if len(errs) > 0 {
+		return nil, errs[0]
 	}
 
 	// Extract the CT-related configuration from each block of config.
@@ -164,6 +278,27 @@ func FromFile(path string) (*Config, error) {
 		logConfigs = append(logConfigs, cfg)
 	}
 
+	// Read the roots that each log accepts.
+	roots := make(map[int64]*Roots, len(parsed.Logs))
+	for i, meta := range parsed.Logs {
+		logRoots, err := readRoots(meta, logConfigs[i].IsMirror, time.Now())
+		if err != nil {
+			return nil, fmt.Errorf("log #%v in config file: %v", i+1, err)
+		}
+		roots[meta.LogId] = logRoots
+	}
+
+	// Read the source log that each mirror follows.
+	mirrors := make(map[int64]MirrorConfig)
+	for i, meta := range parsed.Logs {
+		mirror, err := readMirror(meta)
+		if err != nil {
+			return nil, fmt.Errorf("log #%v in config file: %v", i+1, err)
+		} else if mirror != nil {
+			mirrors[meta.LogId] = *mirror
+		}
+	}
+
 	// Extract the Trillian-related configuration from each block.
 	trees := make([]*trillian.Tree, 0, len(parsed.Logs))
 	for i, meta := range parsed.Logs {
@@ -181,32 +316,192 @@ func FromFile(path string) (*Config, error) {
 		KeyFile:     parsed.KeyFile,
 
 		LevelDBPath: parsed.LevelDBPath,
+		LevelDB: LevelDBConfig{
+			BlockCacheSize:         parsed.LevelDB.BlockCacheSize,
+			WriteBufferSize:        parsed.LevelDB.WriteBufferSize,
+			CompactionTableSize:    parsed.LevelDB.CompactionTableSize,
+			BloomFilterBits:        parsed.LevelDB.BloomFilterBits,
+			OpenFilesCacheCapacity: parsed.LevelDB.OpenFilesCacheCapacity,
+		},
 
-		B2AcctId: os.ExpandEnv(parsed.B2AcctId),
-		B2AppKey: os.ExpandEnv(parsed.B2AppKey),
-		B2Bucket: os.ExpandEnv(parsed.B2Bucket),
+		B2AcctId: b2AcctId,
+		B2AppKey: b2AppKey,
+		B2Bucket: b2Bucket,
 		B2Url:    os.ExpandEnv(parsed.B2Url),
 
 		LeafCacheSize:        parsed.LeafCacheSize,
+		SubtreeCacheSize:     parsed.SubtreeCacheSize,
 		MaxUnsequencedLeaves: parsed.MaxUnsequencedLeaves,
 		MaxClients:           parsed.MaxClients,
 		RequestTimeout:       requestTimeout,
 
+		RateLimit: rateLimit,
 		Signer: SignerConfig{
 			BatchSize:   parsed.Signer.BatchSize,
 			RunInterval: parsed.Signer.RunInterval,
 			GuardWindow: parsed.Signer.GuardWindow,
 		},
+		PKCS11Module: pkcs11Module,
 		LogConfigs:   logConfigs,
-		AdminStorage: &adminStorage{trees},
+		Roots:        roots,
+		Mirrors:      mirrors,
+		AdminStorage: &adminStorage{trees: trees, signerErr: errSignersNotChecked},
 	}, nil
 }
 
+// checkOptions returns a problem with each of the options in `parsed` that
+// is missing or out of range, other than those of the remote database and the
+// logs.
+func checkOptions(parsed *file) []error {
+	errs := make([]error, 0)
+	if len(parsed.MetricsAddr) == 0 {
+		errs = append(errs, fmt.Errorf("no address to serve metrics on was found in config file"))
+	}
+	if len(parsed.ServerAddr) == 0 {
+		errs = append(errs, fmt.Errorf("no address for the server to listen on was found in config file"))
+	}
+
+	if len(parsed.LevelDBPath) == 0 {
+		errs = append(errs, fmt.Errorf("leveldb path not found in config file"))
+	}
+	if parsed.LevelDB.BlockCacheSize < 0 {
+		errs = append(errs, fmt.Errorf("leveldb.block_cache_size cannot be less than zero"))
+	}
+	if parsed.LevelDB.WriteBufferSize < 0 {
+		errs = append(errs, fmt.Errorf("leveldb.write_buffer_size cannot be less than zero"))
+	}
+	if parsed.LevelDB.CompactionTableSize < 0 {
+		errs = append(errs, fmt.Errorf("leveldb.compaction_table_size cannot be less than zero"))
+	}
+	if parsed.LevelDB.BloomFilterBits < 0 {
+		errs = append(errs, fmt.Errorf("leveldb.bloom_filter_bits cannot be less than zero"))
+	}
+	if parsed.LevelDB.OpenFilesCacheCapacity < 0 {
+		errs = append(errs, fmt.Errorf("leveldb.open_files_cache_capacity cannot be less than zero"))
+	}
+
+	if parsed.LeafCacheSize < 0 {
+		errs = append(errs, fmt.Errorf("leaf_cache_size cannot be less than zero"))
+	}
+	if parsed.SubtreeCacheSize < 0 {
+		errs = append(errs, fmt.Errorf("subtree_cache_size cannot be less than zero"))
+	}
+	if parsed.MaxUnsequencedLeaves < 1 {
+		errs = append(errs, fmt.Errorf("max_unsequenced_leaves cannot be less than one"))
+	}
+	if parsed.MaxClients < 1 {
+		errs = append(errs, fmt.Errorf("max_clients cannot be less than one"))
+	}
+	return errs
+}
+
+// readB2 reads the account id, application key, and bucket of the remote
+// database, and checks that they and its download url are given.
+func readB2(parsed *file) (acctId, appKey, bucket string, errs []error) {
+	var err error
+	if acctId, err = readOption("b2_acct_id", parsed.B2AcctId, parsed.B2AcctIdFile, false); err != nil {
+		errs = append(errs, err)
+	} else if len(acctId) == 0 {
+		errs = append(errs, fmt.Errorf("no backblaze account id found in config file"))
+	}
+	if appKey, err = readOption("b2_app_key", parsed.B2AppKey, parsed.B2AppKeyFile, true); err != nil {
+		errs = append(errs, err)
+	} else if len(appKey) == 0 {
+		errs = append(errs, fmt.Errorf("no backblaze application key found in config file"))
+	}
+	if bucket, err = readOption("b2_bucket", parsed.B2Bucket, parsed.B2BucketFile, false); err != nil {
+		errs = append(errs, err)
+	} else if len(bucket) == 0 {
+		errs = append(errs, fmt.Errorf("no backblaze bucket found in config file"))
+	}
+	if len(parsed.B2Url) == 0 {
+		errs = append(errs, fmt.Errorf("no backblaze download url found in config file"))
+	}
+	return acctId, appKey, bucket, errs
+}
+
+// checkLogIDs checks that there is at least one log, and that all log ids are
+// distinct and well-formed.
+func checkLogIDs(parsed *file) []error {
+	if len(parsed.Logs) == 0 {
+		return []error{fmt.Errorf("no logs found in config file")}
+	}
+	errs := make([]error, 0)
+	for i, meta := range parsed.Logs {
+		if meta.LogId <= 0 {
+			errs = append(errs, fmt.Errorf("log #%v in config file: log cannot have id %v", i+1, meta.LogId))
+		}
+
+		for j, cand := range parsed.Logs[i+1:] {
+			if meta.LogId == cand.LogId {
+				errs = append(errs, fmt.Errorf("logs #%v and #%v in config file have the same log id", i+1, i+j+2))
+			}
+		}
+	}
+	return errs
+}
+
+// readPKCS11Module returns the PKCS#11 module that the logs' signers use, if
+// any. Trillian's PKCS#11 key handler can only use one module at a time.
+func readPKCS11Module(parsed *file) (string, []error) {
+	pkcs11Module, errs := "", make([]error, 0)
+	for i, meta := range parsed.Logs {
+		module := meta.Signer.PKCS11.Module
+		if module == "" {
+			continue
+		} else if pkcs11Module != "" && module != pkcs11Module {
+			errs = append(errs, fmt.Errorf("log #%v in config file: all logs must use the same pkcs11 module", i+1))
+			continue
+		}
+		pkcs11Module = module
+	}
+	return pkcs11Module, errs
+}
+
+func readRateLimit(parsed *file) (RateLimitConfig, error) {
+	out := RateLimitConfig{
+		EdgeNetworks: make([]*net.IPNet, 0, len(parsed.RateLimit.EdgeNetworks)),
+		Client:       BucketConfig(parsed.RateLimit.Client),
+		Issuer:       BucketConfig(parsed.RateLimit.Issuer),
+	}
+	for _, in := range parsed.RateLimit.EdgeNetworks {
+		_, network, err := net.ParseCIDR(in)
+		if err != nil {
+			return RateLimitConfig{}, fmt.Errorf("failed to parse rate_limit.edge_networks: %v", err)
+		}
+		out.EdgeNetworks = append(out.EdgeNetworks, network)
+	}
+
+	for name, bucket := range map[string]BucketConfig{"client": out.Client, "issuer": out.Issuer} {
+		if bucket.Capacity < 0 {
+			return RateLimitConfig{}, fmt.Errorf("rate_limit.%v.capacity cannot be less than zero", name)
+		} else if bucket.Capacity > 0 && bucket.RefillRate <= 0 {
+			return RateLimitConfig{}, fmt.Errorf("rate_limit.%v.refill_per_second must be greater than zero", name)
+		}
+	}
+
+	return out, nil
+}
+
 func logConfig(meta logMeta) (*configpb.LogConfig, error) {
 	pubKey, privKey, err := parseKeypair(meta)
 	if err != nil {
 		return nil, err
 	}
+	treeType, err := parseTreeType(meta.TreeType)
+	if err != nil {
+		return nil, err
+	}
+	// Mirrors don't sign anything at the CT layer, so ctfe refuses to be
+	// given a private key for them. Trillian still uses it to sign roots.
+	isMirror := treeType == trillian.TreeType_PREORDERED_LOG
+	if isMirror {
+		privKey = nil
+	}
+	roots, err := rootsFiles(meta)
+	if err != nil {
+		return nil, err
+	}
 	var notAfterStart, notAfterStop *timestamp.Timestamp
 	if meta.NotAfterStart != "" || meta.NotAfterStop != "" {
 		start, err := parseTime(meta.NotAfterStart)
@@ -220,25 +515,144 @@ func logConfig(meta logMeta) (*configpb.LogConfig, error) {
 		notAfterStart = &timestamp.Timestamp{Seconds: start.Unix()}
 		notAfterStop = &timestamp.Timestamp{Seconds: stop.Unix()}
 	}
+	maxMergeDelay, err := parseOptionalDuration("max_merge_delay", meta.MaxMergeDelay)
+	if err != nil {
+		return nil, err
+	}
+	expectedMergeDelay, err := parseOptionalDuration("expected_merge_delay", meta.ExpectedMergeDelay)
+	if err != nil {
+		return nil, err
+	}
+	frozenSTH, err := parseSTH(meta)
+	if err != nil {
+		return nil, err
+	}
+
+	cfg := &configpb.LogConfig{
+		LogId:                 meta.LogId,
+		Prefix:                meta.Prefix,
+		OverrideHandlerPrefix: meta.OverrideHandlerPrefix,
+		RootsPemFile:          roots,
 
-	return &configpb.LogConfig{
-		LogId:        meta.LogId,
-		Prefix:       meta.Prefix,
-		RootsPemFile: []string{meta.RootsFile},
+		RejectExpired:   meta.RejectExpired,
+		RejectUnexpired: meta.RejectUnexpired,
+		ExtKeyUsages:    meta.ExtKeyUsages,
+		NotAfterStart:   notAfterStart,
+		NotAfterLimit:   notAfterStop,
+		AcceptOnlyCa:    meta.AcceptOnlyCA,
 
-		NotAfterStart: notAfterStart,
-		NotAfterLimit: notAfterStop,
+		MaxMergeDelaySec:      int32(maxMergeDelay / time.Second),
+		ExpectedMergeDelaySec: int32(expectedMergeDelay / time.Second),
+		FrozenSth:             frozenSTH,
 
 		PublicKey:  pubKey,
 		PrivateKey: privKey,
+		IsMirror:   isMirror,
+	}
+	// Check the CT config the same way ctfe will when the log is set up, so
+	// that mistakes are found when the config is read.
+	if _, err := ctfe.ValidateLogConfig(cfg); err != nil {
+		return nil, fmt.Errorf("invalid log config: %v", err)
+	}
+	return cfg, nil
+}
+
+// parseOptionalDuration parses the duration in the option `name`, which is zero
+// if it isn't given.
+func parseOptionalDuration(name, in string) (time.Duration, error) {
+	if in == "" {
+		return 0, nil
+	}
+	d, err := time.ParseDuration(in)
+	if err != nil {
+		return 0, fmt.Errorf("failed to parse %v: %v", name, err)
+	} else if d < 0 {
+		return 0, fmt.Errorf("%v cannot be less than zero", name)
+	} else if d/time.Second > math.MaxInt32 {
+		return 0, fmt.Errorf("%v is too long", name)
+	}
+	return d, nil
+}
+
+// parseSTH returns a log's frozen STH, or nil if it doesn't have one. The
+// signature is checked by ctfe.ValidateLogConfig.
+func parseSTH(meta logMeta) (*configpb.SignedTreeHead, error) {
+	if meta.FrozenSTH == nil {
+		return nil, nil
+	} else if meta.TreeState != trillian.TreeState_FROZEN.String() {
+		return nil, fmt.Errorf("frozen_sth can only be given for a log whose tree_state is FROZEN")
+	}
+	rootHash, err := base64.StdEncoding.DecodeString(meta.FrozenSTH.SHA256RootHash)
+	if err != nil {
+		return nil, fmt.Errorf("failed to parse frozen_sth.sha256_root_hash: %v", err)
+	}
+	sig, err := base64.StdEncoding.DecodeString(meta.FrozenSTH.TreeHeadSignature)
+	if err != nil {
+		return nil, fmt.Errorf("failed to parse frozen_sth.tree_head_signature: %v", err)
+	}
+	return &configpb.SignedTreeHead{
+		TreeSize:          meta.FrozenSTH.TreeSize,
+		Timestamp:         meta.FrozenSTH.Timestamp,
+		Sha256RootHash:    rootHash,
+		TreeHeadSignature: sig,
+	}, nil
+}
+
+// readMirror returns the config of the source log that a mirror follows, or nil
+// if the log doesn't follow one. Only PREORDERED_LOGs can follow a source.
+func readMirror(meta logMeta) (*MirrorConfig, error) {
+	if meta.Mirror == nil {
+		return nil, nil
+	} else if treeType, err := parseTreeType(meta.TreeType); err != nil {
+		return nil, err
+	} else if treeType != trillian.TreeType_PREORDERED_LOG {
+		return nil, fmt.Errorf("mirror can only be given for a log whose tree_type is PREORDERED_LOG")
+	}
+
+	if meta.Mirror.Source == "" {
+		return nil, fmt.Errorf("no mirror.source found")
+	}
+	pubKey, err := readOption("mirror.source_pub_key", meta.Mirror.SourcePubKey, meta.Mirror.SourcePubKeyFile, false)
+	if err != nil {
+		return nil, err
+	} else if block, rest := pem.Decode([]byte(pubKey)); block == nil {
+		return nil, fmt.Errorf("failed to pem-decode mirror.source_pub_key")
+	} else if len(rest) > 0 {
+		return nil, fmt.Errorf("unnecessary data appended to mirror.source_pub_key")
+	}
+
+	pollInterval := time.Minute
+	if meta.Mirror.PollInterval != "" {
+		if pollInterval, err = time.ParseDuration(meta.Mirror.PollInterval); err != nil {
+			return nil, fmt.Errorf("failed to parse mirror.poll_interval: %v", err)
+		} else if pollInterval <= 0 {
+			return nil, fmt.Errorf("mirror.poll_interval must be greater than zero")
+		}
+	}
+	batchSize := meta.Mirror.BatchSize
+	if batchSize == 0 {
+		batchSize = 1000
+	} else if batchSize < 0 {
+		return nil, fmt.Errorf("mirror.batch_size cannot be less than zero")
+	}
+
+	return &MirrorConfig{
+		Source:       meta.Mirror.Source,
+		SourcePubKey: pubKey,
+		PollInterval: pollInterval,
+		BatchSize:    batchSize,
 	}, nil
 }
 
 func readTree(meta logMeta) (*trillian.Tree, error) {
+	treeType, err := parseTreeType(meta.TreeType)
+	if err != nil {
+		return nil, err
+	}
 	tree := &trillian.Tree{
 		TreeId: meta.LogId,
 
-		TreeType:      trillian.TreeType_LOG,
+		TreeType:      treeType,
 		HashStrategy:  trillian.HashStrategy_RFC6962_SHA256,
 		HashAlgorithm: spb.DigitallySigned_SHA256,
 	}
@@ -288,8 +702,18 @@ func readTree(meta logMeta) (*trillian.Tree, error) {
 	return tree, nil
 }
 
+// parseKeypair parses a log's public key, and returns the key proto that
+// Trillian and ctfe get a signer from. That's either the private key itself, a
+// PKCS#11 token, or a socket signer.
 func parseKeypair(meta logMeta) (*keyspb.PublicKey, *any.Any, error) {
-	pubStr, privStr := os.ExpandEnv(meta.PubKey), os.ExpandEnv(meta.PrivKey)
+	pubStr, err := readOption("pub_key", meta.PubKey, meta.PubKeyFile, false)
+	if err != nil {
+		return nil, nil, err
+	}
+	privStr, err := readOption("priv_key", meta.PrivKey, meta.PrivKeyFile, true)
+	if err != nil {
+		return nil, nil, err
+	}
 
 	// Parse the public key.
 	pubBlock, rest := pem.Decode([]byte(pubStr))
@@ -300,19 +724,65 @@ func parseKeypair(meta logMeta) (*keyspb.PublicKey, *any.Any, error) {
 	}
 	pubKey := &keyspb.PublicKey{Der: pubBlock.Bytes}
 
-	// Parse the private key.
-	privBlock, rest := pem.Decode([]byte(privStr))
-	if privBlock == nil {
-		return nil, nil, fmt.Errorf("failed to pem-decode private key")
-	} else if len(rest) > 0 {
-		return nil, nil, fmt.Errorf("unnecessary data appended to private key")
+	pkcs11, socket := meta.Signer.PKCS11, meta.Signer.Socket
+	isPKCS11 := pkcs11.Module != "" || pkcs11.TokenLabel != "" || pkcs11.PinFile != ""
+	if isPKCS11 && socket != "" {
+		return nil, nil, fmt.Errorf("signer cannot have both pkcs11 and socket")
+	} else if (isPKCS11 || socket != "") && privStr != "" {
+		return nil, nil, fmt.Errorf("log cannot have both priv_key and signer")
 	}
-	privKey, err := ptypes.MarshalAny(&keyspb.PrivateKey{Der: privBlock.Bytes})
+
+	var privKey proto.Message
+	if isPKCS11 {
+		if pkcs11.Module == "" {
+			return nil, nil, fmt.Errorf("no signer.pkcs11.module found")
+		} else if pkcs11.TokenLabel == "" {
+			return nil, nil, fmt.Errorf("no signer.pkcs11.token_label found")
+		} else if pkcs11.PinFile == "" {
+			return nil, nil, fmt.Errorf("no signer.pkcs11.pin_file found")
+		} else if pkcs11.Slot != nil {
+			return nil, nil, fmt.Errorf("signer.pkcs11.slot is not supported, because Trillian selects the token only by its label; use token_label instead")
+		}
+		pin, err := readFile(os.ExpandEnv(pkcs11.PinFile), true)
+		if err != nil {
+			return nil, nil, fmt.Errorf("failed to read pkcs11 pin: %v", err)
+		}
+		privKey = &keyspb.PKCS11Config{
+			TokenLabel: pkcs11.TokenLabel,
+			Pin:        strings.TrimSpace(string(pin)),
+			PublicKey:  pubStr,
+		}
+	} else if socket != "" {
+		privKey = &signer.Config{Path: socket, PublicKey: pubStr}
+	} else {
+		// Parse the private key.
+		privBlock, rest := pem.Decode([]byte(privStr))
+		if privBlock == nil {
+			return nil, nil, fmt.Errorf("failed to pem-decode private key")
+		} else if len(rest) > 0 {
+			return nil, nil, fmt.Errorf("unnecessary data appended to private key")
+		}
+		privKey = &keyspb.PrivateKey{Der: privBlock.Bytes}
+	}
+	anyKey, err := ptypes.MarshalAny(privKey)
 	if err != nil {
 		return nil, nil, err
 	}
 
-	return pubKey, privKey, nil
+	return pubKey, anyKey, nil
+}
+
+// parseTreeType parses the type of a log's tree. Logs are LOG by default, or
+// PREORDERED_LOG for mirrors of another log.
+func parseTreeType(in string) (trillian.TreeType, error) {
+	switch in {
+	case "", trillian.TreeType_LOG.String():
+		return trillian.TreeType_LOG, nil
+	case trillian.TreeType_PREORDERED_LOG.String():
+		return trillian.TreeType_PREORDERED_LOG, nil
+	default:
+		return 0, fmt.Errorf("unsupported tree type: %v", in)
+	}
 }
 
 func parseTime(in string) (time.Time, error) {
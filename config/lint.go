@@ -0,0 +1,241 @@
+package config
+
+import (
+	"bytes"
+	"crypto/ecdsa"
+	"crypto/rsa"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path"
+	"path/filepath"
+	"time"
+
+	"github.com/golang/protobuf/ptypes"
+	"github.com/google/certificate-transparency-go/trillian/ctfe/configpb"
+	"github.com/google/trillian"
+	"github.com/google/trillian/crypto/keys/der"
+	"github.com/google/trillian/crypto/keyspb"
+	spb "github.com/google/trillian/crypto/sigpb"
+	"gopkg.in/yaml.v2"
+)
+
+// RemoteProbe checks that the remote database with the given credentials can
+// be written to.
+type RemoteProbe func(acctId, appKey, bucket, url string) error
+
+// Lint reads the config file at `path` and returns every problem with it,
+// where FromFile only returns the first. As well as FromFile's checks, it
+// checks that:
+//   - each log's private key matches its public key, and sig_alg is the
+//     algorithm of the key,
+//   - each log's roots are all usable,
+//   - each log's not_after_start is before its not_after_stop,
+//   - the not_after ranges of the logs other than mirrors don't overlap, as
+//     they're the temporal shards of one log,
+//   - each log is served under a different prefix,
+//   - leveldb_path is writable, and
+//   - the remote database can be written to, if `probe` isn't nil.
+func Lint(path string, probe RemoteProbe) []string {
+	raw, err := ioutil.ReadFile(path)
+	if err != nil {
+		return []string{err.Error()}
+	}
+	parsed := &file{}
+	if err = yaml.Unmarshal(raw, parsed); err != nil {
+		return []string{err.Error()}
+	}
+	l := &lint{seen: make(map[string]bool)}
+
+	l.addErrs(checkOptions(parsed))
+	b2AcctId, b2AppKey, b2Bucket, b2Errs := readB2(parsed)
+	l.addErrs(b2Errs)
+	if _, err := time.ParseDuration(parsed.RequestTimeout); err != nil {
+		l.add("failed to parse request timeout: %v", err)
+	}
+	if _, err := readRateLimit(parsed); err != nil {
+		l.add("%v", err)
+	}
+	l.addErrs(checkLogIDs(parsed))
+	_, errs := readPKCS11Module(parsed)
+	l.addErrs(errs)
+
+	logConfigs := make([]*configpb.LogConfig, len(parsed.Logs))
+	for i, meta := range parsed.Logs {
+		cfg, err := logConfig(meta)
+		if err != nil {
+			l.add("log #%v in config file: %v", i+1, err)
+		} else if start, stop := cfg.NotAfterStart, cfg.NotAfterLimit; start != nil && start.Seconds >= stop.Seconds {
+			// ctfe only rejects a not_after_stop that's before
+			// not_after_start, and accepts an empty range.
+			l.add("log #%v in config file: not_after_start must be before not_after_stop", i+1)
+		}
+		logConfigs[i] = cfg
+
+		if _, err := readTree(meta); err != nil {
+			l.add("log #%v in config file: %v", i+1, err)
+		}
+		if _, err := readMirror(meta); err != nil {
+			l.add("log #%v in config file: %v", i+1, err)
+		}
+		for _, err := range checkKeypair(meta) {
+			l.add("log #%v in config file: %v", i+1, err)
+		}
+
+		isMirror := meta.TreeType == trillian.TreeType_PREORDERED_LOG.String()
+		roots, err := readRoots(meta, isMirror, time.Now())
+		if err != nil {
+			l.add("log #%v in config file: %v", i+1, err)
+			continue
+		}
+		for _, problem := range roots.Problems {
+			l.add("log #%v in config file: %v", i+1, problem)
+		}
+	}
+	l.addErrs(checkShards(logConfigs))
+	l.addErrs(checkPrefixes(parsed))
+
+	if len(parsed.LevelDBPath) > 0 {
+		if err := checkWritable(parsed.LevelDBPath); err != nil {
+			l.add("leveldb_path is not writable: %v", err)
+		}
+	}
+	if probe != nil && len(b2Errs) == 0 {
+		if err := probe(b2AcctId, b2AppKey, b2Bucket, os.ExpandEnv(parsed.B2Url)); err != nil {
+			l.add("failed to probe remote database: %v", err)
+		}
+	}
+
+	return l.problems
+}
+
+// lint collects the problems found by Lint. Some problems are found by more
+// than one check, so each is only kept once.
+type lint struct {
+	problems []string
+	seen     map[string]bool
+}
+
+func (l *lint) add(format string, args ...interface{}) {
+	problem := fmt.Sprintf(format, args...)
+	if !l.seen[problem] {
+		l.seen[problem] = true
+		l.problems = append(l.problems, problem)
+	}
+}
+
+func (l *lint) addErrs(errs []error) {
+	for _, err := range errs {
+		l.add("%v", err)
+	}
+}
+
+// checkKeypair checks that a log's private key matches its public key, and
+// that sig_alg is the algorithm of its public key. Private keys in a PKCS#11
+// token or behind a socket can't be read, so only sig_alg is checked for them.
+func checkKeypair(meta logMeta) []error {
+	pubKey, privKey, err := parseKeypair(meta)
+	if err != nil {
+		return nil // Found by logConfig.
+	}
+	pub, err := der.UnmarshalPublicKey(pubKey.Der)
+	if err != nil {
+		return nil // Found by ctfe.ValidateLogConfig.
+	}
+
+	errs := make([]error, 0)
+	var sigAlg spb.DigitallySigned_SignatureAlgorithm
+	switch pub.(type) {
+	case *ecdsa.PublicKey:
+		sigAlg = spb.DigitallySigned_ECDSA
+	case *rsa.PublicKey:
+		sigAlg = spb.DigitallySigned_RSA
+	default:
+		errs = append(errs, fmt.Errorf("unsupported public key type: %T", pub))
+	}
+	if sigAlg != spb.DigitallySigned_ANONYMOUS && meta.SigAlg != sigAlg.String() {
+		errs = append(errs, fmt.Errorf("sig_alg is %v, but the public key is an %v key", meta.SigAlg, sigAlg))
+	}
+
+	priv := &keyspb.PrivateKey{}
+	if !ptypes.Is(privKey, priv) {
+		return errs
+	} else if err := ptypes.UnmarshalAny(privKey, priv); err != nil {
+		return append(errs, err)
+	}
+	signer, err := der.FromProto(priv)
+	if err != nil {
+		return append(errs, fmt.Errorf("failed to parse private key: %v", err))
+	}
+	got, err := der.MarshalPublicKey(signer.Public())
+	if err != nil {
+		return append(errs, err)
+	}
+	want, err := der.MarshalPublicKey(pub)
+	if err != nil {
+		return append(errs, err)
+	} else if !bytes.Equal(got, want) {
+		errs = append(errs, fmt.Errorf("private key doesn't match public key"))
+	}
+	return errs
+}
+
+// checkShards checks that the not_after ranges of logs other than mirrors
+// don't overlap, so that each certificate is only accepted by one temporal
+// shard. Logs whose config couldn't be read are nil, and skipped.
+func checkShards(logConfigs []*configpb.LogConfig) []error {
+	errs := make([]error, 0)
+	for i, a := range logConfigs {
+		if a == nil || a.IsMirror || a.NotAfterStart == nil {
+			continue
+		}
+		for j, b := range logConfigs[i+1:] {
+			if b == nil || b.IsMirror || b.NotAfterStart == nil {
+				continue
+			}
+			if a.NotAfterStart.Seconds < b.NotAfterLimit.Seconds && b.NotAfterStart.Seconds < a.NotAfterLimit.Seconds {
+				errs = append(errs, fmt.Errorf("logs #%v and #%v in config file have overlapping not_after ranges", i+1, i+j+2))
+			}
+		}
+	}
+	return errs
+}
+
+// checkPrefixes checks that each log is served under a different path.
+func checkPrefixes(parsed *file) []error {
+	errs := make([]error, 0)
+	for i, a := range parsed.Logs {
+		for j, b := range parsed.Logs[i+1:] {
+			if logPath(a) == logPath(b) {
+				errs = append(errs, fmt.Errorf("logs #%v and #%v in config file are both served at %v", i+1, i+j+2, logPath(a)))
+			}
+		}
+	}
+	return errs
+}
+
+// logPath returns the path that a log's endpoints are served under.
+func logPath(meta logMeta) string {
+	return path.Join("/", meta.OverrideHandlerPrefix, meta.Prefix)
+}
+
+// checkWritable checks that LevelDB can open a database at `dir`. The
+// directory is created when the database is opened if it doesn't exist, so its
+// closest existing parent must be writable instead.
+func checkWritable(dir string) error {
+	info, err := os.Stat(dir)
+	if os.IsNotExist(err) {
+		return checkWritable(filepath.Dir(dir))
+	} else if err != nil {
+		return err
+	} else if !info.IsDir() {
+		return fmt.Errorf("%v is not a directory", dir)
+	}
+
+	f, err := ioutil.TempFile(dir, ".ct-log-lint")
+	if err != nil {
+		return err
+	}
+	f.Close()
+	return os.Remove(f.Name())
+}
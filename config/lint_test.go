@@ -0,0 +1,143 @@
+package config
+
+import (
+	"testing"
+
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/x509"
+	"encoding/pem"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+	"time"
+
+	"gopkg.in/yaml.v2"
+)
+
+// testKeypair returns a new PEM-encoded private and public key.
+func testKeypair(t *testing.T) (string, string) {
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	priv, err := x509.MarshalECPrivateKey(key)
+	if err != nil {
+		t.Fatal(err)
+	}
+	pub, err := x509.MarshalPKIXPublicKey(key.Public())
+	if err != nil {
+		t.Fatal(err)
+	}
+	return string(pem.EncodeToMemory(&pem.Block{Type: "EC PRIVATE KEY", Bytes: priv})),
+		string(pem.EncodeToMemory(&pem.Block{Type: "PUBLIC KEY", Bytes: pub}))
+}
+
+func TestLint(t *testing.T) {
+	dir, err := ioutil.TempDir("", "ct-log-lint")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	root, _ := testRoot(t, "Root", time.Now().Add(time.Hour))
+	rootsFile := filepath.Join(dir, "roots.pem")
+	if err := ioutil.WriteFile(rootsFile, []byte(root), 0644); err != nil {
+		t.Fatal(err)
+	}
+
+	shard := func(id int64, start, stop string) logMeta {
+		priv, pub := testKeypair(t)
+		return logMeta{
+			LogId:           id,
+			CreateTime:      "2018-01-01 00:00:00 UTC",
+			UpdateTime:      "2018-01-01 00:00:00 UTC",
+			TreeState:       "ACTIVE",
+			SigAlg:          "ECDSA",
+			MaxRootDuration: "1h",
+			NotAfterStart:   start,
+			NotAfterStop:    stop,
+			Prefix:          fmt.Sprintf("log%v", id),
+			RootsFile:       rootsFile,
+			PrivKey:         priv,
+			PubKey:          pub,
+		}
+	}
+	base := func() *file {
+		parsed := &file{
+			MetricsAddr:          ":8081",
+			ServerAddr:           ":8080",
+			LevelDBPath:          filepath.Join(dir, "db"),
+			B2AcctId:             "acct",
+			B2AppKey:             "key",
+			B2Bucket:             "bucket",
+			B2Url:                "https://example.com",
+			MaxUnsequencedLeaves: 1,
+			MaxClients:           1,
+			RequestTimeout:       "1s",
+		}
+		parsed.Logs = []logMeta{
+			shard(1, "2018-01-01 00:00:00 UTC", "2019-01-01 00:00:00 UTC"),
+			shard(2, "2019-01-01 00:00:00 UTC", "2020-01-01 00:00:00 UTC"),
+		}
+		return parsed
+	}
+	lint := func(parsed *file, probe RemoteProbe) []string {
+		raw, err := yaml.Marshal(parsed)
+		if err != nil {
+			t.Fatal(err)
+		}
+		path := filepath.Join(dir, "config.yaml")
+		if err := ioutil.WriteFile(path, raw, 0644); err != nil {
+			t.Fatal(err)
+		}
+		return Lint(path, probe)
+	}
+
+	probed := false
+	probe := func(acctId, appKey, bucket, url string) error {
+		probed = true
+		if acctId != "acct" || appKey != "key" || bucket != "bucket" || url != "https://example.com" {
+			t.Errorf("probe got unexpected credentials: %v, %v, %v, %v", acctId, appKey, bucket, url)
+		}
+		return nil
+	}
+	if problems := lint(base(), probe); len(problems) != 0 {
+		t.Fatalf("got problems with valid config: %q", problems)
+	} else if !probed {
+		t.Fatal("remote database wasn't probed")
+	}
+
+	// Every problem is found, not only the first one.
+	parsed := base()
+	parsed.MaxClients = 0
+	parsed.LevelDBPath = rootsFile
+	parsed.Logs[0].PubKey = parsed.Logs[1].PubKey
+	parsed.Logs[1].SigAlg = "RSA"
+	parsed.Logs[1].NotAfterStart = "2018-06-01 00:00:00 UTC"
+	parsed.Logs = append(parsed.Logs, shard(3, "2020-01-01 00:00:00 UTC", "2020-01-01 00:00:00 UTC"))
+	parsed.Logs[2].Prefix = "log1"
+	wantProblems := []string{
+		"max_clients cannot be less than one",
+		"log #1 in config file: private key doesn't match public key",
+		"log #2 in config file: sig_alg is RSA, but the public key is an ECDSA key",
+		"log #3 in config file: not_after_start must be before not_after_stop",
+		"logs #1 and #2 in config file have overlapping not_after ranges",
+		"logs #1 and #3 in config file are both served at /log1",
+		"leveldb_path is not writable",
+		"failed to probe remote database: unreachable",
+	}
+	problems := lint(parsed, func(acctId, appKey, bucket, url string) error {
+		return fmt.Errorf("unreachable")
+	})
+	if len(problems) != len(wantProblems) {
+		t.Fatalf("got problems %q, wanted %q", problems, wantProblems)
+	}
+	for i, want := range wantProblems {
+		if !strings.HasPrefix(problems[i], want) {
+			t.Errorf("got problem %q, wanted %q", problems[i], want)
+		}
+	}
+}
@@ -0,0 +1,167 @@
+package config
+
+import (
+	"context"
+	"fmt"
+	"strings"
+
+	"github.com/golang/protobuf/proto"
+	"github.com/google/certificate-transparency-go/trillian/ctfe/configpb"
+	"github.com/google/trillian"
+)
+
+// CheckReload returns an error if `next`, a config that was read again, can't
+// be applied to the running server. Roots, tree states, quota limits, the leaf
+// cache size, the request timeout, the B2 credentials and the sources of
+// mirrors can change, and logs can be added. Other options need a restart, and the keys and identity of
+// existing logs can never change.
+func (c *Config) CheckReload(next *Config) error {
+	problems := make([]string, 0)
+	restart := func(option string, changed bool) {
+		if changed {
+			problems = append(problems, fmt.Sprintf("%v can't be changed without a restart", option))
+		}
+	}
+
+	restart("metrics_addr", c.MetricsAddr != next.MetricsAddr)
+	restart("server_addr", c.ServerAddr != next.ServerAddr)
+	restart("cert_file and key_file", c.CertFile != next.CertFile || c.KeyFile != next.KeyFile)
+	restart("leveldb_path", c.LevelDBPath != next.LevelDBPath)
+	restart("leveldb", c.LevelDB != next.LevelDB)
+	restart("b2_bucket and b2_url", c.B2Bucket != next.B2Bucket || c.B2Url != next.B2Url)
+	restart("subtree_cache_size", c.SubtreeCacheSize != next.SubtreeCacheSize)
+	restart("max_clients", c.MaxClients != next.MaxClients)
+	restart("signer", c.Signer != next.Signer)
+	restart("pkcs11 module", c.PKCS11Module != next.PKCS11Module)
+
+	nextTrees := next.trees()
+	for _, tree := range c.trees() {
+		nextTree, ok := nextTrees[tree.TreeId]
+		if !ok {
+			problems = append(problems, fmt.Sprintf("log %v can't be removed", tree.TreeId))
+		} else if err := checkTreeReload(tree, nextTree); err != nil {
+			problems = append(problems, fmt.Sprintf("log %v: %v", tree.TreeId, err))
+		}
+	}
+	nextLogs := make(map[int64]*configpb.LogConfig)
+	for _, logConfig := range next.LogConfigs {
+		nextLogs[logConfig.LogId] = logConfig
+	}
+	for _, logConfig := range c.LogConfigs {
+		if nextLog, ok := nextLogs[logConfig.LogId]; ok {
+			if err := checkLogReload(logConfig, nextLog); err != nil {
+				problems = append(problems, fmt.Sprintf("log %v: %v", logConfig.LogId, err))
+			}
+		}
+	}
+
+	if len(problems) > 0 {
+		return fmt.Errorf("%v", strings.Join(problems, "; "))
+	}
+	return nil
+}
+
+// checkTreeReload returns an error if a tree's Trillian config can't change
+// from `prev` to `next`. Only ACTIVE trees can be frozen, and only the tree
+// state and max root duration can change.
+func checkTreeReload(prev, next *trillian.Tree) error {
+	if prev.TreeState != next.TreeState && !(prev.TreeState == trillian.TreeState_ACTIVE && next.TreeState == trillian.TreeState_FROZEN) {
+		return fmt.Errorf("tree_state can't change from %v to %v", prev.TreeState, next.TreeState)
+	} else if prev.TreeType != next.TreeType {
+		return fmt.Errorf("tree_type can't be changed")
+	} else if prev.SignatureAlgorithm != next.SignatureAlgorithm {
+		return fmt.Errorf("sig_alg can't be changed")
+	} else if !proto.Equal(prev.PublicKey, next.PublicKey) {
+		return fmt.Errorf("pub_key can't be changed")
+	} else if !proto.Equal(prev.PrivateKey, next.PrivateKey) {
+		return fmt.Errorf("priv_key and signer can't be changed")
+	} else if !proto.Equal(prev.CreateTime, next.CreateTime) {
+		return fmt.Errorf("create_time can't be changed")
+	}
+	return nil
+}
+
+// checkLogReload returns an error if a log's CT config can't change from
+// `prev` to `next`. Its handlers are replaced on reload, but the paths that
+// they're served at can't be.
+func checkLogReload(prev, next *configpb.LogConfig) error {
+	if prev.Prefix != next.Prefix {
+		return fmt.Errorf("prefix can't be changed")
+	} else if prev.OverrideHandlerPrefix != next.OverrideHandlerPrefix {
+		return fmt.Errorf("override_handler_prefix can't be changed")
+	}
+	return nil
+}
+
+// trees returns the trees in the config's admin storage, by their id.
+func (c *Config) trees() map[int64]*trillian.Tree {
+	out := make(map[int64]*trillian.Tree)
+	for _, tree := range c.AdminStorage.(*adminStorage).getTrees() {
+		out[tree.TreeId] = tree
+	}
+	return out
+}
+
+// Reload applies `next` to the config, after checking that it can be with
+// CheckReload. The trees of the config's admin storage are replaced with the
+// ones from `next`, so Trillian sees changes to them immediately. Anything else
+// that the server has already set up from the config must be updated by the
+// caller, including the remote database's credentials.
+func (c *Config) Reload(next *Config) error {
+	if err := c.CheckReload(next); err != nil {
+		return err
+	}
+	c.AdminStorage.(*adminStorage).replace(next.AdminStorage.(*adminStorage))
+
+	c.LeafCacheSize = next.LeafCacheSize
+	c.MaxUnsequencedLeaves = next.MaxUnsequencedLeaves
+	c.RequestTimeout = next.RequestTimeout
+	c.RateLimit = next.RateLimit
+	c.B2AcctId, c.B2AppKey = next.B2AcctId, next.B2AppKey
+	c.LogConfigs = next.LogConfigs
+	c.Roots = next.Roots
+	c.Mirrors = next.Mirrors
+	return nil
+}
+
+// CheckSigners checks that a signer can be created for each of the config's
+// logs. The result is reported by the admin storage's health check, which
+// doesn't create signers itself, so it must be called once the signers can be
+// loaded and before the config is applied with Reload.
+func (c *Config) CheckSigners(ctx context.Context) error {
+	return c.AdminStorage.(*adminStorage).checkSigners(ctx)
+}
+
+// TreeState returns the current state of a log's tree.
+func (c *Config) TreeState(treeID int64) (trillian.TreeState, error) {
+	tree, ok := c.trees()[treeID]
+	if !ok {
+		return trillian.TreeState_UNKNOWN_TREE_STATE, fmt.Errorf("log %v not found", treeID)
+	}
+	return tree.TreeState, nil
+}
+
+// SetTreeState changes the state of a log's tree, while it's being frozen.
+// Trillian sees the change immediately. The config file isn't changed, so it
+// must be updated before the config can be reloaded.
+func (c *Config) SetTreeState(treeID int64, state trillian.TreeState) error {
+	return c.AdminStorage.(*adminStorage).setTreeState(treeID, state)
+}
+
+// SetFrozenSTH sets the frozen STH of a log, which it serves once its handlers
+// are set up again.
+func (c *Config) SetFrozenSTH(treeID int64, sth *configpb.SignedTreeHead) error {
+	for i, logConfig := range c.LogConfigs {
+		if logConfig.LogId != treeID {
+			continue
+		}
+		// The current config may be in use by the log's handlers.
+		updated := proto.Clone(logConfig).(*configpb.LogConfig)
+		updated.FrozenSth = sth
+		logConfigs := append([]*configpb.LogConfig(nil), c.LogConfigs...)
+		logConfigs[i] = updated
+		c.LogConfigs = logConfigs
+		return nil
+	}
+	return fmt.Errorf("log %v not found", treeID)
+}
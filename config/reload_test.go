@@ -0,0 +1,147 @@
+package config
+
+import (
+	"testing"
+
+	"context"
+	"fmt"
+
+	"github.com/google/certificate-transparency-go/trillian/ctfe/configpb"
+	"github.com/google/trillian"
+	"github.com/google/trillian/crypto/keyspb"
+)
+
+func reloadConfig(states ...trillian.TreeState) *Config {
+	trees := make([]*trillian.Tree, 0, len(states))
+	logConfigs := make([]*configpb.LogConfig, 0, len(states))
+	for i, state := range states {
+		trees = append(trees, &trillian.Tree{
+			TreeId:    int64(i + 1),
+			TreeState: state,
+			TreeType:  trillian.TreeType_LOG,
+			PublicKey: &keyspb.PublicKey{Der: []byte{byte(i)}},
+		})
+		logConfigs = append(logConfigs, &configpb.LogConfig{
+			LogId:  int64(i + 1),
+			Prefix: fmt.Sprintf("log%v", i+1),
+		})
+	}
+	return &Config{
+		AdminStorage: &adminStorage{trees: trees},
+		LogConfigs:   logConfigs,
+	}
+}
+
+func TestReload(t *testing.T) {
+	active, frozen := trillian.TreeState_ACTIVE, trillian.TreeState_FROZEN
+
+	// Logs can be frozen and added, and quota limits can change.
+	cfg, next := reloadConfig(active, active), reloadConfig(frozen, active, active)
+	next.MaxUnsequencedLeaves = 100
+	if err := cfg.Reload(next); err != nil {
+		t.Fatal(err)
+	} else if len(cfg.trees()) != 3 || cfg.trees()[1].TreeState != frozen {
+		t.Fatalf("trees weren't reloaded: %v", cfg.trees())
+	} else if len(cfg.LogConfigs) != 3 || cfg.MaxUnsequencedLeaves != 100 {
+		t.Fatal("config wasn't reloaded")
+	}
+
+	// Nothing is changed if any change is unsafe.
+	next = reloadConfig(frozen, active)
+	next.trees()[2].PublicKey = &keyspb.PublicKey{Der: []byte{9}}
+	next.MaxUnsequencedLeaves = 200
+	if err := cfg.Reload(next); err == nil {
+		t.Fatal("expected removed log and changed key to be refused")
+	} else if cfg.MaxUnsequencedLeaves != 100 || len(cfg.trees()) != 3 {
+		t.Fatal("config was changed by a refused reload")
+	}
+
+	// Frozen logs can't be unfrozen, and other options need a restart.
+	next = reloadConfig(active, active, active)
+	if err := cfg.CheckReload(next); err == nil {
+		t.Fatal("expected unfreezing a log to be refused")
+	}
+	next = reloadConfig(frozen, active, active)
+	next.ServerAddr = ":8080"
+	if err := cfg.CheckReload(next); err == nil {
+		t.Fatal("expected changed server_addr to be refused")
+	}
+	next = reloadConfig(frozen, active, active)
+	next.LogConfigs[1].Prefix = "z"
+	if err := cfg.CheckReload(next); err == nil {
+		t.Fatal("expected changed prefix to be refused")
+	}
+	next = reloadConfig(frozen, active, active)
+	next.LogConfigs[1].RejectExpired = true
+	if err := cfg.CheckReload(next); err != nil {
+		t.Fatal(err)
+	}
+
+	// B2 credentials can be rotated, but the bucket can't be changed.
+	next = reloadConfig(frozen, active, active)
+	next.B2AcctId, next.B2AppKey = "acct", "rotated"
+	if err := cfg.Reload(next); err != nil {
+		t.Fatal(err)
+	} else if cfg.B2AcctId != "acct" || cfg.B2AppKey != "rotated" {
+		t.Fatal("b2 credentials weren't reloaded")
+	}
+	next = reloadConfig(frozen, active, active)
+	next.B2AcctId, next.B2AppKey, next.B2Bucket = "acct", "rotated", "other"
+	if err := cfg.CheckReload(next); err == nil {
+		t.Fatal("expected changed b2_bucket to be refused")
+	}
+}
+
+func TestCheckSigners(t *testing.T) {
+	ctx := context.Background()
+	active := trillian.TreeState_ACTIVE
+
+	// The health check reports the result of the last check of the signers,
+	// which is carried over by a reload.
+	cfg := reloadConfig(active)
+	cfg.AdminStorage.(*adminStorage).signerErr = errSignersNotChecked
+	if err := cfg.AdminStorage.CheckDatabaseAccessible(ctx); err != errSignersNotChecked {
+		t.Fatalf("unexpected error before signers were checked: %v", err)
+	}
+	cfg.AdminStorage.(*adminStorage).signerErr = nil
+	if err := cfg.AdminStorage.CheckDatabaseAccessible(ctx); err != nil {
+		t.Fatal(err)
+	}
+
+	next := reloadConfig(active, active)
+	if err := next.CheckSigners(ctx); err == nil {
+		t.Fatal("expected trees without private keys to fail the check")
+	} else if err := cfg.Reload(next); err != nil {
+		t.Fatal(err)
+	} else if err := cfg.AdminStorage.CheckDatabaseAccessible(ctx); err == nil {
+		t.Fatal("expected failed signer check to be reported after reload")
+	}
+}
+
+func TestFreezeConfig(t *testing.T) {
+	active := trillian.TreeState_ACTIVE
+	cfg := reloadConfig(active, active)
+	prevLog := cfg.LogConfigs[0]
+
+	// A draining log can't be reloaded from a config file that says it's
+	// active.
+	if err := cfg.SetTreeState(1, trillian.TreeState_DRAINING); err != nil {
+		t.Fatal(err)
+	} else if state, err := cfg.TreeState(1); err != nil || state != trillian.TreeState_DRAINING {
+		t.Fatalf("got tree state %v, %v, wanted DRAINING", state, err)
+	} else if err := cfg.CheckReload(reloadConfig(active, active)); err == nil {
+		t.Fatal("expected draining log to refuse reload as active")
+	}
+
+	// The frozen STH is set on a copy of the log's config.
+	sth := &configpb.SignedTreeHead{TreeSize: 10}
+	if err := cfg.SetFrozenSTH(1, sth); err != nil {
+		t.Fatal(err)
+	} else if cfg.LogConfigs[0].FrozenSth != sth {
+		t.Fatal("frozen sth wasn't set")
+	} else if prevLog.FrozenSth != nil {
+		t.Fatal("log config that may be in use was changed")
+	} else if err := cfg.SetFrozenSTH(3, sth); err == nil {
+		t.Fatal("expected unknown log to be rejected")
+	}
+}
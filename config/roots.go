@@ -0,0 +1,167 @@
+package config
+
+import (
+	"bytes"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/pem"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"sort"
+	"time"
+
+	"github.com/google/certificate-transparency-go/x509"
+)
+
+// Roots is the set of roots that a log accepts, read from every roots source
+// in its config.
+type Roots struct {
+	// Certs are the roots that the log accepts, without duplicates or the
+	// excluded roots, in the order they were read.
+	Certs []Root
+	// Excluded are the roots that were left out because of roots_exclude.
+	Excluded []Root
+	// Problems describes each root that is expired, duplicated or
+	// unparseable, and anything else about the roots sources that's likely
+	// to be a mistake. Unparseable and duplicate roots are left out.
+	Problems []string
+}
+
+// Root is a root certificate, and the file it was read from.
+type Root struct {
+	Cert *x509.Certificate
+	File string
+}
+
+// SPKIHash returns the SHA-256 hash of the root's SubjectPublicKeyInfo, which
+// is how roots are excluded.
+func (r Root) SPKIHash() [sha256.Size]byte {
+	return sha256.Sum256(r.Cert.RawSubjectPublicKeyInfo)
+}
+
+// PEM returns the roots in Certs, PEM-encoded.
+func (r *Roots) PEM() []byte {
+	buff := &bytes.Buffer{}
+	for _, root := range r.Certs {
+		pem.Encode(buff, &pem.Block{Type: "CERTIFICATE", Bytes: root.Cert.Raw})
+	}
+	return buff.Bytes()
+}
+
+// rootsFiles returns the files that a log's roots are read from: roots_file,
+// roots_files, and every .pem file in each of roots_dirs.
+func rootsFiles(meta logMeta) ([]string, error) {
+	files := make([]string, 0)
+	if meta.RootsFile != "" {
+		files = append(files, meta.RootsFile)
+	}
+	files = append(files, meta.RootsFiles...)
+	for _, dir := range meta.RootsDirs {
+		if info, err := os.Stat(dir); err != nil {
+			return nil, fmt.Errorf("failed to read roots_dirs: %v", err)
+		} else if !info.IsDir() {
+			return nil, fmt.Errorf("failed to read roots_dirs: %v is not a directory", dir)
+		}
+		matches, err := filepath.Glob(filepath.Join(dir, "*.pem"))
+		if err != nil {
+			return nil, fmt.Errorf("failed to read roots_dirs: %v", err)
+		}
+		sort.Strings(matches)
+		files = append(files, matches...)
+	}
+	return files, nil
+}
+
+// readRoots reads the roots that a log accepts from each of its roots sources.
+// Logs other than mirrors must accept at least one root.
+func readRoots(meta logMeta, isMirror bool, now time.Time) (*Roots, error) {
+	files, err := rootsFiles(meta)
+	if err != nil {
+		return nil, err
+	}
+	roots, err := loadRoots(files, meta.RootsExclude, now)
+	if err != nil {
+		return nil, err
+	} else if !isMirror && len(roots.Certs) == 0 {
+		return nil, fmt.Errorf("no roots were found")
+	}
+	return roots, nil
+}
+
+// loadRoots reads the roots from every file in `files`, leaving out the roots
+// whose SPKI hash is in `exclude`, given in hex.
+func loadRoots(files, exclude []string, now time.Time) (*Roots, error) {
+	excluded := make(map[[sha256.Size]byte]bool)
+	for _, raw := range exclude {
+		hash, err := hex.DecodeString(raw)
+		if err != nil {
+			return nil, fmt.Errorf("failed to parse roots_exclude: %v", err)
+		} else if len(hash) != sha256.Size {
+			return nil, fmt.Errorf("failed to parse roots_exclude: %v is not a SHA-256 hash", raw)
+		}
+		var key [sha256.Size]byte
+		copy(key[:], hash)
+		excluded[key] = false
+	}
+
+	out := &Roots{}
+	seen := make(map[[sha256.Size]byte]string)
+	for _, file := range files {
+		data, err := ioutil.ReadFile(file)
+		if err != nil {
+			return nil, fmt.Errorf("failed to read roots: %v", err)
+		}
+
+		n := 0
+		for len(data) > 0 {
+			var block *pem.Block
+			block, data = pem.Decode(data)
+			if block == nil {
+				break
+			} else if block.Type != "CERTIFICATE" {
+				continue
+			}
+			n++
+			cert, err := x509.ParseCertificate(block.Bytes)
+			if x509.IsFatal(err) {
+				out.Problems = append(out.Problems, fmt.Sprintf("%v: certificate #%v is unparseable: %v", file, n, err))
+				continue
+			}
+			root := Root{Cert: cert, File: file}
+
+			fingerprint := sha256.Sum256(cert.Raw)
+			if other, ok := seen[fingerprint]; ok {
+				out.Problems = append(out.Problems, fmt.Sprintf("%v: certificate #%v (%v) is a duplicate of one in %v", file, n, cert.Subject, other))
+				continue
+			}
+			seen[fingerprint] = file
+
+			if _, ok := excluded[root.SPKIHash()]; ok {
+				excluded[root.SPKIHash()] = true
+				out.Excluded = append(out.Excluded, root)
+				continue
+			}
+			if now.After(cert.NotAfter) {
+				out.Problems = append(out.Problems, fmt.Sprintf("%v: certificate #%v (%v) expired at %v", file, n, cert.Subject, cert.NotAfter.UTC().Format(time.RFC3339)))
+			}
+			out.Certs = append(out.Certs, root)
+		}
+		if n == 0 {
+			out.Problems = append(out.Problems, fmt.Sprintf("%v: no certificates found", file))
+		}
+	}
+
+	unused := make([]string, 0)
+	for hash, used := range excluded {
+		if !used {
+			unused = append(unused, hex.EncodeToString(hash[:]))
+		}
+	}
+	sort.Strings(unused)
+	for _, hash := range unused {
+		out.Problems = append(out.Problems, fmt.Sprintf("roots_exclude: no root has SPKI hash %v", hash))
+	}
+	return out, nil
+}
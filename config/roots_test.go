@@ -0,0 +1,131 @@
+package config
+
+import (
+	"testing"
+
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/sha256"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/hex"
+	"encoding/pem"
+	"io/ioutil"
+	"math/big"
+	"os"
+	"path/filepath"
+	"strings"
+	"time"
+
+	"github.com/google/certificate-transparency-go/trillian/ctfe"
+)
+
+// testRoot returns a PEM-encoded self-signed root, and the hex SHA-256 hash of
+// its SubjectPublicKeyInfo.
+func testRoot(t *testing.T, name string, notAfter time.Time) (string, string) {
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	tmpl := &x509.Certificate{
+		SerialNumber:          big.NewInt(1),
+		Subject:               pkix.Name{CommonName: name},
+		NotBefore:             notAfter.Add(-365 * 24 * time.Hour),
+		NotAfter:              notAfter,
+		IsCA:                  true,
+		BasicConstraintsValid: true,
+	}
+	der, err := x509.CreateCertificate(rand.Reader, tmpl, tmpl, key.Public(), key)
+	if err != nil {
+		t.Fatal(err)
+	}
+	cert, err := x509.ParseCertificate(der)
+	if err != nil {
+		t.Fatal(err)
+	}
+	hash := sha256.Sum256(cert.RawSubjectPublicKeyInfo)
+	return string(pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: der})), hex.EncodeToString(hash[:])
+}
+
+func TestLoadRoots(t *testing.T) {
+	dir, err := ioutil.TempDir("", "ct-log-roots")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	write := func(name, data string) string {
+		path := filepath.Join(dir, name)
+		if err := ioutil.WriteFile(path, []byte(data), 0644); err != nil {
+			t.Fatal(err)
+		}
+		return path
+	}
+	if err := os.Mkdir(filepath.Join(dir, "roots.d"), 0755); err != nil {
+		t.Fatal(err)
+	}
+
+	now := time.Now()
+	a, _ := testRoot(t, "Root A", now.Add(time.Hour))
+	b, _ := testRoot(t, "Root B", now.Add(time.Hour))
+	c, excludeC := testRoot(t, "Root C", now.Add(time.Hour))
+	expired, _ := testRoot(t, "Expired Root", now.Add(-time.Hour))
+	garbage := string(pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: []byte("garbage")}))
+
+	meta := logMeta{
+		RootsFile:    write("ca.pem", a+expired),
+		RootsFiles:   []string{write("more.pem", b+garbage)},
+		RootsDirs:    []string{filepath.Join(dir, "roots.d")},
+		RootsExclude: []string{excludeC, strings.Repeat("00", 32)},
+	}
+	write("roots.d/1.pem", a+c)
+	write("roots.d/2.pem", "not a pem file")
+	write("roots.d/ignored.txt", b)
+
+	files, err := rootsFiles(meta)
+	if err != nil {
+		t.Fatal(err)
+	} else if len(files) != 4 || filepath.Base(files[2]) != "1.pem" || filepath.Base(files[3]) != "2.pem" {
+		t.Fatalf("got unexpected roots files: %v", files)
+	}
+	roots, err := loadRoots(files, meta.RootsExclude, now)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	subjects := make([]string, 0)
+	for _, root := range roots.Certs {
+		subjects = append(subjects, root.Cert.Subject.CommonName)
+	}
+	if strings.Join(subjects, ",") != "Root A,Expired Root,Root B" {
+		t.Fatalf("got unexpected roots: %v", subjects)
+	} else if len(roots.Excluded) != 1 || roots.Excluded[0].Cert.Subject.CommonName != "Root C" {
+		t.Fatalf("got unexpected excluded roots: %v", roots.Excluded)
+	}
+
+	// Expired, unparseable and duplicate roots are reported, as are files
+	// without roots and exclusions that don't match anything.
+	wantProblems := []string{"expired", "unparseable", "duplicate", "no certificates found", "no root has SPKI hash"}
+	if len(roots.Problems) != len(wantProblems) {
+		t.Fatalf("got problems %q, wanted one of each of %q", roots.Problems, wantProblems)
+	}
+	for i, want := range wantProblems {
+		if !strings.Contains(roots.Problems[i], want) {
+			t.Errorf("got problem %q, wanted one about %q", roots.Problems[i], want)
+		}
+	}
+
+	// The PEM of the roots can be read by ctfe.
+	pool := ctfe.NewPEMCertPool()
+	if err := pool.AppendCertsFromPEMFile(write("effective.pem", string(roots.PEM()))); err != nil {
+		t.Fatal(err)
+	} else if len(pool.RawCertificates()) != 3 {
+		t.Fatalf("got %v roots back from PEM, wanted 3", len(pool.RawCertificates()))
+	}
+
+	if _, err := loadRoots(files, []string{"zz"}, now); err == nil {
+		t.Fatal("expected invalid exclusion to be rejected")
+	} else if _, err := loadRoots([]string{filepath.Join(dir, "missing.pem")}, nil, now); err == nil {
+		t.Fatal("expected missing roots file to be rejected")
+	}
+}
@@ -0,0 +1,50 @@
+package config
+
+import (
+	"fmt"
+	"io/ioutil"
+	"os"
+	"strings"
+)
+
+// readOption returns the value of a config option that can either be given
+// inline as `name`, with environment variables expanded, or read from a file
+// whose path is given as `name`_file. The path also has environment variables
+// expanded, so that files can be found in $CREDENTIALS_DIRECTORY, for example.
+// If `secret` is true, the file must not be accessible by group or others.
+//
+// Options are read each time the config is, so changes to the files are picked
+// up on reload. Of the secrets, only the B2 credentials are applied by a
+// reload; a log's keys can never change.
+func readOption(name, inline, file string, secret bool) (string, error) {
+	if inline != "" && file != "" {
+		return "", fmt.Errorf("cannot have both %v and %v_file", name, name)
+	} else if file == "" {
+		return os.ExpandEnv(inline), nil
+	}
+	raw, err := readFile(os.ExpandEnv(file), secret)
+	if err != nil {
+		return "", fmt.Errorf("failed to read %v_file: %v", name, err)
+	}
+	return strings.TrimSpace(string(raw)), nil
+}
+
+// readFile reads the file at `path`. If `secret` is true, it returns an error
+// if the file can be accessed by anyone other than its owner.
+func readFile(path string, secret bool) ([]byte, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+
+	if secret {
+		info, err := f.Stat()
+		if err != nil {
+			return nil, err
+		} else if perm := info.Mode().Perm(); perm&0077 != 0 {
+			return nil, fmt.Errorf("%v is accessible by group or others (mode %04o), it should be 0600 or stricter", path, perm)
+		}
+	}
+	return ioutil.ReadAll(f)
+}
@@ -0,0 +1,50 @@
+package config
+
+import (
+	"testing"
+
+	"io/ioutil"
+	"os"
+	"path/filepath"
+)
+
+func TestReadOption(t *testing.T) {
+	dir, err := ioutil.TempDir("", "ct-log-config")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	os.Setenv("CT_LOG_TEST_DIR", dir)
+	defer os.Unsetenv("CT_LOG_TEST_DIR")
+
+	private, public := filepath.Join(dir, "private"), filepath.Join(dir, "public")
+	if err := ioutil.WriteFile(private, []byte("secret\n"), 0600); err != nil {
+		t.Fatal(err)
+	} else if err := ioutil.WriteFile(public, []byte("not secret\n"), 0644); err != nil {
+		t.Fatal(err)
+	}
+
+	for _, c := range []struct {
+		inline, file string
+		secret       bool
+
+		want string
+		ok   bool
+	}{
+		{"${CT_LOG_TEST_DIR}", "", true, dir, true},
+		{"", "${CT_LOG_TEST_DIR}/private", true, "secret", true},
+		{"", "${CT_LOG_TEST_DIR}/public", false, "not secret", true},
+		{"", "${CT_LOG_TEST_DIR}/public", true, "", false},
+		{"", "${CT_LOG_TEST_DIR}/missing", false, "", false},
+		{"inline", "${CT_LOG_TEST_DIR}/private", true, "", false},
+	} {
+		got, err := readOption("option", c.inline, c.file, c.secret)
+		if c.ok && err != nil {
+			t.Errorf("readOption(%q, %q, %v): %v", c.inline, c.file, c.secret, err)
+		} else if !c.ok && err == nil {
+			t.Errorf("readOption(%q, %q, %v): expected an error", c.inline, c.file, c.secret)
+		} else if got != c.want {
+			t.Errorf("readOption(%q, %q, %v) = %q, wanted %q", c.inline, c.file, c.secret, got, c.want)
+		}
+	}
+}
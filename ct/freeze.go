@@ -0,0 +1,107 @@
+package ct
+
+import (
+	"context"
+	"crypto"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/json"
+	"fmt"
+
+	ctgo "github.com/google/certificate-transparency-go"
+	"github.com/google/certificate-transparency-go/tls"
+	"github.com/google/certificate-transparency-go/trillian/ctfe/configpb"
+	"github.com/google/trillian/types"
+)
+
+// FreezeSTH signs the final STH of a log that is being frozen, over its most
+// recent root, with the log's CT key `signer`. The log must have no
+// unsequenced leaves left, so the signer should have stopped accepting them
+// and drained the queue first.
+//
+// The STH is stored in the local database and published to the remote one in
+// the format of a get-sth response, and returned in the format of the log's
+// config.
+func (ls *LogStorage) FreezeSTH(ctx context.Context, treeID int64, signer crypto.Signer) (*configpb.SignedTreeHead, error) {
+	if count, err := ls.Local.Unsequenced(treeID); err != nil {
+		return nil, fmt.Errorf("failed to count unsequenced leaves: %v", err)
+	} else if count > 0 {
+		return nil, fmt.Errorf("log still has %v unsequenced leaves", count)
+	}
+	slr, _, err := ls.Local.MostRecentRoot(treeID)
+	if err != nil {
+		return nil, fmt.Errorf("failed to read most recent root: %v", err)
+	}
+	var root types.LogRootV1
+	if err := root.UnmarshalBinary(slr.LogRoot); err != nil {
+		return nil, fmt.Errorf("failed to parse most recent root: %v", err)
+	} else if len(root.RootHash) != sha256.Size {
+		return nil, fmt.Errorf("most recent root has a hash of %v bytes", len(root.RootHash))
+	}
+
+	// Sign the STH the same way that ctfe does for get-sth.
+	sth := ctgo.SignedTreeHead{
+		Version:   ctgo.V1,
+		TreeSize:  root.TreeSize,
+		Timestamp: root.TimestampNanos / 1000 / 1000,
+	}
+	copy(sth.SHA256RootHash[:], root.RootHash)
+	input, err := ctgo.SerializeSTHSignatureInput(sth)
+	if err != nil {
+		return nil, err
+	}
+	digest := sha256.Sum256(input)
+	sig, err := signer.Sign(rand.Reader, digest[:], crypto.SHA256)
+	if err != nil {
+		return nil, fmt.Errorf("failed to sign frozen sth: %v", err)
+	}
+	rawSig, err := tls.Marshal(tls.DigitallySigned{
+		Algorithm: tls.SignatureAndHashAlgorithm{
+			Hash:      tls.SHA256,
+			Signature: tls.SignatureAlgorithmFromPubKey(signer.Public()),
+		},
+		Signature: sig,
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	resp, err := json.Marshal(ctgo.GetSTHResponse{
+		TreeSize:          sth.TreeSize,
+		Timestamp:         sth.Timestamp,
+		SHA256RootHash:    sth.SHA256RootHash[:],
+		TreeHeadSignature: rawSig,
+	})
+	if err != nil {
+		return nil, err
+	} else if err := ls.Local.PutFrozenSTH(treeID, resp); err != nil {
+		return nil, fmt.Errorf("failed to store frozen sth: %v", err)
+	} else if err := ls.Remote.PutFrozenSTH(ctx, treeID, resp); err != nil {
+		return nil, fmt.Errorf("failed to publish frozen sth: %v", err)
+	}
+	return parseFrozenSTH(resp)
+}
+
+// GetFrozenSTH returns the final STH of a log that was frozen with FreezeSTH,
+// in the format of the log's config, or nil if it hasn't been frozen.
+func (ls *LogStorage) GetFrozenSTH(treeID int64) (*configpb.SignedTreeHead, error) {
+	raw, err := ls.Local.GetFrozenSTH(treeID)
+	if err != nil || raw == nil {
+		return nil, err
+	}
+	return parseFrozenSTH(raw)
+}
+
+// parseFrozenSTH converts a get-sth response into the format of a log's config.
+func parseFrozenSTH(raw []byte) (*configpb.SignedTreeHead, error) {
+	var resp ctgo.GetSTHResponse
+	if err := json.Unmarshal(raw, &resp); err != nil {
+		return nil, fmt.Errorf("failed to parse frozen sth: %v", err)
+	}
+	return &configpb.SignedTreeHead{
+		TreeSize:          int64(resp.TreeSize),
+		Timestamp:         int64(resp.Timestamp),
+		Sha256RootHash:    resp.SHA256RootHash,
+		TreeHeadSignature: resp.TreeHeadSignature,
+	}, nil
+}
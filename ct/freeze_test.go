@@ -0,0 +1,167 @@
+package ct
+
+import (
+	"testing"
+
+	"bytes"
+	"context"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"encoding/json"
+	"time"
+
+	ctgo "github.com/google/certificate-transparency-go"
+	"github.com/google/trillian"
+	"github.com/google/trillian/quota"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+)
+
+func TestFreezeSTH(t *testing.T) {
+	ts := newTestStorage(t)
+	defer ts.close()
+	ts.init(t)
+	ctx := context.Background()
+
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// Logs can't be frozen while they have unsequenced leaves.
+	ts.queue(t, 0, 10)
+	if _, err := ts.FreezeSTH(ctx, testTreeID, key); err == nil {
+		t.Fatal("expected log with unsequenced leaves to fail to freeze")
+	}
+	if sth, err := ts.GetFrozenSTH(testTreeID); err != nil {
+		t.Fatal(err)
+	} else if sth != nil {
+		t.Fatal("log has frozen sth before it was frozen")
+	}
+
+	ts.integrate(t)
+	sth, err := ts.FreezeSTH(ctx, testTreeID, key)
+	if err != nil {
+		t.Fatal(err)
+	} else if sth.TreeSize != 10 {
+		t.Fatalf("got frozen sth with tree size %v, wanted 10", sth.TreeSize)
+	}
+
+	// The STH is signed by the log's key, over its most recent root.
+	root, _, err := ts.Local.MostRecentRoot(testTreeID)
+	if err != nil {
+		t.Fatal(err)
+	} else if !bytes.Equal(sth.Sha256RootHash, root.RootHash) {
+		t.Fatal("frozen sth has wrong root hash")
+	}
+	signed, err := (&ctgo.GetSTHResponse{
+		TreeSize:          uint64(sth.TreeSize),
+		Timestamp:         uint64(sth.Timestamp),
+		SHA256RootHash:    sth.Sha256RootHash,
+		TreeHeadSignature: sth.TreeHeadSignature,
+	}).ToSignedTreeHead()
+	if err != nil {
+		t.Fatal(err)
+	}
+	verifier, err := ctgo.NewSignatureVerifier(key.Public())
+	if err != nil {
+		t.Fatal(err)
+	} else if err := verifier.VerifySTHSignature(*signed); err != nil {
+		t.Fatal(err)
+	}
+
+	// The STH is stored locally, and published as a get-sth response.
+	if stored, err := ts.GetFrozenSTH(testTreeID); err != nil {
+		t.Fatal(err)
+	} else if stored == nil || stored.TreeSize != 10 || !bytes.Equal(stored.TreeHeadSignature, sth.TreeHeadSignature) {
+		t.Fatalf("got stored frozen sth %v, wanted %v", stored, sth)
+	}
+	raw, err := ts.Remote.GetFrozenSTH(ctx, testTreeID)
+	if err != nil {
+		t.Fatal(err)
+	}
+	var published ctgo.GetSTHResponse
+	if err := json.Unmarshal(raw, &published); err != nil {
+		t.Fatal(err)
+	} else if published.TreeSize != 10 || !bytes.Equal(published.TreeHeadSignature, sth.TreeHeadSignature) {
+		t.Fatalf("got published frozen sth %v, wanted %v", published, sth)
+	}
+}
+
+func TestQueueFrozen(t *testing.T) {
+	ts := newTestStorage(t)
+	defer ts.close()
+	ts.init(t)
+	ctx := context.Background()
+	tree := &trillian.Tree{TreeId: testTreeID}
+
+	// Once the tree is frozen in storage, leaves that got past the quota
+	// manager aren't queued.
+	ts.Local.SetFrozen(testTreeID, true)
+	_, err := ts.QueueLeaves(ctx, tree, testLeaves(t, 0, 10), time.Now())
+	if code := status.Code(err); code != codes.FailedPrecondition {
+		t.Fatalf("got error %v, wanted %v", err, codes.FailedPrecondition)
+	}
+	if count, err := ts.Local.Unsequenced(testTreeID); err != nil {
+		t.Fatal(err)
+	} else if count != 0 {
+		t.Fatalf("got %v unsequenced leaves, wanted none", count)
+	}
+
+	ts.Local.SetFrozen(testTreeID, false)
+	ts.queue(t, 0, 10)
+}
+
+func TestQuotaManagerFrozen(t *testing.T) {
+	ts := newTestStorage(t)
+	defer ts.close()
+	ts.init(t)
+	ctx := context.Background()
+
+	qm := NewQuotaManager(100)
+	ts.Observer = qm
+	watchCtx, cancel := context.WithCancel(ctx)
+	defer cancel()
+	if err := qm.WatchLog(watchCtx, ts.Local, testTreeID); err != nil {
+		t.Fatal(err)
+	}
+	spec := quota.Spec{Group: quota.Tree, Kind: quota.Write, TreeID: testTreeID}
+
+	qm.SetFrozen(testTreeID, true)
+	if err := qm.GetTokens(ctx, 1, []quota.Spec{spec}); err == nil {
+		t.Fatal("expected frozen log to refuse tokens")
+	} else if tokens, err := qm.PeekTokens(ctx, []quota.Spec{spec}); err != nil {
+		t.Fatal(err)
+	} else if tokens[spec] != 0 {
+		t.Fatalf("got %v tokens for frozen log, wanted 0", tokens[spec])
+	}
+
+	qm.SetFrozen(testTreeID, false)
+	if err := qm.GetTokens(ctx, 1, []quota.Spec{spec}); err != nil {
+		t.Fatal(err)
+	}
+
+	// Frozen logs are no longer watched, but still refuse tokens rather than
+	// being unknown.
+	qm.SetFrozen(testTreeID, true)
+	cancel()
+	for {
+		qm.mu.Lock()
+		_, watched := qm.unsequenced[testTreeID]
+		qm.mu.Unlock()
+		if !watched {
+			break
+		}
+		time.Sleep(time.Millisecond)
+	}
+	if tokens, err := qm.PeekTokens(ctx, []quota.Spec{spec}); err != nil {
+		t.Fatal(err)
+	} else if tokens[spec] != 0 {
+		t.Fatalf("got %v tokens for unwatched frozen log, wanted 0", tokens[spec])
+	} else if err := qm.ResetQuota(ctx, []quota.Spec{spec}); err != nil {
+		t.Fatal(err)
+	} else if err := qm.GetTokens(ctx, 1, []quota.Spec{spec}); err == nil || err.Error() != "log is frozen" {
+		t.Fatalf("got error %v from unwatched frozen log, wanted it to be frozen", err)
+	}
+}
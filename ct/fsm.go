@@ -46,7 +46,7 @@ func (s fsmState) String() string {
 var fsmTransitions = map[fsmState][]fsmState{
 	sBegin:                 {sQueueLeaves, sDequeueLeaves, sStoreSignedLogRoot},
 	sQueueLeaves:           {sCommit},
-	sDequeueLeaves:         {sUpdateSequencedLeaves, sCommit},
+	sDequeueLeaves:         {sUpdateSequencedLeaves, sSetMerkleNodes, sCommit}, // Pre-ordered logs skip UpdateSequencedLeaves.
 	sUpdateSequencedLeaves: {sSetMerkleNodes},
 	sSetMerkleNodes:        {sStoreSignedLogRoot},
 	sStoreSignedLogRoot:    {sCommit},
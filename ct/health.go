@@ -0,0 +1,31 @@
+package ct
+
+import (
+	"fmt"
+	"time"
+)
+
+// LastSequencerRun returns when a sequencing run of the tree was last
+// committed, or false if there hasn't been one since the process started.
+// Sequencing runs are committed even if there were no leaves to integrate.
+func (ls *LogStorage) LastSequencerRun(treeID int64) (time.Time, bool) {
+	t, ok := ls.sequencerRuns.Load(treeID)
+	if !ok {
+		return time.Time{}, false
+	}
+	return t.(time.Time), true
+}
+
+// CheckRootAge returns an error if the tree has no signed root, or if its most
+// recent root was signed more than `maxAge` ago.
+func (ls *LogStorage) CheckRootAge(treeID int64, maxAge time.Duration) error {
+	root, _, err := ls.Local.MostRecentRoot(treeID)
+	if err != nil {
+		return fmt.Errorf("failed to read most recent root of tree %v: %v", treeID, err)
+	}
+	signed := time.Unix(0, root.TimestampNanos)
+	if age := time.Since(signed); age > maxAge {
+		return fmt.Errorf("most recent root of tree %v was signed %v ago, more than %v", treeID, age.Round(time.Second), maxAge)
+	}
+	return nil
+}
@@ -0,0 +1,43 @@
+package ct
+
+import (
+	"testing"
+
+	"context"
+	"time"
+)
+
+func TestHealth(t *testing.T) {
+	ts := newTestStorage(t)
+	defer ts.close()
+
+	if err := ts.CheckDatabaseAccessible(context.Background()); err != nil {
+		t.Fatal(err)
+	}
+	if err := ts.CheckRootAge(testTreeID, time.Hour); err == nil {
+		t.Fatal("expected uninitialized tree to fail root age check")
+	}
+	ts.init(t)
+	if err := ts.CheckRootAge(testTreeID, time.Hour); err != nil {
+		t.Fatal(err)
+	} else if err := ts.CheckRootAge(testTreeID, -time.Hour); err == nil {
+		t.Fatal("expected root to be too old")
+	}
+
+	// Only committed sequencing runs are recorded.
+	if _, ok := ts.LastSequencerRun(testTreeID); ok {
+		t.Fatal("unexpected sequencing run of fresh tree")
+	}
+	ts.queue(t, 0, 10)
+	ts.sequence(t, sDequeueLeaves)
+	if _, ok := ts.LastSequencerRun(testTreeID); ok {
+		t.Fatal("unexpected sequencing run recorded for uncommitted transaction")
+	}
+	before := time.Now()
+	ts.sequence(t, sClose)
+	if last, ok := ts.LastSequencerRun(testTreeID); !ok {
+		t.Fatal("sequencing run was not recorded")
+	} else if last.Before(before) {
+		t.Fatalf("sequencing run was recorded at %v, before it started at %v", last, before)
+	}
+}
@@ -0,0 +1,253 @@
+package ct
+
+import (
+	"bytes"
+	"context"
+	"crypto"
+	"encoding/json"
+	"fmt"
+
+	"github.com/cloudflare/ct-log/custom/frontier"
+
+	ctgo "github.com/google/certificate-transparency-go"
+	"github.com/google/trillian"
+	"github.com/google/trillian/merkle/compact"
+	"github.com/google/trillian/merkle/hashers"
+	"github.com/google/trillian/storage"
+	"github.com/google/trillian/storage/cache"
+	"github.com/google/trillian/storage/storagepb"
+	"github.com/google/trillian/types"
+)
+
+var errIndexNotEmpty = fmt.Errorf("index is not empty")
+
+// Importer rebuilds a tree in empty storage from its leaves and the signed tree
+// heads it was published with. Leaves are added with AddLeaves, and each signed
+// tree head is stored with StoreRoot once the tree has reached its size, which
+// checks that the rebuilt tree matches it.
+//
+// An import that fails part-way can't be resumed; it should be started over
+// with a fresh local database and bucket.
+type Importer struct {
+	ls     *LogStorage
+	treeID int64
+	hasher hashers.LogHasher
+
+	tree  *compact.Tree
+	front frontier.Frontier
+
+	rev     int64 // Revision of the most recently stored root.
+	nextRev int64 // Revision that the most recent leaves were written at.
+}
+
+// NewImporter returns an Importer for the tree with the given treeID. It
+// returns an error if the tree already has any data, locally or remotely.
+func (ls *LogStorage) NewImporter(ctx context.Context, treeID int64) (*Importer, error) {
+	hasher, err := hashers.NewLogHasher(trillian.HashStrategy_RFC6962_SHA256)
+	if err != nil {
+		return nil, err
+	}
+
+	if _, _, err := ls.Local.MostRecentRoot(treeID); err == nil {
+		return nil, fmt.Errorf("tree %v already has a signed tree head", treeID)
+	} else if err != storage.ErrTreeNeedsInit {
+		return nil, err
+	}
+	err = ls.Local.ScanIndex(treeID, true, func([]byte, int64) error { return errIndexNotEmpty })
+	if err == errIndexNotEmpty {
+		return nil, fmt.Errorf("tree %v already has sequenced leaves", treeID)
+	} else if err != nil {
+		return nil, err
+	}
+	if _, err := ls.Remote.GetLeaves(ctx, treeID, []int64{0}); err == nil {
+		return nil, fmt.Errorf("tree %v already has leaves in remote storage", treeID)
+	}
+
+	return &Importer{
+		ls:     ls,
+		treeID: treeID,
+		hasher: hasher,
+
+		tree: compact.NewTree(hasher),
+		rev:  -1,
+	}, nil
+}
+
+// Size returns the number of leaves that have been imported.
+func (im *Importer) Size() int64 { return im.tree.Size() }
+
+// AddLeaves appends `leaves` to the tree. Their indices must be contiguous and
+// start at the current size of the tree. The tree's nodes are written at
+// `treeRevision`, which must be the revision of the next root that will be
+// stored.
+func (im *Importer) AddLeaves(ctx context.Context, leaves []*trillian.LogLeaf, treeRevision int64) error {
+	if treeRevision <= im.rev || treeRevision < im.nextRev {
+		return fmt.Errorf("tree revision %v is older than what has already been imported", treeRevision)
+	}
+	for i, leaf := range leaves {
+		if leaf.LeafIndex != im.tree.Size()+int64(i) {
+			return fmt.Errorf("leaf has index %v, wanted %v", leaf.LeafIndex, im.tree.Size()+int64(i))
+		}
+	}
+	if len(leaves) == 0 {
+		return nil
+	}
+
+	if err := im.ls.Remote.PutLeaves(ctx, im.treeID, leaves); err != nil {
+		return err
+	}
+	ltx := im.ls.Local.Begin()
+
+	var (
+		seqs         = make([]int64, 0, len(leaves))
+		merkleHashes = make([][]byte, 0, len(leaves))
+		idHashes     = make([][]byte, 0, len(leaves))
+	)
+	for _, leaf := range leaves {
+		seqs = append(seqs, leaf.LeafIndex)
+		merkleHashes = append(merkleHashes, leaf.MerkleLeafHash)
+		idHashes = append(idHashes, leaf.LeafIdentityHash)
+	}
+	if err := ltx.PutLeaves(im.treeID, seqs, merkleHashes, idHashes); err != nil {
+		return err
+	}
+
+	// Set the same nodes that Trillian's sequencer would have.
+	stCache := cache.NewLogSubtreeCache(defaultLogStrata, im.hasher)
+	getSubtree := func(id storage.NodeID) (*storagepb.SubtreeProto, error) {
+		subtrees, err := im.ls.Local.GetSubtrees(im.treeID, treeRevision, []storage.NodeID{id})
+		if err != nil || len(subtrees) == 0 {
+			return nil, err
+		}
+		return subtrees[0], nil
+	}
+	setNode := func(depth int, index int64, hash []byte) error {
+		id, err := storage.NewNodeIDForTreeCoords(int64(depth), index, 64)
+		if err != nil {
+			return err
+		}
+		return stCache.SetNodeHash(id, hash, getSubtree)
+	}
+	for _, leaf := range leaves {
+		if _, err := im.tree.AddLeafHash(leaf.MerkleLeafHash, setNode); err != nil {
+			return err
+		}
+		im.front.Append(leaf.MerkleLeafHash)
+	}
+
+	err := stCache.Flush(func(subtrees []*storagepb.SubtreeProto) error {
+		return putSubtrees(ltx, im.treeID, treeRevision, subtrees)
+	})
+	if err != nil {
+		return err
+	} else if err := ltx.Commit(); err != nil {
+		return err
+	}
+	im.nextRev = treeRevision
+
+	return nil
+}
+
+// StoreRoot stores a signed tree head that the log published for the current
+// size of the tree, and makes it the tree's most recent root. It returns an
+// error if the root hash doesn't match the rebuilt tree.
+func (im *Importer) StoreRoot(ctx context.Context, root trillian.SignedLogRoot) error {
+	var logRoot types.LogRootV1
+	if err := logRoot.UnmarshalBinary(root.LogRoot); err != nil {
+		return err
+	}
+	size, rev := int64(logRoot.TreeSize), int64(logRoot.Revision)
+
+	if size != im.tree.Size() {
+		return fmt.Errorf("signed tree head has tree size %v, but %v leaves have been imported", size, im.tree.Size())
+	} else if !bytes.Equal(logRoot.RootHash, im.front.Head()) {
+		return fmt.Errorf("signed tree head at tree size %v has root hash %x, but rebuilt tree has %x", size, logRoot.RootHash, im.front.Head())
+	} else if rev <= im.rev || rev < im.nextRev {
+		return fmt.Errorf("signed tree head at tree size %v has revision %v, which is older than what has already been imported", size, rev)
+	}
+
+	ltx := im.ls.Local.Begin()
+	if err := ltx.StoreRoot(im.treeID, root, im.front); err != nil {
+		return err
+	} else if err := ltx.Commit(); err != nil {
+		return err
+	}
+	im.rev, im.nextRev = rev, rev
+
+	return nil
+}
+
+// StoreFrozenSTH stores the final signed tree head of a log that was frozen,
+// in the format of a get-sth response, locally and in the remote database. It
+// must be called once every leaf has been imported, and returns an error if
+// the STH doesn't match the rebuilt tree or isn't signed by `pubKey`.
+func (im *Importer) StoreFrozenSTH(ctx context.Context, sth []byte, pubKey crypto.PublicKey) error {
+	var resp ctgo.GetSTHResponse
+	if err := json.Unmarshal(sth, &resp); err != nil {
+		return fmt.Errorf("failed to parse frozen sth: %v", err)
+	}
+	signed, err := resp.ToSignedTreeHead()
+	if err != nil {
+		return fmt.Errorf("failed to parse frozen sth: %v", err)
+	} else if int64(signed.TreeSize) != im.tree.Size() {
+		return fmt.Errorf("frozen sth has tree size %v, but %v leaves have been imported", signed.TreeSize, im.tree.Size())
+	} else if !bytes.Equal(signed.SHA256RootHash[:], im.front.Head()) {
+		return fmt.Errorf("frozen sth has root hash %x, but rebuilt tree has %x", signed.SHA256RootHash[:], im.front.Head())
+	}
+	verifier, err := ctgo.NewSignatureVerifier(pubKey)
+	if err != nil {
+		return err
+	} else if err := verifier.VerifySTHSignature(*signed); err != nil {
+		return fmt.Errorf("frozen sth has invalid signature: %v", err)
+	}
+
+	if err := im.ls.Local.PutFrozenSTH(im.treeID, sth); err != nil {
+		return fmt.Errorf("failed to store frozen sth: %v", err)
+	} else if err := im.ls.Remote.PutFrozenSTH(ctx, im.treeID, sth); err != nil {
+		return fmt.Errorf("failed to publish frozen sth: %v", err)
+	}
+	return nil
+}
+
+// AddIndex restores entries of the index by Merkle hash (if byMerkleHash is
+// true) or by identity hash (otherwise). AddLeaves already indexes every leaf,
+// but when a log has duplicate leaves it's arbitrary which one the index points
+// to, so the exported entries are restored as they were. Each entry must point
+// to an imported leaf with a matching hash.
+func (im *Importer) AddIndex(ctx context.Context, byMerkleHash bool, hashes [][]byte, seqs []int64) error {
+	if len(hashes) != len(seqs) {
+		return fmt.Errorf("different number of hashes and sequence numbers given")
+	}
+	lookup := im.ls.Local.GetSequenceByIdentityHash
+	if byMerkleHash {
+		lookup = im.ls.Local.GetSequenceByMerkleHash
+	}
+	current, err := lookup(im.treeID, hashes)
+	if err != nil {
+		return err
+	}
+
+	ltx := im.ls.Local.Begin()
+	for i, hash := range hashes {
+		if seqs[i] == current[i] {
+			continue
+		} else if seqs[i] < 0 || seqs[i] >= im.tree.Size() {
+			return fmt.Errorf("index entry for %x points to leaf %v, which wasn't imported", hash, seqs[i])
+		}
+
+		leaves, err := im.ls.Remote.GetLeaves(ctx, im.treeID, []int64{seqs[i]})
+		if err != nil {
+			return err
+		}
+		got := leaves[0].LeafIdentityHash
+		if byMerkleHash {
+			got = leaves[0].MerkleLeafHash
+		}
+		if !bytes.Equal(got, hash) {
+			return fmt.Errorf("index entry for %x points to leaf %v, which has hash %x", hash, seqs[i], got)
+		}
+		ltx.PutIndex(im.treeID, byMerkleHash, hash, seqs[i])
+	}
+
+	return ltx.Commit()
+}
@@ -0,0 +1,242 @@
+package ct
+
+import (
+	"testing"
+
+	"bytes"
+	"context"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"encoding/json"
+	"math"
+	"reflect"
+
+	"github.com/cloudflare/ct-log/custom/frontier"
+
+	ctgo "github.com/google/certificate-transparency-go"
+	"github.com/google/trillian"
+	"github.com/google/trillian/storage"
+	"github.com/google/trillian/types"
+)
+
+// importFrom imports every leaf and signed tree head of `src` with `im`. If
+// tamper is not nil, it is called on each leaf before it's imported.
+func importFrom(t *testing.T, src *testStorage, im *Importer, tamper func(*trillian.LogLeaf)) error {
+	ctx := context.Background()
+
+	sths, err := src.Local.ListRoots(testTreeID, 0, math.MaxInt64, 1000)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, sth := range sths {
+		var root types.LogRootV1
+		if err := root.UnmarshalBinary(sth.LogRoot); err != nil {
+			t.Fatal(err)
+		}
+		for im.Size() < int64(root.TreeSize) {
+			end := 1024 * (im.Size()/1024 + 1)
+			if end > int64(root.TreeSize) {
+				end = int64(root.TreeSize)
+			}
+			seqs := make([]int64, 0, end-im.Size())
+			for i := im.Size(); i < end; i++ {
+				seqs = append(seqs, i)
+			}
+			leaves, err := src.Remote.GetLeaves(ctx, testTreeID, seqs)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if tamper != nil {
+				for _, leaf := range leaves {
+					tamper(leaf)
+				}
+			}
+			if err := im.AddLeaves(ctx, leaves, int64(root.Revision)); err != nil {
+				return err
+			}
+		}
+		if err := im.StoreRoot(ctx, sth); err != nil {
+			return err
+		}
+	}
+
+	for _, byMerkleHash := range []bool{true, false} {
+		var (
+			hashes [][]byte
+			seqs   []int64
+		)
+		err := src.Local.ScanIndex(testTreeID, byMerkleHash, func(hash []byte, seq int64) error {
+			hashes, seqs = append(hashes, hash), append(seqs, seq)
+			return nil
+		})
+		if err != nil {
+			t.Fatal(err)
+		} else if err := im.AddIndex(ctx, byMerkleHash, hashes, seqs); err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+func TestImport(t *testing.T) {
+	ctx := context.Background()
+
+	src := newTestStorage(t)
+	defer src.close()
+	src.init(t)
+	src.queue(t, 0, 1500)
+	src.sequence(t, sClose)
+	src.queue(t, 1500, 2100)
+	src.sequence(t, sClose)
+
+	dst := newTestStorage(t)
+	defer dst.close()
+	im, err := dst.NewImporter(ctx, testTreeID)
+	if err != nil {
+		t.Fatal(err)
+	} else if err := importFrom(t, src, im, nil); err != nil {
+		t.Fatal(err)
+	}
+	dst.check(t, 2100)
+
+	srcRoot, srcFront, err := src.Local.MostRecentRoot(testTreeID)
+	if err != nil {
+		t.Fatal(err)
+	}
+	dstRoot, dstFront, err := dst.Local.MostRecentRoot(testTreeID)
+	if err != nil {
+		t.Fatal(err)
+	} else if !reflect.DeepEqual(srcRoot, dstRoot) {
+		t.Fatal("imported root doesn't match exported root")
+	} else if !reflect.DeepEqual(srcFront, dstFront) {
+		t.Fatal("imported frontier doesn't match exported frontier")
+	}
+
+	// The node covering the first 256 leaves is the root of an upper stratum's
+	// subtree, so it's only stored if the importer set internal nodes.
+	tx, err := dst.SnapshotForTree(ctx, &trillian.Tree{TreeId: testTreeID})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer tx.Close()
+	leaves, err := tx.GetLeavesByRange(ctx, 0, 256)
+	if err != nil {
+		t.Fatal(err)
+	}
+	var front frontier.Frontier
+	for _, leaf := range leaves {
+		front.Append(leaf.MerkleLeafHash)
+	}
+	id, err := storage.NewNodeIDForTreeCoords(8, 0, 64)
+	if err != nil {
+		t.Fatal(err)
+	}
+	nodes, err := tx.GetMerkleNodes(ctx, dstRoot.TreeRevision, []storage.NodeID{id})
+	if err != nil {
+		t.Fatal(err)
+	} else if len(nodes) != 1 || !bytes.Equal(nodes[0].Hash, front.Head()) {
+		t.Fatal("imported tree has wrong internal node")
+	}
+
+	// A second import into the same storage is refused.
+	if _, err := dst.NewImporter(ctx, testTreeID); err == nil {
+		t.Fatal("expected importing into a non-empty tree to fail")
+	}
+}
+
+func TestImportTampered(t *testing.T) {
+	ctx := context.Background()
+
+	src := newTestStorage(t)
+	defer src.close()
+	src.init(t)
+	src.queue(t, 0, 100)
+	src.sequence(t, sClose)
+
+	dst := newTestStorage(t)
+	defer dst.close()
+	im, err := dst.NewImporter(ctx, testTreeID)
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = importFrom(t, src, im, func(leaf *trillian.LogLeaf) {
+		if leaf.LeafIndex == 50 {
+			leaf.MerkleLeafHash[0] ^= 1
+		}
+	})
+	if err == nil {
+		t.Fatal("expected import of tampered leaves to fail")
+	}
+	// Only the empty tree's root was stored.
+	if root, _, err := dst.Local.MostRecentRoot(testTreeID); err != nil {
+		t.Fatal(err)
+	} else if root.TreeSize != 0 {
+		t.Fatalf("tampered tree has root with tree size %v", root.TreeSize)
+	}
+}
+
+func TestImportFrozen(t *testing.T) {
+	ctx := context.Background()
+
+	src := newTestStorage(t)
+	defer src.close()
+	src.init(t)
+	src.queue(t, 0, 100)
+	src.integrate(t)
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	} else if _, err := src.FreezeSTH(ctx, testTreeID, key); err != nil {
+		t.Fatal(err)
+	}
+	sth, err := src.Local.GetFrozenSTH(testTreeID)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	dst := newTestStorage(t)
+	defer dst.close()
+	im, err := dst.NewImporter(ctx, testTreeID)
+	if err != nil {
+		t.Fatal(err)
+	} else if err := importFrom(t, src, im, nil); err != nil {
+		t.Fatal(err)
+	}
+
+	// The frozen STH must be signed by the log's key, over the rebuilt tree.
+	other, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	} else if err := im.StoreFrozenSTH(ctx, sth, other.Public()); err == nil {
+		t.Fatal("expected frozen sth signed by another key to be refused")
+	}
+	var resp ctgo.GetSTHResponse
+	if err := json.Unmarshal(sth, &resp); err != nil {
+		t.Fatal(err)
+	}
+	resp.TreeSize--
+	tampered, err := json.Marshal(resp)
+	if err != nil {
+		t.Fatal(err)
+	} else if err := im.StoreFrozenSTH(ctx, tampered, key.Public()); err == nil {
+		t.Fatal("expected frozen sth with wrong tree size to be refused")
+	} else if stored, err := dst.GetFrozenSTH(testTreeID); err != nil || stored != nil {
+		t.Fatalf("refused frozen sth was stored: %v %v", stored, err)
+	}
+
+	if err := im.StoreFrozenSTH(ctx, sth, key.Public()); err != nil {
+		t.Fatal(err)
+	}
+	if stored, err := dst.Local.GetFrozenSTH(testTreeID); err != nil {
+		t.Fatal(err)
+	} else if !bytes.Equal(stored, sth) {
+		t.Fatal("imported frozen sth wasn't stored locally")
+	}
+	if published, err := dst.Remote.GetFrozenSTH(ctx, testTreeID); err != nil {
+		t.Fatal(err)
+	} else if !bytes.Equal(published, sth) {
+		t.Fatal("imported frozen sth wasn't published")
+	}
+}
@@ -2,7 +2,7 @@ package ct
 
 import (
 	"context"
-	"fmt"
+	"sync"
 	"time"
 
 	"github.com/cloudflare/ct-log/custom"
@@ -26,14 +26,37 @@ type LogStorage struct {
 	Remote *custom.Remote
 
 	AdminStorage storage.AdminStorage
+	// Observer, if set, is notified whenever leaves are queued or sequenced.
+	Observer QueueObserver
+	// Subtrees, if set, is a cache of subtrees shared by every transaction.
+	Subtrees *SubtreeCache
+
+	// sequencerRuns maps each tree's id to the time.Time that a sequencing run
+	// of it was last committed.
+	sequencerRuns sync.Map
 }
 
 var _ storage.LogStorage = &LogStorage{}
 
+// QueueObserver is notified of changes to the number of unsequenced leaves that
+// each tree has on disk, as soon as they're written.
+type QueueObserver interface {
+	// LeavesQueued is called after n leaves have been queued, or added to a
+	// pre-ordered log.
+	LeavesQueued(treeID int64, n int)
+	// LeavesSequenced is called after a sequencing run that integrated n
+	// leaves has been committed, and the tree has grown to treeSize leaves.
+	LeavesSequenced(treeID int64, n int, treeSize int64)
+}
+
 // CheckDatabaseAccessible returns nil if the database is accessible, error
-// otherwise.
+// otherwise. It makes a write and read round-trip to the local database, and
+// checks that the remote database is reachable.
 func (ls *LogStorage) CheckDatabaseAccessible(ctx context.Context) error {
-	return nil
+	if err := ls.Local.Ping(); err != nil {
+		return err
+	}
+	return ls.Remote.Ping(ctx)
 }
 
 // Snapshot starts a read-only transaction not tied to any particular tree.
@@ -42,8 +65,14 @@ func (ls *LogStorage) Snapshot(ctx context.Context) (storage.ReadOnlyLogTX, erro
 	if err != nil {
 		return nil, err
 	}
+	snap, err := ls.Local.Snapshot()
+	if err != nil {
+		tx.Close()
+		return nil, err
+	}
 
 	return &readOnlyLogTX{
+		snap:    snap,
 		adminTx: tx,
 		closed:  false,
 	}, nil
@@ -57,15 +86,22 @@ func (ls *LogStorage) SnapshotForTree(ctx context.Context, tree *trillian.Tree)
 	}
 	stCache := cache.NewLogSubtreeCache(defaultLogStrata, hasher)
 
-	root, front, err := ls.Local.MostRecentRoot(tree.TreeId)
+	snap, err := ls.Local.Snapshot()
+	if err != nil {
+		return nil, err
+	}
+	root, front, err := snap.MostRecentRoot(tree.TreeId)
 	if err != nil {
+		snap.Release()
 		return nil, err
 	}
 
 	return &readOnlyLogTreeTX{
 		local:        ls.Local,
+		snap:         snap,
 		remote:       ls.Remote,
 		subtreeCache: stCache,
+		subtrees:     ls.Subtrees,
 
 		treeID: tree.TreeId,
 		root:   root,
@@ -74,24 +110,32 @@ func (ls *LogStorage) SnapshotForTree(ctx context.Context, tree *trillian.Tree)
 	}, nil
 }
 
-// beginForTree starts a transaction for the specified treeID.
-func (ls *LogStorage) beginForTree(ctx context.Context, treeID int64) (storage.LogTreeTX, error) {
+// beginForTree starts a transaction for the specified tree.
+func (ls *LogStorage) beginForTree(ctx context.Context, tree *trillian.Tree) (storage.LogTreeTX, error) {
+	treeID := tree.TreeId
 	hasher, err := hashers.NewLogHasher(trillian.HashStrategy_RFC6962_SHA256)
 	if err != nil {
 		return nil, err
 	}
 	stCache := cache.NewLogSubtreeCache(defaultLogStrata, hasher)
 
-	root, front, err := ls.Local.MostRecentRoot(treeID)
+	snap, err := ls.Local.Snapshot()
+	if err != nil {
+		return nil, err
+	}
+	root, front, err := snap.MostRecentRoot(treeID)
 	if err != nil && err != storage.ErrTreeNeedsInit {
+		snap.Release()
 		return nil, err
 	}
 
 	return &logTreeTX{
 		readOnlyLogTreeTX: readOnlyLogTreeTX{
 			local:        ls.Local,
+			snap:         snap,
 			remote:       ls.Remote,
 			subtreeCache: stCache,
+			subtrees:     ls.Subtrees,
 
 			treeID: treeID,
 			root:   root,
@@ -100,14 +144,18 @@ func (ls *LogStorage) beginForTree(ctx context.Context, treeID int64) (storage.L
 		},
 		fsm: fsm{state: sBegin},
 
-		localTx: ls.Local.Begin(),
+		localTx:    ls.Local.Begin(),
+		preordered: tree.TreeType == trillian.TreeType_PREORDERED_LOG,
+		observer:   ls.Observer,
+
+		sequencerRuns: &ls.sequencerRuns,
 	}, nil
 }
 
 // ReadWriteTransaction starts a RW transaction on the underlying storage, and
 // calls f with it.
 func (ls *LogStorage) ReadWriteTransaction(ctx context.Context, tree *trillian.Tree, f storage.LogTXFunc) error {
-	ltx, err := ls.beginForTree(ctx, tree.TreeId)
+	ltx, err := ls.beginForTree(ctx, tree)
 	if err != nil {
 		return err
 	}
@@ -138,13 +186,16 @@ func (ls *LogStorage) QueueLeaves(ctx context.Context, tree *trillian.Tree, leav
 	}
 
 	out := make([]*trillian.QueuedLogLeaf, 0, len(leaves))
+	queued := 0
 	for i, leaf := range leaves {
 		dup, err := lt.queueLeaf(ctx, leaf, queueTimestamp)
 		if err != nil {
+			ls.leavesQueued(tree.TreeId, queued)
 			return nil, err
 		}
 
 		if dup == nil {
+			queued++
 			out = append(out, &trillian.QueuedLogLeaf{Leaf: leaves[i]})
 		} else {
 			out = append(out, &trillian.QueuedLogLeaf{
@@ -153,12 +204,66 @@ func (ls *LogStorage) QueueLeaves(ctx context.Context, tree *trillian.Tree, leav
 			})
 		}
 	}
+	ls.leavesQueued(tree.TreeId, queued)
 	return out, nil
 }
 
+// leavesQueued notifies the observer, if there is one, that n leaves were
+// queued.
+func (ls *LogStorage) leavesQueued(treeID int64, n int) {
+	if ls.Observer != nil && n > 0 {
+		ls.Observer.LeavesQueued(treeID, n)
+	}
+}
+
 // AddSequencedLeaves stores the `leaves` and associates them with the log
 // positions according to their `LeafIndex` field. The indices must be
 // contiguous.
 func (ls *LogStorage) AddSequencedLeaves(ctx context.Context, tree *trillian.Tree, leaves []*trillian.LogLeaf, ts time.Time) ([]*trillian.QueuedLogLeaf, error) {
-	return nil, fmt.Errorf("adding sequenced leaves is not implemented")
+	out, err := addSequencedLeaves(ls.Local, tree, leaves, ts)
+	if err != nil {
+		return nil, err
+	}
+	ls.leavesQueued(tree.TreeId, countOK(out))
+	return out, nil
+}
+
+func addSequencedLeaves(local *custom.Local, tree *trillian.Tree, leaves []*trillian.LogLeaf, ts time.Time) ([]*trillian.QueuedLogLeaf, error) {
+	if tree.TreeType != trillian.TreeType_PREORDERED_LOG {
+		return nil, status.Errorf(codes.FailedPrecondition, "tree %v is not a pre-ordered log", tree.TreeId)
+	}
+
+	conflicts, err := local.AddSequencedLeaves(tree.TreeId, ts.UnixNano(), leaves)
+	if err == custom.ErrLeafGap {
+		return nil, status.Errorf(codes.FailedPrecondition, "leaf index %v: %v", leaves[0].LeafIndex, err)
+	} else if err != nil {
+		return nil, err
+	}
+
+	out := make([]*trillian.QueuedLogLeaf, 0, len(leaves))
+	for i, leaf := range leaves {
+		if conflicts[i] {
+			out = append(out, &trillian.QueuedLogLeaf{
+				Leaf:   leaf,
+				Status: status.Newf(codes.FailedPrecondition, "conflicting LeafIndex: %v", leaf.LeafIndex).Proto(),
+			})
+		} else {
+			out = append(out, &trillian.QueuedLogLeaf{
+				Leaf:   leaf,
+				Status: status.New(codes.OK, "OK").Proto(),
+			})
+		}
+	}
+	return out, nil
+}
+
+// countOK returns the number of leaves that were stored without error.
+func countOK(leaves []*trillian.QueuedLogLeaf) int {
+	n := 0
+	for _, leaf := range leaves {
+		if codes.Code(leaf.Status.GetCode()) == codes.OK {
+			n++
+		}
+	}
+	return n
 }
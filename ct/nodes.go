@@ -0,0 +1,175 @@
+package ct
+
+import (
+	"bytes"
+	"context"
+	"encoding/binary"
+	"fmt"
+	"log"
+
+	"github.com/cloudflare/ct-log/custom"
+
+	"github.com/google/trillian"
+	"github.com/google/trillian/merkle/hashers"
+	"github.com/google/trillian/storage"
+	"github.com/google/trillian/storage/cache"
+	"github.com/google/trillian/storage/storagepb"
+)
+
+// backfillBatchSize is the number of leaves whose nodes are backfilled at once.
+const backfillBatchSize = 4096
+
+// nodeCoord returns the coordinates of a node of a log tree, or false if the
+// node ID isn't one.
+func nodeCoord(id storage.NodeID) (custom.NodeCoord, bool) {
+	if len(id.Path) != 8 || id.PrefixLenBits < 1 || id.PrefixLenBits > 64 {
+		return custom.NodeCoord{}, false
+	}
+	level := 64 - id.PrefixLenBits
+	index := binary.BigEndian.Uint64(id.Path) >> uint(level)
+	return custom.NodeCoord{Level: level, Index: int64(index)}, true
+}
+
+// getCompletedNodes returns the hashes of the nodes that are completed in the
+// transaction's root, and stored by level and index. Other nodes are returned
+// as nil.
+func (rolt *readOnlyLogTreeTX) getCompletedNodes(ids []storage.NodeID) ([][]byte, error) {
+	coords := make([]custom.NodeCoord, 0, len(ids))
+	pos := make([]int, 0, len(ids))
+	for i, id := range ids {
+		if nc, ok := nodeCoord(id); ok && nc.Completed(rolt.root.TreeSize) {
+			coords = append(coords, nc)
+			pos = append(pos, i)
+		}
+	}
+	found, err := rolt.snap.GetCompletedNodes(rolt.treeID, coords)
+	if err != nil {
+		return nil, err
+	}
+	hashes := make([][]byte, len(ids))
+	for i, hash := range found {
+		hashes[pos[i]] = hash
+	}
+	return hashes, nil
+}
+
+// completedNodes returns the coordinates and hashes of the nodes set by the
+// transaction that are completed in a tree of size treeSize.
+func (lt *logTreeTX) completedNodes(treeSize int64) ([]custom.NodeCoord, [][]byte) {
+	coords := make([]custom.NodeCoord, 0, len(lt.setNodes))
+	hashes := make([][]byte, 0, len(lt.setNodes))
+	for _, n := range lt.setNodes {
+		if nc, ok := nodeCoord(n.NodeID); ok && nc.Completed(treeSize) {
+			coords = append(coords, nc)
+			hashes = append(hashes, n.Hash)
+		}
+	}
+	return coords, hashes
+}
+
+// BackfillCompletedNodes stores every node that is completed in the current
+// root of the tree with the given treeID, for trees that were sequenced before
+// completed nodes were stored. The nodes are recomputed from the leaf hashes in
+// the current revision's subtrees, and the result is checked against the root
+// hash. It's safe to run while the log is serving, and does nothing if the tree
+// has already been backfilled.
+func (ls *LogStorage) BackfillCompletedNodes(ctx context.Context, treeID int64) error {
+	if _, ok, err := ls.Local.NodesBackfilled(treeID); err != nil {
+		return err
+	} else if ok {
+		return nil
+	}
+	hasher, err := hashers.NewLogHasher(trillian.HashStrategy_RFC6962_SHA256)
+	if err != nil {
+		return err
+	}
+
+	tx, err := ls.SnapshotForTree(ctx, &trillian.Tree{TreeId: treeID})
+	if err == storage.ErrTreeNeedsInit {
+		return nil
+	} else if err != nil {
+		return err
+	}
+	defer tx.Close()
+	rolt := tx.(*readOnlyLogTreeTX)
+	size, rev := rolt.root.TreeSize, rolt.root.TreeRevision
+	log.Printf("backfilling completed nodes: treeID=%v: tree size %v", treeID, size)
+
+	// stack holds the completed nodes on the right edge of the tree so far,
+	// from the largest to the smallest, like a frontier.
+	type node struct {
+		nc   custom.NodeCoord
+		hash []byte
+	}
+	stack := make([]node, 0, 64)
+
+	for start := int64(0); start < size; start += backfillBatchSize {
+		if err := ctx.Err(); err != nil {
+			return err
+		}
+		end := start + backfillBatchSize
+		if end > size {
+			end = size
+		}
+
+		// Read the leaf hashes with a fresh subtree cache, so that the cache
+		// doesn't grow with the tree. The subtrees are read from disk rather
+		// than through the shared cache, which would otherwise be filled with
+		// every bottom subtree and evict the ones that serve proofs.
+		ids := make([]storage.NodeID, 0, end-start)
+		for idx := start; idx < end; idx++ {
+			id, err := storage.NewNodeIDForTreeCoords(0, idx, 64)
+			if err != nil {
+				return err
+			}
+			ids = append(ids, id)
+		}
+		stCache := cache.NewLogSubtreeCache(defaultLogStrata, hasher)
+		leaves, err := stCache.GetNodes(ids, func(ids []storage.NodeID) ([]*storagepb.SubtreeProto, error) {
+			return rolt.snap.GetSubtrees(treeID, rev, ids)
+		})
+		if err != nil {
+			return err
+		} else if len(leaves) != len(ids) {
+			return fmt.Errorf("got %v leaf hashes in [%v, %v), wanted %v", len(leaves), start, end, len(ids))
+		}
+
+		coords := make([]custom.NodeCoord, 0, 2*len(leaves))
+		hashes := make([][]byte, 0, 2*len(leaves))
+		for i, leaf := range leaves {
+			n := node{custom.NodeCoord{Level: 0, Index: start + int64(i)}, leaf.Hash}
+			coords, hashes = append(coords, n.nc), append(hashes, n.hash)
+
+			for len(stack) > 0 && stack[len(stack)-1].nc.Level == n.nc.Level {
+				left := stack[len(stack)-1]
+				stack = stack[:len(stack)-1]
+				n = node{
+					custom.NodeCoord{Level: n.nc.Level + 1, Index: n.nc.Index / 2},
+					hasher.HashChildren(left.hash, n.hash),
+				}
+				coords, hashes = append(coords, n.nc), append(hashes, n.hash)
+			}
+			stack = append(stack, n)
+		}
+		if err := ls.Local.PutCompletedNodes(treeID, coords, hashes); err != nil {
+			return err
+		}
+	}
+
+	// The root is the hash of the nodes left on the stack, from right to left.
+	root := hasher.EmptyRoot()
+	if len(stack) > 0 {
+		root = stack[len(stack)-1].hash
+		for i := len(stack) - 2; i >= 0; i-- {
+			root = hasher.HashChildren(stack[i].hash, root)
+		}
+	}
+	if !bytes.Equal(root, rolt.root.RootHash) {
+		return fmt.Errorf("backfilled nodes have root hash %x, but tree has %x", root, rolt.root.RootHash)
+	}
+	if err := ls.Local.SetNodesBackfilled(treeID, size); err != nil {
+		return err
+	}
+	log.Printf("backfilled completed nodes: treeID=%v: tree size %v", treeID, size)
+	return nil
+}
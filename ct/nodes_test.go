@@ -0,0 +1,269 @@
+package ct
+
+import (
+	"testing"
+
+	"bytes"
+	"context"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+
+	"github.com/google/trillian"
+	tcrypto "github.com/google/trillian/crypto"
+	tlog "github.com/google/trillian/log"
+	"github.com/google/trillian/merkle"
+	"github.com/google/trillian/merkle/hashers"
+	"github.com/google/trillian/monitoring"
+	"github.com/google/trillian/quota"
+	"github.com/google/trillian/storage"
+	"github.com/google/trillian/storage/cache"
+	"github.com/google/trillian/util"
+	"github.com/prometheus/client_golang/prometheus/testutil"
+)
+
+func testHasher(t testing.TB) hashers.LogHasher {
+	hasher, err := hashers.NewLogHasher(trillian.HashStrategy_RFC6962_SHA256)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return hasher
+}
+
+// integrate runs Trillian's sequencer over the queued leaves. Unlike
+// ts.sequence, it sets every node that's completed, not just the leaves.
+func (ts *testStorage) integrate(t testing.TB) {
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	sequencer := tlog.NewSequencer(testHasher(t), util.SystemTimeSource{}, ts.LogStorage, tcrypto.NewSHA256Signer(key), monitoring.InertMetricFactory{}, quota.Noop())
+	tree := &trillian.Tree{TreeId: testTreeID, TreeType: trillian.TreeType_LOG}
+	if _, err := sequencer.IntegrateBatch(context.Background(), tree, 100000, 0, 0); err != nil {
+		t.Fatal(err)
+	}
+}
+
+// sequencedLeafHashes returns the Merkle hashes of the first `size` leaves of
+// the tree. Leaves queued at the same time are sequenced in any order, so they
+// have to be read back.
+func (ts *testStorage) sequencedLeafHashes(t testing.TB, size int64) [][]byte {
+	indexes := make([]int64, 0, size)
+	for idx := int64(0); idx < size; idx++ {
+		indexes = append(indexes, idx)
+	}
+	leaves, err := ts.Remote.GetLeaves(context.Background(), testTreeID, indexes)
+	if err != nil {
+		t.Fatal(err)
+	}
+	hashes := make([][]byte, 0, len(leaves))
+	for _, leaf := range leaves {
+		hashes = append(hashes, leaf.MerkleLeafHash)
+	}
+	return hashes
+}
+
+// merkleRoot computes the root hash of a tree with the given leaf hashes
+// directly, as in RFC 6962.
+func merkleRoot(hasher hashers.LogHasher, hashes [][]byte) []byte {
+	if len(hashes) == 0 {
+		return hasher.EmptyRoot()
+	} else if len(hashes) == 1 {
+		return hashes[0]
+	}
+	k := 1
+	for k<<1 < len(hashes) {
+		k <<= 1
+	}
+	return hasher.HashChildren(merkleRoot(hasher, hashes[:k]), merkleRoot(hasher, hashes[k:]))
+}
+
+// buildProof turns the nodes fetched for a proof into the proof, rehashing the
+// nodes that need it like Trillian's log server does.
+func buildProof(hasher hashers.LogHasher, fetches []merkle.NodeFetch, nodes []storage.Node) [][]byte {
+	proof := make([][]byte, 0, len(nodes))
+	var rehashed []byte
+	for i, node := range nodes {
+		if fetches[i].Rehash {
+			if rehashed == nil {
+				rehashed = node.Hash
+			} else {
+				rehashed = hasher.HashChildren(node.Hash, rehashed)
+			}
+			continue
+		} else if rehashed != nil {
+			proof = append(proof, rehashed)
+			rehashed = nil
+		}
+		proof = append(proof, node.Hash)
+	}
+	if rehashed != nil {
+		proof = append(proof, rehashed)
+	}
+	return proof
+}
+
+func fetchIDs(fetches []merkle.NodeFetch) []storage.NodeID {
+	ids := make([]storage.NodeID, 0, len(fetches))
+	for _, f := range fetches {
+		ids = append(ids, f.NodeID)
+	}
+	return ids
+}
+
+func TestCompletedNodes(t *testing.T) {
+	ts := newTestStorage(t)
+	defer ts.close()
+	ts.init(t)
+	ctx := context.Background()
+	hasher := testHasher(t)
+
+	for _, r := range [][2]int{{0, 5}, {5, 13}, {13, 32}, {32, 37}} {
+		ts.queue(t, r[0], r[1])
+		ts.sequence(t, sClose)
+	}
+	// Check every completed node against the hash computed from the leaves.
+	// Before backfilling, only the leaf hashes are stored, because they're the
+	// only nodes that the tests' sequencing runs set.
+	checkNodes := func(size, maxLevel int64) {
+		t.Helper()
+		leafHashes := ts.sequencedLeafHashes(t, size)
+		tx, err := ts.SnapshotForTree(ctx, &trillian.Tree{TreeId: testTreeID})
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer tx.Close()
+		rolt := tx.(*readOnlyLogTreeTX)
+
+		for level := int64(0); 1<<uint(level) <= size; level++ {
+			for idx := int64(0); (idx+1)<<uint(level) <= size; idx++ {
+				id, err := storage.NewNodeIDForTreeCoords(level, idx, 64)
+				if err != nil {
+					t.Fatal(err)
+				}
+				hashes, err := rolt.getCompletedNodes([]storage.NodeID{id})
+				if err != nil {
+					t.Fatal(err)
+				}
+				want := merkleRoot(hasher, leafHashes[idx<<uint(level):(idx+1)<<uint(level)])
+				if level > maxLevel && hashes[0] != nil {
+					t.Fatalf("node %v is stored, but shouldn't be", id.CoordString())
+				} else if level <= maxLevel && !bytes.Equal(hashes[0], want) {
+					t.Fatalf("node %v has hash %x, wanted %x", id.CoordString(), hashes[0], want)
+				}
+			}
+		}
+	}
+	checkNodes(37, 0)
+	// The backfill doesn't read through the shared subtree cache.
+	ts.Subtrees = NewSubtreeCache(64)
+	if err := ts.BackfillCompletedNodes(ctx, testTreeID); err != nil {
+		t.Fatal(err)
+	} else if size, ok, err := ts.Local.NodesBackfilled(testTreeID); err != nil || !ok || size != 37 {
+		t.Fatalf("got backfill marker %v %v %v, wanted 37", size, ok, err)
+	}
+	for _, result := range []string{"hit", "miss"} {
+		if got := testutil.ToFloat64(ts.Subtrees.Requests.WithLabelValues(result)); got != 0 {
+			t.Fatalf("backfill made %v subtree cache requests with result %v", got, result)
+		}
+	}
+	ts.Subtrees = nil
+	checkNodes(37, 64)
+
+	// Trillian's sequencer sets every completed node as the tree grows.
+	ts.queue(t, 37, 70)
+	ts.integrate(t)
+	checkNodes(70, 64)
+	leafHashes := ts.sequencedLeafHashes(t, 70)
+
+	// Proofs at old tree sizes only need completed nodes, so they're answered
+	// at any revision; proofs at the current size need the current revision.
+	tx, err := ts.SnapshotForTree(ctx, &trillian.Tree{TreeId: testTreeID})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer tx.Close()
+	rev := tx.(*readOnlyLogTreeTX).root.TreeRevision
+	verifier := merkle.NewLogVerifier(hasher)
+	for _, c := range []struct{ size, index int64 }{{13, 7}, {32, 31}, {37, 36}, {5, 0}, {70, 40}} {
+		fetches, err := merkle.CalcInclusionProofNodeAddresses(c.size, c.index, 70, 64)
+		if err != nil {
+			t.Fatal(err)
+		}
+		treeRevision := int64(0)
+		if c.size == 70 {
+			treeRevision = rev
+		}
+		nodes, err := tx.GetMerkleNodes(ctx, treeRevision, fetchIDs(fetches))
+		if err != nil {
+			t.Fatal(err)
+		} else if len(nodes) != len(fetches) {
+			t.Fatalf("inclusion proof of %v at tree size %v: got %v nodes, wanted %v", c.index, c.size, len(nodes), len(fetches))
+		}
+		proof := buildProof(hasher, fetches, nodes)
+		root := merkleRoot(hasher, leafHashes[:c.size])
+		if err := verifier.VerifyInclusionProof(c.index, c.size, proof, root, leafHashes[c.index]); err != nil {
+			t.Fatalf("inclusion proof of %v at tree size %v: %v", c.index, c.size, err)
+		}
+	}
+	fetches, err := merkle.CalcConsistencyProofNodeAddresses(5, 13, 70, 64)
+	if err != nil {
+		t.Fatal(err)
+	}
+	nodes, err := tx.GetMerkleNodes(ctx, 0, fetchIDs(fetches))
+	if err != nil {
+		t.Fatal(err)
+	}
+	proof := buildProof(hasher, fetches, nodes)
+	if err := verifier.VerifyConsistencyProof(5, 13, merkleRoot(hasher, leafHashes[:5]), merkleRoot(hasher, leafHashes[:13]), proof); err != nil {
+		t.Fatalf("consistency proof: %v", err)
+	}
+}
+
+// BenchmarkGetMerkleNodes compares reading the nodes of an inclusion proof at an
+// old tree size from the store of completed nodes, with reading them from the
+// subtrees.
+func BenchmarkGetMerkleNodes(b *testing.B) {
+	ts := newTestStorage(b)
+	defer ts.close()
+	ts.init(b)
+	ctx := context.Background()
+	hasher := testHasher(b)
+
+	for end := 1024; end <= 16384; end += 1024 {
+		ts.queue(b, end-1024, end)
+		ts.integrate(b)
+	}
+	fetches, err := merkle.CalcInclusionProofNodeAddresses(4096, 1234, 16384, 64)
+	if err != nil {
+		b.Fatal(err)
+	}
+	ids := fetchIDs(fetches)
+
+	run := func(b *testing.B, get func(rolt *readOnlyLogTreeTX) ([]storage.Node, error)) {
+		for i := 0; i < b.N; i++ {
+			tx, err := ts.SnapshotForTree(ctx, &trillian.Tree{TreeId: testTreeID})
+			if err != nil {
+				b.Fatal(err)
+			}
+			nodes, err := get(tx.(*readOnlyLogTreeTX))
+			if err != nil {
+				b.Fatal(err)
+			} else if len(nodes) != len(ids) {
+				b.Fatalf("got %v nodes, wanted %v", len(nodes), len(ids))
+			}
+			tx.Close()
+		}
+	}
+	b.Run("completed", func(b *testing.B) {
+		run(b, func(rolt *readOnlyLogTreeTX) ([]storage.Node, error) {
+			return rolt.GetMerkleNodes(ctx, rolt.root.TreeRevision, ids)
+		})
+	})
+	b.Run("subtrees", func(b *testing.B) {
+		run(b, func(rolt *readOnlyLogTreeTX) ([]storage.Node, error) {
+			stCache := cache.NewLogSubtreeCache(defaultLogStrata, hasher)
+			return stCache.GetNodes(ids, rolt.getSubtreesAtRev(ctx, rolt.root.TreeRevision))
+		})
+	})
+}
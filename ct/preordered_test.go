@@ -0,0 +1,118 @@
+package ct
+
+import (
+	"context"
+	"testing"
+	"time"
+
+	"github.com/google/trillian"
+	"github.com/google/trillian/storage"
+	"google.golang.org/grpc/codes"
+)
+
+var preorderedTree = &trillian.Tree{TreeId: testTreeID, TreeType: trillian.TreeType_PREORDERED_LOG}
+
+func (ts *testStorage) addSequenced(t *testing.T, start, end int) []codes.Code {
+	leaves := testLeaves(t, start, end)
+	for i, leaf := range leaves {
+		leaf.LeafIndex = int64(start + i)
+	}
+	res, err := ts.AddSequencedLeaves(context.Background(), preorderedTree, leaves, time.Now())
+	if err != nil {
+		t.Fatal(err)
+	}
+	out := make([]codes.Code, 0, len(res))
+	for _, r := range res {
+		out = append(out, codes.Code(r.Status.Code))
+	}
+	return out
+}
+
+// sequencePreordered runs one sequencing transaction like Trillian's sequencer
+// would for a pre-ordered log, and returns the number of leaves integrated.
+func (ts *testStorage) sequencePreordered(t *testing.T) int {
+	ctx := context.Background()
+
+	tx, err := ts.beginForTree(ctx, preorderedTree)
+	if err != nil {
+		t.Fatal(err)
+	}
+	lt := tx.(*logTreeTX)
+
+	leaves, err := lt.DequeueLeaves(ctx, 10000, time.Now())
+	if err != nil {
+		t.Fatal(err)
+	}
+	nodes := make([]storage.Node, 0, len(leaves))
+	for i, leaf := range leaves {
+		if leaf.LeafIndex != lt.root.TreeSize+int64(i) {
+			t.Fatalf("dequeued leaf has index %v, wanted %v", leaf.LeafIndex, lt.root.TreeSize+int64(i))
+		}
+		id, err := storage.NewNodeIDForTreeCoords(0, leaf.LeafIndex, 64)
+		if err != nil {
+			t.Fatal(err)
+		}
+		nodes = append(nodes, storage.Node{NodeID: id, Hash: leaf.MerkleLeafHash})
+	}
+	if err := lt.SetMerkleNodes(ctx, nodes); err != nil {
+		t.Fatal(err)
+	} else if err := storeRoot(ctx, lt, lt.root.TreeSize+int64(len(leaves)), time.Now()); err != nil {
+		t.Fatal(err)
+	} else if err := lt.Commit(); err != nil {
+		t.Fatal(err)
+	} else if err := lt.Close(); err != nil {
+		t.Fatal(err)
+	}
+	return len(leaves)
+}
+
+func TestAddSequencedLeaves(t *testing.T) {
+	ts := newTestStorage(t)
+	defer ts.close()
+	ts.init(t)
+
+	for _, code := range ts.addSequenced(t, 0, 100) {
+		if code != codes.OK {
+			t.Fatalf("unexpected status adding leaves: %v", code)
+		}
+	}
+
+	// Leaves that are already pending conflict, but new ones don't.
+	for i, code := range ts.addSequenced(t, 90, 110) {
+		want := codes.FailedPrecondition
+		if i >= 10 {
+			want = codes.OK
+		}
+		if code != want {
+			t.Fatalf("leaf %v: got status %v, wanted %v", 90+i, code, want)
+		}
+	}
+
+	// Leaves that would leave a gap are rejected.
+	leaves := testLeaves(t, 120, 121)
+	leaves[0].LeafIndex = 120
+	if _, err := ts.AddSequencedLeaves(context.Background(), preorderedTree, leaves, time.Now()); err == nil {
+		t.Fatal("expected leaves after a gap to be rejected")
+	}
+	// So are leaves for a tree that isn't pre-ordered.
+	if _, err := ts.AddSequencedLeaves(context.Background(), &trillian.Tree{TreeId: testTreeID}, leaves, time.Now()); err == nil {
+		t.Fatal("expected leaves for a normal log to be rejected")
+	}
+
+	if n := ts.sequencePreordered(t); n != 110 {
+		t.Fatalf("sequenced %v leaves, wanted 110", n)
+	}
+	ts.check(t, 110)
+
+	// Integrated leaves conflict too.
+	for _, code := range ts.addSequenced(t, 100, 110) {
+		if code != codes.FailedPrecondition {
+			t.Fatalf("unexpected status re-adding integrated leaves: %v", code)
+		}
+	}
+	ts.addSequenced(t, 110, 1100)
+	if n := ts.sequencePreordered(t); n != 990 {
+		t.Fatalf("sequenced %v leaves, wanted 990", n)
+	}
+	ts.check(t, 1100)
+}
@@ -3,12 +3,13 @@ package ct
 import (
 	"context"
 	"fmt"
-	"log"
+	"strings"
 	"sync"
 	"time"
 
 	"github.com/cloudflare/ct-log/custom"
 
+	"github.com/google/certificate-transparency-go/trillian/ctfe"
 	"github.com/google/trillian/quota"
 	"github.com/google/trillian/storage"
 	"github.com/prometheus/client_golang/prometheus"
@@ -16,17 +17,41 @@ import (
 
 // QuotaManager is the mechanism which provides backpressure from the signer to
 // the servers, when leaves are being queued faster than they're being
-// sequenced.
+// sequenced. It also limits how fast each submitter can add leaves, if rate
+// limits are set.
+//
+// It must be set as the LogStorage's Observer to learn about leaves as they're
+// queued and sequenced.
 type QuotaManager struct {
 	maxUnsequencedLeaves int64
 
-	unsequenced map[int64]int64
-	mu          sync.Mutex
+	local *custom.Local
+	// unsequenced is the number of unsequenced leaves that each watched tree
+	// has on disk. reserved is the number of tokens that have been acquired
+	// for leaves that haven't been queued or given back yet.
+	unsequenced, reserved map[int64]int64
+	// frozen is the set of trees that aren't accepting new leaves.
+	frozen map[int64]bool
+	// watches is the generation of the current watch of each tree, so that a
+	// cancelled watch doesn't stop a newer one of the same tree.
+	watches    map[int64]uint64
+	generation uint64
+	// clients and issuers are the token buckets of users identified by their
+	// IP address and by an intermediate in their chain, respectively. They're
+	// nil if there's no limit.
+	clients, issuers *userBuckets
+	// rejected counts the requests of each submitter that were rejected by
+	// its rate limit.
+	rejected *rejections
+	now      func() time.Time
+	mu       sync.Mutex
 
 	TreeSize, UnsequencedLeaves *prometheus.GaugeVec
+	RateLimited                 *prometheus.CounterVec
 }
 
 var _ quota.Manager = &QuotaManager{}
+var _ QueueObserver = &QuotaManager{}
 
 func NewQuotaManager(maxUnsequencedLeaves int64) *QuotaManager {
 	treeSizeGauge := prometheus.NewGaugeVec(prometheus.GaugeOpts{
@@ -37,50 +62,166 @@ func NewQuotaManager(maxUnsequencedLeaves int64) *QuotaManager {
 		Name: "unsequenced_leaves",
 		Help: "The number of unsequenced leaves in a log.",
 	}, []string{"tree"})
+	rateLimitedCounter := prometheus.NewCounterVec(prometheus.CounterOpts{
+		Name: "rate_limited_requests",
+		Help: "The number of requests rejected because a submitter was over its rate limit.",
+	}, []string{"kind"})
 
 	return &QuotaManager{
 		maxUnsequencedLeaves: maxUnsequencedLeaves,
 
 		unsequenced: make(map[int64]int64),
+		reserved:    make(map[int64]int64),
+		frozen:      make(map[int64]bool),
+		watches:     make(map[int64]uint64),
+		rejected:    newRejections(),
+		now:         time.Now,
 
 		TreeSize:          treeSizeGauge,
 		UnsequencedLeaves: unsequencedLeavesGauge,
+		RateLimited:       rateLimitedCounter,
 	}
 }
 
-// WatchLog spawns a goroutine to keep track of the number of unsequenced leaves
-// in the log with the given treeID.
-func (qm *QuotaManager) WatchLog(local *custom.Local, treeID int64) {
+// SetMaxUnsequencedLeaves sets the max number of unsequenced leaves that each
+// log can have before submissions are refused.
+func (qm *QuotaManager) SetMaxUnsequencedLeaves(maxUnsequencedLeaves int64) {
 	qm.mu.Lock()
-	qm.unsequenced[treeID] = 0
-	qm.mu.Unlock()
+	defer qm.mu.Unlock()
+	qm.maxUnsequencedLeaves = maxUnsequencedLeaves
+}
+
+// SetFrozen sets whether the log with the given treeID is refusing new leaves,
+// because it's being frozen or has been.
+func (qm *QuotaManager) SetFrozen(treeID int64, frozen bool) {
+	qm.mu.Lock()
+	defer qm.mu.Unlock()
+	if frozen {
+		qm.frozen[treeID] = true
+	} else {
+		delete(qm.frozen, treeID)
+	}
+}
+
+// SetRateLimits sets the limits on how fast each submitter can add leaves.
+// Submitters are either clients, or issuing intermediates. A zero Capacity
+// means there's no limit for that kind of submitter.
+func (qm *QuotaManager) SetRateLimits(client, issuer RateLimit) {
+	qm.mu.Lock()
+	defer qm.mu.Unlock()
+
+	qm.clients, qm.issuers = nil, nil
+	if client.Capacity > 0 {
+		qm.clients = newUserBuckets("client", client)
+	}
+	if issuer.Capacity > 0 {
+		qm.issuers = newUserBuckets("issuer", issuer)
+	}
+}
+
+// RateLimitedUsers returns up to n of the submitters that had the most
+// requests rejected by their rate limit, most rejected first.
+func (qm *QuotaManager) RateLimitedUsers(n int) []RateLimitedUser {
+	qm.mu.Lock()
+	defer qm.mu.Unlock()
+	return qm.rejected.top(n)
+}
+
+// userBuckets returns the token buckets that a spec is limited by, or nil if
+// it isn't rate limited.
+func (qm *QuotaManager) userBuckets(spec quota.Spec) *userBuckets {
+	if spec.Group != quota.User || spec.Kind != quota.Write {
+		return nil
+	} else if strings.HasPrefix(spec.User, ctfe.CertificateQuotaUserPrefix) {
+		return qm.issuers
+	}
+	return qm.clients
+}
+
+// WatchLog starts keeping track of the number of unsequenced leaves in the
+// log with the given treeID, by counting the leaves it has on disk. The count
+// is then kept up to date by the LogStorage, until ctx is cancelled.
+func (qm *QuotaManager) WatchLog(ctx context.Context, local *custom.Local, treeID int64) error {
+	var treeSize int64
+	if root, _, err := local.MostRecentRoot(treeID); err == nil {
+		treeSize = root.TreeSize
+	} else if err != storage.ErrTreeNeedsInit {
+		return fmt.Errorf("error getting the most recent STH: treeID=%v: %v", treeID, err)
+	}
+
+	// The observer is notified after leaves are written, so the count isn't
+	// sequenced with its updates. Logs are watched before their handlers are
+	// set up, so no leaves are being queued, but leaves sequenced just before
+	// the count is taken may be subtracted from it again, leaving it too low
+	// until the queue is empty.
+	qm.mu.Lock()
+	defer qm.mu.Unlock()
+	count, err := local.Unsequenced(treeID)
+	if err != nil {
+		return fmt.Errorf("error getting the unsequenced count: treeID=%v: %v", treeID, err)
+	}
+	qm.generation++
+	gen := qm.generation
+	qm.watches[treeID] = gen
+	qm.local = local
+	qm.unsequenced[treeID] = int64(count)
+	qm.reserved[treeID] = 0
+	qm.TreeSize.WithLabelValues(fmt.Sprint(treeID)).Set(float64(treeSize))
+	qm.UnsequencedLeaves.WithLabelValues(fmt.Sprint(treeID)).Set(float64(count))
 
-	// Spawn a goroutine to update the unsequenced count every so often.
 	go func() {
-		for {
-			time.Sleep(10 * time.Second)
-
-			sth, _, err := local.MostRecentRoot(treeID)
-			if err == storage.ErrTreeNeedsInit {
-				continue
-			} else if err != nil {
-				log.Printf("error getting the most recent STH: treeID=%v: %v", treeID, err)
-				continue
-			}
-			count, err := local.Unsequenced(treeID)
-			if err != nil {
-				log.Printf("error getting the unsequenced count: treeID=%v: %v", treeID, err)
-				continue
-			}
-
-			qm.TreeSize.WithLabelValues(fmt.Sprint(treeID)).Set(float64(sth.TreeSize))
-			qm.UnsequencedLeaves.WithLabelValues(fmt.Sprint(treeID)).Set(float64(count))
-
-			qm.mu.Lock()
-			qm.unsequenced[treeID] = int64(count)
-			qm.mu.Unlock()
+		<-ctx.Done()
+
+		qm.mu.Lock()
+		defer qm.mu.Unlock()
+		if qm.watches[treeID] != gen {
+			return
 		}
+		delete(qm.watches, treeID)
+		delete(qm.unsequenced, treeID)
+		delete(qm.reserved, treeID)
+		qm.TreeSize.DeleteLabelValues(fmt.Sprint(treeID))
+		qm.UnsequencedLeaves.DeleteLabelValues(fmt.Sprint(treeID))
 	}()
+	return nil
+}
+
+// LeavesQueued implements QueueObserver. The queued leaves are no longer
+// reserved, because their tokens were acquired before they were queued.
+func (qm *QuotaManager) LeavesQueued(treeID int64, n int) {
+	qm.mu.Lock()
+	defer qm.mu.Unlock()
+
+	count, ok := qm.unsequenced[treeID]
+	if !ok {
+		return
+	}
+	count += int64(n)
+	qm.unsequenced[treeID] = count
+	qm.reserved[treeID] = max64(qm.reserved[treeID]-int64(n), 0)
+	qm.UnsequencedLeaves.WithLabelValues(fmt.Sprint(treeID)).Set(float64(count))
+}
+
+// LeavesSequenced implements QueueObserver.
+func (qm *QuotaManager) LeavesSequenced(treeID int64, n int, treeSize int64) {
+	qm.mu.Lock()
+	defer qm.mu.Unlock()
+
+	count, ok := qm.unsequenced[treeID]
+	if !ok {
+		return
+	}
+	count = max64(count-int64(n), 0)
+	qm.unsequenced[treeID] = count
+	qm.TreeSize.WithLabelValues(fmt.Sprint(treeID)).Set(float64(treeSize))
+	qm.UnsequencedLeaves.WithLabelValues(fmt.Sprint(treeID)).Set(float64(count))
+}
+
+func max64(a, b int64) int64 {
+	if a > b {
+		return a
+	}
+	return b
 }
 
 // GetUser returns the quota user, as defined by the manager implementation. req
@@ -91,42 +232,84 @@ func (qm *QuotaManager) GetUser(ctx context.Context, req interface{}) string {
 
 // GetTokens acquires numTokens from all specs. Tokens are taken in the order
 // specified by specs. Returns error if numTokens could not be acquired for all
-// specs.
+// specs, in which case none are acquired.
 func (qm *QuotaManager) GetTokens(ctx context.Context, numTokens int, specs []quota.Spec) error {
 	qm.mu.Lock()
 	defer qm.mu.Unlock()
 
+	now := qm.now()
 	for _, spec := range specs {
-		if err := qm.getTokens(ctx, numTokens, spec); err != nil {
+		if err := qm.checkTokens(numTokens, spec, now); err != nil {
 			return err
 		}
 	}
+	for _, spec := range specs {
+		qm.getTokens(numTokens, spec, now)
+	}
 	return nil
 }
 
-func (qm *QuotaManager) getTokens(ctx context.Context, numTokens int, spec quota.Spec) error {
-	if spec.Group != quota.Tree {
+// checkTokens returns an error if numTokens can't be acquired from spec.
+func (qm *QuotaManager) checkTokens(numTokens int, spec quota.Spec, now time.Time) error {
+	if ub := qm.userBuckets(spec); ub != nil {
+		if ub.available(spec.User, now) < float64(numTokens) {
+			qm.RateLimited.WithLabelValues(ub.kind).Inc()
+			qm.rejected.add(ub.kind, spec.User)
+			return fmt.Errorf("rate limit exceeded for %v %q", ub.kind, spec.User)
+		}
 		return nil
-	} else if spec.Kind != quota.Write {
+	} else if spec.Group != quota.Tree || spec.Kind != quota.Write {
 		return nil
 	}
-	tokens := int64(numTokens)
 
+	// Frozen logs are no longer watched, so they're checked first.
 	count, ok := qm.unsequenced[spec.TreeID]
-	if !ok {
+	if qm.frozen[spec.TreeID] {
+		return fmt.Errorf("log is frozen")
+	} else if !ok {
 		return fmt.Errorf("unknown tree id: %v", spec.TreeID)
-	} else if count+tokens > qm.maxUnsequencedLeaves {
+	} else if count+qm.reserved[spec.TreeID]+int64(numTokens) > qm.maxUnsequencedLeaves {
 		return fmt.Errorf("too many unsequenced leaves")
 	}
-	qm.unsequenced[spec.TreeID] += tokens
-
 	return nil
 }
 
+// getTokens acquires numTokens from spec, which must have been checked.
+func (qm *QuotaManager) getTokens(numTokens int, spec quota.Spec, now time.Time) {
+	if ub := qm.userBuckets(spec); ub != nil {
+		ub.set(spec.User, ub.available(spec.User, now)-float64(numTokens), now)
+	} else if spec.Group == quota.Tree && spec.Kind == quota.Write {
+		qm.reserved[spec.TreeID] += int64(numTokens)
+	}
+}
+
 // PeekTokens returns how many tokens are available for each spec, without
 // acquiring any. Infinite quotas should return MaxTokens.
 func (qm *QuotaManager) PeekTokens(ctx context.Context, specs []quota.Spec) (map[quota.Spec]int, error) {
-	return nil, fmt.Errorf("peeking into the quota is not implemented")
+	qm.mu.Lock()
+	defer qm.mu.Unlock()
+
+	now := qm.now()
+	tokens := make(map[quota.Spec]int, len(specs))
+	for _, spec := range specs {
+		if ub := qm.userBuckets(spec); ub != nil {
+			tokens[spec] = int(ub.available(spec.User, now))
+			continue
+		} else if spec.Group != quota.Tree || spec.Kind != quota.Write {
+			tokens[spec] = quota.MaxTokens
+			continue
+		}
+		count, ok := qm.unsequenced[spec.TreeID]
+		if qm.frozen[spec.TreeID] {
+			tokens[spec] = 0
+			continue
+		} else if !ok {
+			return nil, fmt.Errorf("unknown tree id: %v", spec.TreeID)
+		}
+		remaining := qm.maxUnsequencedLeaves - count - qm.reserved[spec.TreeID]
+		tokens[spec] = int(max64(remaining, 0))
+	}
+	return tokens, nil
 }
 
 // PutTokens adds numTokens for all specs.
@@ -143,26 +326,51 @@ func (qm *QuotaManager) PutTokens(ctx context.Context, numTokens int, specs []qu
 }
 
 func (qm *QuotaManager) putTokens(ctx context.Context, numTokens int, spec quota.Spec) error {
-	if spec.Group != quota.Tree {
+	if ub := qm.userBuckets(spec); ub != nil {
+		now := qm.now()
+		ub.set(spec.User, ub.available(spec.User, now)+float64(numTokens), now)
+		return nil
+	} else if spec.Group != quota.Tree {
 		return nil
 	} else if spec.Kind != quota.Write {
 		return nil
 	}
 
-	count, ok := qm.unsequenced[spec.TreeID]
+	reserved, ok := qm.reserved[spec.TreeID]
 	if !ok {
 		return fmt.Errorf("unknown tree id: %v", spec.TreeID)
 	}
-	count -= int64(numTokens)
-	if count < 0 {
-		count = 0
-	}
-	qm.unsequenced[spec.TreeID] = count
+	qm.reserved[spec.TreeID] = max64(reserved-int64(numTokens), 0)
 
 	return nil
 }
 
-// ResetQuota resets the quota for all specs.
+// ResetQuota resets the quota for all specs. A tree's quota is reset by
+// recounting its unsequenced leaves in the local database, which drops any
+// tokens that were acquired for leaves that were never queued. A submitter's
+// quota is reset by refilling its bucket.
 func (qm *QuotaManager) ResetQuota(ctx context.Context, specs []quota.Spec) error {
-	return fmt.Errorf("resetting the quota is not implemented")
+	qm.mu.Lock()
+	defer qm.mu.Unlock()
+
+	for _, spec := range specs {
+		if ub := qm.userBuckets(spec); ub != nil {
+			ub.reset(spec.User)
+			continue
+		} else if spec.Group != quota.Tree || spec.Kind != quota.Write {
+			continue
+		} else if _, ok := qm.unsequenced[spec.TreeID]; !ok && qm.frozen[spec.TreeID] {
+			continue // Frozen logs have no queue to recount.
+		} else if !ok {
+			return fmt.Errorf("unknown tree id: %v", spec.TreeID)
+		}
+		count, err := qm.local.Unsequenced(spec.TreeID)
+		if err != nil {
+			return err
+		}
+		qm.unsequenced[spec.TreeID] = int64(count)
+		qm.reserved[spec.TreeID] = 0
+		qm.UnsequencedLeaves.WithLabelValues(fmt.Sprint(spec.TreeID)).Set(float64(count))
+	}
+	return nil
 }
@@ -0,0 +1,233 @@
+package ct
+
+import (
+	"testing"
+
+	"context"
+	"fmt"
+	"time"
+
+	"github.com/google/certificate-transparency-go/trillian/ctfe"
+	"github.com/google/trillian"
+	"github.com/google/trillian/quota"
+	"github.com/google/trillian/storage"
+	"github.com/prometheus/client_golang/prometheus/testutil"
+)
+
+func TestQuotaManager(t *testing.T) {
+	ts := newTestStorage(t)
+	defer ts.close()
+	ts.init(t)
+	ctx := context.Background()
+
+	qm := NewQuotaManager(100)
+	ts.Observer = qm
+	watchCtx, cancel := context.WithCancel(ctx)
+	defer cancel()
+	if err := qm.WatchLog(watchCtx, ts.Local, testTreeID); err != nil {
+		t.Fatal(err)
+	}
+	spec := quota.Spec{Group: quota.Tree, Kind: quota.Write, TreeID: testTreeID}
+	other := quota.Spec{Group: quota.Global, Kind: quota.Read}
+
+	peek := func(want int) {
+		t.Helper()
+		tokens, err := qm.PeekTokens(ctx, []quota.Spec{spec, other})
+		if err != nil {
+			t.Fatal(err)
+		} else if tokens[spec] != want {
+			t.Fatalf("got %v tokens, wanted %v", tokens[spec], want)
+		} else if tokens[other] != quota.MaxTokens {
+			t.Fatalf("got %v tokens for unlimited spec, wanted %v", tokens[other], quota.MaxTokens)
+		}
+	}
+	peek(100)
+
+	// Tokens that are acquired but never queued are dropped by a reset.
+	if err := qm.GetTokens(ctx, 30, []quota.Spec{spec}); err != nil {
+		t.Fatal(err)
+	}
+	peek(70)
+	ts.queue(t, 0, 10)
+	peek(70)
+	if err := qm.ResetQuota(ctx, []quota.Spec{spec}); err != nil {
+		t.Fatal(err)
+	}
+	peek(90)
+
+	// Queued leaves use up reserved tokens, and sequenced leaves free them.
+	if err := qm.GetTokens(ctx, 5, []quota.Spec{spec}); err != nil {
+		t.Fatal(err)
+	}
+	ts.queue(t, 10, 13)
+	peek(85)
+	if err := qm.PutTokens(ctx, 2, []quota.Spec{spec}); err != nil {
+		t.Fatal(err)
+	}
+	peek(87)
+	ts.sequence(t, sClose)
+	peek(100)
+	if got := testutil.ToFloat64(qm.TreeSize.WithLabelValues(fmt.Sprint(testTreeID))); got != 13 {
+		t.Fatalf("got tree size %v, wanted 13", got)
+	}
+
+	if _, err := qm.PeekTokens(ctx, []quota.Spec{{Group: quota.Tree, Kind: quota.Write, TreeID: 2}}); err == nil {
+		t.Fatal("expected error peeking tokens of unknown tree")
+	}
+
+	// The log stops being watched once the context is cancelled.
+	cancel()
+	for i := 0; ; i++ {
+		if _, err := qm.PeekTokens(ctx, []quota.Spec{spec}); err != nil {
+			break
+		} else if i == 100 {
+			t.Fatal("log is still watched after cancellation")
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+	ts.queue(t, 13, 14)
+
+	// Cancelling a watch doesn't stop a newer watch of the same log.
+	oldCtx, cancelOld := context.WithCancel(ctx)
+	if err := qm.WatchLog(oldCtx, ts.Local, testTreeID); err != nil {
+		t.Fatal(err)
+	}
+	cancelOld()
+	newCtx, cancelNew := context.WithCancel(ctx)
+	defer cancelNew()
+	if err := qm.WatchLog(newCtx, ts.Local, testTreeID); err != nil {
+		t.Fatal(err)
+	}
+	time.Sleep(50 * time.Millisecond)
+	peek(99)
+}
+
+func TestRateLimits(t *testing.T) {
+	ctx := context.Background()
+	now := time.Unix(1000, 0)
+
+	qm := NewQuotaManager(100)
+	qm.unsequenced[testTreeID] = 0
+	qm.reserved[testTreeID] = 0
+	qm.now = func() time.Time { return now }
+	qm.SetRateLimits(RateLimit{Capacity: 10, RefillRate: 1}, RateLimit{})
+
+	tree := quota.Spec{Group: quota.Tree, Kind: quota.Write, TreeID: testTreeID}
+	client := quota.Spec{Group: quota.User, Kind: quota.Write, User: "192.0.2.1"}
+	other := quota.Spec{Group: quota.User, Kind: quota.Write, User: "192.0.2.2"}
+	reader := quota.Spec{Group: quota.User, Kind: quota.Read, User: "192.0.2.1"}
+	issuer := quota.Spec{Group: quota.User, Kind: quota.Write, User: ctfe.CertificateQuotaUserPrefix + " CN=Test"}
+
+	peek := func(spec quota.Spec, want int) {
+		t.Helper()
+		tokens, err := qm.PeekTokens(ctx, []quota.Spec{spec})
+		if err != nil {
+			t.Fatal(err)
+		} else if tokens[spec] != want {
+			t.Fatalf("got %v tokens for %v, wanted %v", tokens[spec], spec.User, want)
+		}
+	}
+
+	if err := qm.GetTokens(ctx, 8, []quota.Spec{client, tree}); err != nil {
+		t.Fatal(err)
+	}
+	peek(client, 2)
+	peek(other, 10)
+	peek(reader, quota.MaxTokens)
+	peek(issuer, quota.MaxTokens)
+
+	// A rejected request doesn't consume any other quota.
+	if err := qm.GetTokens(ctx, 3, []quota.Spec{client, tree}); err == nil {
+		t.Fatal("expected client to be rate limited")
+	}
+	peek(tree, 92)
+	if got := testutil.ToFloat64(qm.RateLimited.WithLabelValues("client")); got != 1 {
+		t.Fatalf("got %v rate limited requests, wanted 1", got)
+	} else if users := qm.RateLimitedUsers(10); len(users) != 1 || users[0] != (RateLimitedUser{"client", client.User, 1}) {
+		t.Fatalf("got unexpected rate limited users: %v", users)
+	}
+
+	// Buckets refill over time, up to their capacity.
+	now = now.Add(2 * time.Second)
+	peek(client, 4)
+	if err := qm.GetTokens(ctx, 3, []quota.Spec{client, tree}); err != nil {
+		t.Fatal(err)
+	}
+	peek(client, 1)
+	now = now.Add(time.Hour)
+	peek(client, 10)
+
+	// Refunded tokens go back in the bucket.
+	if err := qm.GetTokens(ctx, 10, []quota.Spec{client}); err != nil {
+		t.Fatal(err)
+	} else if err := qm.PutTokens(ctx, 4, []quota.Spec{client}); err != nil {
+		t.Fatal(err)
+	}
+	peek(client, 4)
+
+	// Resetting a user's quota refills its bucket.
+	if err := qm.ResetQuota(ctx, []quota.Spec{client}); err != nil {
+		t.Fatal(err)
+	}
+	peek(client, 10)
+}
+
+func TestRejections(t *testing.T) {
+	r := newRejections()
+	for i := 0; i < 5; i++ {
+		r.add("client", "heavy")
+	}
+	for i := 0; i < maxRateLimitedUsers+10; i++ {
+		r.add("client", fmt.Sprint(i))
+	}
+
+	// The number of users is bounded, but heavy users are kept.
+	if len(r.counts) != maxRateLimitedUsers {
+		t.Fatalf("got %v users, wanted %v", len(r.counts), maxRateLimitedUsers)
+	}
+	top := r.top(2)
+	if len(top) != 2 || top[0].User != "heavy" || top[0].Rejected != 5 {
+		t.Fatalf("got unexpected top users: %v", top)
+	}
+}
+
+// fakeAdminTX is a storage.ReadOnlyAdminTX that only implements ListTrees and
+// Close.
+type fakeAdminTX struct {
+	storage.ReadOnlyAdminTX
+	trees []*trillian.Tree
+}
+
+func (fat fakeAdminTX) ListTrees(ctx context.Context, includeDeleted bool) ([]*trillian.Tree, error) {
+	return fat.trees, nil
+}
+
+func (fat fakeAdminTX) Close() error { return nil }
+
+func TestGetUnsequencedCounts(t *testing.T) {
+	ts := newTestStorage(t)
+	defer ts.close()
+	ts.init(t)
+	ts.queue(t, 0, 10)
+
+	snap, err := ts.Local.Snapshot()
+	if err != nil {
+		t.Fatal(err)
+	}
+	rol := &readOnlyLogTX{
+		snap: snap,
+		adminTx: fakeAdminTX{trees: []*trillian.Tree{
+			{TreeId: testTreeID, TreeState: trillian.TreeState_ACTIVE},
+			{TreeId: testTreeID + 1, TreeState: trillian.TreeState_ACTIVE},
+			{TreeId: testTreeID + 2, TreeState: trillian.TreeState_FROZEN},
+			{TreeId: testTreeID + 3, TreeState: trillian.TreeState_DRAINING},
+		}},
+	}
+	defer rol.Close()
+	counts, err := rol.GetUnsequencedCounts(context.Background())
+	if err != nil {
+		t.Fatal(err)
+	} else if len(counts) != 3 || counts[testTreeID] != 10 || counts[testTreeID+1] != 0 || counts[testTreeID+3] != 0 {
+		t.Fatalf("got unexpected unsequenced counts: %v", counts)
+	}
+}
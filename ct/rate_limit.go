@@ -0,0 +1,144 @@
+package ct
+
+import (
+	"math"
+	"sort"
+	"time"
+)
+
+// sweepInterval is how often full buckets are forgotten, so that the number of
+// buckets stays proportional to the number of recent submitters.
+const sweepInterval = time.Minute
+
+// RateLimit configures a token bucket for each quota user. Each user can
+// acquire up to Capacity tokens at once, and the bucket is refilled at
+// RefillRate tokens per second.
+type RateLimit struct {
+	Capacity   int64
+	RefillRate float64
+}
+
+type bucket struct {
+	tokens  float64
+	updated time.Time
+}
+
+// userBuckets is a set of token buckets, one for each user of a kind. Users
+// without a bucket have a full one; buckets are only stored while they're
+// refilling. It is not safe for concurrent use.
+type userBuckets struct {
+	kind    string
+	limit   RateLimit
+	buckets map[string]*bucket
+	swept   time.Time
+}
+
+func newUserBuckets(kind string, limit RateLimit) *userBuckets {
+	return &userBuckets{
+		kind:    kind,
+		limit:   limit,
+		buckets: make(map[string]*bucket),
+	}
+}
+
+// available returns the number of tokens in the user's bucket at `now`.
+func (ub *userBuckets) available(user string, now time.Time) float64 {
+	b, ok := ub.buckets[user]
+	if !ok {
+		return float64(ub.limit.Capacity)
+	}
+	refill := now.Sub(b.updated).Seconds() * ub.limit.RefillRate
+	if refill < 0 {
+		refill = 0
+	}
+	return math.Min(b.tokens+refill, float64(ub.limit.Capacity))
+}
+
+// set sets the number of tokens in the user's bucket at `now`.
+func (ub *userBuckets) set(user string, tokens float64, now time.Time) {
+	if tokens >= float64(ub.limit.Capacity) {
+		delete(ub.buckets, user)
+	} else {
+		ub.buckets[user] = &bucket{tokens: tokens, updated: now}
+	}
+
+	if now.Sub(ub.swept) < sweepInterval {
+		return
+	}
+	ub.swept = now
+	for user := range ub.buckets {
+		if ub.available(user, now) >= float64(ub.limit.Capacity) {
+			delete(ub.buckets, user)
+		}
+	}
+}
+
+// reset refills the user's bucket.
+func (ub *userBuckets) reset(user string) {
+	delete(ub.buckets, user)
+}
+
+// maxRateLimitedUsers is the number of submitters whose rejected requests are
+// counted individually.
+const maxRateLimitedUsers = 1000
+
+// RateLimitedUser is a submitter that had requests rejected because it was over
+// its rate limit.
+type RateLimitedUser struct {
+	Kind     string `json:"kind"`
+	User     string `json:"user"`
+	Rejected int64  `json:"rejected"`
+}
+
+// rejections counts the rejected requests of the submitters that are rate
+// limited the most. Only maxRateLimitedUsers submitters are kept: when a new
+// one is rejected and the set is full, it replaces the one with the fewest
+// rejections and starts from its count. Counts are upper bounds, but the
+// submitters that are rejected most often are always kept. It is not safe for
+// concurrent use.
+type rejections struct {
+	counts map[RateLimitedUser]int64
+}
+
+func newRejections() *rejections {
+	return &rejections{counts: make(map[RateLimitedUser]int64)}
+}
+
+// add counts a rejected request from the user of the given kind.
+func (r *rejections) add(kind, user string) {
+	key := RateLimitedUser{Kind: kind, User: user}
+	if _, ok := r.counts[key]; !ok && len(r.counts) >= maxRateLimitedUsers {
+		var (
+			minKey   RateLimitedUser
+			minCount int64 = math.MaxInt64
+		)
+		for cand, count := range r.counts {
+			if count < minCount {
+				minKey, minCount = cand, count
+			}
+		}
+		delete(r.counts, minKey)
+		r.counts[key] = minCount
+	}
+	r.counts[key]++
+}
+
+// top returns up to n submitters with the most rejected requests, most
+// rejected first.
+func (r *rejections) top(n int) []RateLimitedUser {
+	out := make([]RateLimitedUser, 0, len(r.counts))
+	for key, count := range r.counts {
+		key.Rejected = count
+		out = append(out, key)
+	}
+	sort.Slice(out, func(i, j int) bool {
+		if out[i].Rejected != out[j].Rejected {
+			return out[i].Rejected > out[j].Rejected
+		}
+		return out[i].User < out[j].User
+	})
+	if len(out) > n {
+		out = out[:n]
+	}
+	return out
+}
@@ -4,6 +4,8 @@ import (
 	"context"
 	"fmt"
 
+	"github.com/cloudflare/ct-log/custom"
+
 	"github.com/google/trillian"
 	"github.com/google/trillian/storage"
 )
@@ -11,6 +13,7 @@ import (
 // readOnlyLogTX provides a read-only view into log data. A readOnlyLogTX,
 // unlike readOnlyLogTreeTX, is not tied to a particular tree.
 type readOnlyLogTX struct {
+	snap    *custom.LocalSnapshot
 	adminTx storage.ReadOnlyAdminTX
 	closed  bool
 }
@@ -29,7 +32,9 @@ func (rol *readOnlyLogTX) GetActiveLogIDs(ctx context.Context) ([]int64, error)
 
 	ids := make([]int64, 0, len(trees))
 	for _, tree := range trees {
-		if tree.TreeState != trillian.TreeState_ACTIVE {
+		// Draining logs are still sequenced, until their queue is empty and
+		// they can be frozen.
+		if tree.TreeState != trillian.TreeState_ACTIVE && tree.TreeState != trillian.TreeState_DRAINING {
 			continue
 		}
 		ids = append(ids, tree.TreeId)
@@ -37,8 +42,23 @@ func (rol *readOnlyLogTX) GetActiveLogIDs(ctx context.Context) ([]int64, error)
 	return ids, nil
 }
 
+// GetUnsequencedCounts returns the number of leaves of each active log that
+// are waiting to be integrated.
 func (rol *readOnlyLogTX) GetUnsequencedCounts(ctx context.Context) (storage.CountByLogID, error) {
-	return nil, fmt.Errorf("getting unsequenced counts is not implemented")
+	ids, err := rol.GetActiveLogIDs(ctx)
+	if err != nil {
+		return nil, err
+	}
+
+	counts := make(storage.CountByLogID, len(ids))
+	for _, id := range ids {
+		count, err := rol.snap.Unsequenced(id)
+		if err != nil {
+			return nil, err
+		}
+		counts[id] = int64(count)
+	}
+	return counts, nil
 }
 
 func (rol *readOnlyLogTX) Commit() error {
@@ -51,6 +71,10 @@ func (rol *readOnlyLogTX) Commit() error {
 func (rol *readOnlyLogTX) Rollback() error { return rol.Commit() }
 
 func (rol *readOnlyLogTX) Close() error {
+	if rol.closed {
+		return nil
+	}
+	rol.snap.Release()
 	rol.closed = true
-	return nil
+	return rol.adminTx.Close()
 }
@@ -16,10 +16,17 @@ import (
 
 // readOnlyLogTreeTX provides a read-only view into the log data. A
 // readOnlyLogTreeTX can only read from the tree specified in its creation.
+//
+// All reads from the local database go through snap, which is taken when the
+// transaction starts and released when it's closed, so that they're consistent
+// with root.
 type readOnlyLogTreeTX struct {
 	local        *custom.Local
+	snap         *custom.LocalSnapshot
 	remote       *custom.Remote
 	subtreeCache cache.SubtreeCache
+	// subtrees is the shared subtree cache, or nil if there isn't one.
+	subtrees *SubtreeCache
 
 	treeID int64
 	root   trillian.SignedLogRoot
@@ -104,7 +111,7 @@ func (rolt *readOnlyLogTreeTX) GetLeavesByRange(ctx context.Context, start, coun
 // GetLeavesByHash looks up sequenced leaf metadata and data by their Merkle
 // leaf hash.
 func (rolt *readOnlyLogTreeTX) GetLeavesByHash(ctx context.Context, leafHashes [][]byte, orderBySequence bool) ([]*trillian.LogLeaf, error) {
-	temp, err := rolt.local.GetSequenceByMerkleHash(rolt.treeID, leafHashes)
+	temp, err := rolt.snap.GetSequenceByMerkleHash(rolt.treeID, leafHashes)
 	if err != nil {
 		return nil, err
 	}
@@ -146,9 +153,44 @@ func (rolt *readOnlyLogTreeTX) GetLeavesByHash(ctx context.Context, leafHashes [
 }
 
 // GetMerkleNodes looks up the set of nodes identified by ids, at treeRevision,
-// and returns them.
+// and returns them. Nodes that are completed are read from the store of
+// completed nodes, which is the same at every revision; the others are read
+// from the subtrees at treeRevision.
 func (rolt *readOnlyLogTreeTX) GetMerkleNodes(ctx context.Context, treeRevision int64, ids []storage.NodeID) ([]storage.Node, error) {
-	return rolt.subtreeCache.GetNodes(ids, rolt.getSubtreesAtRev(ctx, treeRevision))
+	hashes, err := rolt.getCompletedNodes(ids)
+	if err != nil {
+		return nil, err
+	}
+	missing := make([]storage.NodeID, 0)
+	for i, hash := range hashes {
+		if hash == nil {
+			missing = append(missing, ids[i])
+		}
+	}
+	if len(missing) == 0 {
+		out := make([]storage.Node, 0, len(ids))
+		for i, id := range ids {
+			out = append(out, storage.Node{NodeID: id, Hash: hashes[i]})
+		}
+		return out, nil
+	}
+
+	fetched, err := rolt.subtreeCache.GetNodes(missing, rolt.getSubtreesAtRev(ctx, treeRevision))
+	if err != nil {
+		return nil, err
+	}
+	// Merge the two, in the order of ids. Nodes that weren't found in either
+	// are left out, like the subtree cache does.
+	out := make([]storage.Node, 0, len(ids))
+	for i, id := range ids {
+		if hashes[i] != nil {
+			out = append(out, storage.Node{NodeID: id, Hash: hashes[i]})
+		} else if len(fetched) > 0 && fetched[0].NodeID.Equivalent(id) {
+			out = append(out, fetched[0])
+			fetched = fetched[1:]
+		}
+	}
+	return out, nil
 }
 
 func (rolt *readOnlyLogTreeTX) getSubtreesAtRev(ctx context.Context, treeRevision int64) cache.GetSubtreesFunc {
@@ -157,8 +199,17 @@ func (rolt *readOnlyLogTreeTX) getSubtreesAtRev(ctx context.Context, treeRevisio
 	}
 }
 
+// getSubtrees reads subtrees through the shared subtree cache, if there is one.
+// Reads at revisions newer than the transaction's root, which haven't been
+// committed yet, always go to disk.
 func (rolt *readOnlyLogTreeTX) getSubtrees(ctx context.Context, treeRevision int64, ids []storage.NodeID) ([]*storagepb.SubtreeProto, error) {
-	return rolt.local.GetSubtrees(rolt.treeID, treeRevision, ids)
+	read := func(ids []storage.NodeID) ([]*storagepb.SubtreeProto, error) {
+		return rolt.snap.GetSubtrees(rolt.treeID, treeRevision, ids)
+	}
+	if rolt.subtrees == nil || treeRevision > rolt.root.TreeRevision {
+		return read(ids)
+	}
+	return rolt.subtrees.getSubtrees(rolt.treeID, treeRevision, ids, read)
 }
 
 func (rolt *readOnlyLogTreeTX) getSubtree(ctx context.Context, treeRevision int64, nodeID storage.NodeID) (*storagepb.SubtreeProto, error) {
@@ -174,10 +225,18 @@ func (rolt *readOnlyLogTreeTX) getSubtree(ctx context.Context, treeRevision int6
 }
 
 func (rolt *readOnlyLogTreeTX) Close() error {
+	rolt.release()
 	rolt.closed = true
 	return nil
 }
 
+// release releases the transaction's snapshot, if it has one.
+func (rolt *readOnlyLogTreeTX) release() {
+	if rolt.snap != nil {
+		rolt.snap.Release()
+	}
+}
+
 func (rolt *readOnlyLogTreeTX) Commit() error   { return rolt.Close() }
 func (rolt *readOnlyLogTreeTX) Rollback() error { return rolt.Close() }
 func (rolt *readOnlyLogTreeTX) IsOpen() bool    { return !rolt.closed }
@@ -0,0 +1,42 @@
+package ct
+
+import (
+	"context"
+	"fmt"
+	"log"
+
+	"github.com/google/trillian/storage"
+)
+
+// Recover reconciles remote storage with the local database, after a
+// sequencing run of the tree with the given treeID was interrupted between
+// uploading leaves and committing them. It should be called on startup, before
+// the signer runs.
+func (ls *LogStorage) Recover(ctx context.Context, treeID int64) error {
+	start, end, ok, err := ls.Local.PendingSequencing(treeID)
+	if err != nil {
+		return err
+	} else if !ok {
+		return nil
+	}
+
+	root, _, err := ls.Local.MostRecentRoot(treeID)
+	if err == storage.ErrTreeNeedsInit {
+		root.TreeSize = 0
+	} else if err != nil {
+		return err
+	}
+
+	if root.TreeSize != start {
+		return fmt.Errorf("unfinished sequencing run of leaves [%v, %v) doesn't start at tree size %v", start, end, root.TreeSize)
+	}
+	log.Printf("recovering from unfinished sequencing run: treeID=%v: removing leaves [%v, %v) from remote storage", treeID, start, end)
+
+	// The leaves of the unfinished run are still in the queue, because
+	// dequeuing them wasn't committed either. They'll be sequenced again in
+	// the next run.
+	if err := ls.Remote.Truncate(ctx, treeID, start, end); err != nil {
+		return fmt.Errorf("failed to remove uncommitted leaves: %v", err)
+	}
+	return ls.Local.ClearSequencing(treeID)
+}
@@ -0,0 +1,518 @@
+package ct
+
+import (
+	"testing"
+
+	"bufio"
+	"context"
+	"crypto/sha256"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"strings"
+	"time"
+
+	"github.com/cloudflare/ct-log/custom"
+	"github.com/cloudflare/ct-log/internal/remotetest"
+
+	"github.com/golang/protobuf/ptypes"
+	"github.com/google/trillian"
+	"github.com/google/trillian/merkle/hashers"
+	"github.com/google/trillian/storage"
+	"github.com/google/trillian/types"
+
+	_ "github.com/google/trillian/merkle/rfc6962"
+)
+
+const testTreeID = 1
+
+// testStorage is a LogStorage over a temporary local database and an in-memory
+// remote database.
+type testStorage struct {
+	*LogStorage
+	path  string
+	store *remotetest.MemoryStore // The remote's store, if it's in memory.
+}
+
+func newTestStorage(t testing.TB) *testStorage {
+	path, err := ioutil.TempDir("", "ct-log-test")
+	if err != nil {
+		t.Fatal(err)
+	}
+	store := remotetest.NewMemoryStore()
+	ts := openTestStorage(t, path, custom.NewRemoteWithStore(store))
+	ts.store = store
+	return ts
+}
+
+// openTestStorage returns a LogStorage over the local database at `path`, and
+// the given remote database.
+func openTestStorage(t testing.TB, path string, remote *custom.Remote) *testStorage {
+	SetLeafCacheSize(75000)
+
+	local, err := custom.NewLocal(path, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return &testStorage{
+		LogStorage: &LogStorage{Local: local, Remote: remote},
+		path:       path,
+	}
+}
+
+// restart simulates the process being killed and started again: any state
+// that wasn't committed to disk is lost, and recovery is run.
+func (ts *testStorage) restart(t testing.TB) {
+	if err := ts.Local.Close(); err != nil {
+		t.Fatal(err)
+	}
+	ts.reopen(t)
+}
+
+// reopen opens the closed local database again, and runs recovery.
+func (ts *testStorage) reopen(t testing.TB) {
+	local, err := custom.NewLocal(ts.path, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	ts.LogStorage = &LogStorage{Local: local, Remote: ts.Remote}
+
+	if err := ts.Recover(context.Background(), testTreeID); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func (ts *testStorage) close() {
+	ts.Local.Close()
+	os.RemoveAll(ts.path)
+}
+
+// testLeaves returns leaves with values "leaf <start>" to "leaf <end-1>".
+func testLeaves(t testing.TB, start, end int) []*trillian.LogLeaf {
+	hasher, err := hashers.NewLogHasher(trillian.HashStrategy_RFC6962_SHA256)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	leaves := make([]*trillian.LogLeaf, 0, end-start)
+	for i := start; i < end; i++ {
+		val := []byte(fmt.Sprintf("leaf %v", i))
+		merkleHash, err := hasher.HashLeaf(val)
+		if err != nil {
+			t.Fatal(err)
+		}
+		idHash := sha256.Sum256(val)
+
+		leaves = append(leaves, &trillian.LogLeaf{
+			MerkleLeafHash:   merkleHash,
+			LeafValue:        val,
+			LeafIdentityHash: idHash[:],
+		})
+	}
+	return leaves
+}
+
+func (ts *testStorage) queue(t testing.TB, start, end int) {
+	tree := &trillian.Tree{TreeId: testTreeID}
+	if _, err := ts.QueueLeaves(context.Background(), tree, testLeaves(t, start, end), time.Now()); err != nil {
+		t.Fatal(err)
+	}
+}
+
+// queueAndCrash queues leaves with values "leaf <start>" to "leaf <end-1>" in
+// a transaction that's abandoned before it's committed, as if the process had
+// died. Leaves of a pre-ordered tree are added with their index.
+func (ts *testStorage) queueAndCrash(t testing.TB, tree *trillian.Tree, start, end int) {
+	ctx := context.Background()
+
+	tx, err := ts.beginForTree(ctx, tree)
+	if err != nil {
+		t.Fatal(err)
+	}
+	lt := tx.(*logTreeTX)
+	leaves := testLeaves(t, start, end)
+	if tree.TreeType != trillian.TreeType_PREORDERED_LOG {
+		if _, err := lt.QueueLeaves(ctx, leaves, time.Now()); err != nil {
+			t.Fatal(err)
+		}
+		return
+	}
+	for i, leaf := range leaves {
+		leaf.LeafIndex = int64(start + i)
+	}
+	if _, err := lt.AddSequencedLeaves(ctx, leaves, time.Now()); err != nil {
+		t.Fatal(err)
+	}
+}
+
+// sequence runs one sequencing transaction like Trillian's sequencer would. If
+// crashAt is not sClose, the transaction is abandoned as soon as it has reached
+// that state, as if the process had died.
+func (ts *testStorage) sequence(t testing.TB, crashAt fsmState) {
+	if err := ts.sequenceTree(&trillian.Tree{TreeId: testTreeID}, crashAt); err != nil {
+		t.Fatal(err)
+	}
+}
+
+// sequenceTree runs one sequencing transaction of `tree`, which may be a
+// pre-ordered log, and returns the first error. If crashAt is not sClose, the
+// transaction is abandoned as soon as it has reached that state, as if the
+// process had died. If crashAt is sRollback, the transaction is rolled back
+// once its leaves have been uploaded instead.
+func (ts *testStorage) sequenceTree(tree *trillian.Tree, crashAt fsmState) error {
+	ctx := context.Background()
+	now := time.Now()
+	preordered := tree.TreeType == trillian.TreeType_PREORDERED_LOG
+
+	tx, err := ts.beginForTree(ctx, tree)
+	if err != nil {
+		return err
+	}
+	lt := tx.(*logTreeTX)
+	if crashAt == sBegin {
+		return nil
+	}
+
+	// Leaves of a pre-ordered log are uploaded when they're dequeued, and
+	// other leaves when they're sequenced.
+	leaves, err := lt.DequeueLeaves(ctx, 10000, now)
+	if err != nil {
+		return err
+	} else if crashAt == sDequeueLeaves {
+		return nil
+	}
+	if !preordered {
+		for i, leaf := range leaves {
+			leaf.LeafIndex = lt.root.TreeSize + int64(i)
+			if leaf.IntegrateTimestamp, err = ptypes.TimestampProto(now); err != nil {
+				return err
+			}
+		}
+		if err := lt.UpdateSequencedLeaves(ctx, leaves); err != nil {
+			return err
+		} else if crashAt == sUpdateSequencedLeaves {
+			return nil
+		}
+	}
+	if crashAt == sRollback {
+		if err := lt.Rollback(); err != nil {
+			return err
+		}
+		return lt.Close()
+	}
+
+	nodes := make([]storage.Node, 0, len(leaves))
+	for _, leaf := range leaves {
+		id, err := storage.NewNodeIDForTreeCoords(0, leaf.LeafIndex, 64)
+		if err != nil {
+			return err
+		}
+		nodes = append(nodes, storage.Node{NodeID: id, Hash: leaf.MerkleLeafHash})
+	}
+	if err := lt.SetMerkleNodes(ctx, nodes); err != nil {
+		return err
+	} else if crashAt == sSetMerkleNodes {
+		return nil
+	}
+
+	if err := storeRoot(ctx, lt, lt.root.TreeSize+int64(len(leaves)), now); err != nil {
+		return err
+	} else if crashAt == sStoreSignedLogRoot {
+		return nil
+	}
+
+	if err := lt.Commit(); err != nil {
+		return err
+	} else if crashAt == sCommit {
+		return nil
+	}
+	return lt.Close()
+}
+
+// storeRoot signs and stores a root for a tree with `size` leaves.
+func storeRoot(ctx context.Context, lt *logTreeTX, size int64, now time.Time) error {
+	rev, err := lt.WriteRevision(ctx)
+	if err != nil {
+		return err
+	}
+	root := types.LogRootV1{
+		TreeSize:       uint64(size),
+		RootHash:       lt.front.Head(),
+		TimestampNanos: uint64(now.UnixNano()),
+		Revision:       uint64(rev),
+	}
+	rootRaw, err := root.MarshalBinary()
+	if err != nil {
+		return err
+	}
+	return lt.StoreSignedLogRoot(ctx, trillian.SignedLogRoot{
+		RootHash:         root.RootHash,
+		LogRoot:          rootRaw,
+		LogRootSignature: []byte("signature"),
+	})
+}
+
+func (ts *testStorage) init(t testing.TB) {
+	ctx := context.Background()
+
+	tx, err := ts.beginForTree(ctx, &trillian.Tree{TreeId: testTreeID})
+	if err != nil {
+		t.Fatal(err)
+	}
+	lt := tx.(*logTreeTX)
+	if err := storeRoot(ctx, lt, 0, time.Now()); err != nil {
+		t.Fatal(err)
+	} else if err := lt.Commit(); err != nil {
+		t.Fatal(err)
+	}
+}
+
+// check verifies that the local and remote databases agree on the contents of
+// the tree, and that the tree has `size` leaves.
+func (ts *testStorage) check(t *testing.T, size int64) {
+	ctx := context.Background()
+
+	if _, _, ok, err := ts.Local.PendingSequencing(testTreeID); err != nil {
+		t.Fatal(err)
+	} else if ok {
+		t.Fatal("sequencing journal was not cleared")
+	}
+
+	tx, err := ts.SnapshotForTree(ctx, &trillian.Tree{TreeId: testTreeID})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer tx.Close()
+	root, err := tx.LatestSignedLogRoot(ctx)
+	if err != nil {
+		t.Fatal(err)
+	} else if root.TreeSize != size {
+		t.Fatalf("tree has size %v, wanted %v", root.TreeSize, size)
+	}
+
+	indexes := make([]int64, 0, size)
+	for i := int64(0); i < size; i++ {
+		indexes = append(indexes, i)
+	}
+	leaves, err := tx.GetLeavesByIndex(ctx, indexes)
+	if err != nil {
+		t.Fatal(err)
+	}
+	// Leaves queued at the same time are sequenced in a random order, so just
+	// check that each leaf appears exactly once.
+	seen := make(map[string]bool)
+	for i, leaf := range leaves {
+		var n int64
+		if _, err := fmt.Sscanf(string(leaf.LeafValue), "leaf %d", &n); err != nil {
+			t.Fatalf("leaf %v has unexpected value %q", i, leaf.LeafValue)
+		} else if n < 0 || n >= size {
+			t.Fatalf("leaf %v has value %q, which shouldn't be sequenced", i, leaf.LeafValue)
+		} else if seen[string(leaf.LeafValue)] {
+			t.Fatalf("leaf %v has value %q, which is duplicated", i, leaf.LeafValue)
+		}
+		seen[string(leaf.LeafValue)] = true
+	}
+
+	// Remote storage should have nothing past the end of the tree.
+	for _, idx := range []int64{size, 1024 * (size/1024 + 1)} {
+		if _, err := ts.Remote.GetLeaves(ctx, testTreeID, []int64{idx}); err == nil {
+			t.Fatalf("remote storage has a leaf at index %v, past the end of the tree", idx)
+		}
+	}
+}
+
+// recoveryTrees are the trees that crash recovery is tested with: a log, and a
+// pre-ordered log, whose leaves are uploaded in a different state.
+var recoveryTrees = []*trillian.Tree{
+	{TreeId: testTreeID, TreeType: trillian.TreeType_LOG},
+	{TreeId: testTreeID, TreeType: trillian.TreeType_PREORDERED_LOG},
+}
+
+// startRecoveryTest returns storage with a tree that ends just before a batch
+// boundary, so that the next run of 10 leaves spans two batches.
+func startRecoveryTest(t *testing.T, tree *trillian.Tree) *testStorage {
+	ts := newTestStorage(t)
+	ts.init(t)
+	ts.add(t, tree, 0, 1020)
+	if err := ts.sequenceTree(tree, sClose); err != nil {
+		t.Fatal(err)
+	}
+	ts.check(t, 1020)
+	return ts
+}
+
+// add queues the leaves with values "leaf <start>" to "leaf <end-1>", or adds
+// them with their index if the tree is pre-ordered.
+func (ts *testStorage) add(t *testing.T, tree *trillian.Tree, start, end int) {
+	if tree.TreeType != trillian.TreeType_PREORDERED_LOG {
+		ts.queue(t, start, end)
+		return
+	}
+	leaves := testLeaves(t, start, end)
+	for i, leaf := range leaves {
+		leaf.LeafIndex = int64(start + i)
+	}
+	if _, err := ts.AddSequencedLeaves(context.Background(), tree, leaves, time.Now()); err != nil {
+		t.Fatal(err)
+	}
+}
+
+// finishRecoveryTest checks that the interrupted run left the tree at 1020
+// leaves after a restart, or at 1030 if it was committed, and that the run
+// can be repeated.
+func finishRecoveryTest(t *testing.T, ts *testStorage, tree *trillian.Tree, committed bool) {
+	if committed {
+		ts.check(t, 1030)
+		return
+	}
+	ts.check(t, 1020)
+	if err := ts.sequenceTree(tree, sClose); err != nil {
+		t.Fatal(err)
+	}
+	ts.check(t, 1030)
+}
+
+func TestRecovery(t *testing.T) {
+	crashes := []fsmState{
+		sBegin, sQueueLeaves, sDequeueLeaves, sUpdateSequencedLeaves,
+		sSetMerkleNodes, sStoreSignedLogRoot, sCommit, sRollback,
+	}
+
+	for _, tree := range recoveryTrees {
+		for _, crashAt := range crashes {
+			if tree.TreeType == trillian.TreeType_PREORDERED_LOG && crashAt == sUpdateSequencedLeaves {
+				continue // Pre-ordered logs skip this state.
+			}
+			t.Run(fmt.Sprintf("%v/%v", tree.TreeType, crashAt), func(t *testing.T) {
+				ts := startRecoveryTest(t, tree)
+				defer ts.close()
+
+				if crashAt == sQueueLeaves {
+					ts.queueAndCrash(t, tree, 1020, 1030)
+					ts.restart(t)
+					finishRecoveryTest(t, ts, tree, false)
+					return
+				}
+				ts.add(t, tree, 1020, 1030)
+				if err := ts.sequenceTree(tree, crashAt); err != nil {
+					t.Fatal(err)
+				}
+				ts.restart(t)
+				finishRecoveryTest(t, ts, tree, crashAt == sCommit)
+			})
+		}
+	}
+}
+
+// TestRecoveryPartialUpload crashes between the uploads of the two batches
+// that a sequencing run spans, or before either of them.
+func TestRecoveryPartialUpload(t *testing.T) {
+	for _, tree := range recoveryTrees {
+		for _, uploaded := range []int{0, 1} {
+			t.Run(fmt.Sprintf("%v/%v", tree.TreeType, uploaded), func(t *testing.T) {
+				ts := startRecoveryTest(t, tree)
+				defer ts.close()
+				ctx := context.Background()
+
+				ts.add(t, tree, 1020, 1030)
+				ts.store.SetWriteLimit(uploaded)
+				if err := ts.sequenceTree(tree, sClose); err == nil {
+					t.Fatal("expected upload to fail")
+				}
+				ts.store.SetWriteLimit(-1)
+
+				// Batches are uploaded in any order, so exactly one of them
+				// has the run's leaves.
+				written := 0
+				for _, idx := range []int64{1020, 1024} {
+					if _, err := ts.Remote.GetLeaves(ctx, testTreeID, []int64{idx}); err == nil {
+						written++
+					}
+				}
+				if written != uploaded {
+					t.Fatalf("%v batches were written, wanted %v", written, uploaded)
+				}
+
+				ts.restart(t)
+				finishRecoveryTest(t, ts, tree, false)
+			})
+		}
+	}
+}
+
+// TestRecoveryKilled kills a process that's in the middle of a sequencing run,
+// after its leaves were uploaded but before they were committed. The process
+// is this test binary, run again with CT_LOG_RECOVERY_CHILD set to the path of
+// the local database and the directory of the remote database.
+func TestRecoveryKilled(t *testing.T) {
+	tree := recoveryTrees[0]
+	if env := os.Getenv("CT_LOG_RECOVERY_CHILD"); env != "" {
+		paths := strings.SplitN(env, string(os.PathListSeparator), 2)
+		remote, err := remotetest.NewDirRemote(paths[1])
+		if err != nil {
+			t.Fatal(err)
+		}
+		ts := openTestStorage(t, paths[0], remote)
+		ts.add(t, tree, 1020, 1030)
+		if err := ts.sequenceTree(tree, sStoreSignedLogRoot); err != nil {
+			t.Fatal(err)
+		}
+		fmt.Println("crash")
+		select {}
+	}
+
+	dir, err := ioutil.TempDir("", "ct-log-test")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	path, remoteDir := filepath.Join(dir, "local"), filepath.Join(dir, "remote")
+	if err := os.Mkdir(remoteDir, 0755); err != nil {
+		t.Fatal(err)
+	}
+	remote, err := remotetest.NewDirRemote(remoteDir)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	ts := openTestStorage(t, path, remote)
+	defer ts.close()
+	ts.init(t)
+	ts.add(t, tree, 0, 1020)
+	ts.sequence(t, sClose)
+	ts.check(t, 1020)
+	if err := ts.Local.Close(); err != nil {
+		t.Fatal(err)
+	}
+
+	// Run the sequencing run in a child process, and kill it once it's about
+	// to commit.
+	child := exec.Command(os.Args[0], "-test.run=^TestRecoveryKilled$")
+	child.Env = append(os.Environ(), "CT_LOG_RECOVERY_CHILD="+path+string(os.PathListSeparator)+remoteDir)
+	child.Stderr = os.Stderr
+	stdout, err := child.StdoutPipe()
+	if err != nil {
+		t.Fatal(err)
+	} else if err := child.Start(); err != nil {
+		t.Fatal(err)
+	}
+	line, err := bufio.NewReader(stdout).ReadString('\n')
+	if err != nil || line != "crash\n" {
+		child.Process.Kill()
+		child.Wait()
+		t.Fatalf("child process didn't reach the crash: %q, %v", line, err)
+	}
+	if err := child.Process.Kill(); err != nil {
+		t.Fatal(err)
+	}
+	child.Wait()
+
+	// The leaves were uploaded, but are removed when the log is recovered.
+	if _, err := remote.GetLeaves(context.Background(), testTreeID, []int64{1024}); err != nil {
+		t.Fatalf("child process didn't upload its leaves: %v", err)
+	}
+	ts.reopen(t)
+	finishRecoveryTest(t, ts, tree, false)
+}
@@ -0,0 +1,240 @@
+package ct
+
+import (
+	"context"
+	"encoding/binary"
+	"fmt"
+	"sync"
+
+	"github.com/cloudflare/ct-log/ct/cache"
+
+	"github.com/golang/protobuf/proto"
+	"github.com/google/trillian"
+	"github.com/google/trillian/storage"
+	"github.com/google/trillian/storage/storagepb"
+	"github.com/prometheus/client_golang/prometheus"
+)
+
+// DefaultSubtreeCacheSize is the number of subtrees that a SubtreeCache holds,
+// if no other size is configured.
+const DefaultSubtreeCacheSize = 1024
+
+// SubtreeCache is a bounded cache of parsed subtrees that's shared by every
+// transaction, so that the subtrees near the top of a tree aren't read from
+// disk and parsed again for each proof.
+//
+// Each cached subtree is the most recent version of it for a range of
+// revisions. Subtrees that haven't been rewritten since the most recent commit
+// that the cache has seen stay valid as the tree grows; the ones that a commit
+// rewrites are replaced with the new version.
+type SubtreeCache struct {
+	// Requests counts the subtrees looked up in the cache, by whether they
+	// were found.
+	Requests *prometheus.CounterVec
+
+	mu      sync.Mutex
+	entries *cache.Cache
+	trees   map[int64]*subtreeTree
+}
+
+// subtreeTree is what the cache knows about the revisions of a tree.
+type subtreeTree struct {
+	// latest is the revision of the most recent commit that the cache has
+	// seen. epoch is changed when a commit isn't the one after latest, which
+	// invalidates the current entries.
+	latest, epoch int64
+}
+
+// subtreeEntry is a cached subtree. It's the most recent version of the
+// subtree at every revision from `from` to `to`, or to the tree's latest
+// revision if the entry is current. Missing subtrees are cached as nil.
+type subtreeEntry struct {
+	subtree  *storagepb.SubtreeProto
+	from, to int64
+
+	current bool
+	epoch   int64
+}
+
+// NewSubtreeCache returns a SubtreeCache that holds up to `size` subtrees.
+func NewSubtreeCache(size int) *SubtreeCache {
+	return &SubtreeCache{
+		Requests: prometheus.NewCounterVec(prometheus.CounterOpts{
+			Name: "subtree_cache_requests",
+			Help: "The number of subtrees looked up in the shared subtree cache, by result.",
+		}, []string{"result"}),
+
+		entries: cache.New(cache.NoExpiration, 0, size),
+		trees:   make(map[int64]*subtreeTree),
+	}
+}
+
+func subtreeKey(treeID int64, id storage.NodeID) string {
+	return fmt.Sprintf("treeID=%v,px=%x", treeID, id.Path[:id.PrefixLenBits/8])
+}
+
+// valid returns true if the entry is the most recent version of its subtree at
+// treeRevision. It must be called with the lock held.
+func (sc *SubtreeCache) valid(treeID int64, e *subtreeEntry, treeRevision int64) bool {
+	if treeRevision < e.from {
+		return false
+	} else if !e.current {
+		return treeRevision <= e.to
+	}
+	t, ok := sc.trees[treeID]
+	return ok && t.epoch == e.epoch && treeRevision <= t.latest
+}
+
+// get returns a copy of the cached subtree with the given id at treeRevision.
+// The second return value is false if it isn't cached.
+func (sc *SubtreeCache) get(treeID, treeRevision int64, id storage.NodeID) (*storagepb.SubtreeProto, bool) {
+	sc.mu.Lock()
+	defer sc.mu.Unlock()
+
+	val, ok := sc.entries.Get(subtreeKey(treeID, id))
+	if !ok || !sc.valid(treeID, val.(*subtreeEntry), treeRevision) {
+		sc.Requests.WithLabelValues("miss").Inc()
+		return nil, false
+	}
+	sc.Requests.WithLabelValues("hit").Inc()
+	return cloneSubtree(val.(*subtreeEntry).subtree), true
+}
+
+// add caches a subtree that was read from disk at treeRevision, which must be
+// a revision that has been committed. It doesn't replace an entry for a newer
+// revision, or one that's still current.
+func (sc *SubtreeCache) add(treeID, treeRevision int64, id storage.NodeID, subtree *storagepb.SubtreeProto) {
+	sc.mu.Lock()
+	defer sc.mu.Unlock()
+
+	key := subtreeKey(treeID, id)
+	if val, ok := sc.entries.Get(key); ok {
+		e := val.(*subtreeEntry)
+		if e.from >= treeRevision || sc.valid(treeID, e, treeRevision) {
+			return
+		} else if t, ok := sc.trees[treeID]; ok && e.current && t.epoch == e.epoch {
+			return
+		}
+	}
+
+	e := &subtreeEntry{subtree: cloneSubtree(subtree), from: treeRevision, to: treeRevision}
+	if t, ok := sc.trees[treeID]; ok && t.latest == treeRevision {
+		e.current, e.epoch = true, t.epoch
+	}
+	sc.entries.Set(key, e, cache.DefaultExpiration)
+}
+
+// committed updates the cache after a commit stored a new root of the tree
+// with the given treeID at treeRevision, and wrote `subtrees` at it.
+func (sc *SubtreeCache) committed(treeID, treeRevision int64, subtrees []*storagepb.SubtreeProto) {
+	sc.mu.Lock()
+	defer sc.mu.Unlock()
+
+	t, ok := sc.trees[treeID]
+	if !ok {
+		t = &subtreeTree{latest: treeRevision}
+		sc.trees[treeID] = t
+	} else if treeRevision == t.latest+1 {
+		t.latest = treeRevision
+	} else {
+		t.latest, t.epoch = treeRevision, t.epoch+1
+	}
+
+	for _, subtree := range subtrees {
+		id := storage.NodeID{Path: subtree.Prefix, PrefixLenBits: 8 * len(subtree.Prefix)}
+		sc.entries.Set(subtreeKey(treeID, id), &subtreeEntry{
+			subtree: cloneSubtree(subtree),
+			from:    treeRevision,
+			to:      treeRevision,
+			current: true,
+			epoch:   t.epoch,
+		}, cache.DefaultExpiration)
+	}
+}
+
+// getSubtrees returns the most recent revision ( <= treeRevision ) of each
+// subtree with a given id, like custom.LocalSnapshot.GetSubtrees. Subtrees
+// that aren't cached are read with `read`, and cached.
+func (sc *SubtreeCache) getSubtrees(treeID, treeRevision int64, ids []storage.NodeID, read func([]storage.NodeID) ([]*storagepb.SubtreeProto, error)) ([]*storagepb.SubtreeProto, error) {
+	out := make([]*storagepb.SubtreeProto, 0, len(ids))
+	missing := make([]storage.NodeID, 0)
+	for _, id := range ids {
+		if subtree, ok := sc.get(treeID, treeRevision, id); !ok {
+			missing = append(missing, id)
+		} else if subtree != nil {
+			out = append(out, subtree)
+		}
+	}
+	if len(missing) == 0 {
+		return out, nil
+	}
+
+	found, err := read(missing)
+	if err != nil {
+		return nil, err
+	}
+	byPrefix := make(map[string]*storagepb.SubtreeProto, len(found))
+	for _, subtree := range found {
+		byPrefix[string(subtree.Prefix)] = subtree
+	}
+	for _, id := range missing {
+		sc.add(treeID, treeRevision, id, byPrefix[string(id.Path[:id.PrefixLenBits/8])])
+	}
+	return append(out, found...), nil
+}
+
+func cloneSubtree(subtree *storagepb.SubtreeProto) *storagepb.SubtreeProto {
+	if subtree == nil {
+		return nil
+	}
+	out := proto.Clone(subtree).(*storagepb.SubtreeProto)
+	if out.Prefix == nil {
+		out.Prefix = []byte{}
+	}
+	return out
+}
+
+// WarmSubtreeCache reads the subtrees on the right edge of the tree with the
+// given treeID into the shared subtree cache. They're the ones that proofs
+// against the current root read most often. It does nothing if the log storage
+// doesn't have a shared subtree cache.
+func (ls *LogStorage) WarmSubtreeCache(ctx context.Context, treeID int64) error {
+	if ls.Subtrees == nil {
+		return nil
+	}
+	tx, err := ls.SnapshotForTree(ctx, &trillian.Tree{TreeId: treeID})
+	if err == storage.ErrTreeNeedsInit {
+		return nil
+	} else if err != nil {
+		return err
+	}
+	defer tx.Close()
+	rolt := tx.(*readOnlyLogTreeTX)
+	if rolt.root.TreeSize == 0 {
+		return nil
+	}
+
+	// The cache only keeps subtrees current once it's seen a commit, so the
+	// root that the warm-up reads at stands in for one.
+	ls.Subtrees.warmed(treeID, rolt.root.TreeRevision)
+
+	path := make([]byte, 8)
+	binary.BigEndian.PutUint64(path, uint64(rolt.root.TreeSize-1))
+	ids := make([]storage.NodeID, 0, len(path))
+	for i := 0; i < len(path); i++ {
+		ids = append(ids, storage.NodeID{Path: path, PrefixLenBits: 8 * i})
+	}
+	_, err = rolt.getSubtrees(ctx, rolt.root.TreeRevision, ids)
+	return err
+}
+
+// warmed records that treeRevision is the latest revision of the tree with the
+// given treeID, if the cache hasn't seen a commit of it yet.
+func (sc *SubtreeCache) warmed(treeID, treeRevision int64) {
+	sc.mu.Lock()
+	defer sc.mu.Unlock()
+
+	if _, ok := sc.trees[treeID]; !ok {
+		sc.trees[treeID] = &subtreeTree{latest: treeRevision}
+	}
+}
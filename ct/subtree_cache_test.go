@@ -0,0 +1,88 @@
+package ct
+
+import (
+	"testing"
+
+	"bytes"
+	"context"
+
+	"github.com/google/trillian"
+	"github.com/google/trillian/merkle"
+	"github.com/google/trillian/storage"
+	"github.com/prometheus/client_golang/prometheus/testutil"
+)
+
+func TestSubtreeCache(t *testing.T) {
+	ts := newTestStorage(t)
+	defer ts.close()
+	ts.init(t)
+	ctx := context.Background()
+	ts.Subtrees = NewSubtreeCache(64)
+	uncached := &LogStorage{Local: ts.Local, Remote: ts.Remote}
+
+	// getNodes reads the nodes of an inclusion proof of the last leaf from
+	// the subtrees of the current revision, bypassing completed nodes.
+	getNodes := func(ls *LogStorage, size int64) []storage.Node {
+		t.Helper()
+		fetches, err := merkle.CalcInclusionProofNodeAddresses(size, size-1, size, 64)
+		if err != nil {
+			t.Fatal(err)
+		}
+		tx, err := ls.SnapshotForTree(ctx, &trillian.Tree{TreeId: testTreeID})
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer tx.Close()
+		rolt := tx.(*readOnlyLogTreeTX)
+		if rolt.root.TreeSize != size {
+			t.Fatalf("tree has size %v, wanted %v", rolt.root.TreeSize, size)
+		}
+		nodes, err := rolt.subtreeCache.GetNodes(fetchIDs(fetches), rolt.getSubtreesAtRev(ctx, rolt.root.TreeRevision))
+		if err != nil {
+			t.Fatal(err)
+		} else if len(nodes) != len(fetches) {
+			t.Fatalf("got %v nodes, wanted %v", len(nodes), len(fetches))
+		}
+		return nodes
+	}
+	check := func(size int64) {
+		t.Helper()
+		want := getNodes(uncached, size)
+		for i := 0; i < 2; i++ {
+			got := getNodes(ts.LogStorage, size)
+			for j := range want {
+				if !bytes.Equal(got[j].Hash, want[j].Hash) {
+					t.Fatalf("tree size %v: node %v has hash %x, wanted %x", size, want[j].NodeID.CoordString(), got[j].Hash, want[j].Hash)
+				}
+			}
+		}
+	}
+	requests := func(sc *SubtreeCache, result string) float64 {
+		return testutil.ToFloat64(sc.Requests.WithLabelValues(result))
+	}
+
+	ts.queue(t, 0, 300)
+	ts.integrate(t)
+	check(300)
+	if hits := requests(ts.Subtrees, "hit"); hits == 0 {
+		t.Fatal("expected subtrees to be read from the cache")
+	}
+
+	// Subtrees that are rewritten by a commit are replaced in the cache.
+	for _, r := range [][2]int{{300, 301}, {301, 520}, {520, 4000}} {
+		ts.queue(t, r[0], r[1])
+		ts.integrate(t)
+		check(int64(r[1]))
+	}
+
+	// A warmed cache has every subtree on the right edge.
+	ts.Subtrees = NewSubtreeCache(64)
+	if err := ts.WarmSubtreeCache(ctx, testTreeID); err != nil {
+		t.Fatal(err)
+	}
+	misses := requests(ts.Subtrees, "miss")
+	check(4000)
+	if got := requests(ts.Subtrees, "miss"); got != misses {
+		t.Fatalf("got %v misses after warm-up, wanted none", got-misses)
+	}
+}
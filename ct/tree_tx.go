@@ -4,26 +4,44 @@ import (
 	"bytes"
 	"context"
 	"fmt"
+	"sync"
 	"time"
 
 	"github.com/cloudflare/ct-log/ct/cache"
 	"github.com/cloudflare/ct-log/custom"
 
+	"github.com/golang/protobuf/ptypes"
+	"github.com/golang/protobuf/ptypes/timestamp"
 	"github.com/google/trillian"
 	"github.com/google/trillian/storage"
 	"github.com/google/trillian/storage/storagepb"
+	"github.com/google/trillian/types"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
 )
 
 // leafCache stores *trillian.LogLeaf's. See SetLeafCacheSize.
-var leafCache = cache.New(1*time.Hour, 1*time.Minute, 75000)
+var (
+	leafCache   = cache.New(1*time.Hour, 1*time.Minute, 75000)
+	leafCacheMu sync.RWMutex
+)
 
 // SetLeafCacheSize sets the max size of the in-memory cache of leaves that have
 // been queued but may not have been integrated into an STH yet. This helps
-// reduce the number of duplicate leaves.
+// reduce the number of duplicate leaves. It's safe to call while the log is
+// serving, but the cache starts out empty.
 func SetLeafCacheSize(size int) {
+	leafCacheMu.Lock()
+	defer leafCacheMu.Unlock()
 	leafCache = cache.New(1*time.Hour, 1*time.Minute, size)
 }
 
+func getLeafCache() *cache.Cache {
+	leafCacheMu.RLock()
+	defer leafCacheMu.RUnlock()
+	return leafCache
+}
+
 func dupSlice(in []byte) []byte {
 	if in == nil {
 		return nil
@@ -33,25 +51,34 @@ func dupSlice(in []byte) []byte {
 	return out
 }
 
+func dupTimestamp(in *timestamp.Timestamp) *timestamp.Timestamp {
+	if in == nil {
+		return nil
+	}
+	return &timestamp.Timestamp{Seconds: in.Seconds, Nanos: in.Nanos}
+}
+
 func dupLeaf(leaf *trillian.LogLeaf) *trillian.LogLeaf {
 	return &trillian.LogLeaf{
-		MerkleLeafHash:   dupSlice(leaf.MerkleLeafHash),
-		LeafValue:        dupSlice(leaf.LeafValue),
-		ExtraData:        dupSlice(leaf.ExtraData),
-		LeafIndex:        leaf.LeafIndex,
-		LeafIdentityHash: dupSlice(leaf.LeafIdentityHash),
+		MerkleLeafHash:     dupSlice(leaf.MerkleLeafHash),
+		LeafValue:          dupSlice(leaf.LeafValue),
+		ExtraData:          dupSlice(leaf.ExtraData),
+		LeafIndex:          leaf.LeafIndex,
+		LeafIdentityHash:   dupSlice(leaf.LeafIdentityHash),
+		QueueTimestamp:     dupTimestamp(leaf.QueueTimestamp),
+		IntegrateTimestamp: dupTimestamp(leaf.IntegrateTimestamp),
 	}
 }
 
 func addLeaf(treeID int64, leaf *trillian.LogLeaf) {
-	leafCache.Set(
+	getLeafCache().Set(
 		fmt.Sprintf("treeID=%v,id=%x", treeID, leaf.LeafIdentityHash),
 		dupLeaf(leaf), cache.DefaultExpiration,
 	)
 }
 
 func getLeafByIdentityHash(treeID int64, id []byte) *trillian.LogLeaf {
-	leaf, ok := leafCache.Get(fmt.Sprintf("treeID=%v,id=%x", treeID, id))
+	leaf, ok := getLeafCache().Get(fmt.Sprintf("treeID=%v,id=%x", treeID, id))
 	if !ok {
 		return nil
 	}
@@ -67,6 +94,32 @@ type logTreeTX struct {
 	localTx *custom.LocalTx
 
 	queuedLeaves bool
+
+	// observer is notified of the leaves that were queued or sequenced by this
+	// transaction once it's committed. queued and sequenced count them, and
+	// treeSize is the size of the root that the transaction stored.
+	observer          QueueObserver
+	queued, sequenced int
+	treeSize          int64
+
+	// setNodes are the nodes set by this transaction. The ones that are
+	// completed are added to the store of completed nodes on commit.
+	setNodes []storage.Node
+	// storedRoot is true if the transaction stored a root, at rootRevision.
+	// flushed are the subtrees that it wrote, which are added to the shared
+	// subtree cache on commit.
+	storedRoot   bool
+	rootRevision int64
+	flushed      []*storagepb.SubtreeProto
+
+	// preordered is true if the tree is a pre-ordered log, whose leaves are
+	// added with their index already assigned.
+	preordered bool
+
+	// dequeued is true if this transaction is a sequencing run. When it's
+	// committed, the time is recorded in sequencerRuns.
+	dequeued      bool
+	sequencerRuns *sync.Map
 }
 
 // WriteRevision returns the tree revision that any writes through this
@@ -96,6 +149,8 @@ func (lt *logTreeTX) QueueLeaves(ctx context.Context, leaves []*trillian.LogLeaf
 		l, err := lt.queueLeaf(ctx, leaf, queueTimestamp)
 		if err != nil {
 			return nil, err
+		} else if l == nil {
+			lt.queued++
 		}
 		out = append(out, l)
 	}
@@ -111,37 +166,30 @@ func (lt *logTreeTX) queueLeaf(ctx context.Context, leaf *trillian.LogLeaf, queu
 	if cachedLeaf != nil {
 		return cachedLeaf, nil
 	}
-	// Since it's not in cache, check if this leaf is already in B2.
-	seq, err := lt.getSequenceByIdentityHash(ctx, leaf.LeafIdentityHash)
-	if err != nil {
+	// Save the new leaves to disk and our local cache, unless the leaf is
+	// already queued or sequenced. The cache only knows about leaves queued
+	// since the process started, but the database knows about all of them.
+	dups, seqs, err := lt.local.QueueLeaves(lt.treeID, queueTimestamp.UnixNano(), []*trillian.LogLeaf{leaf})
+	if err == custom.ErrTreeFrozen {
+		return nil, status.Errorf(codes.FailedPrecondition, "tree %v: %v", lt.treeID, err)
+	} else if err != nil {
 		return nil, err
-	} else if seq > 0 && seq < lt.root.TreeSize {
+	} else if dups[0] != nil {
+		addLeaf(lt.treeID, dups[0])
+		return dups[0], nil
+	} else if seqs[0] >= 0 {
 		// Read the old leaf from B2.
-		dup, err := lt.remote.GetLeaves(ctx, lt.treeID, []int64{seq})
+		dup, err := lt.remote.GetLeaves(ctx, lt.treeID, []int64{seqs[0]})
 		if err != nil {
 			return nil, err
 		}
 		return dup[0], nil
 	}
-
-	// Save the new leaves to disk and our local cache.
-	err = lt.local.QueueLeaves(lt.treeID, queueTimestamp.UnixNano(), []*trillian.LogLeaf{leaf})
-	if err != nil {
-		return nil, err
-	}
 	addLeaf(lt.treeID, leaf)
 
 	return nil, nil
 }
 
-func (lt *logTreeTX) getSequenceByIdentityHash(ctx context.Context, id []byte) (int64, error) {
-	seqs, err := lt.local.GetSequenceByIdentityHash(lt.treeID, [][]byte{id})
-	if err != nil {
-		return 0, err
-	}
-	return seqs[0], nil
-}
-
 // DequeueLeaves will return between [0, limit] leaves from the queue.
 //
 // Leaves which have been dequeued within a rolled-back tx will become available
@@ -151,20 +199,86 @@ func (lt *logTreeTX) DequeueLeaves(ctx context.Context, limit int, cutoffTime ti
 	if err := lt.emit(sDequeueLeaves); err != nil {
 		return nil, err
 	}
+	lt.dequeued = true
+
+	if !lt.preordered {
+		leaves, err := lt.localTx.DequeueLeaves(lt.treeID, lt.root.TreeSize, cutoffTime.UnixNano(), limit)
+		if err != nil {
+			return nil, err
+		}
+		lt.sequenced += len(leaves)
+		return leaves, nil
+	}
 
-	return lt.localTx.DequeueLeaves(lt.treeID, lt.root.TreeSize, cutoffTime.UnixNano(), limit)
+	// Trillian's sequencer doesn't call UpdateSequencedLeaves for pre-ordered
+	// logs, because their leaves already have an index. Store them now instead.
+	leaves, err := lt.localTx.DequeueSequencedLeaves(lt.treeID, lt.root.TreeSize, limit)
+	if err != nil {
+		return nil, err
+	}
+	integrated, err := ptypes.TimestampProto(time.Now())
+	if err != nil {
+		return nil, err
+	}
+	for _, leaf := range leaves {
+		leaf.IntegrateTimestamp = integrated
+	}
+	if err := lt.storeLeaves(ctx, leaves); err != nil {
+		return nil, err
+	}
+	lt.sequenced += len(leaves)
+	return leaves, nil
 }
 
+// AddSequencedLeaves stores the leaves of a pre-ordered log, which must have
+// contiguous indices, until they're integrated.
 func (lt *logTreeTX) AddSequencedLeaves(ctx context.Context, leaves []*trillian.LogLeaf, ts time.Time) ([]*trillian.QueuedLogLeaf, error) {
-	return nil, fmt.Errorf("adding sequenced leaves is not implemented")
+	if err := lt.emit(sQueueLeaves); err != nil {
+		return nil, err
+	}
+	lt.queuedLeaves = true
+
+	tree := &trillian.Tree{TreeId: lt.treeID, TreeType: trillian.TreeType_LOG}
+	if lt.preordered {
+		tree.TreeType = trillian.TreeType_PREORDERED_LOG
+	}
+	out, err := addSequencedLeaves(lt.local, tree, leaves, ts)
+	if err != nil {
+		return nil, err
+	}
+	lt.queued += countOK(out)
+	return out, nil
 }
 
 func (lt *logTreeTX) UpdateSequencedLeaves(ctx context.Context, leaves []*trillian.LogLeaf) error {
 	if err := lt.emit(sUpdateSequencedLeaves); err != nil {
 		return err
+	} else if lt.preordered {
+		return fmt.Errorf("leaves of a pre-ordered log can't be re-sequenced")
 	}
+	return lt.storeLeaves(ctx, leaves)
+}
 
-	// Save leaves to B2.
+// storeLeaves uploads newly sequenced leaves to remote storage, indexes them,
+// and adds them to the frontier.
+func (lt *logTreeTX) storeLeaves(ctx context.Context, leaves []*trillian.LogLeaf) error {
+	// Record the leaves we're about to upload in the sequencing journal, so
+	// that the upload can be undone if we crash before committing. Then save
+	// the leaves to B2.
+	if len(leaves) > 0 {
+		end := lt.root.TreeSize
+		for _, leaf := range leaves {
+			if leaf.LeafIndex < lt.root.TreeSize {
+				return fmt.Errorf("leaf index %v is already sequenced", leaf.LeafIndex)
+			} else if leaf.LeafIndex >= end {
+				end = leaf.LeafIndex + 1
+			}
+		}
+		if err := lt.local.BeginSequencing(lt.treeID, lt.root.TreeSize, end); err != nil {
+			return err
+		}
+		lt.localTx.EndSequencing(lt.treeID)
+	}
 	err := lt.remote.PutLeaves(ctx, lt.treeID, leaves)
 	if err != nil {
 		return err
@@ -211,6 +325,7 @@ func (lt *logTreeTX) SetMerkleNodes(ctx context.Context, nodes []storage.Node) e
 			return err
 		}
 	}
+	lt.setNodes = append(lt.setNodes, nodes...)
 	return nil
 }
 
@@ -222,14 +337,29 @@ func (lt *logTreeTX) StoreSignedLogRoot(ctx context.Context, root trillian.Signe
 		return fmt.Errorf("root hash does not match what is expected")
 	}
 
-	if err := lt.localTx.StoreRoot(lt.treeID, root, lt.front); err != nil {
+	logRoot := types.LogRootV1{}
+	if err := logRoot.UnmarshalBinary(root.LogRoot); err != nil {
+		return err
+	} else if err := lt.localTx.StoreRoot(lt.treeID, root, lt.front); err != nil {
 		return err
 	}
+	lt.treeSize = int64(logRoot.TreeSize)
+	lt.storedRoot, lt.rootRevision = true, int64(logRoot.Revision)
 
 	return nil
 }
 
 func (lt *logTreeTX) storeSubtrees(subtrees []*storagepb.SubtreeProto) error {
+	rev, err := lt.WriteRevision(context.TODO())
+	if err != nil {
+		return err
+	}
+	lt.flushed = append(lt.flushed, subtrees...)
+	return putSubtrees(lt.localTx, lt.treeID, rev, subtrees)
+}
+
+// putSubtrees writes flushed subtrees to `ltx` at the given tree revision.
+func putSubtrees(ltx *custom.LocalTx, treeID, treeRevision int64, subtrees []*storagepb.SubtreeProto) error {
 	ids := make([]storage.NodeID, 0)
 	for _, subtree := range subtrees {
 		if len(subtree.Prefix) > 8 {
@@ -237,32 +367,46 @@ func (lt *logTreeTX) storeSubtrees(subtrees []*storagepb.SubtreeProto) error {
 		}
 		ids = append(ids, storage.NodeID{subtree.Prefix, 8 * len(subtree.Prefix)})
 	}
-	rev, err := lt.WriteRevision(context.TODO())
-	if err != nil {
-		return err
-	}
-	return lt.localTx.PutSubtrees(lt.treeID, rev, ids, subtrees)
+	return ltx.PutSubtrees(treeID, treeRevision, ids, subtrees)
 }
 
 func (lt *logTreeTX) Commit() error {
+	defer lt.release()
 	if err := lt.emit(sCommit); err != nil {
 		return err
 	} else if lt.queuedLeaves {
+		// Queued leaves are written as they're queued, not on commit.
+		if lt.observer != nil && lt.queued > 0 {
+			lt.observer.LeavesQueued(lt.treeID, lt.queued)
+		}
 		lt.closed = true
 		return nil
 	}
 
+	coords, hashes := lt.completedNodes(lt.treeSize)
 	if err := lt.subtreeCache.Flush(lt.storeSubtrees); err != nil {
 		return err
+	} else if err := lt.localTx.PutCompletedNodes(lt.treeID, coords, hashes); err != nil {
+		return err
 	} else if err := lt.localTx.Commit(); err != nil {
 		return err
 	}
+	if lt.storedRoot && lt.subtrees != nil {
+		lt.subtrees.committed(lt.treeID, lt.rootRevision, lt.flushed)
+	}
+	if lt.dequeued && lt.sequencerRuns != nil {
+		lt.sequencerRuns.Store(lt.treeID, time.Now())
+	}
+	if lt.dequeued && lt.observer != nil {
+		lt.observer.LeavesSequenced(lt.treeID, lt.sequenced, lt.treeSize)
+	}
 
 	lt.closed = true
 	return nil
 }
 
 func (lt *logTreeTX) Rollback() error {
+	lt.release()
 	if err := lt.emit(sRollback); err != nil {
 		return err
 	}
@@ -271,6 +415,7 @@ func (lt *logTreeTX) Rollback() error {
 }
 
 func (lt *logTreeTX) Close() error {
+	lt.release()
 	if err := lt.emit(sClose); err != nil {
 		return err
 	}
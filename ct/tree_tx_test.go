@@ -3,10 +3,16 @@ package ct
 import (
 	"testing"
 
+	"bytes"
+	"context"
 	"fmt"
 	"reflect"
+	"time"
 
+	"github.com/golang/protobuf/proto"
+	"github.com/golang/protobuf/ptypes/timestamp"
 	"github.com/google/trillian"
+	"google.golang.org/grpc/codes"
 )
 
 func TestStructLeaf(t *testing.T) {
@@ -29,11 +35,13 @@ func TestStructQueuedLeaf(t *testing.T) {
 
 func TestDupLeaf(t *testing.T) {
 	in := &trillian.LogLeaf{
-		MerkleLeafHash:   []byte("asdf"),
-		LeafValue:        []byte("fdsa"),
-		ExtraData:        []byte("qwerty"),
-		LeafIndex:        700,
-		LeafIdentityHash: []byte("yuiop"),
+		MerkleLeafHash:     []byte("asdf"),
+		LeafValue:          []byte("fdsa"),
+		ExtraData:          []byte("qwerty"),
+		LeafIndex:          700,
+		LeafIdentityHash:   []byte("yuiop"),
+		QueueTimestamp:     &timestamp.Timestamp{Seconds: 1500000000, Nanos: 1},
+		IntegrateTimestamp: &timestamp.Timestamp{Seconds: 1500000300, Nanos: 2},
 	}
 	out := dupLeaf(in)
 
@@ -41,3 +49,100 @@ func TestDupLeaf(t *testing.T) {
 		t.Fatal("duplicated leaf is not equal to original")
 	}
 }
+
+func TestQueueDuplicateAfterRestart(t *testing.T) {
+	ts := newTestStorage(t)
+	defer ts.close()
+	ts.init(t)
+	ctx := context.Background()
+	tree := &trillian.Tree{TreeId: testTreeID}
+
+	queued, err := ts.QueueLeaves(ctx, tree, testLeaves(t, 0, 3), time.Unix(1500000000, 0))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// Resubmitted leaves are reported as duplicates of the originals, even
+	// after a restart has emptied the leaf cache.
+	ts.restart(t)
+	SetLeafCacheSize(75000)
+	dups, err := ts.QueueLeaves(ctx, tree, testLeaves(t, 0, 4), time.Unix(1500000600, 0))
+	if err != nil {
+		t.Fatal(err)
+	}
+	for i, dup := range dups[:3] {
+		if code := codes.Code(dup.Status.GetCode()); code != codes.AlreadyExists {
+			t.Fatalf("leaf %v: got status %v, wanted %v", i, code, codes.AlreadyExists)
+		} else if !proto.Equal(dup.Leaf.QueueTimestamp, queued[i].Leaf.QueueTimestamp) {
+			t.Fatalf("leaf %v: got queue timestamp %v, wanted %v", i, dup.Leaf.QueueTimestamp, queued[i].Leaf.QueueTimestamp)
+		}
+	}
+	if dups[3].Status != nil {
+		t.Fatalf("new leaf was reported as a duplicate: %v", dups[3].Status)
+	}
+	if count, err := ts.Local.Unsequenced(testTreeID); err != nil {
+		t.Fatal(err)
+	} else if count != 4 {
+		t.Fatalf("got %v unsequenced leaves, wanted 4", count)
+	}
+
+	ts.sequence(t, sClose)
+	ts.check(t, 4)
+
+	// Once they're sequenced, they're reported as duplicates of the sequenced
+	// leaves, including the one at index zero.
+	ts.restart(t)
+	SetLeafCacheSize(75000)
+	leaves := testLeaves(t, 0, 4)
+	dups, err = ts.QueueLeaves(ctx, tree, leaves, time.Unix(1500001200, 0))
+	if err != nil {
+		t.Fatal(err)
+	}
+	for i, dup := range dups {
+		if code := codes.Code(dup.Status.GetCode()); code != codes.AlreadyExists {
+			t.Fatalf("leaf %v: got status %v, wanted %v", i, code, codes.AlreadyExists)
+		} else if !bytes.Equal(dup.Leaf.LeafValue, leaves[i].LeafValue) {
+			t.Fatalf("leaf %v: got duplicate of leaf %v", i, dup.Leaf.LeafIndex)
+		}
+	}
+	if count, err := ts.Local.Unsequenced(testTreeID); err != nil {
+		t.Fatal(err)
+	} else if count != 0 {
+		t.Fatalf("got %v unsequenced leaves, wanted none", count)
+	}
+}
+
+func TestSnapshotIsolation(t *testing.T) {
+	ts := newTestStorage(t)
+	defer ts.close()
+	ts.init(t)
+	ts.queue(t, 0, 5)
+	ts.sequence(t, sClose)
+	ctx := context.Background()
+
+	tx, err := ts.SnapshotForTree(ctx, &trillian.Tree{TreeId: testTreeID})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer tx.Close()
+	rolt := tx.(*readOnlyLogTreeTX)
+
+	// Leaves sequenced after the transaction started aren't visible to it,
+	// even in the local database's indices.
+	ts.queue(t, 5, 10)
+	ts.sequence(t, sClose)
+	leaf := testLeaves(t, 7, 8)[0]
+	if seqs, err := rolt.snap.GetSequenceByMerkleHash(testTreeID, [][]byte{leaf.MerkleLeafHash}); err != nil {
+		t.Fatal(err)
+	} else if seqs[0] != -1 {
+		t.Fatalf("transaction sees leaf %v, which was sequenced after it started", seqs[0])
+	}
+	if size, err := tx.GetSequencedLeafCount(ctx); err != nil {
+		t.Fatal(err)
+	} else if size != 5 {
+		t.Fatalf("got tree size %v, wanted 5", size)
+	}
+	if _, err := tx.GetLeavesByIndex(ctx, []int64{0, 4}); err != nil {
+		t.Fatal(err)
+	}
+}
@@ -0,0 +1,107 @@
+package custom
+
+import (
+	"sync"
+
+	"github.com/syndtr/goleveldb/leveldb/cache"
+	"github.com/syndtr/goleveldb/leveldb/opt"
+)
+
+// countingCacher wraps the algorithm of LevelDB's block cache to count how
+// many lookups found a block in the cache, because LevelDB's statistics only
+// include the cache's size.
+//
+// LevelDB promotes a block each time it's looked up and found or read from
+// disk. A block that was just read hasn't been given any cache data by the
+// wrapped algorithm yet, which is how misses are told apart from hits. The
+// cache data is only changed by the wrapped algorithm, so every call to it is
+// made with mu held. Lookups that don't fill the cache, like those of
+// iterators that are told not to, aren't counted when they miss.
+type countingCacher struct {
+	mu     sync.Mutex
+	cacher cache.Cacher
+
+	hits, misses uint64
+}
+
+// withCountingCacher returns a copy of `o` whose block cache is counted by the
+// returned cacher, or nil if the block cache is disabled. The cacher is created
+// when the database is opened.
+func withCountingCacher(o *opt.Options) (*opt.Options, *countingCacher) {
+	if o.GetDisableBlockCache() || o.GetBlockCacher() == nil || o.GetBlockCacheCapacity() == 0 {
+		return o, nil
+	}
+	wrapped := &opt.Options{}
+	if o != nil {
+		*wrapped = *o
+	}
+	cc := &countingCacher{}
+	inner := o.GetBlockCacher()
+	wrapped.BlockCacher = &opt.CacherFunc{NewFunc: func(capacity int) cache.Cacher {
+		cc.mu.Lock()
+		defer cc.mu.Unlock()
+		cc.cacher = inner.New(capacity)
+		return cc
+	}}
+	return wrapped, cc
+}
+
+// requests returns the number of lookups that hit and missed the cache.
+func (cc *countingCacher) requests() (hits, misses uint64) {
+	cc.mu.Lock()
+	defer cc.mu.Unlock()
+	return cc.hits, cc.misses
+}
+
+func (cc *countingCacher) Capacity() int {
+	cc.mu.Lock()
+	defer cc.mu.Unlock()
+	return cc.cacher.Capacity()
+}
+
+func (cc *countingCacher) SetCapacity(capacity int) {
+	cc.mu.Lock()
+	defer cc.mu.Unlock()
+	cc.cacher.SetCapacity(capacity)
+}
+
+func (cc *countingCacher) Promote(n *cache.Node) {
+	cc.mu.Lock()
+	defer cc.mu.Unlock()
+	if n.CacheData == nil {
+		cc.misses++
+	} else {
+		cc.hits++
+	}
+	cc.cacher.Promote(n)
+}
+
+func (cc *countingCacher) Ban(n *cache.Node) {
+	cc.mu.Lock()
+	defer cc.mu.Unlock()
+	cc.cacher.Ban(n)
+}
+
+func (cc *countingCacher) Evict(n *cache.Node) {
+	cc.mu.Lock()
+	defer cc.mu.Unlock()
+	cc.cacher.Evict(n)
+}
+
+func (cc *countingCacher) EvictNS(ns uint64) {
+	cc.mu.Lock()
+	defer cc.mu.Unlock()
+	cc.cacher.EvictNS(ns)
+}
+
+func (cc *countingCacher) EvictAll() {
+	cc.mu.Lock()
+	defer cc.mu.Unlock()
+	cc.cacher.EvictAll()
+}
+
+func (cc *countingCacher) Close() error {
+	cc.mu.Lock()
+	defer cc.mu.Unlock()
+	return cc.cacher.Close()
+}
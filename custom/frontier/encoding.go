@@ -0,0 +1,87 @@
+package frontier
+
+import (
+	"encoding/binary"
+	"fmt"
+)
+
+// encodingVersion is the version of the binary encoding produced by
+// MarshalBinary.
+const encodingVersion = 1
+
+// MarshalBinary returns the binary encoding of the frontier, which is:
+//
+//   0x00 || version || uvarint(len(Roots)) || root_0 || ... || root_n-1
+//
+// where each root is encoded as uvarint(len(root)) || root, and a nil root is
+// encoded with length zero. The leading zero byte is never the first byte of a
+// gob stream, which lets readers tell this encoding apart from the gob
+// encoding used by older versions of the log.
+func (f *Frontier) MarshalBinary() ([]byte, error) {
+	out := make([]byte, 2, 2+binary.MaxVarintLen64+len(f.Roots)*(1+32))
+	out[0], out[1] = 0x00, encodingVersion
+
+	out = appendUvarint(out, uint64(len(f.Roots)))
+	for _, root := range f.Roots {
+		out = appendUvarint(out, uint64(len(root)))
+		out = append(out, root...)
+	}
+
+	return out, nil
+}
+
+// UnmarshalBinary parses a frontier that was serialized with MarshalBinary.
+func (f *Frontier) UnmarshalBinary(in []byte) error {
+	if !IsBinary(in) {
+		return fmt.Errorf("frontier: data is not in the binary encoding")
+	} else if in[1] != encodingVersion {
+		return fmt.Errorf("frontier: unknown encoding version: %v", in[1])
+	}
+	in = in[2:]
+
+	count, n := binary.Uvarint(in)
+	if n <= 0 {
+		return fmt.Errorf("frontier: failed to read number of roots")
+	} else if count > 64 {
+		return fmt.Errorf("frontier: too many roots: %v", count)
+	}
+	in = in[n:]
+
+	roots := make([][]byte, 0, count)
+	for i := uint64(0); i < count; i++ {
+		size, n := binary.Uvarint(in)
+		if n <= 0 {
+			return fmt.Errorf("frontier: failed to read length of root #%v", i)
+		} else if size > uint64(len(in)-n) {
+			return fmt.Errorf("frontier: root #%v is truncated", i)
+		}
+		in = in[n:]
+
+		if size == 0 {
+			roots = append(roots, nil)
+			continue
+		}
+		root := make([]byte, size)
+		copy(root, in[:size])
+		roots = append(roots, root)
+		in = in[size:]
+	}
+	if len(in) > 0 {
+		return fmt.Errorf("frontier: unexpected data after last root")
+	}
+
+	f.Roots = roots
+	return nil
+}
+
+// IsBinary returns true if `in` looks like the output of MarshalBinary, rather
+// than a legacy gob-encoded frontier.
+func IsBinary(in []byte) bool {
+	return len(in) >= 2 && in[0] == 0x00
+}
+
+func appendUvarint(out []byte, x uint64) []byte {
+	buff := make([]byte, binary.MaxVarintLen64)
+	n := binary.PutUvarint(buff, x)
+	return append(out, buff[:n]...)
+}
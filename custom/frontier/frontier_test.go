@@ -5,6 +5,7 @@ import (
 
 	"bytes"
 	"crypto/rand"
+	"reflect"
 
 	"github.com/google/trillian"
 	"github.com/google/trillian/merkle"
@@ -51,3 +52,42 @@ func TestTreeHead(t *testing.T) {
 		t.Fatal("trees with a random number of leaves are hashed incorrectly")
 	}
 }
+
+func TestMarshalBinary(t *testing.T) {
+	for _, leaves := range []int{0, 1, 2, 7, 128, 1000} {
+		f := &Frontier{}
+		for i := 0; i < leaves; i++ {
+			f.Append(hashDomain(0x00, []byte{byte(i), byte(i >> 8)}))
+		}
+
+		raw, err := f.MarshalBinary()
+		if err != nil {
+			t.Fatal(err)
+		} else if !IsBinary(raw) {
+			t.Fatalf("leaves=%v: encoding is not recognized as binary", leaves)
+		}
+		g := &Frontier{}
+		if err := g.UnmarshalBinary(raw); err != nil {
+			t.Fatalf("leaves=%v: %v", leaves, err)
+		} else if !reflect.DeepEqual(f.Roots, g.Roots) && len(f.Roots)+len(g.Roots) != 0 {
+			t.Fatalf("leaves=%v: decoded frontier is different from original", leaves)
+		} else if !bytes.Equal(f.Head(), g.Head()) {
+			t.Fatalf("leaves=%v: decoded frontier has a different head", leaves)
+		}
+
+		if len(raw) > 3 {
+			if err := g.UnmarshalBinary(raw[:len(raw)-1]); err == nil {
+				t.Fatalf("leaves=%v: truncated frontier was accepted", leaves)
+			}
+		}
+		if err := g.UnmarshalBinary(append(raw, 0x00)); err == nil {
+			t.Fatalf("leaves=%v: frontier with trailing data was accepted", leaves)
+		}
+	}
+}
+
+func TestUnmarshalBinaryVersion(t *testing.T) {
+	if err := (&Frontier{}).UnmarshalBinary([]byte{0x00, 0x02, 0x00}); err == nil {
+		t.Fatal("frontier with unknown version was accepted")
+	}
+}
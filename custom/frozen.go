@@ -0,0 +1,45 @@
+package custom
+
+import (
+	"context"
+	"fmt"
+
+	"github.com/syndtr/goleveldb/leveldb"
+	"github.com/syndtr/goleveldb/leveldb/opt"
+)
+
+// PutFrozenSTH records the final signed tree head of a log that has been
+// frozen. `sth` is the get-sth response that the log serves from then on.
+func (l *Local) PutFrozenSTH(treeID int64, sth []byte) error {
+	return l.db.Put(keyS('f', treeID, "sth"), sth, &opt.WriteOptions{Sync: true})
+}
+
+// GetFrozenSTH returns the final signed tree head of a log, or nil if it
+// hasn't been frozen.
+func (l *Local) GetFrozenSTH(treeID int64) ([]byte, error) {
+	sth, err := l.db.Get(keyS('f', treeID, "sth"), nil)
+	if err == leveldb.ErrNotFound {
+		return nil, nil
+	}
+	return sth, err
+}
+
+// PutFrozenSTH publishes the final signed tree head of a log that has been
+// frozen, so that it's kept with the log's leaves.
+func (r *Remote) PutFrozenSTH(ctx context.Context, treeID int64, sth []byte) error {
+	return r.store.Put(ctx, frozenSTHName(treeID), sth)
+}
+
+// GetFrozenSTH returns the final signed tree head of a log that was published
+// with PutFrozenSTH, or nil if there isn't one.
+func (r *Remote) GetFrozenSTH(ctx context.Context, treeID int64) ([]byte, error) {
+	sth, err := r.store.Get(ctx, frozenSTHName(treeID))
+	if err == ErrObjectNotFound {
+		return nil, nil
+	}
+	return sth, err
+}
+
+func frozenSTHName(treeID int64) string {
+	return fmt.Sprintf("sth-%v/frozen", treeID)
+}
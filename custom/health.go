@@ -0,0 +1,65 @@
+package custom
+
+import (
+	"bytes"
+	"context"
+	"crypto/rand"
+	"fmt"
+)
+
+// Ping checks that the local database can be written to and read from, by
+// writing a random value, reading it back, and deleting it.
+func (l *Local) Ping() error {
+	key := keyS('v', 0, "health")
+	val := make([]byte, 16)
+	if _, err := rand.Read(val); err != nil {
+		return err
+	}
+
+	if err := l.db.Put(key, val, nil); err != nil {
+		return fmt.Errorf("failed to write to local database: %v", err)
+	}
+	got, err := l.db.Get(key, nil)
+	if err != nil {
+		return fmt.Errorf("failed to read from local database: %v", err)
+	} else if !bytes.Equal(got, val) {
+		return fmt.Errorf("local database returned %x, but %x was written", got, val)
+	} else if err := l.db.Delete(key, nil); err != nil {
+		return fmt.Errorf("failed to delete from local database: %v", err)
+	}
+	return nil
+}
+
+// Ping checks that the remote database is reachable. It asks the data host
+// itself, because a cache in front of it can keep answering while it's down.
+func (r *Remote) Ping(ctx context.Context) error {
+	if err := r.store.Ping(ctx); err != nil {
+		return fmt.Errorf("failed to reach remote database: %v", err)
+	}
+	return nil
+}
+
+// Probe checks that the remote database can be written to and read from, by
+// writing random contents to the `health` object, reading them back from the
+// data host itself, and then purging every version of the object. The name is
+// fixed, so that a probe that fails part of the way through doesn't leave a new
+// object behind, and is cleaned up by the next one.
+func (r *Remote) Probe(ctx context.Context) error {
+	name, val := "health", make([]byte, 16)
+	if _, err := rand.Read(val); err != nil {
+		return err
+	}
+
+	if err := r.store.Put(ctx, name, val); err != nil {
+		return fmt.Errorf("failed to write to remote database: %v", err)
+	}
+	got, err := r.store.GetDirect(ctx, name)
+	if err != nil {
+		return fmt.Errorf("failed to read from remote database: %v", err)
+	} else if !bytes.Equal(got, val) {
+		return fmt.Errorf("remote database returned %x, but %x was written", got, val)
+	} else if err := r.store.Purge(ctx, name); err != nil {
+		return fmt.Errorf("failed to delete from remote database: %v", err)
+	}
+	return nil
+}
@@ -0,0 +1,29 @@
+package custom_test
+
+import (
+	"testing"
+
+	"context"
+
+	"github.com/cloudflare/ct-log/custom"
+	"github.com/cloudflare/ct-log/internal/remotetest"
+)
+
+func TestRemoteProbe(t *testing.T) {
+	store := remotetest.NewMemoryStore()
+	remote := custom.NewRemoteWithStore(store)
+	ctx := context.Background()
+
+	// Each probe writes the same object, and purges it afterwards.
+	for i := 0; i < 2; i++ {
+		if err := remote.Probe(ctx); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if n := store.Len(); n != 0 {
+		t.Fatalf("probe left %v objects in remote database", n)
+	}
+	if err := remote.Ping(ctx); err != nil {
+		t.Fatal(err)
+	}
+}
@@ -0,0 +1,152 @@
+package custom
+
+import (
+	"encoding/binary"
+	"fmt"
+
+	"github.com/google/trillian"
+	"github.com/google/trillian/types"
+	"github.com/syndtr/goleveldb/leveldb"
+	"github.com/syndtr/goleveldb/leveldb/util"
+)
+
+// ErrRootNotFound is returned when no signed tree head in a log's history
+// matches a query.
+var ErrRootNotFound = fmt.Errorf("no matching signed tree head found")
+
+// putHistory adds a signed tree head to the log's history. The history is
+// stored twice: under `h` it is indexed by timestamp, and under `t` by tree
+// size and then timestamp, so that it can be searched either way.
+func putHistory(batch *leveldb.Batch, treeID int64, rootRaw, sig []byte) error {
+	root := types.LogRootV1{}
+	if err := root.UnmarshalBinary(rootRaw); err != nil {
+		return err
+	}
+
+	val := make([]byte, binary.MaxVarintLen64, binary.MaxVarintLen64+len(rootRaw)+len(sig))
+	n := binary.PutUvarint(val, uint64(len(rootRaw)))
+	val = append(val[:n], rootRaw...)
+	val = append(val, sig...)
+
+	batch.Put(keyB('h', treeID, be64(root.TimestampNanos)), val)
+	batch.Put(keyB('t', treeID, append(be64(root.TreeSize), be64(root.TimestampNanos)...)), nil)
+
+	return nil
+}
+
+// GetRootByTreeSize returns the first signed tree head that the log signed with
+// the given tree size.
+func (l *Local) GetRootByTreeSize(treeID, treeSize int64) (trillian.SignedLogRoot, error) {
+	snap, err := l.db.GetSnapshot()
+	if err != nil {
+		return trillian.SignedLogRoot{}, err
+	}
+	defer snap.Release()
+
+	prefix := keyB('t', treeID, be64(uint64(treeSize)))
+	iter := snap.NewIterator(util.BytesPrefix(prefix), nil)
+	var ts []byte
+	if iter.Next() {
+		ts = dupSlice(iter.Key()[len(prefix):])
+	}
+	iter.Release()
+	if err := iter.Error(); err != nil {
+		return trillian.SignedLogRoot{}, err
+	} else if ts == nil {
+		return trillian.SignedLogRoot{}, ErrRootNotFound
+	}
+
+	val, err := snap.Get(keyB('h', treeID, ts), nil)
+	if err == leveldb.ErrNotFound {
+		return trillian.SignedLogRoot{}, fmt.Errorf("history index is inconsistent: tree size %v", treeSize)
+	} else if err != nil {
+		return trillian.SignedLogRoot{}, err
+	}
+	return parseHistory(treeID, val)
+}
+
+// GetRootAtTime returns the most recent signed tree head that the log signed at
+// or before `timestamp`, in nanoseconds since the epoch. `timestamp` can't be
+// negative.
+func (l *Local) GetRootAtTime(treeID, timestamp int64) (trillian.SignedLogRoot, error) {
+	if timestamp < 0 {
+		return trillian.SignedLogRoot{}, fmt.Errorf("timestamp cannot be less than zero")
+	}
+	snap, err := l.db.GetSnapshot()
+	if err != nil {
+		return trillian.SignedLogRoot{}, err
+	}
+	defer snap.Release()
+
+	iter := snap.NewIterator(&util.Range{
+		Start: keyB('h', treeID, nil),
+		Limit: keyB('h', treeID, be64(uint64(timestamp)+1)),
+	}, nil)
+	var val []byte
+	if iter.Last() {
+		val = dupSlice(iter.Value())
+	}
+	iter.Release()
+	if err := iter.Error(); err != nil {
+		return trillian.SignedLogRoot{}, err
+	} else if val == nil {
+		return trillian.SignedLogRoot{}, ErrRootNotFound
+	}
+
+	return parseHistory(treeID, val)
+}
+
+// ListRoots returns up to `limit` signed tree heads that the log signed in the
+// time range [start, end), in nanoseconds since the epoch. They're returned in
+// the order they were signed.
+func (l *Local) ListRoots(treeID, start, end int64, limit int) ([]trillian.SignedLogRoot, error) {
+	out := make([]trillian.SignedLogRoot, 0)
+	if start < 0 {
+		start = 0
+	}
+	if end <= start {
+		return out, nil
+	}
+
+	snap, err := l.db.GetSnapshot()
+	if err != nil {
+		return nil, err
+	}
+	defer snap.Release()
+
+	iter := snap.NewIterator(&util.Range{
+		Start: keyB('h', treeID, be64(uint64(start))),
+		Limit: keyB('h', treeID, be64(uint64(end))),
+	}, nil)
+	for len(out) < limit && iter.Next() {
+		root, err := parseHistory(treeID, dupSlice(iter.Value()))
+		if err != nil {
+			iter.Release()
+			return nil, err
+		}
+		out = append(out, root)
+	}
+	iter.Release()
+	if err := iter.Error(); err != nil {
+		return nil, err
+	}
+
+	return out, nil
+}
+
+func parseHistory(treeID int64, val []byte) (trillian.SignedLogRoot, error) {
+	size, n := binary.Uvarint(val)
+	if n <= 0 || size > uint64(len(val)-n) {
+		return trillian.SignedLogRoot{}, fmt.Errorf("malformed entry in history")
+	}
+	rootRaw, sig := val[n:n+int(size)], val[n+int(size):]
+
+	return signedLogRoot(treeID, rootRaw, sig)
+}
+
+// be64 returns the big-endian encoding of x.
+func be64(x uint64) []byte {
+	out := make([]byte, 8)
+	binary.BigEndian.PutUint64(out, x)
+	return out
+}
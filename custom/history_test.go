@@ -0,0 +1,79 @@
+package custom
+
+import (
+	"testing"
+
+	"os"
+
+	"github.com/cloudflare/ct-log/custom/frontier"
+
+	"github.com/google/trillian"
+	"github.com/google/trillian/types"
+)
+
+func TestHistory(t *testing.T) {
+	path := tempLocalPath(t)
+	defer os.RemoveAll(path)
+
+	local, err := NewLocal(path, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer local.Close()
+
+	// Sign roots at t=10,20,...,100 where the tree grows every other root.
+	for i := int64(1); i <= 10; i++ {
+		root := types.LogRootV1{TreeSize: uint64(i / 2), TimestampNanos: uint64(10 * i), Revision: uint64(i)}
+		rootRaw, err := root.MarshalBinary()
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		ltx := local.Begin()
+		sth := trillian.SignedLogRoot{LogRoot: rootRaw, LogRootSignature: []byte{byte(i)}}
+		if err := ltx.StoreRoot(1, sth, frontier.Frontier{}); err != nil {
+			t.Fatal(err)
+		} else if err := ltx.Commit(); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	sth, err := local.GetRootByTreeSize(1, 3)
+	if err != nil {
+		t.Fatal(err)
+	} else if sth.TimestampNanos != 60 || sth.LogRootSignature[0] != 6 {
+		t.Fatalf("wrong root for tree size 3: %v", sth)
+	}
+	if _, err := local.GetRootByTreeSize(1, 6); err != ErrRootNotFound {
+		t.Fatalf("unexpected error for missing tree size: %v", err)
+	}
+
+	sth, err = local.GetRootAtTime(1, 55)
+	if err != nil {
+		t.Fatal(err)
+	} else if sth.TimestampNanos != 50 {
+		t.Fatalf("wrong root at time 55: %v", sth)
+	}
+	if _, err := local.GetRootAtTime(1, 5); err != ErrRootNotFound {
+		t.Fatalf("unexpected error for time before first root: %v", err)
+	}
+	if _, err := local.GetRootAtTime(2, 55); err != ErrRootNotFound {
+		t.Fatalf("unexpected error for unknown tree: %v", err)
+	}
+	if sth, err := local.GetRootAtTime(1, -2); err == nil {
+		t.Fatalf("expected error for negative time, got root: %v", sth)
+	}
+
+	sths, err := local.ListRoots(1, 20, 80, 100)
+	if err != nil {
+		t.Fatal(err)
+	} else if len(sths) != 6 || sths[0].TimestampNanos != 20 || sths[5].TimestampNanos != 70 {
+		t.Fatalf("wrong roots listed: %v", sths)
+	}
+	sths, err = local.ListRoots(1, 0, 1000, 3)
+	if err != nil {
+		t.Fatal(err)
+	} else if len(sths) != 3 {
+		t.Fatalf("limit was not respected: %v", len(sths))
+	}
+}
@@ -0,0 +1,63 @@
+package custom
+
+import (
+	"encoding/binary"
+	"fmt"
+
+	"github.com/syndtr/goleveldb/leveldb"
+	"github.com/syndtr/goleveldb/leveldb/opt"
+)
+
+// The sequencing journal records which leaves a sequencing run is about to
+// upload to remote storage, before it uploads them. The journal entry is
+// removed in the same transaction that commits the run. If the process dies in
+// between, the journal entry is left behind, and tells the log on startup which
+// uploaded leaves were never committed.
+
+// BeginSequencing durably records that leaves with indices in [start, end) are
+// about to be uploaded to remote storage for the tree with the given treeID. If
+// an unfinished run is already recorded from the same starting point, the
+// journal covers both runs.
+func (l *Local) BeginSequencing(treeID, start, end int64) error {
+	if start < 0 || end < start {
+		return fmt.Errorf("invalid range to sequence: [%v, %v)", start, end)
+	}
+
+	prevStart, prevEnd, ok, err := l.PendingSequencing(treeID)
+	if err != nil {
+		return err
+	} else if ok && prevStart != start {
+		return fmt.Errorf("unfinished sequencing run from %v needs to be recovered first", prevStart)
+	} else if ok && prevEnd > end {
+		end = prevEnd
+	}
+
+	val := append(be64(uint64(start)), be64(uint64(end))...)
+	return l.db.Put(keyS('j', treeID, "sequencing"), val, &opt.WriteOptions{Sync: true})
+}
+
+// PendingSequencing returns the range of leaf indices of the unfinished
+// sequencing run of the tree with the given treeID, if there is one.
+func (l *Local) PendingSequencing(treeID int64) (start, end int64, ok bool, err error) {
+	val, err := l.db.Get(keyS('j', treeID, "sequencing"), nil)
+	if err == leveldb.ErrNotFound {
+		return 0, 0, false, nil
+	} else if err != nil {
+		return 0, 0, false, err
+	} else if len(val) != 16 {
+		return 0, 0, false, fmt.Errorf("malformed entry in sequencing journal")
+	}
+	return int64(binary.BigEndian.Uint64(val[:8])), int64(binary.BigEndian.Uint64(val[8:])), true, nil
+}
+
+// ClearSequencing removes the journal entry of the tree with the given treeID,
+// once its unfinished sequencing run has been recovered.
+func (l *Local) ClearSequencing(treeID int64) error {
+	return l.db.Delete(keyS('j', treeID, "sequencing"), &opt.WriteOptions{Sync: true})
+}
+
+// EndSequencing removes the journal entry of the tree with the given treeID
+// when the transaction is committed.
+func (ltx *LocalTx) EndSequencing(treeID int64) {
+	ltx.batch.Delete(keyS('j', treeID, "sequencing"))
+}
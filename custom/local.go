@@ -6,10 +6,12 @@ import (
 	"encoding/binary"
 	"encoding/gob"
 	"fmt"
+	"sync"
 
 	"github.com/cloudflare/ct-log/custom/frontier"
 
 	"github.com/golang/protobuf/proto"
+	"github.com/golang/protobuf/ptypes/timestamp"
 	"github.com/google/trillian"
 	"github.com/google/trillian/storage"
 	"github.com/google/trillian/storage/storagepb"
@@ -41,47 +43,87 @@ func keyB(typ byte, treeID int64, val []byte) []byte {
 // frequently accessed.
 type Local struct {
 	db *leveldb.DB
+
+	// queueMu serializes QueueLeaves, so that two leaves with the same
+	// identity hash can't both be queued, and guards frozen.
+	queueMu sync.Mutex
+	// frozen is the set of trees that leaves can't be queued for.
+	frozen map[int64]bool
+
+	// blockCache counts the lookups in LevelDB's block cache, or is nil if
+	// it's disabled.
+	blockCache *countingCacher
 }
 
-// NewLocal returns a new local database, with data stored at `path`.
-func NewLocal(path string) (*Local, error) {
-	db, err := leveldb.OpenFile(path, nil)
+// ErrTreeFrozen is returned by QueueLeaves when the tree is being frozen, or
+// has been.
+var ErrTreeFrozen = fmt.Errorf("tree is frozen")
+
+// NewLocal returns a new local database, with data stored at `path`. `o` may be
+// nil to use LevelDB's default options. Any pending schema migrations are
+// applied before it is returned, unless `o` opens the database read-only, in
+// which case the database must already be at the current schema version.
+func NewLocal(path string, o *opt.Options) (*Local, error) {
+	o, blockCache := withCountingCacher(o)
+	db, err := leveldb.OpenFile(path, o)
+	if err != nil {
+		return nil, err
+	}
+	if o.GetReadOnly() {
+		err = checkSchemaVersion(db)
+	} else {
+		err = migrate(db)
+	}
 	if err != nil {
+		db.Close()
+		return nil, err
+	}
+	return &Local{db: db, frozen: make(map[int64]bool), blockCache: blockCache}, nil
+}
+
+// Close closes the local database.
+func (l *Local) Close() error {
+	return l.db.Close()
+}
+
+// Stats returns LevelDB's internal statistics about the local database.
+func (l *Local) Stats() (*leveldb.DBStats, error) {
+	stats := &leveldb.DBStats{}
+	if err := l.db.Stats(stats); err != nil {
 		return nil, err
 	}
-	return &Local{db}, nil
+	return stats, nil
+}
+
+// BlockCacheRequests returns the number of lookups in LevelDB's block cache
+// that found the block in the cache (hits), and that read it from disk
+// (misses). Both are zero if the block cache is disabled.
+func (l *Local) BlockCacheRequests() (hits, misses uint64) {
+	if l.blockCache == nil {
+		return 0, 0
+	}
+	return l.blockCache.requests()
 }
 
 // MostRecentRoot returns most-recently committed root for the tree with the
 // given treeID.
 func (l *Local) MostRecentRoot(treeID int64) (trillian.SignedLogRoot, frontier.Frontier, error) {
-	snap, err := l.db.GetSnapshot()
+	snap, err := l.Snapshot()
 	if err != nil {
 		return trillian.SignedLogRoot{}, frontier.Frontier{}, err
 	}
 	defer snap.Release()
+	return snap.MostRecentRoot(treeID)
+}
 
-	rootRaw, err := snap.Get(keyS('r', treeID, "root"), nil)
-	if err == leveldb.ErrNotFound {
-		return trillian.SignedLogRoot{}, frontier.Frontier{}, storage.ErrTreeNeedsInit
-	} else if err != nil {
-		return trillian.SignedLogRoot{}, frontier.Frontier{}, err
-	}
-	sig, err := snap.Get(keyS('r', treeID, "sig"), nil)
-	if err != nil {
-		return trillian.SignedLogRoot{}, frontier.Frontier{}, err
-	}
-	frontRaw, err := snap.Get(keyS('r', treeID, "frontier"), nil)
-	if err != nil {
-		return trillian.SignedLogRoot{}, frontier.Frontier{}, err
-	}
-	rootRaw, sig, frontRaw = dupSlice(rootRaw), dupSlice(sig), dupSlice(frontRaw)
-
+// signedLogRoot builds a SignedLogRoot from a serialized types.LogRootV1 and
+// its signature.
+func signedLogRoot(treeID int64, rootRaw, sig []byte) (trillian.SignedLogRoot, error) {
 	root := types.LogRootV1{}
-	if err = root.UnmarshalBinary(rootRaw); err != nil {
-		return trillian.SignedLogRoot{}, frontier.Frontier{}, err
+	if err := root.UnmarshalBinary(rootRaw); err != nil {
+		return trillian.SignedLogRoot{}, err
 	}
-	sth := trillian.SignedLogRoot{
+	return trillian.SignedLogRoot{
 		TimestampNanos: int64(root.TimestampNanos),
 		RootHash:       root.RootHash,
 		TreeSize:       int64(root.TreeSize),
@@ -90,169 +132,230 @@ func (l *Local) MostRecentRoot(treeID int64) (trillian.SignedLogRoot, frontier.F
 		KeyHint:          types.SerializeKeyHint(treeID),
 		LogRoot:          rootRaw,
 		LogRootSignature: sig,
-	}
+	}, nil
+}
 
+// parseFrontier decodes a stored frontier. Frontiers written by older versions
+// of the log are gob-encoded; they're still accepted here, and are rewritten in
+// the binary encoding the next time the log signs a root.
+func parseFrontier(raw []byte) (frontier.Frontier, error) {
 	front := frontier.Frontier{}
-	if err = gob.NewDecoder(bytes.NewBuffer(frontRaw)).Decode(&front); err != nil {
-		return trillian.SignedLogRoot{}, frontier.Frontier{}, err
+	if frontier.IsBinary(raw) {
+		if err := front.UnmarshalBinary(raw); err != nil {
+			return frontier.Frontier{}, err
+		}
+		return front, nil
 	}
-
-	return sth, front, nil
+	// The legacy encoding has to be decoded into a type without an
+	// UnmarshalBinary method, or gob will try to use it.
+	legacy := struct{ Roots [][]byte }{}
+	if err := gob.NewDecoder(bytes.NewBuffer(raw)).Decode(&legacy); err != nil {
+		return frontier.Frontier{}, err
+	}
+	front.Roots = legacy.Roots
+	return front, nil
 }
 
-func (l *Local) QueueLeaves(treeID, queueTimestamp int64, leaves []*trillian.LogLeaf) error {
+// QueueLeaves adds leaves to the queue of the tree with the given treeID, and
+// indexes them by identity hash until they're dequeued. The leaves'
+// QueueTimestamp is set to `queueTimestamp`, in nanoseconds since the epoch.
+//
+// Leaves with the same identity hash as a leaf that's already queued or
+// sequenced are not added again. For each leaf, the first returned slice holds
+// the queued leaf that it duplicates, and the second holds the index of the
+// sequenced leaf that it duplicates, or -1.
+func (l *Local) QueueLeaves(treeID, queueTimestamp int64, leaves []*trillian.LogLeaf) ([]*trillian.LogLeaf, []int64, error) {
+	l.queueMu.Lock()
+	defer l.queueMu.Unlock()
+	if l.frozen[treeID] {
+		return nil, nil, ErrTreeFrozen
+	}
+
+	// Leaves are only queued while queueMu is held, and sequenced leaves are
+	// removed from the queue and indexed in the same batch, so the snapshot
+	// has every leaf exactly once.
+	snap, err := l.db.GetSnapshot()
+	if err != nil {
+		return nil, nil, err
+	}
+	defer snap.Release()
+
+	dups, seqs := make([]*trillian.LogLeaf, len(leaves)), make([]int64, len(leaves))
 	batch := new(leveldb.Batch)
-	for _, leaf := range leaves {
+	added := make(map[string]*trillian.LogLeaf)
+	for i, leaf := range leaves {
+		seqs[i] = -1
+		if dup, ok := added[string(leaf.LeafIdentityHash)]; ok {
+			dups[i] = proto.Clone(dup).(*trillian.LogLeaf)
+			continue
+		}
+		dup, err := getQueuedLeaf(snap, treeID, leaf.LeafIdentityHash)
+		if err != nil {
+			return nil, nil, err
+		} else if dup != nil {
+			dups[i] = dup
+			continue
+		}
+		seq, err := getSequencedLeaf(snap, treeID, leaf.LeafIdentityHash)
+		if err != nil {
+			return nil, nil, err
+		} else if seq >= 0 {
+			seqs[i] = seq
+			continue
+		}
+
+		leaf.QueueTimestamp = &timestamp.Timestamp{
+			Seconds: queueTimestamp / 1e9,
+			Nanos:   int32(queueTimestamp % 1e9),
+		}
 		v, err := proto.Marshal(leaf)
 		if err != nil {
-			return err
+			return nil, nil, err
 		}
-		batch.Put(keyB('l', treeID, rowkeyLeaf(queueTimestamp, true)), v)
+		rowkey := rowkeyLeaf(queueTimestamp, true)
+		batch.Put(keyB('l', treeID, rowkey), v)
+		if len(leaf.LeafIdentityHash) > 0 {
+			batch.Put(keyB('q', treeID, leaf.LeafIdentityHash), rowkey)
+			added[string(leaf.LeafIdentityHash)] = leaf
+		}
+	}
+	if err := l.db.Write(batch, &opt.WriteOptions{Sync: true}); err != nil {
+		return nil, nil, err
 	}
-	return l.db.Write(batch, &opt.WriteOptions{Sync: true})
+	return dups, seqs, nil
 }
 
-// Unsequenced returns the number of unsequenced leaves that a log has on disk.
-func (l *Local) Unsequenced(treeID int64) (int, error) {
-	snap, err := l.db.GetSnapshot()
-	if err != nil {
-		return 0, err
+// SetFrozen sets whether leaves can be queued for the tree with the given
+// treeID. Once it returns, no more leaves will be queued for a frozen tree, so
+// its unsequenced leaves can be counted for the last time.
+func (l *Local) SetFrozen(treeID int64, frozen bool) {
+	l.queueMu.Lock()
+	defer l.queueMu.Unlock()
+	if frozen {
+		l.frozen[treeID] = true
+	} else {
+		delete(l.frozen, treeID)
 	}
-	defer snap.Release()
+}
 
-	keys := 0
+// getQueuedLeaf returns the queued leaf with the given identity hash, or nil if
+// there isn't one.
+func getQueuedLeaf(snap *leveldb.Snapshot, treeID int64, id []byte) (*trillian.LogLeaf, error) {
+	if len(id) == 0 {
+		return nil, nil
+	}
+	rowkey, err := snap.Get(keyB('q', treeID, id), nil)
+	if err == leveldb.ErrNotFound {
+		return nil, nil
+	} else if err != nil {
+		return nil, err
+	}
+	raw, err := snap.Get(keyB('l', treeID, rowkey), nil)
+	if err == leveldb.ErrNotFound {
+		return nil, nil
+	} else if err != nil {
+		return nil, err
+	}
+	leaf := &trillian.LogLeaf{}
+	if err := proto.Unmarshal(raw, leaf); err != nil {
+		return nil, err
+	}
+	return leaf, nil
+}
 
-	iter := snap.NewIterator(&util.Range{
-		Start: keyB('l', treeID, rowkeyLeaf(0, false)),
-		Limit: keyB('l', treeID+1, rowkeyLeaf(0, false)),
-	}, nil)
-	for iter.Next() {
-		keys++
+// getSequencedLeaf returns the index of the sequenced leaf with the given
+// identity hash, or -1 if there isn't one.
+func getSequencedLeaf(snap *leveldb.Snapshot, treeID int64, id []byte) (int64, error) {
+	if len(id) == 0 {
+		return -1, nil
 	}
-	iter.Release()
-	if err := iter.Error(); err != nil {
-		return 0, nil
+	raw, err := snap.Get(keyB('i', treeID, id), nil)
+	if err == leveldb.ErrNotFound {
+		return -1, nil
+	} else if err != nil {
+		return 0, err
+	}
+	seq, n := binary.Varint(raw)
+	if n != len(raw) {
+		return 0, fmt.Errorf("malformed entry in index")
 	}
+	return seq, nil
+}
 
-	return keys, nil
+// Unsequenced returns the number of unsequenced leaves that a log has on disk,
+// whether queued or pending.
+func (l *Local) Unsequenced(treeID int64) (int, error) {
+	snap, err := l.Snapshot()
+	if err != nil {
+		return 0, err
+	}
+	defer snap.Release()
+	return snap.Unsequenced(treeID)
 }
 
 // GetSequenceByMerkleHash returns the sequence numbers for the leaves with the
 // given Merkle hashes, in the tree with the given tree id. Missing sequence
 // numbers are returned as -1.
 func (l *Local) GetSequenceByMerkleHash(treeID int64, hashes [][]byte) ([]int64, error) {
-	leaves, err := l.getSequenceBy('m', treeID, hashes)
+	snap, err := l.Snapshot()
 	if err != nil {
-		return nil, fmt.Errorf("failed to lookup by merkle hash: %v", err)
+		return nil, err
 	}
-	return leaves, nil
+	defer snap.Release()
+	return snap.GetSequenceByMerkleHash(treeID, hashes)
 }
 
 // GetSequenceByIdentityHash returns the sequence numbers for the leaves with
 // the given identity hashes, in the tree with the given tree id. Missing
 // sequence numbers are returned as -1.
 func (l *Local) GetSequenceByIdentityHash(treeID int64, hashes [][]byte) ([]int64, error) {
-	leaves, err := l.getSequenceBy('i', treeID, hashes)
+	snap, err := l.Snapshot()
 	if err != nil {
-		return nil, fmt.Errorf("failed to lookup by identity hash: %v", err)
+		return nil, err
 	}
-	return leaves, nil
+	defer snap.Release()
+	return snap.GetSequenceByIdentityHash(treeID, hashes)
 }
 
-func (l *Local) getSequenceBy(typ byte, treeID int64, hashes [][]byte) ([]int64, error) {
-	out := make([]int64, 0, len(hashes))
+// ScanIndex calls fn with each entry of the index by Merkle hash (if
+// byMerkleHash is true) or by identity hash (otherwise) of the tree with the
+// given tree id. Entries are visited in order of their hash.
+func (l *Local) ScanIndex(treeID int64, byMerkleHash bool, fn func(hash []byte, seq int64) error) error {
+	typ := byte('i')
+	if byMerkleHash {
+		typ = 'm'
+	}
+	prefix := keyB(typ, treeID, nil)
 
 	snap, err := l.db.GetSnapshot()
 	if err != nil {
-		return nil, err
+		return err
 	}
 	defer snap.Release()
 
-	for _, hash := range hashes {
-		raw, err := snap.Get(keyB(typ, treeID, hash), nil)
-		if err == leveldb.ErrNotFound {
-			out = append(out, -1)
-			continue
-		} else if err != nil {
-			return nil, err
-		}
-		idx, n := binary.Varint(raw)
-		if n != len(raw) {
-			return nil, fmt.Errorf("malformed entry in index")
+	iter := snap.NewIterator(util.BytesPrefix(prefix), nil)
+	defer iter.Release()
+
+	for iter.Next() {
+		idx, n := binary.Varint(iter.Value())
+		if n != len(iter.Value()) {
+			return fmt.Errorf("malformed entry in index")
+		} else if err := fn(dupSlice(iter.Key()[len(prefix):]), idx); err != nil {
+			return err
 		}
-		out = append(out, idx)
 	}
-
-	return out, nil
+	return iter.Error()
 }
 
 // GetSubtrees returns the most recent revision ( <= treeRevision ) of each
 // subtree with a given id. Missing subtrees are silently elided.
 func (l *Local) GetSubtrees(treeID, treeRevision int64, ids []storage.NodeID) ([]*storagepb.SubtreeProto, error) {
-	out := make([]*storagepb.SubtreeProto, 0, len(ids))
-
-	for i, id := range ids {
-		subtree, err := l.getSubtree(treeID, treeRevision, id)
-		if err != nil {
-			return nil, fmt.Errorf("node id #%v: %v", i+1, err)
-		} else if subtree != nil {
-			out = append(out, subtree)
-		}
-	}
-
-	return out, nil
-}
-
-func (l *Local) getSubtree(treeID, treeRevision int64, id storage.NodeID) (*storagepb.SubtreeProto, error) {
-	start, stop, err := rangeNodeID(treeRevision, id)
-	if err != nil {
-		return nil, err
-	}
-	start, stop = keyB('s', treeID, start), keyB('s', treeID, stop)
-
-	// Get the row with the equivalent rowkey or its immediate predecessor.
-	snap, err := l.db.GetSnapshot()
+	snap, err := l.Snapshot()
 	if err != nil {
 		return nil, err
 	}
 	defer snap.Release()
-
-	iter := snap.NewIterator(nil, nil)
-
-	var k, v []byte
-	if ok := iter.Seek(start); ok {
-		if bytes.Equal(iter.Key(), start) {
-			k, v = iter.Key(), iter.Value()
-		} else if ok := iter.Prev(); ok {
-			k, v = iter.Key(), iter.Value()
-		}
-	} else if ok := iter.Last(); ok {
-		k, v = iter.Key(), iter.Value()
-	}
-	if k != nil && bytes.Compare(k, start) != 1 && bytes.Compare(k, stop) == 1 {
-		k, v = nil, dupSlice(v)
-	} else {
-		k, v = nil, nil
-	}
-
-	iter.Release()
-	if err := iter.Error(); err != nil {
-		return nil, err
-	}
-
-	// Parse the subtree, should we have found one.
-	if v == nil {
-		return nil, nil
-	}
-
-	subtree := &storagepb.SubtreeProto{}
-	if err := proto.Unmarshal(v, subtree); err != nil {
-		return nil, err
-	}
-	if subtree.Prefix == nil {
-		subtree.Prefix = []byte{}
-	}
-	return subtree, nil
+	return snap.GetSubtrees(treeID, treeRevision, ids)
 }
 
 func (l *Local) Begin() *LocalTx {
@@ -278,6 +381,7 @@ func (ltx *LocalTx) DequeueLeaves(treeID, seq, cutoffTime int64, limit int) ([]*
 	}
 	defer snap.Release()
 
+	prefix := keyB('l', treeID, nil)
 	iter := snap.NewIterator(&util.Range{
 		Start: keyB('l', treeID, rowkeyLeaf(0, false)),
 		Limit: keyB('l', treeID, rowkeyLeaf(cutoffTime+1, false)),
@@ -293,6 +397,21 @@ func (ltx *LocalTx) DequeueLeaves(treeID, seq, cutoffTime int64, limit int) ([]*
 
 		ltx.batch.Delete(dupSlice(iter.Key()))
 		leaves = append(leaves, leaf)
+
+		// Remove the leaf from the index of queued leaves, unless the index
+		// points at a different leaf with the same identity hash.
+		if len(leaf.LeafIdentityHash) == 0 {
+			continue
+		}
+		qKey := keyB('q', treeID, leaf.LeafIdentityHash)
+		rowkey, err := snap.Get(qKey, nil)
+		if err == leveldb.ErrNotFound {
+			continue
+		} else if err != nil {
+			return nil, err
+		} else if bytes.Equal(rowkey, iter.Key()[len(prefix):]) {
+			ltx.batch.Delete(qKey)
+		}
 	}
 	iter.Release()
 	if err := iter.Error(); err != nil {
@@ -323,6 +442,18 @@ func (ltx *LocalTx) PutLeaves(treeID int64, seqs []int64, merkleHashes, idHashes
 	return nil
 }
 
+// PutIndex sets a single entry of the index by Merkle hash (if byMerkleHash is
+// true) or by identity hash (otherwise).
+func (ltx *LocalTx) PutIndex(treeID int64, byMerkleHash bool, hash []byte, seq int64) {
+	typ := byte('i')
+	if byMerkleHash {
+		typ = 'm'
+	}
+	raw := make([]byte, binary.MaxVarintLen64)
+	n := binary.PutVarint(raw, seq)
+	ltx.batch.Put(keyB(typ, treeID, hash), raw[:n])
+}
+
 // PutSubtrees serializes the subtrees and writes them to disk, indexed by their
 // id. It is assumed that ids[i] corresponds to subtrees[i].
 func (ltx *LocalTx) PutSubtrees(treeID, treeRevision int64, ids []storage.NodeID, subtrees []*storagepb.SubtreeProto) error {
@@ -346,14 +477,18 @@ func (ltx *LocalTx) PutSubtrees(treeID, treeRevision int64, ids []storage.NodeID
 }
 
 func (ltx *LocalTx) StoreRoot(treeID int64, root trillian.SignedLogRoot, front frontier.Frontier) error {
-	frontRaw := &bytes.Buffer{}
-	if err := gob.NewEncoder(frontRaw).Encode(front); err != nil {
+	frontRaw, err := front.MarshalBinary()
+	if err != nil {
 		return err
 	}
 
 	ltx.batch.Put(keyS('r', treeID, "root"), dupSlice(root.LogRoot))
 	ltx.batch.Put(keyS('r', treeID, "sig"), dupSlice(root.LogRootSignature))
-	ltx.batch.Put(keyS('r', treeID, "frontier"), frontRaw.Bytes())
+	ltx.batch.Put(keyS('r', treeID, "frontier"), frontRaw)
+
+	if err := putHistory(ltx.batch, treeID, root.LogRoot, root.LogRootSignature); err != nil {
+		return err
+	}
 
 	return nil
 }
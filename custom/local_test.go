@@ -3,11 +3,20 @@ package custom
 import (
 	"testing"
 
+	"bytes"
+	"encoding/gob"
 	"fmt"
+	"os"
+	"reflect"
+
+	"github.com/cloudflare/ct-log/custom/frontier"
 
 	"github.com/google/trillian"
 	"github.com/google/trillian/storage"
 	"github.com/google/trillian/storage/storagepb"
+	"github.com/syndtr/goleveldb/leveldb"
+	"github.com/syndtr/goleveldb/leveldb/opt"
+	"github.com/syndtr/goleveldb/leveldb/util"
 )
 
 func TestStructRoot(t *testing.T) {
@@ -48,3 +57,94 @@ func TestStructSubtreeProto(t *testing.T) {
 		t.Fatal("SubtreeProto struct has changed")
 	}
 }
+
+func TestParseFrontier(t *testing.T) {
+	want := frontier.Frontier{}
+	for i := 0; i < 13; i++ {
+		want.Append(make([]byte, 32))
+	}
+
+	legacy := &bytes.Buffer{}
+	if err := gob.NewEncoder(legacy).Encode(struct{ Roots [][]byte }{want.Roots}); err != nil {
+		t.Fatal(err)
+	}
+	current, err := want.MarshalBinary()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	for name, raw := range map[string][]byte{"gob": legacy.Bytes(), "binary": current} {
+		cand, err := parseFrontier(raw)
+		if err != nil {
+			t.Fatalf("%v: %v", name, err)
+		} else if !reflect.DeepEqual(want, cand) {
+			t.Fatalf("%v: parsed frontier is different from original", name)
+		}
+	}
+}
+
+func TestPing(t *testing.T) {
+	path := tempLocalPath(t)
+	defer os.RemoveAll(path)
+
+	local, err := NewLocal(path, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer local.Close()
+
+	if err := local.Ping(); err != nil {
+		t.Fatal(err)
+	} else if _, err := local.db.Get(keyS('v', 0, "health"), nil); err != leveldb.ErrNotFound {
+		t.Fatalf("health check left its scratch value behind: %v", err)
+	}
+}
+
+func TestBlockCacheRequests(t *testing.T) {
+	path := tempLocalPath(t)
+	defer os.RemoveAll(path)
+
+	local, err := NewLocal(path, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer local.Close()
+
+	// Move the values into a table, so that they're read through the block
+	// cache rather than from memory.
+	for i := 0; i < 100; i++ {
+		if err := local.db.Put(keyS('t', 0, fmt.Sprint(i)), []byte{byte(i)}, nil); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if err := local.db.CompactRange(util.Range{}); err != nil {
+		t.Fatal(err)
+	}
+
+	read := func() (hits, misses uint64) {
+		t.Helper()
+		if _, err := local.db.Get(keyS('t', 0, "50"), nil); err != nil {
+			t.Fatal(err)
+		}
+		return local.BlockCacheRequests()
+	}
+	hits, misses := read()
+	if misses == 0 {
+		t.Fatal("first read of a block wasn't counted as a miss")
+	}
+	if hits2, misses2 := read(); misses2 != misses || hits2 <= hits {
+		t.Fatalf("second read of a block counted %v hits and %v misses, wanted more than %v and %v", hits2, misses2, hits, misses)
+	}
+
+	// Nothing is counted when the block cache is disabled.
+	uncachedPath := tempLocalPath(t)
+	defer os.RemoveAll(uncachedPath)
+	uncached, err := NewLocal(uncachedPath, &opt.Options{BlockCacheCapacity: -1})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer uncached.Close()
+	if hits, misses := uncached.BlockCacheRequests(); hits != 0 || misses != 0 {
+		t.Fatalf("uncached database counted %v hits and %v misses", hits, misses)
+	}
+}
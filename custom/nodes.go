@@ -0,0 +1,95 @@
+package custom
+
+import (
+	"encoding/binary"
+	"fmt"
+
+	"github.com/syndtr/goleveldb/leveldb"
+	"github.com/syndtr/goleveldb/leveldb/opt"
+)
+
+// A Merkle node is completed once the tree has all the leaves underneath it.
+// Completed nodes never change, so they're kept under `n`, keyed by level and
+// index, where they can be read at any tree size without searching for the
+// right subtree revision. `c` records how far the nodes of each tree have been
+// backfilled, because trees that predate the store are missing older nodes.
+
+// NodeCoord identifies a Merkle node by its level, where leaves are at level
+// zero, and its index within that level.
+type NodeCoord struct {
+	Level int
+	Index int64
+}
+
+// Completed returns true if the node is completed in a tree of the given size.
+func (nc NodeCoord) Completed(treeSize int64) bool {
+	if nc.Level < 0 || nc.Level >= 63 || nc.Index < 0 {
+		return false
+	}
+	end := (nc.Index + 1) << uint(nc.Level)
+	return end > 0 && end <= treeSize
+}
+
+func keyNode(treeID int64, nc NodeCoord) []byte {
+	return keyB('n', treeID, append([]byte{byte(nc.Level)}, be64(uint64(nc.Index))...))
+}
+
+// GetCompletedNodes returns the hashes of the completed nodes with the given
+// coordinates. Missing nodes are returned as nil.
+func (ls *LocalSnapshot) GetCompletedNodes(treeID int64, coords []NodeCoord) ([][]byte, error) {
+	out := make([][]byte, 0, len(coords))
+	for _, nc := range coords {
+		hash, err := ls.snap.Get(keyNode(treeID, nc), nil)
+		if err == leveldb.ErrNotFound {
+			out = append(out, nil)
+			continue
+		} else if err != nil {
+			return nil, err
+		}
+		out = append(out, hash)
+	}
+	return out, nil
+}
+
+// PutCompletedNodes stores the hashes of completed nodes when the transaction
+// is committed. It is assumed that coords[i] corresponds to hashes[i].
+func (ltx *LocalTx) PutCompletedNodes(treeID int64, coords []NodeCoord, hashes [][]byte) error {
+	if len(coords) != len(hashes) {
+		return fmt.Errorf("different number of coordinates than hashes")
+	}
+	for i, nc := range coords {
+		ltx.batch.Put(keyNode(treeID, nc), dupSlice(hashes[i]))
+	}
+	return nil
+}
+
+// PutCompletedNodes immediately stores the hashes of completed nodes. It is
+// used to backfill nodes, which is safe to do alongside the sequencer because
+// completed nodes never change.
+func (l *Local) PutCompletedNodes(treeID int64, coords []NodeCoord, hashes [][]byte) error {
+	ltx := l.Begin()
+	if err := ltx.PutCompletedNodes(treeID, coords, hashes); err != nil {
+		return err
+	}
+	return l.db.Write(ltx.batch, nil)
+}
+
+// NodesBackfilled returns the tree size up to which the completed nodes of the
+// tree with the given treeID have been backfilled, or false if they haven't.
+func (l *Local) NodesBackfilled(treeID int64) (int64, bool, error) {
+	val, err := l.db.Get(keyS('c', treeID, "backfill"), nil)
+	if err == leveldb.ErrNotFound {
+		return 0, false, nil
+	} else if err != nil {
+		return 0, false, err
+	} else if len(val) != 8 {
+		return 0, false, fmt.Errorf("malformed backfill marker")
+	}
+	return int64(binary.BigEndian.Uint64(val)), true, nil
+}
+
+// SetNodesBackfilled records that every node completed in a tree of size
+// `treeSize` is stored.
+func (l *Local) SetNodesBackfilled(treeID, treeSize int64) error {
+	return l.db.Put(keyS('c', treeID, "backfill"), be64(uint64(treeSize)), &opt.WriteOptions{Sync: true})
+}
@@ -0,0 +1,137 @@
+package custom
+
+import (
+	"encoding/binary"
+	"fmt"
+
+	"github.com/golang/protobuf/proto"
+	"github.com/golang/protobuf/ptypes/timestamp"
+	"github.com/google/trillian"
+	"github.com/google/trillian/storage"
+	"github.com/google/trillian/types"
+	"github.com/syndtr/goleveldb/leveldb"
+	"github.com/syndtr/goleveldb/leveldb/util"
+)
+
+// Pre-ordered logs, like mirrors, receive leaves that have already been
+// assigned an index. They're kept under `p`, keyed by index, until the
+// sequencer integrates them into the tree.
+
+// ErrLeafGap is returned by AddSequencedLeaves when the given leaves don't
+// follow on from the leaves that the tree already has.
+var ErrLeafGap = fmt.Errorf("leaves would leave a gap in the tree")
+
+// AddSequencedLeaves stores leaves of a pre-ordered log until they're
+// integrated. The leaves' indices must be contiguous, and the first must be at
+// most the index right after the last leaf that's integrated or pending. The
+// leaves' QueueTimestamp is set to `queueTimestamp`, in nanoseconds since the
+// epoch.
+//
+// The returned slice says, for each leaf, whether it conflicted with a leaf
+// that's already integrated or pending at the same index. Conflicting leaves
+// aren't stored.
+func (l *Local) AddSequencedLeaves(treeID, queueTimestamp int64, leaves []*trillian.LogLeaf) ([]bool, error) {
+	for i, leaf := range leaves {
+		if leaf.LeafIndex < 0 {
+			return nil, fmt.Errorf("leaf has negative index %v", leaf.LeafIndex)
+		} else if i > 0 && leaf.LeafIndex != leaves[i-1].LeafIndex+1 {
+			return nil, fmt.Errorf("leaf indices are not contiguous: %v follows %v", leaf.LeafIndex, leaves[i-1].LeafIndex)
+		}
+	}
+	if len(leaves) == 0 {
+		return nil, nil
+	}
+
+	// A transaction blocks other writes, including commits of the sequencer,
+	// so the tree size and pending leaves can't change until it's done.
+	tr, err := l.db.OpenTransaction()
+	if err != nil {
+		return nil, err
+	}
+	defer tr.Discard()
+
+	rootRaw, err := tr.Get(keyS('r', treeID, "root"), nil)
+	if err == leveldb.ErrNotFound {
+		return nil, storage.ErrTreeNeedsInit
+	} else if err != nil {
+		return nil, err
+	}
+	root := types.LogRootV1{}
+	if err := root.UnmarshalBinary(rootRaw); err != nil {
+		return nil, err
+	}
+	treeSize := int64(root.TreeSize)
+
+	next := treeSize
+	iter := tr.NewIterator(util.BytesPrefix(keyB('p', treeID, nil)), nil)
+	if iter.Last() {
+		key := iter.Key()
+		if idx := int64(binary.BigEndian.Uint64(key[len(key)-8:])) + 1; idx > next {
+			next = idx
+		}
+	}
+	iter.Release()
+	if err := iter.Error(); err != nil {
+		return nil, err
+	} else if leaves[0].LeafIndex > next {
+		return nil, ErrLeafGap
+	}
+
+	conflicts := make([]bool, len(leaves))
+	for i, leaf := range leaves {
+		if leaf.LeafIndex < next {
+			conflicts[i] = true
+			continue
+		}
+		leaf.QueueTimestamp = &timestamp.Timestamp{
+			Seconds: queueTimestamp / 1e9,
+			Nanos:   int32(queueTimestamp % 1e9),
+		}
+		v, err := proto.Marshal(leaf)
+		if err != nil {
+			return nil, err
+		} else if err := tr.Put(keyB('p', treeID, be64(uint64(leaf.LeafIndex))), v, nil); err != nil {
+			return nil, err
+		}
+	}
+
+	if err := tr.Commit(); err != nil {
+		return nil, err
+	}
+	return conflicts, nil
+}
+
+// DequeueSequencedLeaves returns up to `limit` pending leaves of a pre-ordered
+// log, starting at index `seq`, and stopping at the first missing index. The
+// leaves are removed from storage when the transaction is committed.
+func (ltx *LocalTx) DequeueSequencedLeaves(treeID, seq int64, limit int) ([]*trillian.LogLeaf, error) {
+	leaves := make([]*trillian.LogLeaf, 0)
+
+	snap, err := ltx.db.GetSnapshot()
+	if err != nil {
+		return nil, err
+	}
+	defer snap.Release()
+
+	iter := snap.NewIterator(&util.Range{
+		Start: keyB('p', treeID, be64(uint64(seq))),
+		Limit: keyB('p', treeID+1, nil),
+	}, nil)
+	for len(leaves) < limit && iter.Next() {
+		leaf := &trillian.LogLeaf{}
+		if err := proto.Unmarshal(iter.Value(), leaf); err != nil {
+			return nil, err
+		} else if leaf.LeafIndex != seq+int64(len(leaves)) {
+			break
+		}
+
+		ltx.batch.Delete(dupSlice(iter.Key()))
+		leaves = append(leaves, leaf)
+	}
+	iter.Release()
+	if err := iter.Error(); err != nil {
+		return nil, err
+	}
+
+	return leaves, nil
+}
@@ -5,9 +5,11 @@ import (
 	"context"
 	"encoding/json"
 	"fmt"
+	"io/ioutil"
 	"net"
 	"net/http"
 	"sort"
+	"sync"
 	"time"
 
 	"github.com/google/trillian"
@@ -32,14 +34,43 @@ var (
 	}
 
 	errLeavesNotFound = fmt.Errorf("leaves not found in remote database")
+
+	// ErrObjectNotFound is returned by an ObjectStore's Get and GetDirect when
+	// there's no object with the given name.
+	ErrObjectNotFound = fmt.Errorf("object not found in remote database")
 )
 
+// ObjectStore is the interface that Remote uses to read and write objects in
+// a large-scale data host.
+type ObjectStore interface {
+	// Get returns the contents of the object with the given name, or
+	// ErrObjectNotFound if there is no such object.
+	Get(ctx context.Context, name string) ([]byte, error)
+	// GetDirect is like Get, but reads the object from the data host itself,
+	// rather than through any cache in front of it.
+	GetDirect(ctx context.Context, name string) ([]byte, error)
+	// Put creates or replaces the object with the given name.
+	Put(ctx context.Context, name string, data []byte) error
+	// Delete removes the object with the given name, if it exists.
+	Delete(ctx context.Context, name string) error
+	// Purge is like Delete, but also removes every earlier version of the
+	// object that the data host keeps.
+	Purge(ctx context.Context, name string) error
+	// Ping checks that the data host itself is reachable, bypassing any cache
+	// in front of it.
+	Ping(ctx context.Context) error
+}
+
 // Remote implements convenience methods over a large-scale data host. The data
 // is possibly hosted remotely, so may take a long time to fetch.
 type Remote struct {
-	b2     *backblaze.B2
-	bucket string
-	url    string
+	store ObjectStore
+}
+
+// NewRemoteWithStore returns a remote database over the given object store,
+// instead of a B2 bucket.
+func NewRemoteWithStore(store ObjectStore) *Remote {
+	return &Remote{store}
 }
 
 // NewRemote returns a new remote database, where `acctId` and `appKey` are the
@@ -53,10 +84,34 @@ func NewRemote(acctId, appKey, bucket, url string) (*Remote, error) {
 	if err != nil {
 		return nil, err
 	}
-	return &Remote{
+	return &Remote{&b2Store{
 		b2:     b2,
 		bucket: bucket,
 		url:    url,
+	}}, nil
+}
+
+// AuthorizeCredentials authorizes a new Account ID and Application Key for
+// the remote database, so that they can be rotated without a restart. It
+// returns a function that replaces the credentials that the remote database is
+// written with; the old ones are used until it's called. Remote databases that
+// aren't hosted in B2 don't have credentials, and are left unchanged.
+func (r *Remote) AuthorizeCredentials(acctId, appKey string) (func(), error) {
+	bs, ok := r.store.(*b2Store)
+	if !ok {
+		return func() {}, nil
+	}
+	b2, err := backblaze.NewB2(backblaze.Credentials{
+		AccountID:      acctId,
+		ApplicationKey: appKey,
+	})
+	if err != nil {
+		return nil, err
+	}
+	return func() {
+		bs.mu.Lock()
+		bs.b2 = b2
+		bs.mu.Unlock()
 	}, nil
 }
 
@@ -95,33 +150,43 @@ func (r *Remote) GetLeaves(ctx context.Context, treeID int64, seqs []int64) ([]*
 }
 
 func (r *Remote) getBatch(ctx context.Context, treeID, batch int64) ([]*trillian.LogLeaf, error) {
-	req, err := http.NewRequest("GET", fmt.Sprintf(
-		"%v/leaves-%v/%x", r.url, treeID, batch,
-	), nil)
-	if err != nil {
-		return nil, err
-	}
-	req = req.WithContext(ctx)
+	return parseBatch(r.store.Get(ctx, batchName(treeID, batch)))
+}
 
-	resp, err := client.Do(req)
-	if err != nil {
-		return nil, err
-	}
-	defer resp.Body.Close()
-	if resp.StatusCode == 404 {
+// getBatchDirect is like getBatch, but reads the batch from the bucket instead
+// of through the download url, whose responses may be cached.
+func (r *Remote) getBatchDirect(ctx context.Context, treeID, batch int64) ([]*trillian.LogLeaf, error) {
+	return parseBatch(r.store.GetDirect(ctx, batchName(treeID, batch)))
+}
+
+// parseBatch parses the leaves of a batch read from the object store.
+func parseBatch(raw []byte, err error) ([]*trillian.LogLeaf, error) {
+	if err == ErrObjectNotFound {
 		return nil, errLeavesNotFound
-	} else if resp.StatusCode != 200 {
-		return nil, fmt.Errorf("unexpected response status: %v", resp.Status)
+	} else if err != nil {
+		return nil, err
 	}
 
 	parsed := make([]*trillian.LogLeaf, 0)
-	if err = json.NewDecoder(resp.Body).Decode(&parsed); err != nil {
+	if err = json.Unmarshal(raw, &parsed); err != nil {
 		return nil, err
 	}
 
 	return parsed, nil
 }
 
+func (r *Remote) putBatch(ctx context.Context, treeID, batch int64, leaves []*trillian.LogLeaf) error {
+	buff := &bytes.Buffer{}
+	if err := json.NewEncoder(buff).Encode(leaves); err != nil {
+		return err
+	}
+	return r.store.Put(ctx, batchName(treeID, batch), buff.Bytes())
+}
+
+func batchName(treeID, batch int64) string {
+	return fmt.Sprintf("leaves-%v/%x", treeID, batch)
+}
+
 func (r *Remote) PutLeaves(ctx context.Context, treeID int64, leaves []*trillian.LogLeaf) error {
 	// Group leaves into batches.
 	batches := make(map[int64][]*trillian.LogLeaf)
@@ -171,21 +236,168 @@ func (r *Remote) PutLeaves(ctx context.Context, treeID int64, leaves []*trillian
 		}
 
 		// Serialize the merged batch and write to B2.
-		buff := &bytes.Buffer{}
-		if err := json.NewEncoder(buff).Encode(updated); err != nil {
+		if err := r.putBatch(ctx, treeID, b, updated); err != nil {
 			return err
 		}
-		name := fmt.Sprintf("leaves-%v/%x", treeID, b)
-		meta := make(map[string]string)
+	}
+
+	return nil
+}
+
+// Truncate removes every leaf with an index in [size, end) from remote
+// storage. It is used to undo uploads for leaves that were never committed to
+// the local database. The leaves in [size, end) must be the last leaves that
+// were uploaded. Batches are read directly from the bucket, so that a stale
+// cached copy isn't written back.
+func (r *Remote) Truncate(ctx context.Context, treeID, size, end int64) error {
+	if size < 0 || end < size {
+		return fmt.Errorf("invalid range to truncate: [%v, %v)", size, end)
+	} else if size == end {
+		return nil
+	}
+
+	for b := size / 1024; b <= (end-1)/1024; b++ {
+		off := int(size - 1024*b)
+		if off <= 0 {
+			if err := r.store.Delete(ctx, batchName(treeID, b)); err != nil {
+				return err
+			}
+			continue
+		}
 
-		bucket, err := r.b2.Bucket(r.bucket)
-		if err != nil {
+		existing, err := r.getBatchDirect(ctx, treeID, b)
+		if err == errLeavesNotFound {
+			return fmt.Errorf("batch %x is missing, but should have %v leaves", b, off)
+		} else if err != nil {
 			return err
+		} else if len(existing) < off {
+			return fmt.Errorf("batch %x has %v leaves, but should have at least %v", b, len(existing), off)
+		} else if len(existing) == off {
+			continue
 		}
-		if _, err := bucket.UploadFile(name, meta, buff); err != nil {
+		if err := r.putBatch(ctx, treeID, b, existing[:off]); err != nil {
 			return err
 		}
 	}
 
 	return nil
 }
+
+// b2Store implements ObjectStore over a Backblaze B2 bucket. Objects are read
+// through `url`, which is expected to be cached by Cloudflare's edge.
+type b2Store struct {
+	mu     sync.RWMutex
+	b2     *backblaze.B2
+	bucket string
+	url    string
+}
+
+// client returns the B2 client that's authorized with the current
+// credentials.
+func (bs *b2Store) client() *backblaze.B2 {
+	bs.mu.RLock()
+	defer bs.mu.RUnlock()
+	return bs.b2
+}
+
+func (bs *b2Store) Get(ctx context.Context, name string) ([]byte, error) {
+	req, err := http.NewRequest("GET", fmt.Sprintf("%v/%v", bs.url, name), nil)
+	if err != nil {
+		return nil, err
+	}
+	req = req.WithContext(ctx)
+
+	resp, err := client.Do(req)
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode == 404 {
+		return nil, ErrObjectNotFound
+	} else if resp.StatusCode != 200 {
+		return nil, fmt.Errorf("unexpected response status: %v", resp.Status)
+	}
+
+	return ioutil.ReadAll(resp.Body)
+}
+
+func (bs *b2Store) GetDirect(ctx context.Context, name string) ([]byte, error) {
+	bucket, err := bs.client().Bucket(bs.bucket)
+	if err != nil {
+		return nil, err
+	} else if bucket == nil {
+		return nil, fmt.Errorf("bucket %v not found", bs.bucket)
+	}
+	_, body, err := bucket.DownloadFileByName(name)
+	if b2err, ok := err.(*backblaze.B2Error); ok && (b2err.Status == 404 || b2err.Code == "not_found") {
+		return nil, ErrObjectNotFound
+	} else if err != nil {
+		return nil, err
+	}
+	defer body.Close()
+
+	return ioutil.ReadAll(body)
+}
+
+// Ping lists at most one file in the bucket through the B2 API.
+func (bs *b2Store) Ping(ctx context.Context) error {
+	bucket, err := bs.client().Bucket(bs.bucket)
+	if err != nil {
+		return err
+	} else if bucket == nil {
+		return fmt.Errorf("bucket %v not found", bs.bucket)
+	}
+	_, err = bucket.ListFileNames("", 1)
+	return err
+}
+
+func (bs *b2Store) Put(ctx context.Context, name string, data []byte) error {
+	bucket, err := bs.client().Bucket(bs.bucket)
+	if err != nil {
+		return err
+	}
+	meta := make(map[string]string)
+	_, err = bucket.UploadFile(name, meta, bytes.NewReader(data))
+	return err
+}
+
+// Delete hides the object with the given name. Prior versions are kept
+// according to the bucket's lifecycle settings.
+func (bs *b2Store) Delete(ctx context.Context, name string) error {
+	bucket, err := bs.client().Bucket(bs.bucket)
+	if err != nil {
+		return err
+	}
+	_, err = bucket.HideFile(name)
+	if b2err, ok := err.(*backblaze.B2Error); ok && (b2err.Status == 404 || b2err.Code == "no_such_file") {
+		return nil
+	}
+	return err
+}
+
+// Purge deletes every version of the object with the given name, including
+// the hidden ones, so that nothing is left in the bucket.
+func (bs *b2Store) Purge(ctx context.Context, name string) error {
+	bucket, err := bs.client().Bucket(bs.bucket)
+	if err != nil {
+		return err
+	}
+	for {
+		res, err := bucket.ListFileVersions(name, "", 100)
+		if err != nil {
+			return err
+		}
+		deleted := 0
+		for _, file := range res.Files {
+			if file.Name != name {
+				break
+			} else if _, err := bucket.DeleteFileVersion(file.Name, file.ID); err != nil {
+				return err
+			}
+			deleted++
+		}
+		if deleted < len(res.Files) || res.NextFileName != name {
+			return nil
+		}
+	}
+}
@@ -0,0 +1,68 @@
+package custom_test
+
+import (
+	"testing"
+
+	"context"
+	"fmt"
+
+	"github.com/cloudflare/ct-log/custom"
+	"github.com/cloudflare/ct-log/internal/remotetest"
+
+	"github.com/google/trillian"
+)
+
+// cachedStore is an in-memory store whose Get serves the first version of each
+// object that it read, like a cache in front of the bucket.
+type cachedStore struct {
+	*remotetest.MemoryStore
+	cache map[string][]byte
+}
+
+func (cs *cachedStore) Get(ctx context.Context, name string) ([]byte, error) {
+	if data, ok := cs.cache[name]; ok {
+		return data, nil
+	}
+	data, err := cs.MemoryStore.Get(ctx, name)
+	if err == nil {
+		cs.cache[name] = data
+	}
+	return data, err
+}
+
+func putLeaves(t *testing.T, remote *custom.Remote, start, end int64) {
+	leaves := make([]*trillian.LogLeaf, 0, end-start)
+	for i := start; i < end; i++ {
+		leaves = append(leaves, &trillian.LogLeaf{LeafIndex: i, LeafValue: []byte(fmt.Sprintf("leaf %v", i))})
+	}
+	if err := remote.PutLeaves(context.Background(), 1, leaves); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestTruncateUncached(t *testing.T) {
+	store := &cachedStore{remotetest.NewMemoryStore(), make(map[string][]byte)}
+	remote := custom.NewRemoteWithStore(store)
+	ctx := context.Background()
+
+	// Cache the batch while it has 5 leaves, and then add 15 more.
+	putLeaves(t, remote, 0, 5)
+	if _, err := remote.GetLeaves(ctx, 1, []int64{4}); err != nil {
+		t.Fatal(err)
+	}
+	putLeaves(t, remote, 5, 20)
+
+	// Truncating reads the batch from the store itself, not the cache.
+	if err := remote.Truncate(ctx, 1, 10, 20); err != nil {
+		t.Fatal(err)
+	}
+	delete(store.cache, "leaves-1/0")
+	if leaves, err := remote.GetLeaves(ctx, 1, []int64{9}); err != nil {
+		t.Fatal(err)
+	} else if string(leaves[0].LeafValue) != "leaf 9" {
+		t.Fatalf("got leaf %q, wanted %q", leaves[0].LeafValue, "leaf 9")
+	}
+	if _, err := remote.GetLeaves(ctx, 1, []int64{10}); err == nil {
+		t.Fatal("truncated leaf is still stored")
+	}
+}
@@ -0,0 +1,229 @@
+package custom
+
+import (
+	"bytes"
+	"encoding/binary"
+	"fmt"
+	"log"
+	"strconv"
+
+	"github.com/cloudflare/ct-log/custom/frontier"
+
+	"github.com/golang/protobuf/proto"
+	"github.com/google/trillian"
+	"github.com/syndtr/goleveldb/leveldb"
+	"github.com/syndtr/goleveldb/leveldb/opt"
+	"github.com/syndtr/goleveldb/leveldb/util"
+)
+
+// The local database's key layout is:
+//
+//   r<tree>:root       -> Most recent serialized types.LogRootV1.
+//   r<tree>:sig        -> Signature over the most recent root.
+//   r<tree>:frontier   -> Frontier of the most recent root.
+//   l<tree>:<rowkey>   -> Queued leaf; rowkey is from rowkeyLeaf.
+//   q<tree>:<hash>     -> Rowkey of the queued leaf with this identity hash.
+//   p<tree>:<index>    -> Pending leaf of a pre-ordered log, at that index.
+//   m<tree>:<hash>     -> Sequence number of the leaf with this Merkle hash.
+//   i<tree>:<hash>     -> Sequence number of the leaf with this identity hash.
+//   s<tree>:<rowkey>   -> Subtree; rowkey is from rowkeyNodeID.
+//   n<tree>:<lvl><idx> -> Hash of the completed node at that level and index.
+//   c<tree>:backfill   -> Tree size up to which completed nodes are backfilled.
+//   h<tree>:<ts>       -> Signed tree head signed at timestamp ts.
+//   t<tree>:<size><ts> -> Empty; indexes the signed tree heads by tree size.
+//   j<tree>:sequencing -> Range of leaves being uploaded by a sequencing run.
+//   f<tree>:sth        -> Final signed tree head of a frozen log, as get-sth.
+//   v<0>:schema        -> Schema version of the database.
+//   v<0>:health        -> Scratch value written and deleted by health checks.
+//
+// where <tree> is the tree id in 16 hex characters. Any change to this layout
+// must come with a new entry in `migrations`, except for v<0>:health, which is
+// never left in the database.
+
+// migration is a step that moves the local database from version-1 to version.
+// Migrations write their changes to `batch`, which is committed atomically with
+// the new schema version.
+type migration struct {
+	version int
+	desc    string
+	run     func(snap *leveldb.Snapshot, batch *leveldb.Batch) error
+}
+
+// migrations is the ordered list of every schema change. The schema version of
+// a database is the version of the last migration that was applied to it.
+var migrations = []migration{
+	{1, "initial key layout", noMigration},
+	{2, "re-encode gob frontiers in binary encoding", migrateFrontiers},
+	{3, "record current roots in signed tree head history", migrateHistory},
+	{4, "add sequencing journal", noMigration},
+	{5, "add pending leaves of pre-ordered logs", noMigration},
+	{6, "index queued leaves by identity hash", migrateQueueIndex},
+	{7, "add store of completed merkle nodes", noMigration},
+	{8, "add frozen signed tree heads", noMigration},
+}
+
+// noMigration is used for schema changes that only add new keys. The version
+// bump still prevents older code, which doesn't know about the keys, from
+// opening the database.
+func noMigration(*leveldb.Snapshot, *leveldb.Batch) error { return nil }
+
+// schemaVersion is the schema version that this version of the code writes.
+func schemaVersion() int {
+	return migrations[len(migrations)-1].version
+}
+
+func getSchemaVersion(db *leveldb.DB) (int, error) {
+	raw, err := db.Get(keyS('v', 0, "schema"), nil)
+	if err == leveldb.ErrNotFound {
+		return 0, nil
+	} else if err != nil {
+		return 0, err
+	}
+	version, n := binary.Uvarint(raw)
+	if n != len(raw) {
+		return 0, fmt.Errorf("malformed schema version")
+	}
+	return int(version), nil
+}
+
+// migrate brings the database up to date with the current schema, or returns
+// an error if the database was written by a newer version of the code.
+func migrate(db *leveldb.DB) error {
+	current, err := getSchemaVersion(db)
+	if err != nil {
+		return fmt.Errorf("failed to read schema version: %v", err)
+	} else if current > schemaVersion() {
+		return fmt.Errorf("database has schema version %v, but only versions up to %v are supported", current, schemaVersion())
+	}
+
+	from := current
+	for _, m := range migrations {
+		if m.version <= current {
+			continue
+		} else if m.version != current+1 {
+			return fmt.Errorf("migrations are out of order: %v follows %v", m.version, current)
+		}
+
+		snap, err := db.GetSnapshot()
+		if err != nil {
+			return err
+		}
+		batch := new(leveldb.Batch)
+		err = m.run(snap, batch)
+		snap.Release()
+		if err != nil {
+			return fmt.Errorf("failed to migrate to schema version %v (%v): %v", m.version, m.desc, err)
+		}
+
+		raw := make([]byte, binary.MaxVarintLen64)
+		n := binary.PutUvarint(raw, uint64(m.version))
+		batch.Put(keyS('v', 0, "schema"), raw[:n])
+
+		if err := db.Write(batch, &opt.WriteOptions{Sync: true}); err != nil {
+			return err
+		}
+		current = m.version
+	}
+	if from != current {
+		log.Printf("migrated local database from schema version %v to %v", from, current)
+	}
+
+	return nil
+}
+
+// checkSchemaVersion returns an error if the database isn't at the current
+// schema version. It's used instead of migrate when the database is opened
+// read-only.
+func checkSchemaVersion(db *leveldb.DB) error {
+	current, err := getSchemaVersion(db)
+	if err != nil {
+		return fmt.Errorf("failed to read schema version: %v", err)
+	} else if current > schemaVersion() {
+		return fmt.Errorf("database has schema version %v, but only versions up to %v are supported", current, schemaVersion())
+	} else if current < schemaVersion() {
+		return fmt.Errorf("database has schema version %v and needs to be migrated to %v, which can't be done read-only", current, schemaVersion())
+	}
+	return nil
+}
+
+// migrateFrontiers rewrites every frontier that is still gob-encoded.
+func migrateFrontiers(snap *leveldb.Snapshot, batch *leveldb.Batch) error {
+	iter := snap.NewIterator(util.BytesPrefix([]byte("r")), nil)
+	for iter.Next() {
+		if !bytes.HasSuffix(iter.Key(), []byte(":frontier")) {
+			continue
+		} else if frontier.IsBinary(iter.Value()) {
+			continue
+		}
+
+		front, err := parseFrontier(iter.Value())
+		if err != nil {
+			iter.Release()
+			return fmt.Errorf("key %q: %v", iter.Key(), err)
+		}
+		raw, err := front.MarshalBinary()
+		if err != nil {
+			iter.Release()
+			return err
+		}
+		batch.Put(dupSlice(iter.Key()), raw)
+	}
+	iter.Release()
+	return iter.Error()
+}
+
+// migrateHistory seeds the history of signed tree heads with the current root
+// of each tree.
+func migrateHistory(snap *leveldb.Snapshot, batch *leveldb.Batch) error {
+	iter := snap.NewIterator(util.BytesPrefix([]byte("r")), nil)
+	defer iter.Release()
+
+	for iter.Next() {
+		key := iter.Key()
+		if !bytes.HasSuffix(key, []byte(":root")) {
+			continue
+		}
+		treeID, err := strconv.ParseInt(string(key[1:17]), 16, 64)
+		if err != nil {
+			return fmt.Errorf("key %q: %v", key, err)
+		}
+		sig, err := snap.Get(keyS('r', treeID, "sig"), nil)
+		if err != nil {
+			return fmt.Errorf("key %q: %v", key, err)
+		}
+		if err := putHistory(batch, treeID, dupSlice(iter.Value()), dupSlice(sig)); err != nil {
+			return fmt.Errorf("key %q: %v", key, err)
+		}
+	}
+	return iter.Error()
+}
+
+// migrateQueueIndex indexes every queued leaf by its identity hash. If several
+// queued leaves have the same identity hash, the oldest one is indexed.
+func migrateQueueIndex(snap *leveldb.Snapshot, batch *leveldb.Batch) error {
+	iter := snap.NewIterator(util.BytesPrefix([]byte("l")), nil)
+	defer iter.Release()
+
+	indexed := make(map[string]bool)
+	for iter.Next() {
+		key := iter.Key()
+		treeID, err := strconv.ParseInt(string(key[1:17]), 16, 64)
+		if err != nil {
+			return fmt.Errorf("key %q: %v", key, err)
+		}
+		leaf := &trillian.LogLeaf{}
+		if err := proto.Unmarshal(iter.Value(), leaf); err != nil {
+			return fmt.Errorf("key %q: %v", key, err)
+		} else if len(leaf.LeafIdentityHash) == 0 {
+			continue
+		}
+
+		qKey := keyB('q', treeID, leaf.LeafIdentityHash)
+		if indexed[string(qKey)] {
+			continue
+		}
+		indexed[string(qKey)] = true
+		batch.Put(qKey, dupSlice(key[len(keyB('l', treeID, nil)):]))
+	}
+	return iter.Error()
+}
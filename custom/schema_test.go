@@ -0,0 +1,164 @@
+package custom
+
+import (
+	"testing"
+
+	"bytes"
+	"encoding/binary"
+	"encoding/gob"
+	"io/ioutil"
+	"os"
+
+	"github.com/cloudflare/ct-log/custom/frontier"
+
+	"github.com/golang/protobuf/proto"
+	"github.com/google/trillian"
+	"github.com/syndtr/goleveldb/leveldb"
+	"github.com/syndtr/goleveldb/leveldb/opt"
+)
+
+func tempLocalPath(t *testing.T) string {
+	dir, err := ioutil.TempDir("", "ct-log-local")
+	if err != nil {
+		t.Fatal(err)
+	}
+	return dir
+}
+
+func TestMigrateFresh(t *testing.T) {
+	path := tempLocalPath(t)
+	defer os.RemoveAll(path)
+
+	local, err := NewLocal(path, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer local.Close()
+
+	version, err := getSchemaVersion(local.db)
+	if err != nil {
+		t.Fatal(err)
+	} else if version != schemaVersion() {
+		t.Fatalf("fresh database has schema version %v, wanted %v", version, schemaVersion())
+	}
+}
+
+func TestMigrateNewer(t *testing.T) {
+	path := tempLocalPath(t)
+	defer os.RemoveAll(path)
+
+	db, err := leveldb.OpenFile(path, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	raw := make([]byte, binary.MaxVarintLen64)
+	n := binary.PutUvarint(raw, uint64(schemaVersion()+1))
+	if err := db.Put(keyS('v', 0, "schema"), raw[:n], nil); err != nil {
+		t.Fatal(err)
+	}
+	db.Close()
+
+	if local, err := NewLocal(path, nil); err == nil {
+		local.Close()
+		t.Fatal("database with newer schema version was opened")
+	}
+}
+
+func TestMigrateFrontiers(t *testing.T) {
+	path := tempLocalPath(t)
+	defer os.RemoveAll(path)
+
+	front := frontier.Frontier{}
+	for i := 0; i < 5; i++ {
+		front.Append(make([]byte, 32))
+	}
+	legacy := &bytes.Buffer{}
+	if err := gob.NewEncoder(legacy).Encode(struct{ Roots [][]byte }{front.Roots}); err != nil {
+		t.Fatal(err)
+	}
+
+	db, err := leveldb.OpenFile(path, nil)
+	if err != nil {
+		t.Fatal(err)
+	} else if err := db.Put(keyS('r', 7, "frontier"), legacy.Bytes(), nil); err != nil {
+		t.Fatal(err)
+	}
+	db.Close()
+
+	local, err := NewLocal(path, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer local.Close()
+
+	raw, err := local.db.Get(keyS('r', 7, "frontier"), nil)
+	if err != nil {
+		t.Fatal(err)
+	} else if !frontier.IsBinary(raw) {
+		t.Fatal("frontier was not re-encoded")
+	}
+	cand, err := parseFrontier(raw)
+	if err != nil {
+		t.Fatal(err)
+	} else if !bytes.Equal(front.Head(), cand.Head()) {
+		t.Fatal("re-encoded frontier has a different head")
+	}
+}
+
+func TestMigrateQueueIndex(t *testing.T) {
+	path := tempLocalPath(t)
+	defer os.RemoveAll(path)
+
+	leaf := &trillian.LogLeaf{LeafIdentityHash: []byte("id"), LeafValue: []byte("leaf")}
+	raw, err := proto.Marshal(leaf)
+	if err != nil {
+		t.Fatal(err)
+	}
+	db, err := leveldb.OpenFile(path, nil)
+	if err != nil {
+		t.Fatal(err)
+	} else if err := db.Put(keyB('l', 7, rowkeyLeaf(1000, true)), raw, nil); err != nil {
+		t.Fatal(err)
+	}
+	db.Close()
+
+	local, err := NewLocal(path, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer local.Close()
+
+	dups, _, err := local.QueueLeaves(7, 2000, []*trillian.LogLeaf{{LeafIdentityHash: []byte("id")}})
+	if err != nil {
+		t.Fatal(err)
+	} else if dups[0] == nil || !bytes.Equal(dups[0].LeafValue, leaf.LeafValue) {
+		t.Fatalf("leaf queued before migration was not found: %v", dups[0])
+	}
+}
+
+func TestReadOnlyUnmigrated(t *testing.T) {
+	path := tempLocalPath(t)
+	defer os.RemoveAll(path)
+
+	db, err := leveldb.OpenFile(path, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	db.Close()
+
+	if local, err := NewLocal(path, &opt.Options{ReadOnly: true}); err == nil {
+		local.Close()
+		t.Fatal("database that needs migration was opened read-only")
+	}
+
+	local, err := NewLocal(path, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	local.Close()
+	local, err = NewLocal(path, &opt.Options{ReadOnly: true})
+	if err != nil {
+		t.Fatal(err)
+	}
+	local.Close()
+}
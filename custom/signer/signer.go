@@ -0,0 +1,168 @@
+// Package signer implements a crypto.Signer that asks another process to sign,
+// over a Unix socket, so that the log's private key is never loaded by the
+// server. It registers a key handler with Trillian for its Config proto, which
+// makes it usable anywhere that Trillian or ctfe take a private key.
+//
+// For each signature, the signer connects to the socket, writes a request like
+//
+//	{"hash": "SHA-256", "digest": "<base64>"}
+//
+// followed by a newline, and reads a response like
+//
+//	{"signature": "<base64>"}
+//
+// or {"error": "<message>"}. Signatures are the same format that the key's
+// crypto.Signer would produce: ASN.1 for ECDSA, and PKCS #1 v1.5 for RSA. They
+// are verified against the configured public key before they're used.
+package signer
+
+import (
+	"bufio"
+	"context"
+	"crypto"
+	"crypto/ecdsa"
+	"crypto/rsa"
+	"encoding/asn1"
+	"encoding/json"
+	"fmt"
+	"io"
+	"math/big"
+	"net"
+	"time"
+
+	"github.com/golang/protobuf/proto"
+	"github.com/google/trillian/crypto/keys"
+	"github.com/google/trillian/crypto/keys/pem"
+)
+
+// timeout is how long a signature is waited for.
+const timeout = 10 * time.Second
+
+// Config is the key proto for a socket signer. It's stored in the same place as
+// a log's private key would be.
+type Config struct {
+	// Path is the path of the Unix socket to connect to.
+	Path string `protobuf:"bytes,1,opt,name=path,proto3" json:"path,omitempty"`
+	// PublicKey is the PEM-encoded public key of the signer.
+	PublicKey string `protobuf:"bytes,2,opt,name=public_key,json=publicKey,proto3" json:"public_key,omitempty"`
+
+	XXX_NoUnkeyedLiteral struct{} `json:"-"`
+	XXX_unrecognized     []byte   `json:"-"`
+	XXX_sizecache        int32    `json:"-"`
+}
+
+func (m *Config) Reset()         { *m = Config{} }
+func (m *Config) String() string { return proto.CompactTextString(m) }
+func (*Config) ProtoMessage()    {}
+
+func init() {
+	proto.RegisterType((*Config)(nil), "ctlog.signer.Config")
+
+	keys.RegisterHandler(&Config{}, func(ctx context.Context, pb proto.Message) (crypto.Signer, error) {
+		cfg, ok := pb.(*Config)
+		if !ok {
+			return nil, fmt.Errorf("signer: got %T, want *signer.Config", pb)
+		}
+		pub, err := pem.UnmarshalPublicKey(cfg.PublicKey)
+		if err != nil {
+			return nil, fmt.Errorf("signer: failed to parse public key: %v", err)
+		}
+		return New(cfg.Path, pub)
+	})
+}
+
+var hashNames = map[crypto.Hash]string{
+	crypto.SHA256: "SHA-256",
+	crypto.SHA384: "SHA-384",
+	crypto.SHA512: "SHA-512",
+}
+
+type request struct {
+	Hash   string `json:"hash"`
+	Digest []byte `json:"digest"`
+}
+
+type response struct {
+	Signature []byte `json:"signature"`
+	Error     string `json:"error"`
+}
+
+// Signer is a crypto.Signer that signs through a Unix socket.
+type Signer struct {
+	path string
+	pub  crypto.PublicKey
+}
+
+// New returns a Signer that connects to the Unix socket at `path`, and whose
+// signatures are verified with `pub`. Only ECDSA and RSA keys are supported.
+func New(path string, pub crypto.PublicKey) (*Signer, error) {
+	switch pub.(type) {
+	case *ecdsa.PublicKey, *rsa.PublicKey:
+	default:
+		return nil, fmt.Errorf("signer: unsupported public key type: %T", pub)
+	}
+	return &Signer{path: path, pub: pub}, nil
+}
+
+// Public returns the public key of the signer.
+func (s *Signer) Public() crypto.PublicKey { return s.pub }
+
+// Sign asks the process behind the socket to sign `digest`, which is the hash
+// of a message made with opts.HashFunc(). `rand` is ignored.
+func (s *Signer) Sign(rand io.Reader, digest []byte, opts crypto.SignerOpts) ([]byte, error) {
+	hash, ok := hashNames[opts.HashFunc()]
+	if !ok {
+		return nil, fmt.Errorf("signer: unsupported hash function: %v", opts.HashFunc())
+	} else if _, ok := opts.(*rsa.PSSOptions); ok {
+		return nil, fmt.Errorf("signer: RSA-PSS is not supported")
+	}
+
+	conn, err := net.DialTimeout("unix", s.path, timeout)
+	if err != nil {
+		return nil, fmt.Errorf("signer: %v", err)
+	}
+	defer conn.Close()
+	if err := conn.SetDeadline(time.Now().Add(timeout)); err != nil {
+		return nil, fmt.Errorf("signer: %v", err)
+	}
+
+	if err := json.NewEncoder(conn).Encode(request{Hash: hash, Digest: digest}); err != nil {
+		return nil, fmt.Errorf("signer: failed to write request: %v", err)
+	}
+	line, err := bufio.NewReader(conn).ReadBytes('\n')
+	if err != nil && err != io.EOF {
+		return nil, fmt.Errorf("signer: failed to read response: %v", err)
+	}
+	var resp response
+	if err := json.Unmarshal(line, &resp); err != nil {
+		return nil, fmt.Errorf("signer: failed to parse response: %v", err)
+	} else if resp.Error != "" {
+		return nil, fmt.Errorf("signer: %v", resp.Error)
+	} else if err := verify(s.pub, opts.HashFunc(), digest, resp.Signature); err != nil {
+		return nil, fmt.Errorf("signer: %v", err)
+	}
+	return resp.Signature, nil
+}
+
+// verify checks that `sig` is a signature of `digest` by the key `pub`.
+func verify(pub crypto.PublicKey, hash crypto.Hash, digest, sig []byte) error {
+	switch pub := pub.(type) {
+	case *ecdsa.PublicKey:
+		var parsed struct{ R, S *big.Int }
+		if rest, err := asn1.Unmarshal(sig, &parsed); err != nil {
+			return fmt.Errorf("failed to parse signature: %v", err)
+		} else if len(rest) > 0 {
+			return fmt.Errorf("unnecessary data appended to signature")
+		} else if !ecdsa.Verify(pub, digest, parsed.R, parsed.S) {
+			return fmt.Errorf("signature doesn't match public key")
+		}
+		return nil
+	case *rsa.PublicKey:
+		if err := rsa.VerifyPKCS1v15(pub, hash, digest, sig); err != nil {
+			return fmt.Errorf("signature doesn't match public key")
+		}
+		return nil
+	default:
+		return fmt.Errorf("unsupported public key type: %T", pub)
+	}
+}
@@ -0,0 +1,140 @@
+package signer
+
+import (
+	"testing"
+
+	"bufio"
+	"context"
+	"crypto"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/sha256"
+	"crypto/x509"
+	"encoding/json"
+	"encoding/pem"
+	"io/ioutil"
+	"net"
+	"os"
+	"path/filepath"
+
+	"github.com/golang/protobuf/ptypes"
+	"github.com/google/trillian/crypto/keys"
+)
+
+// serve answers signing requests on a Unix socket in a temporary directory,
+// with `key`. If fail is set, it returns an error instead.
+func serve(t *testing.T, key crypto.Signer, fail string) (string, func()) {
+	dir, err := ioutil.TempDir("", "ct-log-signer")
+	if err != nil {
+		t.Fatal(err)
+	}
+	path := filepath.Join(dir, "signer.sock")
+	ln, err := net.Listen("unix", path)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	go func() {
+		for {
+			conn, err := ln.Accept()
+			if err != nil {
+				return
+			}
+			var req request
+			line, _ := bufio.NewReader(conn).ReadBytes('\n')
+			resp := response{Error: fail}
+			if err := json.Unmarshal(line, &req); err != nil {
+				resp.Error = err.Error()
+			} else if fail == "" {
+				resp.Signature, err = key.Sign(rand.Reader, req.Digest, crypto.SHA256)
+				if err != nil {
+					resp.Error = err.Error()
+				}
+			}
+			json.NewEncoder(conn).Encode(resp)
+			conn.Close()
+		}
+	}()
+
+	return path, func() {
+		ln.Close()
+		os.RemoveAll(dir)
+	}
+}
+
+func publicKeyPEM(t *testing.T, key crypto.Signer) string {
+	der, err := x509.MarshalPKIXPublicKey(key.Public())
+	if err != nil {
+		t.Fatal(err)
+	}
+	return string(pem.EncodeToMemory(&pem.Block{Type: "PUBLIC KEY", Bytes: der}))
+}
+
+func TestSigner(t *testing.T) {
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	path, stop := serve(t, key, "")
+	defer stop()
+
+	// Get a signer the way Trillian and ctfe do, from the key proto.
+	anyKey, err := ptypes.MarshalAny(&Config{Path: path, PublicKey: publicKeyPEM(t, key)})
+	if err != nil {
+		t.Fatal(err)
+	}
+	var keyProto ptypes.DynamicAny
+	if err := ptypes.UnmarshalAny(anyKey, &keyProto); err != nil {
+		t.Fatal(err)
+	}
+	signer, err := keys.NewSigner(context.Background(), keyProto.Message)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	digest := sha256.Sum256([]byte("hello"))
+	sig, err := signer.Sign(rand.Reader, digest[:], crypto.SHA256)
+	if err != nil {
+		t.Fatal(err)
+	} else if err := verify(&key.PublicKey, crypto.SHA256, digest[:], sig); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestSignerErrors(t *testing.T) {
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	other, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	digest := sha256.Sum256([]byte("hello"))
+
+	// Errors from the other process are returned.
+	path, stop := serve(t, key, "key is locked")
+	defer stop()
+	signer, err := New(path, key.Public())
+	if err != nil {
+		t.Fatal(err)
+	} else if _, err := signer.Sign(rand.Reader, digest[:], crypto.SHA256); err == nil || err.Error() != "signer: key is locked" {
+		t.Fatalf("got error %v, wanted the other process's", err)
+	}
+
+	// Signatures by the wrong key are rejected.
+	path, stop = serve(t, other, "")
+	defer stop()
+	signer, err = New(path, key.Public())
+	if err != nil {
+		t.Fatal(err)
+	} else if _, err := signer.Sign(rand.Reader, digest[:], crypto.SHA256); err == nil {
+		t.Fatal("expected signature by the wrong key to be rejected")
+	}
+
+	// Unsupported hashes aren't sent.
+	if _, err := signer.Sign(rand.Reader, digest[:], crypto.SHA1); err == nil {
+		t.Fatal("expected SHA-1 to be rejected")
+	}
+}
@@ -0,0 +1,61 @@
+//go:build pkcs11
+// +build pkcs11
+
+package signer
+
+import (
+	"testing"
+
+	"context"
+	"crypto"
+	"crypto/rand"
+	"crypto/sha256"
+	"flag"
+	"io/ioutil"
+	"os"
+
+	"github.com/google/trillian/crypto/keys"
+	_ "github.com/google/trillian/crypto/keys/pkcs11/proto"
+	"github.com/google/trillian/crypto/keyspb"
+)
+
+// TestSoftHSM checks that a log's key can be used from a PKCS#11 token, the way
+// config sets it up. It needs a token, for example from SoftHSM:
+//
+//	$ softhsm2-util --init-token --free --label ct-log --so-pin 1234 --pin 1234
+//	$ pkcs11-tool --module /usr/lib/softhsm/libsofthsm2.so --token-label ct-log \
+//	    --login --pin 1234 --keypairgen --key-type EC:prime256v1 --id 01
+//	$ pkcs11-tool --module /usr/lib/softhsm/libsofthsm2.so --token-label ct-log \
+//	    --read-object --type pubkey --id 01 | openssl ec -pubin -inform DER -out log.pub
+//	$ PKCS11_MODULE=/usr/lib/softhsm/libsofthsm2.so PKCS11_TOKEN_LABEL=ct-log \
+//	    PKCS11_PIN=1234 PKCS11_PUBLIC_KEY=log.pub go test -tags pkcs11 ./custom/signer/
+func TestSoftHSM(t *testing.T) {
+	module, label := os.Getenv("PKCS11_MODULE"), os.Getenv("PKCS11_TOKEN_LABEL")
+	pin, pubFile := os.Getenv("PKCS11_PIN"), os.Getenv("PKCS11_PUBLIC_KEY")
+	if module == "" || label == "" || pubFile == "" {
+		t.Skip("PKCS11_MODULE, PKCS11_TOKEN_LABEL and PKCS11_PUBLIC_KEY aren't set")
+	}
+	pub, err := ioutil.ReadFile(pubFile)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := flag.Set("pkcs11_module_path", module); err != nil {
+		t.Fatal(err)
+	}
+
+	signer, err := keys.NewSigner(context.Background(), &keyspb.PKCS11Config{
+		TokenLabel: label,
+		Pin:        pin,
+		PublicKey:  string(pub),
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	digest := sha256.Sum256([]byte("hello"))
+	sig, err := signer.Sign(rand.Reader, digest[:], crypto.SHA256)
+	if err != nil {
+		t.Fatal(err)
+	} else if err := verify(signer.Public(), crypto.SHA256, digest[:], sig); err != nil {
+		t.Fatal(err)
+	}
+}
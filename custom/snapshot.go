@@ -0,0 +1,199 @@
+package custom
+
+import (
+	"bytes"
+	"encoding/binary"
+	"fmt"
+
+	"github.com/cloudflare/ct-log/custom/frontier"
+
+	"github.com/golang/protobuf/proto"
+	"github.com/google/trillian"
+	"github.com/google/trillian/storage"
+	"github.com/google/trillian/storage/storagepb"
+	"github.com/syndtr/goleveldb/leveldb"
+	"github.com/syndtr/goleveldb/leveldb/util"
+)
+
+// LocalSnapshot is a read-only view of the local database at the moment it was
+// taken. Reads from a snapshot are unaffected by later writes, so everything
+// read from one snapshot is consistent with the same root. A snapshot must be
+// released when it's no longer needed.
+type LocalSnapshot struct {
+	snap *leveldb.Snapshot
+}
+
+// Snapshot returns a snapshot of the current state of the local database.
+func (l *Local) Snapshot() (*LocalSnapshot, error) {
+	snap, err := l.db.GetSnapshot()
+	if err != nil {
+		return nil, err
+	}
+	return &LocalSnapshot{snap: snap}, nil
+}
+
+// Release releases the snapshot. It's safe to call more than once.
+func (ls *LocalSnapshot) Release() {
+	ls.snap.Release()
+}
+
+// MostRecentRoot returns most-recently committed root for the tree with the
+// given treeID.
+func (ls *LocalSnapshot) MostRecentRoot(treeID int64) (trillian.SignedLogRoot, frontier.Frontier, error) {
+	rootRaw, err := ls.snap.Get(keyS('r', treeID, "root"), nil)
+	if err == leveldb.ErrNotFound {
+		return trillian.SignedLogRoot{}, frontier.Frontier{}, storage.ErrTreeNeedsInit
+	} else if err != nil {
+		return trillian.SignedLogRoot{}, frontier.Frontier{}, err
+	}
+	sig, err := ls.snap.Get(keyS('r', treeID, "sig"), nil)
+	if err != nil {
+		return trillian.SignedLogRoot{}, frontier.Frontier{}, err
+	}
+	frontRaw, err := ls.snap.Get(keyS('r', treeID, "frontier"), nil)
+	if err != nil {
+		return trillian.SignedLogRoot{}, frontier.Frontier{}, err
+	}
+	rootRaw, sig, frontRaw = dupSlice(rootRaw), dupSlice(sig), dupSlice(frontRaw)
+
+	sth, err := signedLogRoot(treeID, rootRaw, sig)
+	if err != nil {
+		return trillian.SignedLogRoot{}, frontier.Frontier{}, err
+	}
+	front, err := parseFrontier(frontRaw)
+	if err != nil {
+		return trillian.SignedLogRoot{}, frontier.Frontier{}, err
+	}
+
+	return sth, front, nil
+}
+
+// Unsequenced returns the number of unsequenced leaves that a log has on disk,
+// whether queued or pending.
+func (ls *LocalSnapshot) Unsequenced(treeID int64) (int, error) {
+	keys := 0
+
+	// Count queued leaves, and the pending leaves of pre-ordered logs. A tree
+	// only ever has one or the other.
+	for _, r := range []*util.Range{
+		{Start: keyB('l', treeID, rowkeyLeaf(0, false)), Limit: keyB('l', treeID+1, rowkeyLeaf(0, false))},
+		util.BytesPrefix(keyB('p', treeID, nil)),
+	} {
+		iter := ls.snap.NewIterator(r, nil)
+		for iter.Next() {
+			keys++
+		}
+		iter.Release()
+		if err := iter.Error(); err != nil {
+			return 0, err
+		}
+	}
+
+	return keys, nil
+}
+
+// GetSequenceByMerkleHash returns the sequence numbers for the leaves with the
+// given Merkle hashes, in the tree with the given tree id. Missing sequence
+// numbers are returned as -1.
+func (ls *LocalSnapshot) GetSequenceByMerkleHash(treeID int64, hashes [][]byte) ([]int64, error) {
+	leaves, err := ls.getSequenceBy('m', treeID, hashes)
+	if err != nil {
+		return nil, fmt.Errorf("failed to lookup by merkle hash: %v", err)
+	}
+	return leaves, nil
+}
+
+// GetSequenceByIdentityHash returns the sequence numbers for the leaves with
+// the given identity hashes, in the tree with the given tree id. Missing
+// sequence numbers are returned as -1.
+func (ls *LocalSnapshot) GetSequenceByIdentityHash(treeID int64, hashes [][]byte) ([]int64, error) {
+	leaves, err := ls.getSequenceBy('i', treeID, hashes)
+	if err != nil {
+		return nil, fmt.Errorf("failed to lookup by identity hash: %v", err)
+	}
+	return leaves, nil
+}
+
+func (ls *LocalSnapshot) getSequenceBy(typ byte, treeID int64, hashes [][]byte) ([]int64, error) {
+	out := make([]int64, 0, len(hashes))
+
+	for _, hash := range hashes {
+		raw, err := ls.snap.Get(keyB(typ, treeID, hash), nil)
+		if err == leveldb.ErrNotFound {
+			out = append(out, -1)
+			continue
+		} else if err != nil {
+			return nil, err
+		}
+		idx, n := binary.Varint(raw)
+		if n != len(raw) {
+			return nil, fmt.Errorf("malformed entry in index")
+		}
+		out = append(out, idx)
+	}
+
+	return out, nil
+}
+
+// GetSubtrees returns the most recent revision ( <= treeRevision ) of each
+// subtree with a given id. Missing subtrees are silently elided.
+func (ls *LocalSnapshot) GetSubtrees(treeID, treeRevision int64, ids []storage.NodeID) ([]*storagepb.SubtreeProto, error) {
+	out := make([]*storagepb.SubtreeProto, 0, len(ids))
+
+	for i, id := range ids {
+		subtree, err := ls.getSubtree(treeID, treeRevision, id)
+		if err != nil {
+			return nil, fmt.Errorf("node id #%v: %v", i+1, err)
+		} else if subtree != nil {
+			out = append(out, subtree)
+		}
+	}
+
+	return out, nil
+}
+
+func (ls *LocalSnapshot) getSubtree(treeID, treeRevision int64, id storage.NodeID) (*storagepb.SubtreeProto, error) {
+	start, stop, err := rangeNodeID(treeRevision, id)
+	if err != nil {
+		return nil, err
+	}
+	start, stop = keyB('s', treeID, start), keyB('s', treeID, stop)
+
+	// Get the row with the equivalent rowkey or its immediate predecessor.
+	iter := ls.snap.NewIterator(nil, nil)
+
+	var k, v []byte
+	if ok := iter.Seek(start); ok {
+		if bytes.Equal(iter.Key(), start) {
+			k, v = iter.Key(), iter.Value()
+		} else if ok := iter.Prev(); ok {
+			k, v = iter.Key(), iter.Value()
+		}
+	} else if ok := iter.Last(); ok {
+		k, v = iter.Key(), iter.Value()
+	}
+	if k != nil && bytes.Compare(k, start) != 1 && bytes.Compare(k, stop) == 1 {
+		k, v = nil, dupSlice(v)
+	} else {
+		k, v = nil, nil
+	}
+
+	iter.Release()
+	if err := iter.Error(); err != nil {
+		return nil, err
+	}
+
+	// Parse the subtree, should we have found one.
+	if v == nil {
+		return nil, nil
+	}
+
+	subtree := &storagepb.SubtreeProto{}
+	if err := proto.Unmarshal(v, subtree); err != nil {
+		return nil, err
+	}
+	if subtree.Prefix == nil {
+		subtree.Prefix = []byte{}
+	}
+	return subtree, nil
+}
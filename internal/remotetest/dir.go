@@ -0,0 +1,100 @@
+package remotetest
+
+import (
+	"context"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path"
+	"path/filepath"
+
+	"github.com/cloudflare/ct-log/custom"
+)
+
+// NewDirRemote returns a remote database that keeps each object in a file in
+// `dir`, so that its data outlives the process.
+func NewDirRemote(dir string) (*custom.Remote, error) {
+	if info, err := os.Stat(dir); err != nil {
+		return nil, err
+	} else if !info.IsDir() {
+		return nil, fmt.Errorf("%v is not a directory", dir)
+	}
+	return custom.NewRemoteWithStore(dirStore{dir}), nil
+}
+
+// dirStore implements custom.ObjectStore over the files in a directory. Object
+// names are used as paths relative to the directory, with "/" as the separator.
+type dirStore struct {
+	dir string
+}
+
+func (ds dirStore) path(name string) (string, error) {
+	if name == "" || path.Clean("/"+name) != "/"+name {
+		return "", fmt.Errorf("invalid object name: %q", name)
+	}
+	return filepath.Join(ds.dir, filepath.FromSlash(name)), nil
+}
+
+func (ds dirStore) Get(ctx context.Context, name string) ([]byte, error) {
+	path, err := ds.path(name)
+	if err != nil {
+		return nil, err
+	}
+	data, err := ioutil.ReadFile(path)
+	if os.IsNotExist(err) {
+		return nil, custom.ErrObjectNotFound
+	}
+	return data, err
+}
+
+func (ds dirStore) GetDirect(ctx context.Context, name string) ([]byte, error) {
+	return ds.Get(ctx, name)
+}
+
+// Put writes the object to a temporary file and renames it into place, so that
+// an object is never seen half-written.
+func (ds dirStore) Put(ctx context.Context, name string, data []byte) error {
+	path, err := ds.path(name)
+	if err != nil {
+		return err
+	} else if err := os.MkdirAll(filepath.Dir(path), 0755); err != nil {
+		return err
+	}
+	f, err := ioutil.TempFile(filepath.Dir(path), ".tmp-"+filepath.Base(path))
+	if err != nil {
+		return err
+	}
+	if _, err := f.Write(data); err != nil {
+		f.Close()
+		os.Remove(f.Name())
+		return err
+	} else if err := f.Sync(); err != nil {
+		f.Close()
+		os.Remove(f.Name())
+		return err
+	} else if err := f.Close(); err != nil {
+		os.Remove(f.Name())
+		return err
+	}
+	return os.Rename(f.Name(), path)
+}
+
+func (ds dirStore) Delete(ctx context.Context, name string) error {
+	path, err := ds.path(name)
+	if err != nil {
+		return err
+	}
+	if err := os.Remove(path); err != nil && !os.IsNotExist(err) {
+		return err
+	}
+	return nil
+}
+
+func (ds dirStore) Purge(ctx context.Context, name string) error {
+	return ds.Delete(ctx, name)
+}
+
+func (ds dirStore) Ping(ctx context.Context) error {
+	_, err := os.Stat(ds.dir)
+	return err
+}
@@ -0,0 +1,103 @@
+// Package remotetest implements remote databases for tests, which keep their
+// data in memory or in a local directory instead of a B2 bucket.
+package remotetest
+
+import (
+	"context"
+	"fmt"
+	"sync"
+
+	"github.com/cloudflare/ct-log/custom"
+)
+
+// NewMemoryRemote returns a remote database that keeps all of its data in
+// memory.
+func NewMemoryRemote() *custom.Remote {
+	return custom.NewRemoteWithStore(NewMemoryStore())
+}
+
+// MemoryStore implements custom.ObjectStore over an in-memory map.
+type MemoryStore struct {
+	mu      sync.Mutex
+	objects map[string][]byte
+	// writeLimit is the number of writes that can be made before they fail,
+	// or negative if there's no limit.
+	writeLimit int
+}
+
+// NewMemoryStore returns an empty in-memory object store.
+func NewMemoryStore() *MemoryStore {
+	return &MemoryStore{objects: make(map[string][]byte), writeLimit: -1}
+}
+
+// SetWriteLimit makes the store fail every write after the next n, as if the
+// process had died part of the way through an upload. A negative n removes the
+// limit.
+func (ms *MemoryStore) SetWriteLimit(n int) {
+	ms.mu.Lock()
+	defer ms.mu.Unlock()
+	ms.writeLimit = n
+}
+
+// Len returns the number of objects in the store.
+func (ms *MemoryStore) Len() int {
+	ms.mu.Lock()
+	defer ms.mu.Unlock()
+	return len(ms.objects)
+}
+
+// write counts a write against the write limit, and returns an error if the
+// limit was already reached.
+func (ms *MemoryStore) write() error {
+	if ms.writeLimit == 0 {
+		return fmt.Errorf("write limit of in-memory remote database reached")
+	} else if ms.writeLimit > 0 {
+		ms.writeLimit--
+	}
+	return nil
+}
+
+func (ms *MemoryStore) Get(ctx context.Context, name string) ([]byte, error) {
+	ms.mu.Lock()
+	defer ms.mu.Unlock()
+
+	data, ok := ms.objects[name]
+	if !ok {
+		return nil, custom.ErrObjectNotFound
+	}
+	return append([]byte{}, data...), nil
+}
+
+func (ms *MemoryStore) GetDirect(ctx context.Context, name string) ([]byte, error) {
+	return ms.Get(ctx, name)
+}
+
+func (ms *MemoryStore) Put(ctx context.Context, name string, data []byte) error {
+	ms.mu.Lock()
+	defer ms.mu.Unlock()
+
+	if err := ms.write(); err != nil {
+		return err
+	}
+	ms.objects[name] = append([]byte{}, data...)
+	return nil
+}
+
+func (ms *MemoryStore) Delete(ctx context.Context, name string) error {
+	ms.mu.Lock()
+	defer ms.mu.Unlock()
+
+	if err := ms.write(); err != nil {
+		return err
+	}
+	delete(ms.objects, name)
+	return nil
+}
+
+func (ms *MemoryStore) Purge(ctx context.Context, name string) error {
+	return ms.Delete(ctx, name)
+}
+
+func (ms *MemoryStore) Ping(ctx context.Context) error {
+	return nil
+}
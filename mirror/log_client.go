@@ -0,0 +1,45 @@
+package mirror
+
+import (
+	"context"
+	"fmt"
+
+	ctgo "github.com/google/certificate-transparency-go"
+	"github.com/google/certificate-transparency-go/client"
+	"github.com/google/certificate-transparency-go/jsonclient"
+)
+
+// LogClient overloads the proper CT log client to expose get-entries without
+// parsing each entry, because the mirror stores entries exactly as the source
+// log serves them.
+type LogClient struct {
+	client.LogClient
+}
+
+// NewLogClient returns a client for the source log at `uri`, which verifies
+// the signature on every signed tree head with the PEM-encoded `pubKey`.
+func NewLogClient(uri, pubKey string) (*LogClient, error) {
+	temp, err := client.New(uri, nil, jsonclient.Options{
+		PublicKey: pubKey,
+		UserAgent: "ct-log-mirror",
+	})
+	if err != nil {
+		return nil, fmt.Errorf("failed to create a CT log client: %v", err)
+	}
+	return &LogClient{*temp}, nil
+}
+
+// GetRawEntries exposes the /ct/v1/get-entries result with only the JSON
+// parsing done. The source log may return fewer entries than were asked for.
+func (c *LogClient) GetRawEntries(ctx context.Context, start, end int64) (*ctgo.GetEntriesResponse, error) {
+	params := map[string]string{
+		"start": fmt.Sprint(start),
+		"end":   fmt.Sprint(end),
+	}
+	var resp ctgo.GetEntriesResponse
+	_, _, err := c.GetAndParse(ctx, ctgo.GetEntriesPath, params, &resp)
+	if err != nil {
+		return nil, err
+	}
+	return &resp, nil
+}
@@ -0,0 +1,243 @@
+// Package mirror follows a source RFC 6962 log, and copies its entries into
+// one of our pre-ordered logs with identical indices.
+package mirror
+
+import (
+	"bytes"
+	"context"
+	"crypto/sha256"
+	"fmt"
+	"log"
+	"time"
+
+	"github.com/cloudflare/ct-log/ct"
+
+	ctgo "github.com/google/certificate-transparency-go"
+	"github.com/google/trillian"
+	"github.com/google/trillian/merkle/hashers"
+	"google.golang.org/grpc/codes"
+
+	_ "github.com/google/trillian/merkle/rfc6962"
+)
+
+// Mirror copies the entries of a source log into one of our pre-ordered trees,
+// at the same indices. Leaves are added with AddSequencedLeaves and integrated
+// by the server's sequencer, like any other leaves, and the resulting root is
+// checked against the source's signed tree head.
+type Mirror struct {
+	src          *LogClient
+	ls           *ct.LogStorage
+	tree         *trillian.Tree
+	hasher       hashers.LogHasher
+	batchSize    int64
+	pollInterval time.Duration
+	runInterval  time.Duration
+}
+
+// New returns a mirror of `src` into `tree`, which must already be initialized.
+// The source's signed tree head is fetched every pollInterval, and at most
+// batchSize entries are added before waiting for the sequencer, whose state is
+// checked every runInterval.
+func New(src *LogClient, ls *ct.LogStorage, tree *trillian.Tree, batchSize int64, pollInterval, runInterval time.Duration) (*Mirror, error) {
+	if tree.TreeType != trillian.TreeType_PREORDERED_LOG {
+		return nil, fmt.Errorf("tree %v has type %v, but mirrors must be PREORDERED_LOG", tree.TreeId, tree.TreeType)
+	} else if batchSize <= 0 {
+		return nil, fmt.Errorf("batch size must be positive")
+	} else if pollInterval <= 0 || runInterval <= 0 {
+		return nil, fmt.Errorf("poll and run intervals must be positive")
+	}
+	hasher, err := hashers.NewLogHasher(tree.HashStrategy)
+	if err != nil {
+		return nil, err
+	}
+	return &Mirror{
+		src:          src,
+		ls:           ls,
+		tree:         tree,
+		hasher:       hasher,
+		batchSize:    batchSize,
+		pollInterval: pollInterval,
+		runInterval:  runInterval,
+	}, nil
+}
+
+// Run keeps the mirror up to date with the source log until the context is
+// cancelled, or the mirror diverges from the source. Other errors, like the
+// source being unreachable, are logged and retried at the next poll.
+func (m *Mirror) Run(ctx context.Context) error {
+	for {
+		sth, err := m.Step(ctx)
+		if ctx.Err() != nil {
+			return nil
+		} else if _, ok := err.(divergedError); ok {
+			return err
+		} else if err != nil {
+			log.Printf("failed to mirror log %v: %v", m.tree.TreeId, err)
+		} else {
+			log.Printf("mirrored %v entries into log %v, up to source timestamp %v", sth.TreeSize, m.tree.TreeId, sth.Timestamp)
+		}
+
+		select {
+		case <-ctx.Done():
+			return nil
+		case <-time.After(m.pollInterval):
+		}
+	}
+}
+
+// divergedError is returned when the mirror's tree doesn't match the source's
+// signed tree head, so it can't follow the source any longer.
+type divergedError struct {
+	msg string
+}
+
+func (err divergedError) Error() string { return err.msg }
+
+// Step brings the mirror up to date with the source log's current signed tree
+// head, and returns it. The source's new entries are only added once they're
+// checked against its signed tree head, and it returns an error without adding
+// any of them if they don't match.
+func (m *Mirror) Step(ctx context.Context) (*ctgo.SignedTreeHead, error) {
+	sth, err := m.src.GetSTH(ctx)
+	if err != nil {
+		return nil, fmt.Errorf("failed to get source's signed tree head: %v", err)
+	}
+	target := int64(sth.TreeSize)
+
+	root, front, err := m.ls.Local.MostRecentRoot(m.tree.TreeId)
+	if err != nil {
+		return nil, err
+	} else if target < root.TreeSize {
+		return nil, divergedError{fmt.Sprintf("source has tree size %v, but the mirror already has %v leaves", target, root.TreeSize)}
+	}
+
+	// Fetch every entry that we don't have yet, and check that the tree they
+	// make with the mirror's leaves has the source's root hash.
+	leaves := make([]*trillian.LogLeaf, 0, target-root.TreeSize)
+	for next := root.TreeSize; next < target; {
+		end := next + m.batchSize
+		if end > target {
+			end = target
+		}
+		batch, err := m.getLeaves(ctx, next, end)
+		if err != nil {
+			return nil, err
+		}
+		for _, leaf := range batch {
+			front.Append(leaf.MerkleLeafHash)
+		}
+		leaves = append(leaves, batch...)
+		next += int64(len(batch))
+	}
+	if !bytes.Equal(front.Head(), sth.SHA256RootHash[:]) {
+		return nil, divergedError{fmt.Sprintf("source's entries [%v, %v) don't match its signed tree head with root hash %x", root.TreeSize, target, sth.SHA256RootHash[:])}
+	}
+
+	// Add them a batch at a time, and wait for the sequencer to integrate each
+	// batch before adding the next, so that the log never has more than a
+	// batch of unsequenced leaves.
+	for len(leaves) > 0 {
+		n := int64(len(leaves))
+		if n > m.batchSize {
+			n = m.batchSize
+		}
+		if err := m.addLeaves(ctx, leaves[:n]); err != nil {
+			return nil, err
+		} else if err := m.waitForSize(ctx, leaves[n-1].LeafIndex+1); err != nil {
+			return nil, err
+		}
+		leaves = leaves[n:]
+	}
+
+	root, _, err = m.ls.Local.MostRecentRoot(m.tree.TreeId)
+	if err != nil {
+		return nil, err
+	} else if root.TreeSize != target {
+		return nil, divergedError{fmt.Sprintf("mirror has tree size %v, but source has %v", root.TreeSize, target)}
+	} else if !bytes.Equal(root.RootHash, sth.SHA256RootHash[:]) {
+		return nil, divergedError{fmt.Sprintf("mirror has root hash %x at tree size %v, but source has %x", root.RootHash, target, sth.SHA256RootHash[:])}
+	}
+	return sth, nil
+}
+
+// waitForSize waits until the sequencer has integrated the mirror's leaves up
+// to `size`.
+func (m *Mirror) waitForSize(ctx context.Context, size int64) error {
+	for {
+		got, err := m.size()
+		if err != nil {
+			return err
+		} else if got >= size {
+			return nil
+		}
+
+		select {
+		case <-ctx.Done():
+			return ctx.Err()
+		case <-time.After(m.runInterval):
+		}
+	}
+}
+
+// size returns the number of leaves integrated into the mirror.
+func (m *Mirror) size() (int64, error) {
+	root, _, err := m.ls.Local.MostRecentRoot(m.tree.TreeId)
+	if err != nil {
+		return 0, err
+	}
+	return root.TreeSize, nil
+}
+
+// getLeaves fetches the entries [start, end) of the source log, or some prefix
+// of them if the source returns fewer, and converts them into leaves.
+func (m *Mirror) getLeaves(ctx context.Context, start, end int64) ([]*trillian.LogLeaf, error) {
+	resp, err := m.src.GetRawEntries(ctx, start, end-1)
+	if err != nil {
+		return nil, fmt.Errorf("failed to get entries [%v, %v) from source: %v", start, end, err)
+	} else if len(resp.Entries) == 0 {
+		return nil, fmt.Errorf("source returned no entries starting at %v", start)
+	} else if int64(len(resp.Entries)) > end-start {
+		return nil, fmt.Errorf("source returned %v entries, but only %v were requested", len(resp.Entries), end-start)
+	}
+
+	leaves := make([]*trillian.LogLeaf, 0, len(resp.Entries))
+	for i, entry := range resp.Entries {
+		index := start + int64(i)
+
+		rle, err := ctgo.RawLogEntryFromLeaf(index, &entry)
+		if err != nil {
+			return nil, fmt.Errorf("failed to parse entry %v from source: %v", index, err)
+		}
+		merkleHash, err := m.hasher.HashLeaf(entry.LeafInput)
+		if err != nil {
+			return nil, err
+		}
+		idHash := sha256.Sum256(rle.Cert.Data)
+
+		leaves = append(leaves, &trillian.LogLeaf{
+			MerkleLeafHash:   merkleHash,
+			LeafValue:        entry.LeafInput,
+			ExtraData:        entry.ExtraData,
+			LeafIndex:        index,
+			LeafIdentityHash: idHash[:],
+		})
+	}
+	return leaves, nil
+}
+
+// addLeaves stores leaves until the sequencer integrates them. Leaves that
+// conflict with pending leaves were fetched by an earlier run that didn't get
+// to integrate them, and are skipped; if they differ, the root hash check
+// catches it.
+func (m *Mirror) addLeaves(ctx context.Context, leaves []*trillian.LogLeaf) error {
+	res, err := m.ls.AddSequencedLeaves(ctx, m.tree, leaves, time.Now())
+	if err != nil {
+		return fmt.Errorf("failed to add leaves: %v", err)
+	}
+	for i, r := range res {
+		if code := codes.Code(r.Status.GetCode()); code != codes.OK && code != codes.FailedPrecondition {
+			return fmt.Errorf("failed to add leaf %v: %v", leaves[i].LeafIndex, r.Status.GetMessage())
+		}
+	}
+	return nil
+}
@@ -0,0 +1,407 @@
+package mirror
+
+import (
+	"testing"
+
+	"bytes"
+	"context"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/x509"
+	"encoding/json"
+	"encoding/pem"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"strconv"
+	"sync"
+	"time"
+
+	"github.com/cloudflare/ct-log/ct"
+	"github.com/cloudflare/ct-log/custom"
+	"github.com/cloudflare/ct-log/custom/frontier"
+	"github.com/cloudflare/ct-log/internal/remotetest"
+
+	"github.com/golang/protobuf/ptypes"
+	ctgo "github.com/google/certificate-transparency-go"
+	"github.com/google/certificate-transparency-go/client"
+	"github.com/google/certificate-transparency-go/jsonclient"
+	"github.com/google/certificate-transparency-go/tls"
+	"github.com/google/trillian"
+	"github.com/google/trillian/crypto/keyspb"
+	"github.com/google/trillian/crypto/sigpb"
+	tlog "github.com/google/trillian/log"
+	"github.com/google/trillian/merkle/rfc6962"
+	"github.com/google/trillian/monitoring"
+	"github.com/google/trillian/quota"
+	"github.com/google/trillian/storage"
+	"github.com/google/trillian/trees"
+	"github.com/google/trillian/types"
+	"github.com/google/trillian/util"
+
+	_ "github.com/google/trillian/crypto/keys/der/proto"
+)
+
+// fakeSource is an in-process RFC 6962 log that serves get-sth and get-entries
+// over a list of entries that tests can change at will.
+type fakeSource struct {
+	mu         sync.Mutex
+	key        *ecdsa.PrivateKey
+	entries    []ctgo.LeafEntry
+	maxEntries int
+	// forged are entries that get-entries serves in place of the ones that
+	// the signed tree head covers, by index.
+	forged map[int]ctgo.LeafEntry
+}
+
+func newFakeSource(t *testing.T) *fakeSource {
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return &fakeSource{key: key, maxEntries: 300, forged: make(map[int]ctgo.LeafEntry)}
+}
+
+// add appends entries with certificates "cert <start>" to "cert <end-1>".
+func (fs *fakeSource) add(t *testing.T, start, end int) {
+	fs.mu.Lock()
+	defer fs.mu.Unlock()
+
+	for i := start; i < end; i++ {
+		fs.entries = append(fs.entries, fakeEntry(t, fmt.Sprintf("cert %v", i)))
+	}
+}
+
+func fakeEntry(t *testing.T, cert string) ctgo.LeafEntry {
+	leaf := ctgo.CreateX509MerkleTreeLeaf(ctgo.ASN1Cert{Data: []byte(cert)}, uint64(time.Now().UnixNano()/1e6))
+	leafInput, err := tls.Marshal(*leaf)
+	if err != nil {
+		t.Fatal(err)
+	}
+	extraData, err := tls.Marshal(ctgo.CertificateChain{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	return ctgo.LeafEntry{LeafInput: leafInput, ExtraData: extraData}
+}
+
+func (fs *fakeSource) ServeHTTP(rw http.ResponseWriter, req *http.Request) {
+	fs.mu.Lock()
+	defer fs.mu.Unlock()
+
+	var resp interface{}
+	switch req.URL.Path {
+	case "/ct/v1/get-sth":
+		var front frontier.Frontier
+		for _, entry := range fs.entries {
+			hash, err := rfc6962.DefaultHasher.HashLeaf(entry.LeafInput)
+			if err != nil {
+				http.Error(rw, err.Error(), 500)
+				return
+			}
+			front.Append(hash)
+		}
+		sth := ctgo.SignedTreeHead{
+			Version:   ctgo.V1,
+			TreeSize:  uint64(len(fs.entries)),
+			Timestamp: uint64(time.Now().UnixNano() / 1e6),
+		}
+		copy(sth.SHA256RootHash[:], front.Head())
+		input, err := ctgo.SerializeSTHSignatureInput(sth)
+		if err != nil {
+			http.Error(rw, err.Error(), 500)
+			return
+		}
+		sig, err := tls.CreateSignature(*fs.key, tls.SHA256, input)
+		if err != nil {
+			http.Error(rw, err.Error(), 500)
+			return
+		}
+		sigRaw, err := tls.Marshal(sig)
+		if err != nil {
+			http.Error(rw, err.Error(), 500)
+			return
+		}
+		resp = ctgo.GetSTHResponse{
+			TreeSize:          sth.TreeSize,
+			Timestamp:         sth.Timestamp,
+			SHA256RootHash:    sth.SHA256RootHash[:],
+			TreeHeadSignature: sigRaw,
+		}
+
+	case "/ct/v1/get-entries":
+		start, err := strconv.Atoi(req.URL.Query().Get("start"))
+		if err != nil {
+			http.Error(rw, err.Error(), 400)
+			return
+		}
+		end, err := strconv.Atoi(req.URL.Query().Get("end"))
+		if err != nil {
+			http.Error(rw, err.Error(), 400)
+			return
+		}
+		if end >= len(fs.entries) {
+			end = len(fs.entries) - 1
+		}
+		if end-start+1 > fs.maxEntries {
+			end = start + fs.maxEntries - 1
+		}
+		if start < 0 || start > end {
+			http.Error(rw, "bad range", 400)
+			return
+		}
+		entries := append([]ctgo.LeafEntry{}, fs.entries[start:end+1]...)
+		for i := range entries {
+			if forged, ok := fs.forged[start+i]; ok {
+				entries[i] = forged
+			}
+		}
+		resp = ctgo.GetEntriesResponse{Entries: entries}
+
+	default:
+		http.NotFound(rw, req)
+		return
+	}
+
+	rw.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(rw).Encode(resp)
+}
+
+// client returns a client for the fake source that verifies signatures with
+// `key`.
+func (fs *fakeSource) client(t *testing.T, srv *httptest.Server, key *ecdsa.PrivateKey) *LogClient {
+	der, err := x509.MarshalPKIXPublicKey(&key.PublicKey)
+	if err != nil {
+		t.Fatal(err)
+	}
+	pubkey := pem.EncodeToMemory(&pem.Block{Type: "PUBLIC KEY", Bytes: der})
+
+	temp, err := client.New(srv.URL, srv.Client(), jsonclient.Options{PublicKey: string(pubkey)})
+	if err != nil {
+		t.Fatal(err)
+	}
+	return &LogClient{*temp}
+}
+
+// testMirror is a mirror into a fresh local database and in-memory bucket,
+// whose leaves are integrated by a sequencer like the server's.
+type testMirror struct {
+	*Mirror
+	path   string
+	cancel context.CancelFunc
+	done   chan struct{} // Closed once the sequencer has stopped.
+}
+
+func newTestMirror(t *testing.T, src *LogClient) *testMirror {
+	path, err := ioutil.TempDir("", "ct-log-mirror")
+	if err != nil {
+		t.Fatal(err)
+	}
+	local, err := custom.NewLocal(path, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	ls := &ct.LogStorage{Local: local, Remote: remotetest.NewMemoryRemote()}
+
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	der, err := x509.MarshalECPrivateKey(key)
+	if err != nil {
+		t.Fatal(err)
+	}
+	privKey, err := ptypes.MarshalAny(&keyspb.PrivateKey{Der: der})
+	if err != nil {
+		t.Fatal(err)
+	}
+	tree := &trillian.Tree{
+		TreeId:             1,
+		TreeType:           trillian.TreeType_PREORDERED_LOG,
+		TreeState:          trillian.TreeState_ACTIVE,
+		HashStrategy:       trillian.HashStrategy_RFC6962_SHA256,
+		HashAlgorithm:      sigpb.DigitallySigned_SHA256,
+		SignatureAlgorithm: sigpb.DigitallySigned_ECDSA,
+		PrivateKey:         privKey,
+	}
+
+	// Initialize the tree, and integrate leaves as they're added, like the
+	// server does.
+	ctx, cancel := context.WithCancel(context.Background())
+	signer, err := trees.Signer(ctx, tree)
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = ls.ReadWriteTransaction(ctx, tree, func(ctx context.Context, tx storage.LogTreeTX) error {
+		root, err := signer.SignLogRoot(&types.LogRootV1{
+			RootHash:       rfc6962.DefaultHasher.EmptyRoot(),
+			TimestampNanos: uint64(time.Now().UnixNano()),
+		})
+		if err != nil {
+			return err
+		}
+		return tx.StoreSignedLogRoot(ctx, *root)
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	sequencer := tlog.NewSequencer(rfc6962.DefaultHasher, util.SystemTimeSource{}, ls, signer, monitoring.InertMetricFactory{}, quota.Noop())
+	done := make(chan struct{})
+	go func() {
+		defer close(done)
+		for ctx.Err() == nil {
+			if _, err := sequencer.IntegrateBatch(ctx, tree, 1000, 0, 0); err != nil && ctx.Err() == nil {
+				t.Errorf("failed to integrate leaves: %v", err)
+				return
+			}
+			time.Sleep(time.Millisecond)
+		}
+	}()
+
+	m, err := New(src, ls, tree, 1000, time.Minute, time.Millisecond)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return &testMirror{m, path, cancel, done}
+}
+
+func (tm *testMirror) close() {
+	tm.cancel()
+	<-tm.done
+	tm.ls.Local.Close()
+	os.RemoveAll(tm.path)
+}
+
+// check verifies that the mirror's leaves are exactly the source's entries.
+func (tm *testMirror) check(t *testing.T, fs *fakeSource) {
+	seqs := make([]int64, 0, len(fs.entries))
+	for i := range fs.entries {
+		seqs = append(seqs, int64(i))
+	}
+	leaves, err := tm.ls.Remote.GetLeaves(context.Background(), tm.tree.TreeId, seqs)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for i, leaf := range leaves {
+		if !bytes.Equal(leaf.LeafValue, fs.entries[i].LeafInput) || !bytes.Equal(leaf.ExtraData, fs.entries[i].ExtraData) {
+			t.Fatalf("leaf %v doesn't match the source's entry", i)
+		}
+	}
+}
+
+func TestMirror(t *testing.T) {
+	fs := newFakeSource(t)
+	srv := httptest.NewServer(fs)
+	defer srv.Close()
+
+	tm := newTestMirror(t, fs.client(t, srv, fs.key))
+	defer tm.close()
+	ctx := context.Background()
+
+	// Mirror an empty log, and then several batches of entries. The source
+	// returns fewer entries than requested, like real logs do.
+	for _, size := range []int{0, 2500, 2500, 2501, 4000} {
+		fs.add(t, len(fs.entries), size)
+
+		sth, err := tm.Step(ctx)
+		if err != nil {
+			t.Fatal(err)
+		} else if sth.TreeSize != uint64(size) {
+			t.Fatalf("got signed tree head with size %v, wanted %v", sth.TreeSize, size)
+		}
+		if got, err := tm.size(); err != nil {
+			t.Fatal(err)
+		} else if got != int64(size) {
+			t.Fatalf("mirror has size %v, wanted %v", got, size)
+		}
+	}
+	tm.check(t, fs)
+
+	// A mirror that's restarted picks up where it left off.
+	tm2, err := New(tm.src, tm.ls, tm.tree, 1000, time.Minute, time.Millisecond)
+	if err != nil {
+		t.Fatal(err)
+	}
+	fs.add(t, 4000, 4100)
+	if _, err := tm2.Step(ctx); err != nil {
+		t.Fatal(err)
+	}
+	tm.check(t, fs)
+}
+
+func TestMirrorDiverged(t *testing.T) {
+	fs := newFakeSource(t)
+	srv := httptest.NewServer(fs)
+	defer srv.Close()
+
+	tm := newTestMirror(t, fs.client(t, srv, fs.key))
+	defer tm.close()
+	ctx := context.Background()
+
+	fs.add(t, 0, 100)
+	if _, err := tm.Step(ctx); err != nil {
+		t.Fatal(err)
+	}
+
+	// The source serves a new entry that its signed tree head doesn't cover.
+	// None of the new entries are added.
+	fs.add(t, 100, 200)
+	fs.forged[150] = fakeEntry(t, "evil cert")
+	if _, err := tm.Step(ctx); err == nil {
+		t.Fatal("expected mirror to detect that the source's entries don't match its sth")
+	}
+	tm.checkUnchanged(t, 100)
+	delete(fs.forged, 150)
+
+	// The source rewrites an entry that the mirror already has.
+	fs.entries[50] = fakeEntry(t, "evil cert")
+	if _, err := tm.Step(ctx); err == nil {
+		t.Fatal("expected mirror to detect that the source's history changed")
+	}
+	tm.checkUnchanged(t, 100)
+	// The mirror stops following the source, instead of retrying.
+	if err := tm.Run(ctx); err == nil {
+		t.Fatal("expected mirror to stop once it has diverged")
+	}
+}
+
+// checkUnchanged verifies that the mirror has `size` leaves, and that no other
+// leaves were added.
+func (tm *testMirror) checkUnchanged(t *testing.T, size int64) {
+	if got, err := tm.size(); err != nil {
+		t.Fatal(err)
+	} else if got != size {
+		t.Fatalf("mirror has size %v, wanted %v", got, size)
+	}
+	if count, err := tm.ls.Local.Unsequenced(tm.tree.TreeId); err != nil {
+		t.Fatal(err)
+	} else if count != 0 {
+		t.Fatalf("mirror has %v unsequenced leaves, wanted none", count)
+	}
+}
+
+func TestMirrorWrongKey(t *testing.T) {
+	fs := newFakeSource(t)
+	srv := httptest.NewServer(fs)
+	defer srv.Close()
+
+	other, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	tm := newTestMirror(t, fs.client(t, srv, other))
+	defer tm.close()
+
+	fs.add(t, 0, 100)
+	if _, err := tm.Step(context.Background()); err == nil {
+		t.Fatal("expected signed tree head with the wrong signature to be rejected")
+	}
+	if size, err := tm.size(); err != nil {
+		t.Fatal(err)
+	} else if size != 0 {
+		t.Fatalf("mirror has size %v, wanted 0", size)
+	}
+}